@@ -0,0 +1,209 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/buse/lib/go/buse"
+)
+
+// Implemented by BuseReadWriters which can rebuild their extent map from the
+// objects.
+type rebuilder interface {
+	Rebuild() error
+}
+
+// Implemented by BuseReadWriters which can discard arbitrary range of blocks.
+type discarder interface {
+	Discard(sector, length int64) error
+}
+
+// Implemented by BuseReadWriters which can remove dead objects on demand.
+type deadCollector interface {
+	CollectDead() error
+}
+
+// Implemented by BuseReadWriters which can pause IO for online maintenance.
+type pauser interface {
+	Pause() error
+	Resume() error
+}
+
+// Implemented by BuseReadWriters which can make acknowledged writes durable on
+// request.
+type flusher interface {
+	Flush() error
+}
+
+// Implemented by BuseReadWriters which can take the checkpoint on demand.
+type checkpointer interface {
+	Checkpoint() error
+}
+
+// Implemented by BuseReadWriters which can write a report of their extent map.
+type mapDumper interface {
+	DumpMap(w io.Writer) error
+}
+
+// Implemented by BuseReadWriters which can export their extent map and replace
+// it by an exported one.
+type mapExporter interface {
+	ExportMap(w io.Writer) error
+	ImportMap(r io.Reader) error
+}
+
+// Implemented by BuseReadWriters which can switch reads to the read replica and
+// back during an outage of the primary region.
+type replicaSwitcher interface {
+	UseReplica() error
+	UsePrimary() error
+}
+
+// Serves metrics of all volumes in JSON published by the expvar package at
+// /debug/vars and control commands of individual volumes at
+// /volumes/<major>/<command>. Only commands implemented by the BuseReadWriter
+// of the volume are registered.
+func runAdmin(port int, majors []int, readWriters []buse.BuseReadWriter) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	for i, rw := range readWriters {
+		prefix := fmt.Sprintf("/volumes/%d/", majors[i])
+
+		if r, ok := rw.(rebuilder); ok {
+			mux.Handle(prefix+"rebuild", command(r.Rebuild))
+		}
+
+		if d, ok := rw.(discarder); ok {
+			mux.Handle(prefix+"discard", discard(d))
+		}
+
+		if f, ok := rw.(flusher); ok {
+			mux.Handle(prefix+"flush", command(f.Flush))
+		}
+
+		if c, ok := rw.(checkpointer); ok {
+			mux.Handle(prefix+"checkpoint", command(c.Checkpoint))
+		}
+
+		if m, ok := rw.(mapDumper); ok {
+			mux.Handle(prefix+"dump", streamCommand(m.DumpMap))
+		}
+
+		if m, ok := rw.(mapExporter); ok {
+			mux.Handle(prefix+"export", streamCommand(m.ExportMap))
+			mux.Handle(prefix+"import", bodyCommand(m.ImportMap))
+		}
+
+		if s, ok := rw.(replicaSwitcher); ok {
+			mux.Handle(prefix+"replica", command(s.UseReplica))
+			mux.Handle(prefix+"primary", command(s.UsePrimary))
+		}
+
+		if c, ok := rw.(deadCollector); ok {
+			mux.Handle(prefix+"dead", command(c.CollectDead))
+		}
+
+		if p, ok := rw.(pauser); ok {
+			mux.Handle(prefix+"pause", command(p.Pause))
+			mux.Handle(prefix+"resume", command(p.Resume))
+		}
+	}
+
+	go func() {
+		log.Info().Err(http.ListenAndServe(fmt.Sprintf("localhost:%d", port), mux)).Send()
+	}()
+}
+
+// Returns handler running fn for POST requests. The response is sent when fn
+// finishes, so the caller knows the result.
+func command(fn func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Command has to be sent by POST.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := fn(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// Returns command handler discarding blocks given by the sector and length
+// query parameters in blocks.
+func discard(d discarder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sector, err := strconv.ParseInt(r.URL.Query().Get("sector"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid sector.", http.StatusBadRequest)
+			return
+		}
+
+		length, err := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid length.", http.StatusBadRequest)
+			return
+		}
+
+		command(func() error {
+			return d.Discard(sector, length)
+		}).ServeHTTP(w, r)
+	})
+}
+
+// Returns handler running fn for POST requests with the response body as the
+// writer, so the output is never stored on the host running bs3. Error of fn is
+// sent as the status when nothing was written yet, otherwise the response is
+// aborted, so the client sees it truncated.
+func streamCommand(fn func(w io.Writer) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Command has to be sent by POST.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cw := &countingWriter{w: w}
+		if err := fn(cw); err != nil {
+			if cw.n == 0 {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Error().Err(err).Msgf("Response of %s aborted.", r.URL.Path)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// Writer counting bytes written into w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// Returns command handler running fn with the request body, so the input is
+// never read from the host running bs3.
+func bodyCommand(fn func(r io.Reader) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		command(func() error {
+			return fn(r.Body)
+		}).ServeHTTP(w, r)
+	})
+}
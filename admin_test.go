@@ -0,0 +1,73 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		fn     func(w io.Writer) error
+		status int
+		body   string
+	}{
+		{"output", http.MethodPost, func(w io.Writer) error {
+			_, err := io.WriteString(w, "report\n")
+			return err
+		}, http.StatusOK, "report\n"},
+		{"error before output", http.MethodPost, func(w io.Writer) error {
+			return errors.New("failed")
+		}, http.StatusInternalServerError, "failed\n"},
+		{"GET", http.MethodGet, func(w io.Writer) error {
+			t.Error("command run for GET")
+			return nil
+		}, http.StatusMethodNotAllowed, "Command has to be sent by POST.\n"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		streamCommand(tt.fn).ServeHTTP(rec, httptest.NewRequest(tt.method, "/volumes/0/dump", nil))
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("%s: status %d, body %q", tt.name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestStreamCommandAbort(t *testing.T) {
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Fatalf("recovered %v", r)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	streamCommand(func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("failed")
+	}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/volumes/0/dump", nil))
+
+	t.Fatal("truncated response not aborted")
+}
+
+func TestBodyCommand(t *testing.T) {
+	var got string
+	h := bodyCommand(func(r io.Reader) error {
+		b, err := io.ReadAll(r)
+		got = string(b)
+		return err
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/volumes/0/import", strings.NewReader("map")))
+	if rec.Code != http.StatusOK || got != "map" {
+		t.Fatalf("status %d, body read %q", rec.Code, got)
+	}
+}
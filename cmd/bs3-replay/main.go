@@ -0,0 +1,125 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// bs3-replay feeds the IO trace recorded by the trace option into a bs3
+// instance without any block device, so an IO pattern from production can be
+// reproduced offline. It reads the same configuration as bs3 and replays the
+// trace from trace_path of every configured volume into that volume. Point the
+// configuration to a scratch bucket, since the replay writes to it.
+//
+// Traces do not contain data, hence every write is replayed with zeros. Reads
+// are replayed as well, so their latency and the load on the backend match the
+// original. The chunk_size and block_size have to be the same as when the
+// trace was recorded. Records are replayed one by one in the order they were
+// recorded, as fast as possible.
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3"
+	"github.com/asch/bs3/internal/config"
+	"github.com/asch/bs3/internal/trace"
+)
+
+func main() {
+	if err := config.Configure(); err != nil {
+		log.Panic().Err(err).Send()
+	}
+
+	if config.Cfg.Log.Pretty && !config.Cfg.Log.JSON {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
+	zerolog.SetGlobalLevel(zerolog.Level(config.Cfg.Log.Level))
+
+	for _, cfg := range config.Volumes() {
+		if err := replay(cfg); err != nil {
+			log.Panic().Err(err).Msgf("Replay of %s failed.", cfg.TracePath)
+		}
+	}
+}
+
+// Replays the trace of the volume configured by cfg into a new bs3 instance.
+// Failed reads and writes are logged and the replay continues.
+func replay(cfg *config.Config) error {
+	file, err := os.Open(cfg.TracePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := trace.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	b, err := bs3.NewWithDefaults(cfg)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Replaying %s to volume %d.", cfg.TracePath, cfg.Major)
+	b.BusePreRun()
+
+	start := time.Now()
+	var reads, writes, failed int64
+	var chunk []byte
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Warn().Msg("Trace is cut in the middle of a record. Ignoring the rest.")
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch rec.Op {
+		case trace.OpWrite:
+			chunk = zeroed(chunk, rec.ChunkLength)
+			copy(chunk, rec.Items)
+			err = b.BuseWrite(rec.Writes, chunk)
+			writes++
+		case trace.OpRead:
+			chunk = zeroed(chunk, rec.Length*int64(cfg.BlockSize))
+			err = b.BuseRead(rec.Sector, rec.Length, chunk)
+			reads++
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msgf("Replay of the record at %s failed.", rec.Time)
+			failed++
+		}
+	}
+
+	b.PrepareStop()
+	b.BusePostRemove()
+
+	log.Info().Msgf("Replayed %d writes and %d reads in %s, %d of them failed.",
+		writes, reads, time.Since(start).Round(time.Millisecond), failed)
+
+	return nil
+}
+
+// Returns buf resized to size with all bytes zero. The buffer is reused when it
+// is big enough.
+func zeroed(buf []byte, size int64) []byte {
+	if int64(cap(buf)) < size {
+		return make([]byte, size)
+	}
+
+	buf = buf[:size]
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	return buf
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// bs3-verify checks the checkpoint of every configured volume against the
+// Merkle roots recorded by the integrity option. It reads the same
+// configuration as bs3, downloads every object of the checkpoint chain and
+// compares it with the root in its trailer and with its record in the
+// integrity log, when the log exists. Only the backend is opened, read-only,
+// and neither the map file nor the disk cache is touched, so it can be run
+// against a running volume. The exit status is 1 when any checkpoint does not
+// match, is missing or has no root.
+package main
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3"
+	"github.com/asch/bs3/internal/config"
+)
+
+func main() {
+	if err := config.Configure(); err != nil {
+		log.Panic().Err(err).Send()
+	}
+
+	if config.Cfg.Log.Pretty && !config.Cfg.Log.JSON {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
+	zerolog.SetGlobalLevel(zerolog.Level(config.Cfg.Log.Level))
+
+	failed := false
+	for _, cfg := range config.Volumes() {
+		if err := verify(cfg); err != nil {
+			log.Error().Err(err).Msgf("Checkpoint of volume %d in bucket %s failed verification.",
+				cfg.Major, cfg.S3.Bucket)
+			failed = true
+			continue
+		}
+
+		log.Info().Msgf("Checkpoint of volume %d in bucket %s verified.", cfg.Major, cfg.S3.Bucket)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Verifies the checkpoint of the volume configured by cfg.
+func verify(cfg *config.Config) error {
+	b, err := bs3.NewReadOnly(cfg)
+	if err != nil {
+		return err
+	}
+
+	return b.VerifyCheckpoint()
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// Objects of writes acknowledged to the kernel before they were uploaded. The
+// extent map already references them, hence reads and GC are served from the
+// memory until the upload finishes. The number of staged objects is limited by
+// the number of uploaders, the write blocks when the limit is reached.
+type staging struct {
+	mutex   sync.RWMutex
+	objects map[int64][]byte
+
+	// Free slots for staged objects.
+	slots chan struct{}
+
+	// Uploads in progress.
+	pending sync.WaitGroup
+
+	// Signaled with the mutex whenever an object is dropped from the
+	// staging.
+	uploaded *sync.Cond
+}
+
+// Stages copy of the object with key and uploads it in the background. The
+// object is dropped from the staging when the upload succeeds. The upload is
+// retried infinitely as in BuseWrite. The object has to be counted in the bytes
+// in flight, they are released after the upload.
+func (b *bs3) uploadAsync(key int64, object []byte) {
+	b.staging.slots <- struct{}{}
+
+	staged := make([]byte, len(object))
+	copy(staged, object)
+
+	b.staging.mutex.Lock()
+	b.staging.objects[key] = staged
+	b.staging.mutex.Unlock()
+
+	b.staging.pending.Add(1)
+	go func() {
+		defer b.staging.pending.Done()
+
+		b.uploadRetry(key, staged, true, objproxy.SourceWrite)
+
+		b.staging.mutex.Lock()
+		delete(b.staging.objects, key)
+		b.staging.uploaded.Broadcast()
+		b.staging.mutex.Unlock()
+
+		b.releaseInflight(int64(len(staged)))
+		<-b.staging.slots
+	}()
+}
+
+// Copies data of the staged object key starting at sector in blocks into data.
+// Returns false when the object is not staged, i.e. it is already uploaded.
+func (b *bs3) readStaged(key int64, data []byte, sector int64) bool {
+	if b.staging.objects == nil {
+		return false
+	}
+
+	b.staging.mutex.RLock()
+	defer b.staging.mutex.RUnlock()
+
+	object, ok := b.staging.objects[key]
+	if !ok {
+		return false
+	}
+	copy(data, object[sector*int64(b.cfg().BlockSize):])
+
+	return true
+}
+
+// Removes staged objects from the list of dead objects. Empty object uploaded
+// by dead GC would be overwritten by the pending upload.
+func (b *bs3) filterStagedObjects(deadObjects map[int64]struct{}) {
+	if b.staging.objects == nil {
+		return
+	}
+
+	b.staging.mutex.RLock()
+	defer b.staging.mutex.RUnlock()
+
+	for k := range b.staging.objects {
+		delete(deadObjects, k)
+	}
+}
@@ -4,15 +4,24 @@ package bs3
 
 import (
 	"encoding/binary"
+	"expvar"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/asch/bs3/internal/bs3/cache"
 	"github.com/asch/bs3/internal/bs3/key"
 	"github.com/asch/bs3/internal/bs3/mapproxy"
 	"github.com/asch/bs3/internal/bs3/mapproxy/sectormap"
 	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/diskcache"
+	"github.com/asch/bs3/internal/bs3/objproxy/encryption"
+	"github.com/asch/bs3/internal/bs3/objproxy/failover"
+	"github.com/asch/bs3/internal/bs3/objproxy/fs"
+	"github.com/asch/bs3/internal/bs3/objproxy/hedge"
 	"github.com/asch/bs3/internal/bs3/objproxy/s3"
 	"github.com/asch/bs3/internal/config"
 )
@@ -29,10 +38,6 @@ const (
 	// Typical number of extents per object for precise memory allocation
 	// for return values. In the worst case reallocation happens.
 	typicalExtentsPerObject = 128
-
-	// Sector is a linux constant, which is always 512, no matter how big your sectors or blocks
-	// are. Please be careful since the terminology is ambiguous.
-	sectorUnit = 512
 )
 
 // bs3 implements BuseReadWriter interface which can be passed to the buse
@@ -45,6 +50,14 @@ const (
 // functionality. The default structure is sectormap but it can be changed
 // trivially.
 type bs3 struct {
+	// Configuration of the volume. All volumes managed by the daemon share
+	// the same values except the volume specific ones. It is replaced as a
+	// whole on reload, hence it is read through cfg().
+	config atomic.Value
+
+	// Counter of object keys of the volume.
+	key key.Counter
+
 	// Proxy struct for the operations on objects like uploads, downloads
 	// etc. Proxy structs are used for serialization and prioritization of
 	// requests.
@@ -55,16 +68,132 @@ type bs3 struct {
 	// requests.
 	extentMapProxy mapproxy.ExtentMapProxy
 
+	// Cache of blocks read from the backend. Nil when disabled.
+	cache *cache.Cache
+
+	// Read-ahead into the cache.
+	readAhead readAhead
+
 	// Data private to the garbage collection process.
 	gcData struct {
 		// Reference counter of objects which are actually downloaded
 		// and hence cannot be deleted from the storage backend.
 		refcounter map[int64]int64
 
-		// Lock guarding the refcounter.
+		// Objects with discard records which are not covered by any
+		// checkpoint yet. They have no data, but they cannot be deleted,
+		// otherwise the roll forward recovery would miss the discard.
+		discards map[int64]struct{}
+
+		// Lock guarding the refcounter and discards.
 		reflock sync.Mutex
+
+		// Lock serializing GC runs which copy live data.
+		collecting sync.Mutex
+
+		// Block where the next threshold GC run with time budget
+		// starts the scan of the map. Guarded by collecting.
+		cursor int64
+
+		// Lock making the removal of dead objects atomic with respect
+		// to checkpoints. Dead GC holds it from the upload of the
+		// first empty object until the objects are removed from the
+		// map, checkpoints hold it from the serialization of the map
+		// until the checkpoint is uploaded.
+		removing sync.Mutex
 	}
 
+	// Histogram of sizes of created objects published in the metrics.
+	objectSizes *expvar.Map
+
+	// Counters of created and reclaimed objects published in the metrics.
+	churn churn
+
+	// Objects of asynchronous writes which are not uploaded yet.
+	staging staging
+
+	// Gate of IO and garbage collection. Both hold it for reading, the
+	// maintenance operations which need the device quiesced hold it for
+	// writing.
+	quiesce sync.RWMutex
+
+	// IO paused by an operator.
+	pause pause
+
+	// Bytes of objects of writes being uploaded.
+	inflight inflight
+
+	// Foreground IO activity deferring GC runs.
+	idle idle
+
+	// Limits of goroutines downloading object parts of reads and
+	// prefetches and of GC.
+	readFanout *fanout
+	gcFanout   *fanout
+
+	// Outcome of the recovery until the next checkpoint.
+	recovery recovery
+
+	// Integrity log of checkpoints, see loadIntegrityLog().
+	integrity integrity
+
+	// Phase deciding the timeout of backend requests.
+	timeouts timeouts
+
+	// S3 backend downloading through the CDN after the recovery, nil for
+	// the local directory.
+	cdn *s3.S3
+
+	// Failover to the read replica, nil when no replica is configured, and
+	// reads switched to the replica by the operator.
+	failover *failover.Failover
+	replica  replica
+
+	// Lazy restore of the checkpoint in progress. Garbage collection and
+	// checkpointing wait until the map is fully warmed.
+	warming sync.WaitGroup
+
+	// Identifier of the volume stored in the checkpoint. It is validated
+	// during restore. volumeIDPersisted is false when the identifier was
+	// just generated and the volume id file was not written yet.
+	volumeID          volumeID
+	volumeIDPersisted bool
+
+	// Generation of the current checkpoint chain and number of deltas in
+	// it. Zero generation means there is no chain and the next checkpoint
+	// has to be the base.
+	checkpointGeneration int64
+	checkpointDeltas     int64
+
+	// Slot of keys of shards of the current checkpoint base.
+	checkpointSlot int64
+
+	// Speculative checkpoint started when the device is being stopped.
+	// earlyCheckpointed is true when it was uploaded successfully and the
+	// final checkpoint can be just a delta on top of it.
+	early             sync.WaitGroup
+	earlyCheckpointed bool
+
+	// Closed when the device is going to be stopped. No new threshold GC
+	// is started afterwards.
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+
+	// Closed when the map is restored. Before that the map is accessed
+	// directly, bypassing the proxy.
+	restored chan struct{}
+
+	// Schedule of threshold GC, nil when it is triggered only by SIGUSR1.
+	gcSchedule *schedule
+
+	// Epoch stamped into sequential numbers of all writes served in this
+	// run. During restore it holds the newest epoch seen so far.
+	epoch int64
+
+	// Incarnation of the volume, see incarnation.go. During restore it
+	// holds the newest incarnation seen so far.
+	incarnation int64
+
 	// Size of the metadata for one write in the write chunk read from the
 	// kernel.
 	write_item_size int
@@ -76,48 +205,328 @@ type bs3 struct {
 }
 
 // Returns bs3 with default configuration, i.e. with s3 as a communication
-// protocol and sectormap as an extent map.
-func NewWithDefaults() (*bs3, error) {
-	s3Handler, err := s3.New(s3.Options{
-		Remote:    config.Cfg.S3.Remote,
-		Region:    config.Cfg.S3.Region,
-		AccessKey: config.Cfg.S3.AccessKey,
-		SecretKey: config.Cfg.S3.SecretKey,
-		Bucket:    config.Cfg.S3.Bucket,
-	})
+// protocol, or the local directory when it is configured, and sectormap as an
+// extent map. Objects are encrypted when the encryption passphrase is configured.
+func NewWithDefaults(cfg *config.Config) (*bs3, error) {
+	if size := metadataSize(cfg); size%cfg.BlockSize != 0 {
+		return nil, fmt.Errorf("metadata size %d of chunk size %d is not aligned to block size %d",
+			size, cfg.Write.ChunkSize, cfg.BlockSize)
+	}
+
+	if cfg.S3.KeySpan != 0 && cfg.S3.KeySpan < minKeySpan {
+		return nil, fmt.Errorf("key span %d is lower than %d needed for checkpoint keys", cfg.S3.KeySpan, int64(minKeySpan))
+	}
 
+	volumeID, persisted, err := loadVolumeID(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	mapSize := config.Cfg.Size / int64(config.Cfg.BlockSize)
-	bs3 := New(s3Handler, sectormap.New(mapSize))
+	be, err := newBackend(cfg, volumeID, false)
+	if err != nil {
+		return nil, err
+	}
+	objectStore := be.store
+
+	mapSize := cfg.Size / int64(cfg.BlockSize)
+	var extentMap *sectormap.SectorMap
+	if cfg.MapFile != "" {
+		extentMap, err = sectormap.NewMapped(mapSize, cfg.MapFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		extentMap = sectormap.New(mapSize)
+	}
+
+	bs3 := New(cfg, objectStore, extentMap)
+	bs3.volumeID = volumeID
+	bs3.volumeIDPersisted = persisted
+	bs3.failover = be.failover
+	bs3.cdn = be.s3
+
+	if cfg.GC.Schedule != "" {
+		bs3.gcSchedule, err = parseSchedule(cfg.GC.Schedule)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return bs3, nil
 }
 
+// Returns bs3 for inspection of the backend of the volume configured by cfg,
+// e.g. by bs3-verify while the volume is running. It has only the read-only
+// backend and an empty extent map in memory. The map file, the disk cache and
+// the volume id file are never touched, hence it must not be started.
+func NewReadOnly(cfg *config.Config) (*bs3, error) {
+	be, err := newBackend(cfg, volumeID{}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(cfg, be.store, sectormap.New(0)), nil
+}
+
+// Backend of the volume with its parts controlled by bs3 at runtime.
+type backend struct {
+	store objproxy.ObjectUploadDownloaderAt
+
+	// Failover to the read replica, nil when it is not configured.
+	failover *failover.Failover
+
+	// The primary S3 backend, nil for the local directory.
+	s3 *s3.S3
+}
+
+// Returns the backend of the volume with id, i.e. the local directory or S3
+// with the failover, wrapped in the hedging, the disk cache and the encryption
+// when they are configured. The disk cache is below the encryption, so it
+// keeps ciphertext only. The read-only backend changes nothing when it is
+// created and it has no disk cache.
+func newBackend(cfg *config.Config, id volumeID, readOnly bool) (backend, error) {
+	var be backend
+	var err error
+	if cfg.FS.Path != "" {
+		be.store, err = fs.New(fs.Options{Dir: cfg.FS.Path, ReadOnly: readOnly})
+	} else {
+		be, err = newS3Backend(cfg, id, readOnly)
+	}
+	if err != nil {
+		return be, err
+	}
+	objectStore := be.store
+
+	if cfg.S3.HedgeDelayMs > 0 {
+		objectStore = hedge.New(hedge.Options{
+			Backend: objectStore,
+			Delay:   time.Duration(cfg.S3.HedgeDelayMs) * time.Millisecond,
+			Name:    metricsName(cfg),
+		})
+	}
+
+	if cfg.Cache.DiskDir != "" && !readOnly {
+		// Cached blocks of encrypted objects are the sealed segments
+		// after the header.
+		blockSize, offset := cfg.BlockSize, int64(0)
+		if cfg.Encryption.Passphrase != "" {
+			blockSize, offset = cfg.BlockSize+encryption.TagSize, encryption.HeaderSize
+		}
+		objectStore, err = diskcache.New(diskcache.Options{
+			Backend:   objectStore,
+			Dir:       cfg.Cache.DiskDir,
+			BlockSize: blockSize,
+			Offset:    offset,
+			Capacity:  cfg.Cache.DiskSize,
+			Name:      metricsName(cfg),
+			Identity:  backendIdentity(cfg, id),
+		})
+		if err != nil {
+			return be, err
+		}
+	}
+
+	if cfg.Encryption.Passphrase != "" {
+		objectStore, err = encryption.New(encryption.Options{
+			Backend:     objectStore,
+			Passphrase:  cfg.Encryption.Passphrase,
+			SaltKey:     encryptionSaltKey,
+			SegmentSize: cfg.BlockSize,
+			ReadOnly:    readOnly,
+		})
+		if err != nil {
+			return be, err
+		}
+	}
+
+	be.store = objectStore
+
+	return be, nil
+}
+
+// Returns the S3 backend of the volume with id, wrapped in the failover to the
+// read replica when it is configured.
+func newS3Backend(cfg *config.Config, id volumeID, readOnly bool) (backend, error) {
+	s3Handler, err := s3.New(s3.Options{
+		Remote:    cfg.S3.Remote,
+		Region:    cfg.S3.Region,
+		AccessKey: cfg.S3.AccessKey,
+		SecretKey: cfg.S3.SecretKey,
+		Bucket:    cfg.S3.Bucket,
+		CDN:       cfg.S3.CDN,
+		HTTPProxy: cfg.S3.HTTPProxy,
+
+		AutoRegion: cfg.S3.AutoRegion,
+
+		LockMode:      cfg.S3.LockMode,
+		LockRetention: time.Duration(cfg.S3.LockDays) * 24 * time.Hour,
+
+		VolumeID: id.String(),
+
+		PrefixDepth:     cfg.S3.PrefixDepth,
+		DeleteBatchSize: cfg.S3.DeleteBatchSize,
+		MaxRetries:      cfg.S3.MaxRetries,
+		NamePrefix:      cfg.S3.NamePrefix,
+		KeyBase:         cfg.S3.KeyBase,
+		KeySpan:         cfg.S3.KeySpan,
+
+		SDKLogLevel:     cfg.S3.SDKLogLevel,
+		AbortMultipart:  cfg.S3.AbortMultipart,
+		ContentEncoding: cfg.S3.ContentEncoding,
+		TagSource:       cfg.S3.TagSource,
+
+		ReadOnly: readOnly,
+	})
+
+	if err != nil {
+		return backend{}, err
+	}
+
+	if cfg.S3.Secondary.Bucket != "" {
+		secondary, err := s3.New(s3.Options{
+			Remote:    cfg.S3.Secondary.Remote,
+			Region:    cfg.S3.Secondary.Region,
+			AccessKey: cfg.S3.Secondary.AccessKey,
+			SecretKey: cfg.S3.Secondary.SecretKey,
+			Bucket:    cfg.S3.Secondary.Bucket,
+			HTTPProxy: cfg.S3.HTTPProxy,
+
+			AutoRegion: cfg.S3.AutoRegion,
+
+			MaxRetries: cfg.S3.MaxRetries,
+			NamePrefix: cfg.S3.NamePrefix,
+			KeyBase:    cfg.S3.KeyBase,
+			KeySpan:    cfg.S3.KeySpan,
+
+			SDKLogLevel:     cfg.S3.SDKLogLevel,
+			ContentEncoding: cfg.S3.ContentEncoding,
+
+			ReadOnly: readOnly,
+		})
+
+		if err != nil {
+			return backend{}, err
+		}
+
+		fo := failover.New(failover.Options{
+			Primary:   s3Handler,
+			Secondary: secondary,
+			Failures:  cfg.S3.Secondary.Failures,
+			OpenTime:  time.Duration(cfg.S3.Secondary.OpenTime) * time.Second,
+			Name:      metricsName(cfg),
+		})
+
+		return backend{store: fo, failover: fo, s3: s3Handler}, nil
+	}
+
+	return backend{store: s3Handler, s3: s3Handler}, nil
+}
+
 // Returns bs3 with provided protocol for communication with backend storage
 // and extentMap for keeping the mapping between local device and remote
-// backend.
-func New(objectStore objproxy.ObjectUploadDownloaderAt, extentMap mapproxy.ExtentMapper) *bs3 {
+// backend. cfg is the configuration of the volume.
+func New(cfg *config.Config, objectStore objproxy.ObjectUploadDownloaderAt, extentMap mapproxy.ExtentMapper) *bs3 {
 	bs3 := bs3{
 		objectStoreProxy: objproxy.New(
-			objectStore, config.Cfg.S3.Uploaders, config.Cfg.S3.Downloaders,
-			time.Duration(config.Cfg.GC.IdleTimeoutMs)*time.Millisecond),
+			objectStore, cfg.S3.Uploaders, cfg.S3.Downloaders,
+			time.Duration(cfg.GC.IdleTimeoutMs)*time.Millisecond, metricsName(cfg)),
 
 		extentMapProxy: mapproxy.New(
-			extentMap, time.Duration(config.Cfg.GC.IdleTimeoutMs)*time.Millisecond),
+			extentMap, time.Duration(cfg.GC.IdleTimeoutMs)*time.Millisecond, metricsName(cfg)),
 
-		metadata_size: config.Cfg.Write.ChunkSize / config.Cfg.BlockSize * WRITE_ITEM_SIZE,
+		metadata_size: metadataSize(cfg),
 
 		write_item_size: WRITE_ITEM_SIZE,
+
+		stopping: make(chan struct{}),
+		restored: make(chan struct{}),
 	}
 
+	bs3.config.Store(cfg)
 	bs3.gcData.refcounter = make(map[int64]int64)
+	bs3.gcData.discards = make(map[int64]struct{})
+	bs3.objectStoreProxy.SetDeadline(time.Duration(cfg.S3.DeadlineMs) * time.Millisecond)
+	bs3.applyTimeout()
+
+	bs3.objectSizes = new(expvar.Map).Init()
+	objectMetrics.Set(metricsName(cfg), bs3.objectSizes)
+	bs3.publishChurn(metricsName(cfg))
+	pauseMetrics.Set(metricsName(cfg), expvar.Func(bs3.pauseState))
+	reclaimMetrics.Set(metricsName(cfg), expvar.Func(bs3.reclaimableState))
+	bs3.inflight.released = sync.NewCond(&bs3.inflight.mutex)
+	bs3.replica.ended = sync.NewCond(&bs3.replica.mutex)
+	bs3.readFanout = newFanout(cfg.Read.MaxFanout)
+	bs3.gcFanout = newFanout(cfg.GC.MaxFanout)
+	fanoutMetrics.Set(metricsName(cfg), expvar.Func(bs3.fanoutState))
+	inflightMetrics.Set(metricsName(cfg), expvar.Func(bs3.inflightBytes))
+	bs3.publishThrottle(metricsName(cfg))
+	bs3.readAhead.init()
+	readAheadMetrics.Set(metricsName(cfg), expvar.Func(bs3.readAheadState))
+	gcIdleMetrics.Set(metricsName(cfg), expvar.Func(bs3.gcIdleState))
+	recoveryMetrics.Set(metricsName(cfg), expvar.Func(bs3.recoveryState))
+
+	if cfg.Write.Async {
+		log.Warn().Msgf("Asynchronous writes enabled for bucket %s. Writes are acknowledged before they are uploaded. "+
+			"They are lost on crash together with all successive writes and flushes do not make them durable.", cfg.S3.Bucket)
+		bs3.staging.objects = make(map[int64][]byte)
+		bs3.staging.slots = make(chan struct{}, cfg.S3.Uploaders)
+		bs3.staging.uploaded = sync.NewCond(&bs3.staging.mutex)
+	}
+
+	if cfg.Write.Durable {
+		log.Info().Msgf("Flushes of volume in bucket %s are durable.", cfg.S3.Bucket)
+	} else {
+		log.Info().Msgf("Flushes of volume in bucket %s are barriers only.", cfg.S3.Bucket)
+	}
+
+	if cfg.Cache.Size > 0 {
+		bs3.cache = cache.New(cache.Options{
+			BlockSize:   cfg.BlockSize,
+			Capacity:    cfg.Cache.Size,
+			MemoryLimit: uint64(cfg.Cache.MemoryLimit),
+			Pressure:    cfg.Cache.Pressure,
+			Name:        metricsName(cfg),
+		})
+	}
 
 	return &bs3
 }
 
+// Returns name of the volume in the metrics, i.e. the local directory or the
+// bucket and the name prefix, which identify the volume uniquely.
+func metricsName(cfg *config.Config) string {
+	if cfg.FS.Path != "" {
+		return cfg.FS.Path
+	}
+
+	return cfg.S3.Bucket + "/" + cfg.S3.NamePrefix
+}
+
+// Returns identity of objects of the volume with id, i.e. the local directory
+// or the endpoint, the bucket, the name prefix and the key base. Objects of
+// two volumes have the same keys and different identities.
+func backendIdentity(cfg *config.Config, id volumeID) string {
+	if cfg.FS.Path != "" {
+		return fmt.Sprintf("%s/%s", cfg.FS.Path, id)
+	}
+
+	return fmt.Sprintf("%s/%s/%s/%d/%s", cfg.S3.Remote, cfg.S3.Bucket, cfg.S3.NamePrefix, cfg.S3.KeyBase, id)
+}
+
+// Returns size of the metadata part of the write chunk and of every object,
+// which has a write item for every block of the chunk. It is given by the
+// kernel module. Data start right after it, so it has to be aligned to blocks,
+// which holds for chunk sizes in whole MB. Hence reads of data are always
+// aligned and no format change is needed.
+func metadataSize(cfg *config.Config) int {
+	return cfg.Write.ChunkSize / cfg.BlockSize * WRITE_ITEM_SIZE
+}
+
+// Returns the first block of data in every object.
+func (b *bs3) dataBegin() int64 {
+	return int64(b.metadata_size / b.cfg().BlockSize)
+}
+
 // Handle writes comming from the buse library. writes contain number write
 // commands in this call and chunk contains memory where these commands are
 // stored together with their data. First part of the chunk are metadata, until
@@ -127,15 +536,59 @@ func New(objectStore objproxy.ObjectUploadDownloaderAt, extentMap mapproxy.Exten
 // to update the mapping. Before we actually do that, we wait until the whole
 // chunk us uploaded with generated key, which is just one more than the
 // previous one.
+//
+// The chunk is the shared memory of the kernel which is reused for the next
+// chunk once this function returns. It is uploaded directly without any copy,
+// hence the upload has to finish before returning. Only objects which outlive
+// the call, i.e. objects of asynchronous writes, are copied.
+//
+// The chunk is persisted all-or-nothing. All its writes are stored in a single
+// object, which appears on the backend at once, also when it is bigger than the
+// part size and it is uploaded in parts by a multipart upload. The parts are
+// not visible before the upload is completed by its last request. The extent
+// map is updated only after the upload, so either every write of the chunk is
+// durable and visible, or none of them is, including after a crash. The buse
+// library acknowledges the whole chunk to the kernel once this function
+// returns and it ignores the returned error, hence there is no way to report a
+// partial failure. A failed upload is therefore never returned. It is retried
+// until it succeeds and the chunk is acknowledged only after that.
+// Asynchronous writes are acknowledged once the object is staged, a crash
+// before the upload loses the whole chunk.
+//
+// Malformed chunk is rejected as a whole before it gets a key, so the sequence
+// of objects stays without gaps. The error is logged, since the library ignores
+// it and the kernel sees the writes as successful.
+//
+// Chunk without writes has nothing to persist, hence it gets no key and no
+// object is uploaded. Flushes are handled by the library, which waits only for
+// writes in flight, so there is nothing to wait for either.
 func (b *bs3) BuseWrite(writes int64, chunk []byte) error {
-	key := key.Next()
+	if err := b.checkChunk(writes, chunk); err != nil {
+		log.Error().Err(err).Msg("Malformed write chunk rejected. Its writes are lost.")
+		return err
+	}
+
+	if writes == 0 {
+		return nil
+	}
+
+	b.touchIO()
+	b.waitPrimary()
+
+	b.quiesce.RLock()
+	defer b.quiesce.RUnlock()
+
+	key := b.key.Next()
 
 	metadata := chunk[:b.metadata_size]
 	extents := make([]mapproxy.Extent, writes)
 
+	aligned := true
 	var writtenTotalBlocks uint64
 	for i := int64(0); i < writes; i++ {
-		e := parseExtent(metadata[:b.write_item_size])
+		stampEpoch(metadata[:b.write_item_size], b.epoch)
+		e := parseExtent(metadata[:b.write_item_size], b.cfg().BlockSize)
+		aligned = aligned && isAligned(metadata[:b.write_item_size], b.cfg().BlockSize)
 		extents[i] = e
 		metadata = metadata[b.write_item_size:]
 		writtenTotalBlocks += uint64(e.Length)
@@ -148,98 +601,315 @@ func (b *bs3) BuseWrite(writes int64, chunk []byte) error {
 		metadata[i] = 0
 	}
 
-	dataSize := writtenTotalBlocks * uint64(config.Cfg.BlockSize)
+	if aligned && b.cfg().Write.Coalesce {
+		extents = b.coalesce(extents, chunk[:b.metadata_size])
+	}
+
+	dataSize := writtenTotalBlocks * uint64(b.cfg().BlockSize)
 	object := chunk[:uint64(b.metadata_size)+dataSize]
 
-	// Some s3 backends, like minio just drops connection when they are
-	// under load. Hence the loop with exponential backoff till the
-	// operation succeeds. There is no point to return error, since the
-	// best thing we can do is to try infinitely and print a message to
-	// log.
-	for i := 1; ; i *= 2 {
-		err := b.objectStoreProxy.Upload(key, object, true)
-		if err == nil {
+	if !aligned {
+		log.Debug().Msgf("Write chunk for object %d is not aligned to blocks. Using read-modify-write.", key)
+		object, extents = b.readModifyWrite(writes, chunk)
+	}
+
+	b.stampFormat(object)
+
+	if b.cfg().Write.Checksum {
+		b.stampChecksums(object, extents)
+	}
+
+	if b.cfg().Write.Align > 0 {
+		object = b.pad(object, chunk)
+	}
+
+	// The upload is retried under the same key till it succeeds, see
+	// uploadRetry(). There is no point to return error, since the chunk
+	// would be acknowledged anyway.
+	b.throttle()
+	b.acquireInflight(int64(len(object)))
+	if b.cfg().Write.Async {
+		b.uploadAsync(key, object)
+	} else {
+		b.uploadRetry(key, object, true, objproxy.SourceWrite)
+		b.releaseInflight(int64(len(object)))
+	}
+
+	b.extentMapProxy.Update(extents, b.dataBegin(), key)
+	var blocks int64
+	for _, e := range extents {
+		blocks += e.Length
+	}
+	b.recordObjectSize(blocks)
+	b.churn.written.Add(1)
+
+	return nil
+}
+
+// Returns object padded by zeros to the multiple of the configured alignment.
+// The padding is done in place when the object is a prefix of buf and buf is
+// large enough, otherwise the object is copied. The padding is never read,
+// since the data are located by the lengths of writes in the header and the
+// object size matters only when it is zero.
+func (b *bs3) pad(object, buf []byte) []byte {
+	align := b.cfg().Write.Align
+	size := (len(object) + align - 1) / align * align
+	if size == len(object) {
+		return object
+	}
+
+	if size <= len(buf) && &object[0] == &buf[0] {
+		padding := buf[len(object):size]
+		for i := range padding {
+			padding[i] = 0
+		}
+
+		return buf[:size]
+	}
+
+	padded := make([]byte, size)
+	copy(padded, object)
+
+	return padded
+}
+
+// Download part of the object to the memory buffer chunk. The part is
+// specified by part. When the part is a whole write with checksum, the data are
+// verified and downloaded again if they do not match. Returns error when they
+// still do not match after all retries. Such data are never cached.
+func (b *bs3) downloadObjectPart(part mapproxy.ObjectPart, chunk []byte) error {
+	if b.readStaged(part.Key, chunk, part.Sector) {
+		return nil
+	}
+
+	if b.cache != nil && b.cache.Get(part.Key, part.Sector, chunk) {
+		return nil
+	}
+
+	for retry := 0; ; retry++ {
+		b.download(part, chunk)
+		if b.checksumValid(part.Flag, chunk) {
 			break
 		}
-		log.Info().Err(err).Send()
-		time.Sleep(time.Duration(i) * time.Second)
+		if retry == checksumRetries {
+			err := fmt.Errorf("data of object %d at block %d do not match the checksum", part.Key, part.Sector)
+			log.Error().Err(err).Send()
+			return err
+		}
+		log.Warn().Msgf("Data of object %d at block %d do not match the checksum. Downloading again.", part.Key, part.Sector)
 	}
 
-	b.extentMapProxy.Update(extents, int64(b.metadata_size/config.Cfg.BlockSize), key)
+	if b.cache != nil {
+		b.cache.Put(part.Key, part.Sector, chunk)
+	}
 
 	return nil
 }
 
-// Download part of the object to the memory buffer chunk. The part is
-// specified by part and it is necessary to call wg.Done() when the upload is
-// finished.
-func (b *bs3) downloadObjectPart(part mapproxy.ObjectPart, chunk []byte, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Downloads part of the object to the memory buffer chunk. Parts bigger than
+// the multipart threshold are split into pieces of the threshold size, which
+// are downloaded in parallel directly to their places in chunk, hence they are
+// assembled in order without any copying.
+func (b *bs3) download(part mapproxy.ObjectPart, chunk []byte) {
+	piece := b.cfg().Read.MultipartThreshold / int64(b.cfg().BlockSize) * int64(b.cfg().BlockSize)
+	if piece <= 0 || int64(len(chunk)) <= piece {
+		b.downloadRange(part.Key, chunk, part.Sector*int64(b.cfg().BlockSize))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for offset := int64(0); offset < int64(len(chunk)); offset += piece {
+		end := offset + piece
+		if end > int64(len(chunk)) {
+			end = int64(len(chunk))
+		}
+
+		wg.Add(1)
+		go func(offset, end int64) {
+			defer wg.Done()
+			b.downloadRange(part.Key, chunk[offset:end], part.Sector*int64(b.cfg().BlockSize)+offset)
+		}(offset, end)
+	}
+	wg.Wait()
+}
 
+// Downloads len(chunk) bytes of the object identified by key starting at
+// offset to chunk.
+func (b *bs3) downloadRange(key int64, chunk []byte, offset int64) {
 	// Some s3 backends, like minio just drops connection when they are
-	// under load. Hence the loop with exponential backoff till the
-	// operation succeeds. There is no point to return error, since the
-	// best thing we can do is to try infinitely and print a message to
-	// log.
-	for i := 1; ; i *= 2 {
-		err := b.objectStoreProxy.Download(part.Key, chunk, part.Sector*int64(config.Cfg.BlockSize), true)
+	// under load. Hence the loop with exponential backoff limited by the
+	// configured maximal delay till the operation succeeds. There is no
+	// point to return error, since the best thing we can do is to try
+	// infinitely and print a message to log. Timed out downloads are
+	// retried as well.
+	for delay := time.Second; ; delay = b.nextRetryDelay(delay) {
+		err := b.objectStoreProxy.Download(key, chunk, offset, true)
 		if err == nil {
 			break
 		}
-		log.Info().Err(err).Send()
-		time.Sleep(time.Duration(i) * time.Second)
+		log.Info().Err(err).Msgf("Download of object %d failed. Retrying in %s.", key, delay)
+		time.Sleep(delay)
 	}
 }
 
 // Read extent starting at sector with length length to the buffer chunk.
-// Length of the chunk is the same as length variable. This function consults
-// the extent map and asynchronously downloads all needed pieces to reconstruct
-// the logical extent.
+// Length of the chunk is the same as length variable. The portion of the
+// extent beyond the device, e.g. due to a resize race, reads as zeros and an
+// error is returned. Error is returned as well when data do not match their
+// checksum after all retries, so the read fails with EIO whenever the buse
+// library propagates errors to the kernel. The current library only logs
+// them.
 func (b *bs3) BuseRead(sector, length int64, chunk []byte) error {
+	b.touchIO()
+
+	b.quiesce.RLock()
+	defer b.quiesce.RUnlock()
+
+	valid := b.cfg().Size/int64(b.cfg().BlockSize) - sector
+	if sector < 0 || valid < 0 {
+		valid = 0
+	}
+	if valid > 0 {
+		b.readAheadAfter(sector, length)
+	}
+	if valid >= length {
+		return b.read(sector, length, chunk)
+	}
+
+	var err error
+	if valid > 0 {
+		err = b.read(sector, valid, chunk)
+	}
+	truncated := chunk[valid*int64(b.cfg().BlockSize):]
+	for i := range truncated {
+		truncated[i] = 0
+	}
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("read of %d blocks at %d is truncated to %d blocks by the device end", length, sector, valid)
+}
+
+// Consults the extent map and asynchronously downloads all needed pieces to
+// reconstruct the logical extent starting at sector with length length into
+// chunk. Unmapped pieces are looked up in recent objects when deep read is
+// enabled, see deepRead(). Returns error when data of any piece do not match
+// their checksum, the rest of the extent is read anyway.
+func (b *bs3) read(sector, length int64, chunk []byte) error {
 	objectPieces := b.getObjectPiecesRefCounterInc(sector, length)
+	errs := make([]error, len(objectPieces))
 
 	var wg sync.WaitGroup
-	for _, op := range objectPieces {
-		size := op.Length * int64(config.Cfg.BlockSize)
+	for i, op := range objectPieces {
+		size := op.Length * int64(b.cfg().BlockSize)
 		if op.Key != mapproxy.NotMappedKey {
-			wg.Add(1)
-			go b.downloadObjectPart(op, chunk[:size], &wg)
+			i, op, part := i, op, chunk[:size]
+			b.readFanout.goDownload(&wg, func() {
+				errs[i] = b.downloadObjectPart(op, part)
+			})
+		} else if b.cfg().DeepRead > 0 {
+			b.deepRead(sector, op.Length)
 		}
 		chunk = chunk[size:]
+		sector += op.Length
 	}
 
 	wg.Wait()
 
 	b.objectPiecesRefCounterDec(objectPieces)
 
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Before buse library communicating with the kernel starts, we restore map
-// stored on the backend and register signal handler of SIGUSR1 which servers
-// for threshold garbage collection. Then we run infinite loop with garbage
-// collection deleting just completely dead objects withou any data. It is very
-// fast and efficiet and has a huge impact on the backend space utilization.
-// Hence we run it continuously.
+// stored on the backend and register signal handlers of SIGUSR1 which servers
+// for threshold garbage collection and of SIGUSR2 which takes the checkpoint.
+// Then we run infinite loop with garbage collection deleting just completely
+// dead objects withou any data. It is very fast and efficiet and has a huge
+// impact on the backend space utilization. Hence we run it continuously,
+// unless dead GC is manual.
 func (b *bs3) BusePreRun() {
-	if !config.Cfg.SkipCheckpoint {
+	if !b.cfg().SkipCheckpoint {
 		b.restore()
+	} else {
+		b.extentMapProxy.UseLocal(0, 0)
 	}
+	close(b.restored)
+	b.nextEpoch()
+	go b.finishRecovery()
 
 	b.registerSigUSR1Handler()
+	b.registerSigUSR2Handler()
+	if b.gcSchedule != nil {
+		go b.gcScheduled()
+	}
 
-	go b.gcDead()
+	if !b.cfg().GC.DeadManual {
+		go b.gcDead()
+	}
 }
 
 // After disconnecting from the kernel module and just before shuting the
 // daemon down we save the map to the backend so it can be restored during next
 // start and mapping is not lost.
 func (b *bs3) BusePostRemove() {
-	if !config.Cfg.SkipCheckpoint {
+	if !b.cfg().SkipCheckpoint {
 		b.checkpoint()
 	}
 }
 
+// Called when the device is going to be stopped. No new threshold GC is
+// started afterwards. It starts the speculative checkpoint in the background
+// while the device is draining, hence the final checkpoint after the device
+// removal is only a small delta.
+func (b *bs3) PrepareStop() {
+	b.stoppingOnce.Do(func() {
+		close(b.stopping)
+	})
+
+	if b.cfg().SkipCheckpoint || !b.cfg().EarlyCheckpoint {
+		return
+	}
+
+	b.early.Add(1)
+	go func() {
+		defer b.early.Done()
+
+		b.warming.Wait()
+
+		log.Info().Msg("Early checkpointing started.")
+
+		nextKey, ok := b.takeCheckpoint(false)
+		b.earlyCheckpointed = ok
+
+		log.Info().Msgf("Early checkpointing finished. Last checkpointed object is %d.", nextKey)
+	}()
+}
+
+// Returns the current configuration of the volume. The returned configuration
+// is never modified, reload replaces it by another one.
+func (b *bs3) cfg() *config.Config {
+	return b.config.Load().(*config.Config)
+}
+
+// Replaces the configuration by cfg with values changed at runtime. GC
+// parameters are read from the configuration whenever they are used, hence
+// only the object store proxy needs to be resized and its deadline and timeout
+// updated.
+func (b *bs3) Reconfigure(cfg *config.Config) {
+	b.config.Store(cfg)
+	b.objectStoreProxy.Resize(b.cfg().S3.Uploaders, b.cfg().S3.Downloaders)
+	b.objectStoreProxy.SetDeadline(time.Duration(b.cfg().S3.DeadlineMs) * time.Millisecond)
+	b.applyTimeout()
+}
+
 // Returns object pieces for reconstructing logical extent but before that
 // safely increments the refcounter for the objects. Objects in refcounter are
 // excluded from garbage collection.
@@ -268,73 +938,389 @@ func (b *bs3) objectPiecesRefCounterDec(objectPieces []mapproxy.ObjectPart) {
 	b.gcData.reflock.Unlock()
 }
 
-// Restores the map from the checkpoint saved on the backend and updates the
-// current object key accordingly. If it exists.
-func (b *bs3) restoreFromCheckpoint() {
-	mapSize, err := b.objectStoreProxy.Instance.GetObjectSize(checkpointKey)
-	if err == nil {
-		log.Info().Msg("->Checkpoint found. Checkpoint recovery started.")
+// Restores the map from the checkpoint chain saved on the backend and updates
+// the current object key accordingly. If it exists.
+func (b *bs3) restoreFromCheckpoint(chain []checkpointObject, ok bool) {
+	if ok {
+		log.Info().Msgf("->Checkpoint with %d deltas found. Checkpoint recovery started.", len(chain)-1)
 
-		compressedMap := make([]byte, mapSize)
-		b.objectStoreProxy.Download(checkpointKey, compressedMap, 0, false)
-		newKey := b.extentMapProxy.Instance.DeserializeAndReturnNextKey(compressedMap)
-		key.Replace(newKey)
+		last := chain[len(chain)-1].trailer
+		if last.version != 0 {
+			b.checkVolumeID(last.volumeID)
+		}
+
+		newKey := b.loadCheckpointChain(chain, b.extentMapProxy.Instance)
+		b.verifyMap(b.extentMapProxy.Instance)
+		if last.version != 0 {
+			newKey = last.nextKey
+		}
+		b.key.Replace(newKey)
+		b.epoch = last.epoch
+		b.incarnation = last.incarnation
+		b.checkpointGeneration = last.generation
+		b.checkpointDeltas = last.delta
+		b.checkpointSlot = last.slot
 
 		log.Info().Msgf("->Checkpoint recovery process finished. Last object from checkpoint is %d.", newKey)
 	}
 }
 
+// Starts lazy restore of the checkpoint. Only the checkpoint trailers are read
+// synchronously to find out the next object key, the map itself is downloaded,
+// decoded and merged in the background by warm(). Returns false when the lazy
+// restore cannot be used, i.e. there is no checkpoint or it is a legacy one
+// without the trailer.
+//
+// Until the map is warmed, sectors from the checkpoint read as not mapped,
+// i.e. zeros. Writes and roll forward recovery proceed normally and always
+// take precedence over the checkpoint, since they are newer.
+func (b *bs3) restoreFromCheckpointLazily(chain []checkpointObject, ok bool) bool {
+	if !ok {
+		return false
+	}
+
+	last := chain[len(chain)-1].trailer
+	if last.version == 0 {
+		log.Info().Msg("->Legacy checkpoint found. Lazy recovery is not possible.")
+		return false
+	}
+
+	b.checkVolumeID(last.volumeID)
+	b.key.Replace(last.nextKey)
+	b.epoch = last.epoch
+	b.incarnation = last.incarnation
+	b.checkpointGeneration = last.generation
+	b.checkpointDeltas = last.delta
+	b.checkpointSlot = last.slot
+
+	b.warming.Add(1)
+	go b.warm(chain)
+
+	log.Info().Msgf("->Checkpoint found. Lazy checkpoint recovery started. Last object from checkpoint is %d.", last.nextKey)
+
+	return true
+}
+
+// Restores the map from its local copy when it corresponds to the last
+// checkpoint of the chain, hence the checkpoint does not have to be
+// downloaded. Returns false when there is no usable local copy, the map is
+// empty then.
+func (b *bs3) restoreFromLocal(chain []checkpointObject, ok bool) bool {
+	var last checkpointTrailer
+	if ok {
+		last = chain[len(chain)-1].trailer
+	}
+
+	if !b.extentMapProxy.UseLocal(last.generation, last.delta) {
+		return false
+	}
+	b.verifyMap(b.extentMapProxy.Instance)
+
+	b.checkVolumeID(last.volumeID)
+	b.key.Replace(last.nextKey)
+	b.epoch = last.epoch
+	b.incarnation = last.incarnation
+	b.checkpointGeneration = last.generation
+	b.checkpointDeltas = last.delta
+	b.checkpointSlot = last.slot
+
+	log.Info().Msgf("->Local copy of checkpoint found. Last object from checkpoint is %d.", last.nextKey)
+
+	return true
+}
+
+// Downloads and decodes the checkpoint into the staging map and merges it into
+// the live map. The merge is done in steps so the map is not locked for too
+// long and reads and writes can be served in between.
+func (b *bs3) warm(chain []checkpointObject) {
+	defer b.warming.Done()
+
+	staging := b.extentMapProxy.Instance.Empty()
+	b.loadCheckpointChain(chain, staging)
+	b.verifyMap(staging)
+
+	sectors := b.cfg().Size / int64(b.cfg().BlockSize)
+	for i := int64(0); i < sectors; i += b.cfg().GC.Step {
+		b.extentMapProxy.Warm(staging, i, b.cfg().GC.Step)
+	}
+	b.extentMapProxy.WarmFinish(staging)
+
+	log.Info().Msg("Lazy checkpoint recovery finished.")
+}
+
 // Restores the map from individual objects. It reconstructs the map replaying
 // all the writes from metadata part of continuous sequence of objects until a
 // missing object is found. This is the point where prefix consistency is
 // corrupted and we cannot recover more. Any successive objects are deleted.
-func (b *bs3) restoreFromObjects() {
-	log.Info().Msg("->Looking for objects to do roll forward recovery.")
+// Object of an older incarnation is treated as missing.
+//
+// Headers are downloaded in parallel in batches of consecutive keys and
+// replayed in the order of keys. The batch size is limited by the recovery
+// memory budget, since every header has metadata_size bytes.
+//
+// With listing, sizes of objects are taken from the inventory of the backend
+// listed at once and the size of each object is requested separately only when
+// the object is not in the inventory. Runs of garbage collected objects, which
+// are left with size 0, are skipped right away without downloading any batch,
+// since they are often the majority of keys of a volume after heavy GC.
+func (b *bs3) restoreFromObjects(extentMap updater, listing bool) error {
+	parallelism := b.recoveryParallelism()
+	log.Info().Msgf("->Looking for objects to do roll forward recovery. Parallelism %d.", parallelism)
+
+	var inventory map[int64]int64
+	if listing {
+		inventory = b.listInventory()
+	}
 
-	keyBefore := key.Current()
-	for ; ; key.Next() {
-		header := make([]byte, b.metadata_size)
-		size, err := b.objectStoreProxy.Instance.GetObjectSize(key.Current())
-		if err != nil {
-			// Prefix consistency broken.
-			break
+	headers := make([][]byte, parallelism)
+	for i := range headers {
+		headers[i] = make([]byte, b.metadata_size)
+	}
+	sizes := make([]int64, parallelism)
+	incarnations := make([]int64, parallelism)
+	errs := make([]error, parallelism)
+
+	keyBefore := b.key.Current()
+	var skipped int64
+	for broken := false; !broken; {
+		skipped += b.skipCollected(inventory)
+		first := b.key.Current()
+
+		var wg sync.WaitGroup
+		for i := range headers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				sizes[i], incarnations[i], errs[i] = b.downloadHeader(first+int64(i), headers[i], inventory)
+			}(i)
 		}
-		if size == 0 {
-			// Garbage collected object, that is OK, prefix
-			// consistency kept.
-			continue
+		wg.Wait()
+
+		for i := range headers {
+			if errs[i] != nil {
+				sizes[i], incarnations[i], errs[i] = b.downloadMissingHeader(first+int64(i), headers[i], errs[i])
+			}
+			if errs[i] != nil || b.staleIncarnation(first+int64(i), incarnations[i]) {
+				// Prefix consistency broken.
+				broken = true
+				break
+			}
+
+			// Size 0 is garbage collected object, that is OK,
+			// prefix consistency kept.
+			if sizes[i] != 0 {
+				if err := b.replayHeader(extentMap, headers[i], b.key.Current(), sizes[i]); err != nil {
+					return err
+				}
+			}
+			b.key.Next()
 		}
+	}
 
-		// Get writes metadata for object.
-		err = b.objectStoreProxy.Instance.DownloadAt(key.Current(), header, 0)
-		if err != nil {
+	if keyBefore == b.key.Current() {
+		log.Info().Msg("->No extra objects found for roll forward recovery.")
+	} else {
+		log.Info().Msgf("->Extra %d objects for roll forward recovery found, %d garbage collected ones skipped.",
+			b.key.Current()-keyBefore, skipped)
+	}
+
+	return nil
+}
+
+// Moves the current key over the run of garbage collected objects starting at
+// it which are in the inventory. Such objects have no writes to replay and they
+// keep prefix consistency, hence nothing is requested for them. Returns the
+// number of skipped objects.
+func (b *bs3) skipCollected(inventory map[int64]int64) int64 {
+	var skipped int64
+	for {
+		size, ok := inventory[b.key.Current()]
+		if !ok || size != 0 {
+			return skipped
+		}
+
+		b.key.Next()
+		skipped++
+	}
+}
+
+// Map updated by the roll forward recovery. It is either the extent map proxy
+// or a private map which is not accessed concurrently.
+type updater interface {
+	Update(extents []mapproxy.Extent, startOfDataSectors, key int64)
+}
+
+// Returns number of headers downloaded in parallel during recovery. It is
+// derived from the recovery memory budget and limited by the number of
+// downloaders.
+func (b *bs3) recoveryParallelism() int {
+	n := b.cfg().RecoveryMemory / int64(b.metadata_size)
+	if n > int64(b.cfg().S3.Downloaders) {
+		n = int64(b.cfg().S3.Downloaders)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	return int(n)
+}
+
+// Returns sizes of all objects of the volume by their keys listed from the
+// backend. Returns nil when the listing fails or when incarnations are enabled,
+// since the listing does not return them and every object has to be asked
+// anyway.
+func (b *bs3) listInventory() map[int64]int64 {
+	if b.cfg().Incarnation {
+		log.Info().Msg("->Listing of objects is not used with incarnations.")
+		return nil
+	}
+
+	inventory := make(map[int64]int64)
+	err := b.objectStoreProxy.Instance.ListKeys(func(key, size int64) bool {
+		inventory[key] = size
+		return true
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("->Listing of objects failed. Sizes of objects are requested one by one.")
+		return nil
+	}
+
+	log.Info().Msgf("->Listed %d objects.", len(inventory))
+
+	return inventory
+}
+
+// Downloads writes metadata of the object identified by key into header.
+// Returns size and incarnation of the object, header is not touched when the
+// size is 0. The size is taken from the inventory when the object is there.
+func (b *bs3) downloadHeader(key int64, header []byte, inventory map[int64]int64) (int64, int64, error) {
+	var size, incarnation int64
+	var err error
+	if s, ok := inventory[key]; ok {
+		size = s
+	} else {
+		size, incarnation, err = b.objectStoreProxy.Instance.GetObjectInfo(key)
+	}
+	if err != nil || size == 0 {
+		return size, incarnation, err
+	}
+
+	err = b.objectStoreProxy.Instance.DownloadAt(key, header, 0)
+
+	return size, incarnation, err
+}
+
+// Downloads header of the object which was not found, retrying the configured
+// number of times with exponential backoff starting at 1 second. Objects on
+// eventually consistent backends may be invisible for a while and treating
+// them as missing would delete them together with all their successors. err is
+// the error of the first attempt. The returned error wraps the error of the
+// last attempt, so e.g. objproxy.ErrNotFound can be told apart from other
+// failures.
+func (b *bs3) downloadMissingHeader(key int64, header []byte, err error) (int64, int64, error) {
+	for i, wait := 0, time.Second; i < b.cfg().RecoveryMissingRetries; i, wait = i+1, wait*2 {
+		log.Info().Err(err).Msgf("->Object %d not found. Retrying in %s.", key, wait)
+		time.Sleep(wait)
+
+		var size, incarnation int64
+		size, incarnation, err = b.downloadHeader(key, header, nil)
+		if err == nil {
+			return size, incarnation, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("object %d not found: %w", key, err)
+}
+
+// Replays all writes from the header of the object with key and size into
+// extentMap. Returns error when the object cannot be replayed, the current key
+// stays at it then.
+func (b *bs3) replayHeader(extentMap updater, header []byte, key, size int64) error {
+	extents, err := b.parseHeader(header, key, size)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range extents {
+		if epochOf(e.SeqNo) > b.epoch {
+			b.epoch = epochOf(e.SeqNo)
+		}
+		if e.Flag&mapproxy.FlagDiscard != 0 {
+			b.keepDiscards(key)
+		}
+	}
+
+	extentMap.Update(extents, b.dataBegin(), key)
+
+	return nil
+}
+
+// Returns all writes from the header of the object with key and size until
+// extent with length 0 is found. It is invalid value and it means that the
+// memory is zeroed, which means end of the metadata section of the object. The
+// memory is zeroed out in BuseWrite function where the object is uploaded.
+//
+// Writes are in sectors, except objects written by GC before the format
+// version 2, which have writes in blocks. They are the same with 512 byte
+// blocks. Otherwise such objects are told apart by their size, see
+// legacyBlocks().
+func (b *bs3) parseHeader(header []byte, key, size int64) ([]mapproxy.Extent, error) {
+	version := b.objectFormat(header)
+	if err := formatError(version, fmt.Sprintf("Object %d", key)); err != nil {
+		return nil, err
+	}
+
+	var items [][]byte
+	for h := header; len(h) >= b.write_item_size; h = h[b.write_item_size:] {
+		if binary.LittleEndian.Uint64(h[8:16]) == 0 {
 			break
 		}
+		items = append(items, h[:b.write_item_size])
+	}
 
-		// Replay all writes from metadata part until extent with
-		// length 0 is found. It is invalid value and it means that the
-		// memory is zeroed, which means end of the metadata section of
-		// the object. The memory is zeroed out in BuseWrite function
-		// where the object is uploaded.
-		extents := make([]mapproxy.Extent, 0, typicalExtentsPerObject)
-		for {
-			e := parseExtent(header[:b.write_item_size])
-			if e.Length == 0 {
-				break
-			}
-			extents = append(extents, e)
-			header = header[b.write_item_size:]
+	blocks := version < alignedFormatVersion && b.cfg().BlockSize != sectorUnit && b.legacyBlocks(items, size)
+
+	extents := make([]mapproxy.Extent, 0, typicalExtentsPerObject)
+	for _, item := range items {
+		if blocks {
+			extents = append(extents, mapproxy.Extent{
+				Sector: int64(binary.LittleEndian.Uint64(item[:8])),
+				Length: int64(binary.LittleEndian.Uint64(item[8:16])),
+				SeqNo:  int64(binary.LittleEndian.Uint64(item[16:24])),
+				Flag:   int64(binary.LittleEndian.Uint64(item[24:32])),
+			})
+			continue
 		}
 
-		dataBegin := int64(b.metadata_size / config.Cfg.BlockSize)
-		b.extentMapProxy.Update(extents, dataBegin, key.Current())
+		// Objects contain only whole blocks. Anything else means the
+		// volume was written with a different block size and replaying
+		// it would corrupt the map.
+		if !isAligned(item, b.cfg().BlockSize) {
+			return nil, fmt.Errorf("object %d of format version %d contains write not aligned to blocks of %d bytes, "+
+				"check that block_size matches the one the volume was created with", key, version, b.cfg().BlockSize)
+		}
+		extents = append(extents, parseExtent(item, b.cfg().BlockSize))
 	}
 
-	if keyBefore == key.Current() {
-		log.Info().Msg("->No extra objects found for roll forward recovery.")
-	} else {
-		log.Info().Msgf("->Extra %d objects for roll forward recovery found.", key.Current()-keyBefore)
+	return extents, nil
+}
+
+// Returns true when the object of size with write items is a legacy GC object
+// with writes in blocks. Objects of writes have exactly the size of the header
+// and the data of writes in sectors. Legacy GC objects always have the chunk
+// size and their data in blocks fit it. Both cannot hold at once, since the
+// data in blocks are bigger than the data in sectors.
+func (b *bs3) legacyBlocks(items [][]byte, size int64) bool {
+	var total uint64
+	for _, item := range items {
+		total += binary.LittleEndian.Uint64(item[8:16])
+	}
+
+	if size == int64(b.metadata_size)+int64(total)*sectorUnit {
+		return false
 	}
+
+	return size == int64(b.cfg().Write.ChunkSize) && int64(b.metadata_size)+int64(total)*int64(b.cfg().BlockSize) <= size
 }
 
 // Restores map from saved checkpoint and then continuous in restoration from
@@ -342,40 +1328,204 @@ func (b *bs3) restoreFromObjects() {
 // hence the old checkpoint is read. However there can already be uploaded new
 // set of objects fulfilling prefix consistency.
 func (b *bs3) restore() {
-	log.Info().Msgf("Checking for old volume in bucket %s.", config.Cfg.S3.Bucket)
+	log.Info().Msgf("Checking for old volume in bucket %s.", b.cfg().S3.Bucket)
 
-	b.restoreFromCheckpoint()
-	b.restoreFromObjects()
-	b.objectStoreProxy.Instance.DeleteKeyAndSuccessors(key.Current())
+	b.loadIntegrityLog()
+	chain, ok := b.findCheckpointChain()
+	checkCheckpointFormat(chain)
+	b.checkCheckpointFingerprint(chain)
+	if !b.restoreFromLocal(chain, ok) &&
+		(!b.cfg().LazyRestore || !b.restoreFromCheckpointLazily(chain, ok)) {
 
-	if key.Current() == 0 {
-		log.Info().Msgf("No volume found. Bucket %s is used for new volume.", config.Cfg.S3.Bucket)
+		b.restoreFromCheckpoint(chain, ok)
+	}
+	checkpoint := b.key.Current()
+	if err := b.restoreFromObjects(&b.extentMapProxy, b.cfg().RecoveryListing); err != nil {
+		log.Panic().Err(err).Msg("Roll forward recovery failed.")
+	}
+	report := b.unrecoverable(checkpoint, b.key.Current())
+	b.objectStoreProxy.Instance.DeleteKeyAndSuccessors(b.key.Current())
+	b.reportRecovery(report)
+	b.nextIncarnation()
+
+	if !b.volumeIDPersisted && !b.volumeID.isZero() {
+		persistVolumeID(b.volumeID, b.cfg().VolumeIDFile)
+		b.volumeIDPersisted = true
+	}
+
+	if b.key.Current() == 0 {
+		log.Info().Msgf("No volume found. Bucket %s is used for new volume.", b.cfg().S3.Bucket)
 	} else {
-		log.Info().Msgf("Volume found in bucket %s. The last object is %d.", config.Cfg.S3.Bucket, key.Current())
+		log.Info().Msgf("Volume found in bucket %s. The last object is %d.", b.cfg().S3.Bucket, b.key.Current())
 	}
 }
 
-// Serializes extent map and upload it to the backend.
+// Serializes extent map and upload it to the backend. When a checkpoint chain
+// exists and it is not too long, only a delta against the previous checkpoint
+// is uploaded. After the early checkpoint, the delta is uploaded regardless of
+// the chain length.
 func (b *bs3) checkpoint() {
+	b.warming.Wait()
+	b.early.Wait()
+
 	log.Info().Msg("Checkpointing started.")
 
+	nextKey, _ := b.takeCheckpoint(b.earlyCheckpointed)
+
+	log.Info().Msgf("Checkpointing finished. Last checkpointed object is %d.", nextKey)
+}
+
+// Serializes the map and uploads it as the next checkpoint of the chain, the
+// delta is forced by forceDelta. Returns the key in the trailer and whether the
+// upload succeeded.
+//
+// All acknowledged writes and finished GC runs have to be in the serialized
+// map and asynchronous writes have to be uploaded. Writes and GC runs in flight
+// have keys lower than the current one but they are not in the map yet, hence
+// IO and maintenance are quiesced until the map is serialized, so it covers
+// all objects under the key and references no newer one. The upload is done
+// with IO resumed. Dead GC in progress is finished first and excluded until
+// the upload finishes, so the checkpoint never sees its objects emptied on the
+// backend but still referenced as dead by the map, and they cannot be emptied
+// while the checkpoint is uploaded.
+func (b *bs3) takeCheckpoint(forceDelta bool) (int64, bool) {
+	resume := b.quiesceMaintenance()
+	b.gcData.removing.Lock()
+	defer b.gcData.removing.Unlock()
+
+	nextKey := b.key.Current()
+	c := b.prepareCheckpoint(nextKey, forceDelta)
+	resume()
+
+	return nextKey, b.uploadCheckpoint(c)
+}
+
+// Checkpoint serialized by prepareCheckpoint() and uploaded by
+// uploadCheckpoint().
+type preparedCheckpoint struct {
+	key     int64
+	dump    []byte
+	summary mapproxy.Summary
+	trailer checkpointTrailer
+}
+
+// Serializes extent map as the next checkpoint of the chain with nextKey in the
+// trailer. All objects under nextKey have to be in the map and the map must not
+// reference any object at or above it, otherwise the recovery after a crash
+// could delete objects referenced by the restored map. Hence the caller has to
+// hold quiesce for writing, which keeps writes and GC out of the map. Delta is
+// forced by forceDelta, otherwise it is limited by the configured chain length.
+func (b *bs3) prepareCheckpoint(nextKey int64, forceDelta bool) preparedCheckpoint {
 	log.Info().Msg("->Serialization of extent map started.")
-	dump := b.extentMapProxy.Instance.Serialize()
+	c := preparedCheckpoint{key: checkpointKey}
+
+	// Deltas of the chain taken before the integrity log was started are
+	// not in the log, hence the new log starts with the base.
+	if b.cfg().Integrity && b.cfg().IntegrityLog && !b.integrity.logged {
+		b.checkpointGeneration = 0
+	}
+
+	if b.checkpointGeneration != 0 && (forceDelta || b.checkpointDeltas < b.cfg().CheckpointDeltas) {
+		c.dump, c.summary = b.serializeMap(true)
+		if c.dump != nil {
+			b.checkpointDeltas++
+			c.key = deltaKey(b.checkpointDeltas)
+		}
+	}
+	if c.dump == nil {
+		c.dump, c.summary = b.serializeMap(false)
+		b.checkpointGeneration = time.Now().UnixNano()
+		b.checkpointDeltas = 0
+	}
+	c.trailer = checkpointTrailer{
+		version:     formatVersion,
+		nextKey:     nextKey,
+		volumeID:    b.volumeID,
+		generation:  b.checkpointGeneration,
+		delta:       b.checkpointDeltas,
+		epoch:       b.epoch,
+		slot:        b.checkpointSlot,
+		incarnation: b.incarnation,
+	}
+	b.stampFingerprint(&c.trailer)
 	log.Info().Msg("->Serialization of extent map finished.")
 
-	log.Info().Msg("->Upload of extent map started.")
-	b.objectStoreProxy.Upload(checkpointKey, dump, false)
+	return c
+}
+
+// Uploads the checkpoint prepared by prepareCheckpoint(). It does not need
+// quiesce, so IO can be resumed before. Returns false when the upload failed.
+func (b *bs3) uploadCheckpoint(c preparedCheckpoint) bool {
+	dump, trailer, objectKey, summary := c.dump, c.trailer, c.key, c.summary
+	nextKey := trailer.nextKey
+
+	if b.cfg().VerifyCheckpoint {
+		if err := b.verifyRoundTrip(dump, objectKey != checkpointKey, summary); err != nil {
+			// The delta is lost like after a failed upload, hence
+			// the next checkpoint has to be the base.
+			log.Error().Err(err).Msg("->Serialized extent map does not round-trip. Checkpoint not uploaded.")
+			b.checkpointGeneration = 0
+			return false
+		}
+		log.Info().Msg("->Serialized extent map round-trips.")
+	}
+
+	if b.cfg().Integrity {
+		trailer.root = computeMerkleRoot(dump)
+		if b.cfg().IntegrityLog {
+			if err := b.logIntegrity(trailer); err != nil {
+				log.Error().Err(err).Msg("->Upload of integrity log failed. Checkpoint not uploaded.")
+				b.checkpointGeneration = 0
+				return false
+			}
+		}
+		log.Info().Msgf("->Merkle root of extent map is %s.", trailer.root)
+	}
+
+	log.Info().Msgf("->Upload of extent map started. Checkpoint delta %d.", trailer.delta)
+	var err error
+	if b.cfg().CheckpointShards > 1 {
+		// The base goes to the slot not referenced by the uploaded
+		// base.
+		if objectKey == checkpointKey {
+			trailer.slot = 1 - b.checkpointSlot
+		}
+		dump, trailer.shards, err = b.uploadShards(dump, b.cfg().CheckpointShards, trailer.delta, trailer.slot)
+	}
+	if err == nil {
+		err = b.objectStoreProxy.Upload(objectKey, append(dump, trailer.marshal()...), false, objproxy.SourceCheckpoint)
+	}
+	if err != nil {
+		// Changes in the lost delta would be missing in the next one,
+		// hence the next checkpoint has to be the base.
+		log.Error().Err(err).Msg("->Upload of extent map failed.")
+		b.checkpointGeneration = 0
+		return false
+	}
 	log.Info().Msg("->Upload of extent map finished.")
+	b.checkpointSlot = trailer.slot
+
+	if err := b.extentMapProxy.SaveLocal(trailer.generation, trailer.delta); err != nil {
+		log.Warn().Err(err).Msg("->Local copy of extent map was not saved.")
+	}
 
-	log.Info().Msgf("Checkpointing finished. Last checkpointed object is %d.", key.Current())
+	b.releaseDiscards(nextKey)
+	b.clearRecovery()
+
+	return true
 }
 
 // Parses write extent information from 32 bytes of raw memory. The memory is
-// one write in metadata section of the object.
-func parseExtent(b []byte) mapproxy.Extent {
+// one write in metadata section of the object. Sector and length are converted
+// from sectors to blocks and rounded down, hence the write has to be aligned,
+// see isAligned.
+func parseExtent(b []byte, blockSize int) mapproxy.Extent {
+	sector, _ := sectorsToBlocks(binary.LittleEndian.Uint64(b[:8]), blockSize)
+	length, _ := sectorsToBlocks(binary.LittleEndian.Uint64(b[8:16]), blockSize)
+
 	return mapproxy.Extent{
-		Sector: int64(binary.LittleEndian.Uint64(b[:8]) * sectorUnit / uint64(config.Cfg.BlockSize)),
-		Length: int64(binary.LittleEndian.Uint64(b[8:16]) * sectorUnit / uint64(config.Cfg.BlockSize)),
+		Sector: sector,
+		Length: length,
 		SeqNo:  int64(binary.LittleEndian.Uint64(b[16:24])),
 		Flag:   int64(binary.LittleEndian.Uint64(b[24:32])),
 	}
@@ -0,0 +1,197 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/ilyakaznacheev/cleanenv"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy/sectormap"
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+	"github.com/asch/bs3/internal/config"
+)
+
+const (
+	testBlockSize = 4096
+	testChunkSize = 1024 * 1024
+	testSize      = 64 * 1024 * 1024
+)
+
+// Returns configuration with the default values of all options for the volume
+// of testSize bytes with chunks of testChunkSize. Every test gets its own
+// bucket, so the metrics of volumes do not collide.
+func newTestConfig(t testing.TB) *config.Config {
+	t.Helper()
+
+	cfg := new(config.Config)
+	if err := cleanenv.ReadEnv(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.S3.Bucket = t.Name()
+	cfg.Size = testSize
+	cfg.BlockSize = testBlockSize
+	cfg.Write.ChunkSize = testChunkSize
+	cfg.Write.CollisionSize = testChunkSize
+	cfg.RecoveryMemory *= 1024 * 1024
+	cfg.GC.DeadManual = true
+
+	return cfg
+}
+
+// Returns started volume configured by cfg on the backend store, typically the
+// memory one.
+func newTestVolume(t testing.TB, cfg *config.Config, store objproxy.ObjectUploadDownloaderAt) *bs3 {
+	t.Helper()
+
+	b := New(cfg, store, sectormap.New(cfg.Size/int64(cfg.BlockSize)))
+	b.BusePreRun()
+
+	return b
+}
+
+// Write of data at block given by the kernel.
+type testWrite struct {
+	block int64
+	data  []byte
+}
+
+// Returns the write chunk with writes as the kernel passes it to BuseWrite.
+// Every write gets the sequential number of its position in the chunk
+// increased by seqNo.
+func testChunk(b *bs3, seqNo int64, writes ...testWrite) []byte {
+	chunk := make([]byte, b.metadata_size+b.cfg().Write.ChunkSize)
+	data := chunk[b.metadata_size:]
+	for i, w := range writes {
+		item := chunk[i*b.write_item_size:]
+		binary.LittleEndian.PutUint64(item[0:8], uint64(w.block*int64(b.cfg().BlockSize)/sectorUnit))
+		binary.LittleEndian.PutUint64(item[8:16], uint64(len(w.data)/sectorUnit))
+		binary.LittleEndian.PutUint64(item[16:24], uint64(seqNo+int64(i)))
+		data = data[copy(data, w.data):]
+	}
+
+	return chunk
+}
+
+// Returns blocks of the block size filled by value.
+func testData(blocks int, value byte) []byte {
+	return bytes.Repeat([]byte{value}, blocks*testBlockSize)
+}
+
+// Reads blocks at block and fails the test when they differ from want.
+func expectRead(t *testing.T, b *bs3, block int64, want []byte) {
+	t.Helper()
+
+	got := make([]byte, len(want))
+	if err := b.BuseRead(block, int64(len(want)/testBlockSize), got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("blocks at %d differ from the written data", block)
+	}
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{10, testData(3, 1)}, testWrite{100, testData(2, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BuseWrite(1, testChunk(b, 10, testWrite{11, testData(1, 3)})); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append(testData(1, 1), testData(1, 3)...), testData(1, 1)...)
+	expectRead(t, b, 10, want)
+	expectRead(t, b, 100, testData(2, 2))
+	expectRead(t, b, 0, testData(1, 0))
+
+	// The volume restored from the objects reads the same.
+	restored := newTestVolume(t, newTestConfig(t), store)
+	expectRead(t, restored, 10, want)
+	expectRead(t, restored, 100, testData(2, 2))
+}
+
+func TestRestorePrefixConsistent(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+
+	for i := int64(0); i < 3; i++ {
+		if err := b.BuseWrite(1, testChunk(b, 10*(i+1), testWrite{i, testData(1, byte(i+1))})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Objects after the missing one are not replayed and they are deleted,
+	// so the device is prefix consistent.
+	last := mustDownload(t, b, 2)
+	store.DeleteKeyAndSuccessors(1)
+	store.Upload(2, last, objproxy.SourceWrite)
+
+	restored := newTestVolume(t, newTestConfig(t), store)
+	if restored.key.Current() != 1 {
+		t.Fatalf("restore stopped at object %d, not at the missing object 1", restored.key.Current())
+	}
+	expectRead(t, restored, 0, testData(1, 1))
+	expectRead(t, restored, 1, testData(1, 0))
+	expectRead(t, restored, 2, testData(1, 0))
+	if _, err := store.GetObjectSize(2); err == nil {
+		t.Fatal("object after the missing one was not deleted")
+	}
+}
+
+// Returns the whole object with key uploaded by b.
+func mustDownload(t *testing.T, b *bs3, key int64) []byte {
+	t.Helper()
+
+	size, err := b.objectStoreProxy.Instance.GetObjectSize(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := make([]byte, size)
+	if err := b.objectStoreProxy.Instance.DownloadAt(key, object, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return object
+}
+
+func TestReadBeyondDevice(t *testing.T) {
+	b := newTestVolume(t, newTestConfig(t), memory.New())
+	last := b.cfg().Size/int64(b.cfg().BlockSize) - 1
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{last, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The part within the device is read and the rest is zeroed.
+	chunk := bytes.Repeat([]byte{0xff}, 3*testBlockSize)
+	if err := b.BuseRead(last, 3, chunk); err == nil {
+		t.Fatal("read beyond the device end succeeded")
+	}
+	if !bytes.Equal(chunk, append(testData(1, 1), testData(2, 0)...)) {
+		t.Fatal("truncated read returned wrong data")
+	}
+
+	if err := b.BuseRead(last+1, 1, make([]byte, testBlockSize)); err == nil {
+		t.Fatal("read after the device end succeeded")
+	}
+	expectRead(t, b, last, testData(1, 1))
+}
+
+func TestMissingHeaderError(t *testing.T) {
+	b := newTestVolume(t, newTestConfig(t), memory.New())
+	cfg := *b.cfg()
+	cfg.RecoveryMissingRetries = 1
+	b.Reconfigure(&cfg)
+
+	_, _, err := b.downloadMissingHeader(100, make([]byte, b.metadata_size), errors.New("first attempt"))
+	if !errors.Is(err, objproxy.ErrNotFound) {
+		t.Fatalf("error %v of the missing object does not wrap the error of the last attempt", err)
+	}
+}
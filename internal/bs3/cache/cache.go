@@ -0,0 +1,207 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package cache implements in-memory LRU cache of blocks read from the
+// backend. Objects are never modified after creation, hence the cached blocks
+// never become stale and no invalidation is needed.
+package cache
+
+import (
+	"container/list"
+	"expvar"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Period of checking the memory pressure.
+	watchPeriod = time.Second
+)
+
+// Statistics of all caches, published under "cache" in the metrics.
+var metrics = expvar.NewMap("cache")
+
+// Identification of the block in the backend.
+type block struct {
+	key    int64
+	sector int64
+}
+
+// Cached block.
+type entry struct {
+	block
+	data []byte
+}
+
+// LRU cache of blocks. The cache is bounded by its capacity and it is shrunk
+// further when the heap of the whole process crosses the configured fraction
+// of the memory limit. Like this the cache yields memory to the extent map,
+// which cannot be shrunk.
+type Cache struct {
+	mutex     sync.Mutex
+	blockSize int
+	capacity  int64
+	size      int64
+	lru       *list.List
+	blocks    map[block]*list.Element
+
+	bytes     *expvar.Int
+	hits      *expvar.Int
+	misses    *expvar.Int
+	evictions *expvar.Int
+}
+
+// Options to use in New() function.
+type Options struct {
+	BlockSize int
+
+	// Maximal size of cached data in bytes.
+	Capacity int64
+
+	// Memory limit of the process in bytes and fraction of it which, when
+	// crossed by the heap, makes the cache to evict aggressively. Zero
+	// limit means total memory of the system. Zero pressure disables the
+	// watching.
+	MemoryLimit uint64
+	Pressure    float64
+
+	// Name of the cache in the metrics, e.g. the bucket name.
+	Name string
+}
+
+func New(o Options) *Cache {
+	c := &Cache{
+		blockSize: o.BlockSize,
+		capacity:  o.Capacity,
+		lru:       list.New(),
+		blocks:    make(map[block]*list.Element),
+		bytes:     new(expvar.Int),
+		hits:      new(expvar.Int),
+		misses:    new(expvar.Int),
+		evictions: new(expvar.Int),
+	}
+
+	stats := new(expvar.Map).Init()
+	stats.Set("bytes", c.bytes)
+	stats.Set("hits", c.hits)
+	stats.Set("misses", c.misses)
+	stats.Set("evictions", c.evictions)
+	metrics.Set(o.Name, stats)
+
+	if o.Pressure > 0 {
+		limit := o.MemoryLimit
+		if limit == 0 {
+			limit = totalMemory()
+		}
+		if limit != 0 {
+			go c.watch(uint64(float64(limit) * o.Pressure))
+		}
+	}
+
+	return c
+}
+
+// Copies blocks of the object key starting at sector into buf. The length of
+// buf is the length of requested data. Returns false and leaves buf in
+// undefined state when any of the blocks is not cached.
+func (c *Cache) Get(key, sector int64, buf []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := 0; i < len(buf); i += c.blockSize {
+		e, ok := c.blocks[block{key, sector + int64(i/c.blockSize)}]
+		if !ok {
+			c.misses.Add(1)
+			return false
+		}
+		c.lru.MoveToFront(e)
+		copy(buf[i:], e.Value.(*entry).data)
+	}
+
+	c.hits.Add(1)
+
+	return true
+}
+
+// Returns true when all length blocks of the object key starting at sector are
+// cached. Unlike Get, it neither copies the blocks nor counts hits and misses.
+func (c *Cache) Contains(key, sector, length int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := int64(0); i < length; i++ {
+		if _, ok := c.blocks[block{key, sector + i}]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Stores blocks of the object key starting at sector from buf.
+func (c *Cache) Put(key, sector int64, buf []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := 0; i+c.blockSize <= len(buf); i += c.blockSize {
+		b := block{key, sector + int64(i/c.blockSize)}
+		if e, ok := c.blocks[b]; ok {
+			c.lru.MoveToFront(e)
+			continue
+		}
+
+		data := make([]byte, c.blockSize)
+		copy(data, buf[i:])
+		c.blocks[b] = c.lru.PushFront(&entry{b, data})
+		c.size += int64(c.blockSize)
+	}
+
+	c.evict(c.capacity)
+}
+
+// Evicts the least recently used blocks until the size of cached data is at
+// most target. Must be called with mutex held.
+func (c *Cache) evict(target int64) {
+	for c.size > target {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*entry).block)
+		c.size -= int64(c.blockSize)
+		c.evictions.Add(1)
+	}
+
+	c.bytes.Set(c.size)
+}
+
+// Periodically checks the heap of the process and halves the cache whenever it
+// is over the threshold. The heap does not shrink until the next garbage
+// collection, hence the cache is halved repeatedly under sustained pressure.
+func (c *Cache) watch(threshold uint64) {
+	var m runtime.MemStats
+	for range time.Tick(watchPeriod) {
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc < threshold {
+			continue
+		}
+
+		c.mutex.Lock()
+		if c.size > 0 {
+			log.Debug().Msgf("Memory pressure, heap %d B. Shrinking cache from %d B.", m.HeapAlloc, c.size)
+			c.evict(c.size / 2)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// Returns total memory of the system in bytes.
+func totalMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
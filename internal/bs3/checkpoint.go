@@ -0,0 +1,516 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// The checkpoint is either a single object with the serialized map, the base,
+// or the base followed by a chain of deltas. Each delta contains only sectors
+// changed since the previous checkpoint. Deltas are stored under keys below the
+// checkpoint key, i.e. -2, -3, etc. All objects of one chain have the same
+// generation in the trailer, so deltas of an older chain, which were not
+// deleted, are never applied on a newer base.
+//
+// Any object of the chain can be sharded. Then the serialized map is split into
+// shards stored in separate objects uploaded in parallel and the object of the
+// chain is just a manifest listing the shards. Shards of the base alternate
+// between two slots of keys, hence the shards of the base referenced by the
+// uploaded manifest are never overwritten by the next base before its manifest
+// is uploaded.
+
+const (
+	// Size of the trailer appended to the serialized extent map in the
+	// checkpoint object. It is fixed and generous, so new fields can be
+	// added without changing the layout of the existing ones.
+	checkpointTrailerSize = 256
+
+	// Magic stored in the last bytes of the checkpoint trailer. Checkpoints
+	// without it are legacy checkpoints containing just the serialized
+	// map.
+	checkpointMagic = "bs3ckpt\x00"
+
+	// Keys of checkpoint shards are below this key, far from the keys of
+	// deltas.
+	shardKeyBase = -(1 << 40)
+
+	// Size of the identifier of the extent map type in the checkpoint
+	// trailer, see ExtentMapper.Type().
+	mapTypeSize = 32
+
+	// Maximal number of shards of one checkpoint object.
+	maxShards = 1 << 16
+
+	// Size of one shard in the manifest.
+	manifestItemSize = 24
+
+	// Minimal size of the key window of the volume in the bucket. Keys of
+	// shards go below shardKeyBase, this leaves room for chains of
+	// millions of deltas.
+	minKeySpan = -2 * shardKeyBase
+)
+
+// Information stored together with the serialized extent map. The trailer is
+// placed at the end of the checkpoint object instead of its beginning to avoid
+// copying of the possibly huge serialized map. It can be read by a single
+// ranged download when the object size is known.
+//
+// Layout of the trailer, all values are little endian:
+//
+//	[0:8]     format version, see formatVersion
+//	[8:16]    next unassigned object key at the time of checkpoint
+//	[16:32]   volume id, zeroed when unknown
+//	[32:40]   generation of the checkpoint chain
+//	[40:48]   position in the checkpoint chain, 0 for the base
+//	[48:56]   epoch of sequential numbers of the run taking the checkpoint
+//	[56:64]   number of shards, 0 when the map is stored in the object itself
+//	[64:72]   slot of keys of the shards
+//	[72:80]   incarnation of the volume
+//	[80:88]   block size in bytes
+//	[88:96]   write chunk size in bytes
+//	[96:104]  device size in bytes
+//	[104:136] type of the extent map, zero padded
+//	[136:168] Merkle root of the serialized map, zeroed when not computed
+//	[168:248] reserved, zeroed
+//	[248:256] magic
+//
+// Block size, chunk size, device size and type of the map are the fingerprint
+// of the configuration the checkpoint was taken with. They are zero in
+// checkpoints taken before the fingerprint was introduced.
+type checkpointTrailer struct {
+	version    int64
+	nextKey    int64
+	volumeID   volumeID
+	generation int64
+	delta      int64
+	epoch      int64
+	shards     int64
+	slot       int64
+
+	incarnation int64
+
+	blockSize int64
+	chunkSize int64
+	size      int64
+	mapType   string
+
+	root merkleRoot
+}
+
+// Returns raw representation of the trailer.
+func (t checkpointTrailer) marshal() []byte {
+	b := make([]byte, checkpointTrailerSize)
+
+	binary.LittleEndian.PutUint64(b[0:], uint64(t.version))
+	binary.LittleEndian.PutUint64(b[8:], uint64(t.nextKey))
+	copy(b[16:32], t.volumeID[:])
+	binary.LittleEndian.PutUint64(b[32:], uint64(t.generation))
+	binary.LittleEndian.PutUint64(b[40:], uint64(t.delta))
+	binary.LittleEndian.PutUint64(b[48:], uint64(t.epoch))
+	binary.LittleEndian.PutUint64(b[56:], uint64(t.shards))
+	binary.LittleEndian.PutUint64(b[64:], uint64(t.slot))
+	binary.LittleEndian.PutUint64(b[72:], uint64(t.incarnation))
+	binary.LittleEndian.PutUint64(b[80:], uint64(t.blockSize))
+	binary.LittleEndian.PutUint64(b[88:], uint64(t.chunkSize))
+	binary.LittleEndian.PutUint64(b[96:], uint64(t.size))
+	copy(b[104:104+mapTypeSize], t.mapType)
+	copy(b[136:168], t.root[:])
+	copy(b[checkpointTrailerSize-len(checkpointMagic):], checkpointMagic)
+
+	return b
+}
+
+// Parses trailer from its raw representation. Returns false if b is not a
+// checkpoint trailer, which is the case for legacy checkpoints.
+func parseCheckpointTrailer(b []byte) (checkpointTrailer, bool) {
+	if len(b) != checkpointTrailerSize ||
+		string(b[checkpointTrailerSize-len(checkpointMagic):]) != checkpointMagic {
+
+		return checkpointTrailer{}, false
+	}
+
+	t := checkpointTrailer{
+		version: int64(binary.LittleEndian.Uint64(b[0:])),
+		nextKey: int64(binary.LittleEndian.Uint64(b[8:])),
+	}
+	copy(t.volumeID[:], b[16:32])
+	t.generation = int64(binary.LittleEndian.Uint64(b[32:]))
+	t.delta = int64(binary.LittleEndian.Uint64(b[40:]))
+	t.epoch = int64(binary.LittleEndian.Uint64(b[48:]))
+	t.shards = int64(binary.LittleEndian.Uint64(b[56:]))
+	t.slot = int64(binary.LittleEndian.Uint64(b[64:]))
+	t.incarnation = int64(binary.LittleEndian.Uint64(b[72:]))
+	t.blockSize = int64(binary.LittleEndian.Uint64(b[80:]))
+	t.chunkSize = int64(binary.LittleEndian.Uint64(b[88:]))
+	t.size = int64(binary.LittleEndian.Uint64(b[96:]))
+	t.mapType = strings.TrimRight(string(b[104:104+mapTypeSize]), "\x00")
+	copy(t.root[:], b[136:168])
+
+	return t, true
+}
+
+// Stores the fingerprint of the current configuration into the trailer.
+func (b *bs3) stampFingerprint(t *checkpointTrailer) {
+	t.blockSize = int64(b.cfg().BlockSize)
+	t.chunkSize = int64(b.cfg().Write.ChunkSize)
+	t.size = b.cfg().Size
+	t.mapType = b.extentMapProxy.Instance.Type()
+}
+
+// Refuses checkpoint chains taken with a configuration incompatible with the
+// current one, see checkFingerprint(). Checkpoints without the fingerprint are
+// not checked.
+func (b *bs3) checkCheckpointFingerprint(chain []checkpointObject) {
+	for _, c := range chain {
+		if err := b.checkFingerprint(c.trailer); err != nil {
+			log.Panic().Msgf("Checkpoint object %d was taken with %s. "+
+				"Restore the original configuration to open the volume.", c.key, err)
+		}
+
+		if t := c.trailer; t.blockSize != 0 && t.size != b.cfg().Size {
+			log.Info().Msgf("Checkpoint object %d was taken with device size %d B, the device size is %d B now.",
+				c.key, t.size, b.cfg().Size)
+		}
+	}
+}
+
+// Returns error when the fingerprint in trailer t does not match the current
+// configuration. The map is in blocks and object headers have the size derived
+// from the chunk size, hence a map restored with a different block size, chunk
+// size or map type would silently map wrong data. The device size can change,
+// the map is resized during the restore. Trailers without the fingerprint
+// always match.
+func (b *bs3) checkFingerprint(t checkpointTrailer) error {
+	if t.blockSize == 0 {
+		return nil
+	}
+
+	mismatch := func(what string, checkpoint, current interface{}) error {
+		return fmt.Errorf("%s %v, but the %s is %v now", what, checkpoint, what, current)
+	}
+
+	if t.blockSize != int64(b.cfg().BlockSize) {
+		return mismatch("block size", t.blockSize, b.cfg().BlockSize)
+	}
+	if t.chunkSize != int64(b.cfg().Write.ChunkSize) {
+		return mismatch("write chunk size", t.chunkSize, b.cfg().Write.ChunkSize)
+	}
+	if current := b.extentMapProxy.Instance.Type(); t.mapType != current {
+		return mismatch("extent map type", t.mapType, current)
+	}
+
+	return nil
+}
+
+// Splits the checkpoint object into the serialized map and the trailer. For
+// legacy checkpoints the whole object is the serialized map and false is
+// returned.
+func splitCheckpoint(checkpoint []byte) ([]byte, checkpointTrailer, bool) {
+	if len(checkpoint) < checkpointTrailerSize {
+		return checkpoint, checkpointTrailer{}, false
+	}
+
+	body := checkpoint[:len(checkpoint)-checkpointTrailerSize]
+	t, ok := parseCheckpointTrailer(checkpoint[len(body):])
+	if !ok {
+		return checkpoint, checkpointTrailer{}, false
+	}
+
+	return body, t, true
+}
+
+// Returns key of the n-th delta in the checkpoint chain.
+func deltaKey(n int64) int64 {
+	return checkpointKey - n
+}
+
+// One object of the checkpoint chain.
+type checkpointObject struct {
+	key     int64
+	size    int64
+	trailer checkpointTrailer
+}
+
+// Finds the checkpoint base and all valid deltas on top of it. Only sizes and
+// trailers are downloaded. Returns false when there is no checkpoint. Legacy
+// checkpoint is returned as a base with zeroed trailer.
+func (b *bs3) findCheckpointChain() ([]checkpointObject, bool) {
+	size, err := b.objectStoreProxy.Instance.GetObjectSize(checkpointKey)
+	if err != nil {
+		return nil, false
+	}
+
+	base := checkpointObject{key: checkpointKey, size: size}
+	base.trailer, _ = b.downloadCheckpointTrailer(checkpointKey, size)
+	chain := []checkpointObject{base}
+
+	for n := int64(1); base.trailer.generation != 0; n++ {
+		size, err := b.objectStoreProxy.Instance.GetObjectSize(deltaKey(n))
+		if err != nil {
+			break
+		}
+
+		t, ok := b.downloadCheckpointTrailer(deltaKey(n), size)
+		if !ok || t.generation != base.trailer.generation || t.delta != n {
+			break
+		}
+
+		chain = append(chain, checkpointObject{key: deltaKey(n), size: size, trailer: t})
+	}
+
+	return chain, true
+}
+
+// Downloads and parses the trailer of the checkpoint object with key and size.
+func (b *bs3) downloadCheckpointTrailer(key, size int64) (checkpointTrailer, bool) {
+	if size < checkpointTrailerSize {
+		return checkpointTrailer{}, false
+	}
+
+	raw := make([]byte, checkpointTrailerSize)
+	err := b.objectStoreProxy.Download(key, raw, size-checkpointTrailerSize, false)
+	if err != nil {
+		return checkpointTrailer{}, false
+	}
+
+	return parseCheckpointTrailer(raw)
+}
+
+// Downloads all objects of the checkpoint chain and restores them into the
+// extentMap. Returns the next key derived from the map by the base
+// deserialization, which is needed only for legacy checkpoints. The daemon
+// refuses to start when an object does not match its Merkle root, see
+// checkIntegrity().
+func (b *bs3) loadCheckpointChain(chain []checkpointObject, extentMap mapproxy.ExtentMapper) int64 {
+	var nextKey int64
+
+	required := b.checkRequiredIntegrity()
+	for i, c := range chain {
+		body, err := b.downloadCheckpointBody(c)
+		if err != nil {
+			log.Panic().Err(err).Msg("->Checkpoint cannot be downloaded. Refusing to start.")
+		}
+		err = checkIntegrity(c, body, b.integrity.records, required, b.integrity.logged)
+		if err != nil {
+			log.Panic().Err(err).Msg("->Checkpoint integrity violated. Refusing to start.")
+		}
+
+		if i == 0 {
+			nextKey = extentMap.DeserializeAndReturnNextKey(body)
+		} else {
+			extentMap.DeserializeDelta(body)
+		}
+	}
+
+	return nextKey
+}
+
+// Downloads the checkpoint object c and returns its serialized map, assembled
+// from the shards when it is sharded. Returns error when the object or any of
+// its shards cannot be downloaded, or when a shard is corrupted.
+func (b *bs3) downloadCheckpointBody(c checkpointObject) ([]byte, error) {
+	checkpoint := make([]byte, c.size)
+	if err := b.objectStoreProxy.Download(c.key, checkpoint, 0, false); err != nil {
+		return nil, fmt.Errorf("checkpoint object %d: %w", c.key, err)
+	}
+	body, t, _ := splitCheckpoint(checkpoint)
+	if t.shards > 0 {
+		return b.downloadShards(c.key, body)
+	}
+
+	return body, nil
+}
+
+// Verifies consistency of the restored extentMap when it is enabled. The daemon
+// refuses to start with a corrupted mapping, while inconsistent accounting of
+// objects is repaired.
+func (b *bs3) verifyMap(extentMap mapproxy.ExtentMapper) {
+	if !b.cfg().VerifyMap {
+		return
+	}
+
+	first := b.dataBegin()
+	end := int64((b.metadata_size + b.cfg().Write.ChunkSize) / b.cfg().BlockSize)
+
+	repaired, err := extentMap.Verify(first, end)
+	if err != nil {
+		log.Panic().Err(err).Msg("->Restored extent map is corrupted. Refusing to start.")
+	}
+	if repaired > 0 {
+		log.Warn().Msgf("->Accounting of %d objects in restored extent map was inconsistent and it was repaired.", repaired)
+	} else {
+		log.Info().Msg("->Restored extent map verified.")
+	}
+}
+
+// Returns key of the i-th shard of the n-th object of the checkpoint chain in
+// slot.
+func shardKey(slot, n, i int64) int64 {
+	return shardKeyBase - ((n*2+slot)*maxShards + i)
+}
+
+// One shard in the manifest. Layout of the item, all values are little endian:
+//
+//	[0:8]   key
+//	[8:16]  size in bytes
+//	[16:20] CRC32 (Castagnoli) of the shard
+//	[20:24] reserved, zeroed
+type checkpointShard struct {
+	key  int64
+	size int64
+	crc  uint32
+}
+
+// Splits the serialized map body into at most shards shards of the n-th object
+// of the checkpoint chain in slot and uploads them in parallel. Returns the
+// manifest listing the shards and the number of shards.
+func (b *bs3) uploadShards(body []byte, shards, n, slot int64) ([]byte, int64, error) {
+	if shards > maxShards {
+		shards = maxShards
+	}
+	if shards > int64(len(body)) {
+		shards = int64(len(body))
+	}
+	if shards < 1 {
+		shards = 1
+	}
+
+	manifest := make([]byte, shards*manifestItemSize)
+	errs := make([]error, shards)
+	var wg sync.WaitGroup
+
+	size := (int64(len(body)) + shards - 1) / shards
+	for i := int64(0); i < shards; i++ {
+		shard := body[i*size:]
+		if int64(len(shard)) > size {
+			shard = shard[:size]
+		}
+
+		key := shardKey(slot, n, i)
+		item := manifest[i*manifestItemSize:]
+		binary.LittleEndian.PutUint64(item[0:], uint64(key))
+		binary.LittleEndian.PutUint64(item[8:], uint64(len(shard)))
+		binary.LittleEndian.PutUint32(item[16:], crc32.Checksum(shard, castagnoli))
+
+		wg.Add(1)
+		go func(i int64) {
+			defer wg.Done()
+			errs[i] = b.objectStoreProxy.Upload(key, shard, false, objproxy.SourceCheckpoint)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, 0, fmt.Errorf("upload of checkpoint shard %d failed: %w", i, err)
+		}
+	}
+
+	return manifest, shards, nil
+}
+
+// Downloads shards listed in the manifest of the checkpoint object with key in
+// parallel and returns the serialized map joined from them. Returns error when
+// any shard is missing or corrupted, since the map cannot be restored without
+// it.
+func (b *bs3) downloadShards(key int64, manifest []byte) ([]byte, error) {
+	shards := make([]checkpointShard, len(manifest)/manifestItemSize)
+	var total int64
+	for i := range shards {
+		item := manifest[i*manifestItemSize:]
+		shards[i] = checkpointShard{
+			key:  int64(binary.LittleEndian.Uint64(item[0:])),
+			size: int64(binary.LittleEndian.Uint64(item[8:])),
+			crc:  binary.LittleEndian.Uint32(item[16:]),
+		}
+		total += shards[i].size
+	}
+
+	body := make([]byte, total)
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+
+	data := body
+	for i, s := range shards {
+		wg.Add(1)
+		go func(i int, s checkpointShard, data []byte) {
+			defer wg.Done()
+			if err := b.objectStoreProxy.Download(s.key, data, 0, false); err != nil {
+				errs[i] = err
+			} else if crc32.Checksum(data, castagnoli) != s.crc {
+				errs[i] = errors.New("checksum mismatch")
+			}
+		}(i, s, data[:s.size])
+		data = data[s.size:]
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("shard %d of %d (object %d) of checkpoint object %d: %w",
+				i, len(shards), shards[i].key, key, err)
+		}
+	}
+
+	return body, nil
+}
+
+// Takes the checkpoint on demand while the device is running, e.g. before a
+// risky operation or to bound the time of the roll forward recovery. IO is
+// paused until writes and GC in flight are in the map, like for the early
+// checkpoint, so all objects under the key in the trailer are covered. The
+// upload is done with IO resumed. IO paused by Pause() stays paused and the
+// checkpoint does not wait for the resume. Dead GC is excluded for the whole
+// checkpoint. Returns when the checkpoint is uploaded.
+func (b *bs3) Checkpoint() error {
+	if b.cfg().SkipCheckpoint {
+		return errors.New("checkpoints are disabled")
+	}
+
+	select {
+	case <-b.stopping:
+		return errors.New("device is being stopped, the checkpoint is taken on removal")
+	default:
+	}
+
+	b.warming.Wait()
+
+	log.Info().Msg("Forced checkpointing started.")
+
+	nextKey, ok := b.takeCheckpoint(false)
+	if !ok {
+		return errors.New("upload of the checkpoint failed")
+	}
+
+	log.Info().Msgf("Forced checkpointing finished. Last checkpointed object is %d.", nextKey)
+
+	return nil
+}
+
+// Register SIGUSR2 as a trigger for the checkpoint.
+func (b *bs3) registerSigUSR2Handler() {
+	checkpointChan := make(chan os.Signal, 1)
+	signal.Notify(checkpointChan, syscall.SIGUSR2)
+
+	go func() {
+		for range checkpointChan {
+			if err := b.Checkpoint(); err != nil {
+				log.Warn().Err(err).Msg("Checkpoint requested by SIGUSR2 was not taken.")
+			}
+		}
+	}()
+}
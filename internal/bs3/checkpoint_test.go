@@ -0,0 +1,56 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Memory backend failing downloads of the whole checkpoint, while its trailer
+// is downloaded.
+type failingCheckpointStore struct {
+	*memory.Memory
+}
+
+func (s *failingCheckpointStore) DownloadAt(key int64, buf []byte, offset int64) error {
+	if key == checkpointKey && offset == 0 {
+		return errors.New("download failed")
+	}
+
+	return s.Memory.DownloadAt(key, buf, offset)
+}
+
+func TestCheckpointDownloadFailureRefused(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("volume started without the checkpoint it found")
+		}
+	}()
+	newTestVolume(t, newTestConfig(t), &failingCheckpointStore{store})
+}
+
+func TestCheckpointMapType(t *testing.T) {
+	b := newTestVolume(t, newTestConfig(t), memory.New())
+	if err := b.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The identifier is part of the format, it does not follow the names
+	// of Go types.
+	_, trailer, ok := splitCheckpoint(mustDownload(t, b, checkpointKey))
+	if !ok || trailer.mapType != "sectormap" {
+		t.Fatalf("checkpoint has map type %q", trailer.mapType)
+	}
+}
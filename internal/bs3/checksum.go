@@ -0,0 +1,70 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// The flag of the write metadata item is not used by the kernel. When
+// checksums are enabled, it is repurposed for the integrity of the write data
+// with following layout:
+//
+//	bits  0-29 length of the write in blocks
+//	bit     30 reserved for mapproxy.FlagDiscard
+//	bit     31 format flag, the item carries the checksum
+//	bits 32-63 CRC32 (Castagnoli) of the write data
+//
+// Objects written without checksums have the format flag cleared and they are
+// read without any verification, hence both formats can be mixed in one
+// bucket. The flag travels with the extent through the extent map and garbage
+// collection, so the checksum can be verified whenever the whole write is read
+// from the object. Parts of the write are not verified.
+const (
+	checksumFlag = 1 << 31
+
+	checksumLengthMask = mapproxy.FlagDiscard - 1
+
+	checksumShift = 32
+
+	// Number of repeated downloads of data which do not match the
+	// checksum.
+	checksumRetries = 3
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Returns flag of the write with data data and length length in blocks.
+func checksumFlagOf(data []byte, length int64) int64 {
+	crc := crc32.Checksum(data, castagnoli)
+	return int64(uint64(crc)<<checksumShift | checksumFlag | uint64(length)&checksumLengthMask)
+}
+
+// Stores checksums of all writes into the flags of the extents and into the
+// metadata part of the object. The object has to have the final layout, i.e.
+// after the read-modify-write and coalescing.
+func (b *bs3) stampChecksums(object []byte, extents []mapproxy.Extent) {
+	data := object[b.metadata_size:]
+	for i := range extents {
+		size := extents[i].Length * int64(b.cfg().BlockSize)
+		extents[i].Flag = checksumFlagOf(data[:size], extents[i].Length)
+		binary.LittleEndian.PutUint64(object[i*b.write_item_size+24:], uint64(extents[i].Flag))
+		data = data[size:]
+	}
+}
+
+// Returns false when data are the whole write described by flag and they do
+// not match its checksum. Data without checksum or just a part of the write
+// are always valid.
+func (b *bs3) checksumValid(flag int64, data []byte) bool {
+	if flag&checksumFlag == 0 ||
+		flag&checksumLengthMask != int64(len(data)/b.cfg().BlockSize) {
+
+		return true
+	}
+
+	return uint32(uint64(flag)>>checksumShift) == crc32.Checksum(data, castagnoli)
+}
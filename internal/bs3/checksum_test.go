@@ -0,0 +1,34 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+func TestChecksumMismatchFailsRead(t *testing.T) {
+	store := memory.New()
+	cfg := newTestConfig(t)
+	cfg.Write.Checksum = true
+	b := newTestVolume(t, cfg, store)
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{0, testData(1, 1)}, testWrite{10, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	key := b.key.Current() - 1
+
+	// Data of the first write are corrupted on the backend.
+	object := mustDownload(t, b, key)
+	object[b.metadata_size] ^= 1
+	store.Upload(key, object, objproxy.SourceWrite)
+
+	if err := b.BuseRead(0, 1, make([]byte, testBlockSize)); err == nil {
+		t.Fatal("read of data not matching the checksum succeeded")
+	}
+	if err := b.BuseRead(0, 11, make([]byte, 11*testBlockSize)); err == nil {
+		t.Fatal("read covering data not matching the checksum succeeded")
+	}
+	expectRead(t, b, 10, testData(1, 2))
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Validates the write chunk received from the kernel before anything of it is
+// used. The chunk is in the memory shared with the kernel and the buse library
+// provides no checksum of it, hence a torn or otherwise malformed chunk would
+// be parsed into garbage extents, mapped and uploaded. The number of writes has
+// to fit the header with the format item, every write has to be non-empty and
+// within the device and data of all writes have to fit the data part of the
+// chunk. All values of write items are in sectors.
+func (b *bs3) checkChunk(writes int64, chunk []byte) error {
+	if len(chunk) < b.metadata_size {
+		return fmt.Errorf("chunk of %d bytes is smaller than the metadata %d bytes", len(chunk), b.metadata_size)
+	}
+
+	// The last write item is reserved for the format item.
+	maxWrites := int64(b.metadata_size/b.write_item_size - 1)
+	if writes < 0 || writes > maxWrites {
+		return fmt.Errorf("chunk has %d writes, at most %d fit the metadata", writes, maxWrites)
+	}
+
+	deviceSectors := uint64(b.cfg().Size / sectorUnit)
+	dataSectors := uint64(len(chunk)-b.metadata_size) / sectorUnit
+	var totalSectors uint64
+	for i := int64(0); i < writes; i++ {
+		item := chunk[i*int64(b.write_item_size):]
+		sector := binary.LittleEndian.Uint64(item[:8])
+		length := binary.LittleEndian.Uint64(item[8:16])
+
+		if length == 0 || sector >= deviceSectors || length > deviceSectors-sector {
+			return fmt.Errorf("write %d of %d sectors at %d is out of the device of %d sectors",
+				i, length, sector, deviceSectors)
+		}
+
+		totalSectors += length
+		if totalSectors > dataSectors {
+			return fmt.Errorf("writes up to %d have %d sectors of data, chunk has %d sectors of data",
+				i, totalSectors, dataSectors)
+		}
+	}
+
+	return nil
+}
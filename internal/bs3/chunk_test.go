@@ -0,0 +1,123 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy/sectormap"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+func TestCheckChunk(t *testing.T) {
+	b := New(newTestConfig(t), memory.New(), sectormap.New(0))
+	capacity := int64(b.metadata_size/b.write_item_size - 1)
+
+	valid := testChunk(b, 1, testWrite{0, testData(2, 1)})
+	outOfDevice := testChunk(b, 1, testWrite{testSize/testBlockSize - 1, testData(2, 1)})
+	empty := testChunk(b, 1, testWrite{0, nil})
+	overflow := testChunk(b, 1, testWrite{0, testData(1, 1)})
+	binary.LittleEndian.PutUint64(overflow[8:16], uint64(testChunkSize/sectorUnit+1))
+
+	tests := []struct {
+		name   string
+		writes int64
+		chunk  []byte
+		ok     bool
+	}{
+		{"valid", 1, valid, true},
+		{"no writes", 0, valid, true},
+		{"inflated count", capacity + 1, valid, false},
+		{"huge count", 1 << 62, valid, false},
+		{"negative count", -1, valid, false},
+		{"chunk shorter than metadata", 1, valid[:b.metadata_size-1], false},
+		{"write out of device", 1, outOfDevice, false},
+		{"empty write", 1, empty, false},
+		{"data beyond chunk", 1, overflow, false},
+	}
+
+	for _, tt := range tests {
+		err := b.checkChunk(tt.writes, tt.chunk)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+}
+
+func TestBuseWriteInflatedCount(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+
+	chunk := testChunk(b, 1, testWrite{0, testData(1, 1)})
+	if err := b.BuseWrite(int64(b.metadata_size/b.write_item_size), chunk); err == nil {
+		t.Fatal("chunk with inflated count of writes accepted")
+	}
+	if b.key.Current() != 0 {
+		t.Fatalf("rejected chunk got key, the next key is %d", b.key.Current())
+	}
+	if _, err := store.GetObjectSize(0); err == nil {
+		t.Fatal("rejected chunk uploaded")
+	}
+}
+
+func TestBuseWriteMalformedChunks(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+	keyBefore := b.key.Current()
+
+	outOfDevice := testChunk(b, 10, testWrite{0, testData(1, 2)}, testWrite{testSize / testBlockSize, testData(1, 2)})
+	empty := testChunk(b, 10, testWrite{0, testData(1, 2)}, testWrite{1, nil})
+	overflow := testChunk(b, 10, testWrite{0, testData(1, 2)})
+	binary.LittleEndian.PutUint64(overflow[8:16], uint64(testChunkSize/sectorUnit+1))
+
+	tests := []struct {
+		name   string
+		writes int64
+		chunk  []byte
+	}{
+		{"write out of device", 2, outOfDevice},
+		{"empty write", 2, empty},
+		{"data beyond chunk", 1, overflow},
+	}
+	for _, tt := range tests {
+		// Valid writes of the chunk are rejected as well.
+		if err := b.BuseWrite(tt.writes, tt.chunk); err == nil {
+			t.Fatalf("%s: malformed chunk accepted", tt.name)
+		}
+		if b.key.Current() != keyBefore {
+			t.Fatalf("%s: rejected chunk got key %d", tt.name, b.key.Current()-1)
+		}
+		if _, err := store.GetObjectSize(keyBefore); err == nil {
+			t.Fatalf("%s: rejected chunk uploaded", tt.name)
+		}
+		expectRead(t, b, 0, testData(1, 1))
+	}
+}
+
+func TestBuseWriteWithoutWrites(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+	keyBefore := b.key.Current()
+
+	if err := b.BuseWrite(0, testChunk(b, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if b.key.Current() != keyBefore {
+		t.Fatalf("chunk without writes got key %d", keyBefore)
+	}
+	if keys := storedKeys(t, store); len(keys) != 0 {
+		t.Fatalf("chunk without writes uploaded objects %v", keys)
+	}
+
+	// The next write gets the key as if there was no empty chunk.
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedKeys(t, store); len(keys) != 1 || keys[0] != keyBefore {
+		t.Fatalf("write after the chunk without writes uploaded objects %v", keys)
+	}
+}
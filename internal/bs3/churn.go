@@ -0,0 +1,52 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+)
+
+// Counters of created and reclaimed objects of all volumes, published under
+// "churn" in the metrics.
+var churnMetrics = expvar.NewMap("churn")
+
+// Cumulative counts of objects created and reclaimed since the start. When GC
+// keeps up with the writes, the number of removed objects grows at the same
+// rate as the number of created ones and the number of live objects is stable.
+type churn struct {
+	// Objects created by writes, by discards and by threshold, locality
+	// and small objects GC.
+	written   *expvar.Int
+	discarded *expvar.Int
+	collected *expvar.Int
+
+	// Dead objects replaced by empty objects on the backend and dead
+	// objects removed from the map. Without object lock every removed
+	// object was emptied first, with object lock objects are only removed
+	// and their space is reclaimed by the lifecycle rules of the bucket.
+	emptied *expvar.Int
+	removed *expvar.Int
+}
+
+// Publishes the counters together with the current number of live objects
+// under name.
+func (b *bs3) publishChurn(name string) {
+	b.churn = churn{
+		written:   new(expvar.Int),
+		discarded: new(expvar.Int),
+		collected: new(expvar.Int),
+		emptied:   new(expvar.Int),
+		removed:   new(expvar.Int),
+	}
+
+	stats := new(expvar.Map).Init()
+	stats.Set("written", b.churn.written)
+	stats.Set("discarded", b.churn.discarded)
+	stats.Set("collected", b.churn.collected)
+	stats.Set("emptied", b.churn.emptied)
+	stats.Set("removed", b.churn.removed)
+	stats.Set("live", expvar.Func(func() interface{} {
+		return b.extentMapProxy.LiveObjects()
+	}))
+	churnMetrics.Set(name, stats)
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Merges adjacent writes of one chunk into a single extent. Writes following
+// each other in the chunk have their data stored consecutively in the object,
+// hence two writes can be merged whenever the second one starts on the device
+// where the first one ends. Overlapping writes are never merged, since their
+// data cannot be merged without copying.
+//
+// The merged extent gets the highest sequential number of the merged writes.
+// Any other write with a sequential number in between was in flight together
+// with the merged ones, hence the kernel did not guarantee any ordering
+// between them. Writes from different collision domains are never merged,
+// because their sequential numbers are not comparable.
+//
+// The metadata part of the chunk is rewritten with the merged extents, so the
+// roll forward recovery replays exactly the same updates as the extent map
+// gets now. Returns the merged extents.
+func (b *bs3) coalesce(extents []mapproxy.Extent, metadata []byte) []mapproxy.Extent {
+	if len(extents) < 2 {
+		return extents
+	}
+
+	domain := int64(b.cfg().Write.CollisionSize / b.cfg().BlockSize)
+	if domain == 0 {
+		domain = 1
+	}
+
+	merged := extents[:1]
+	for _, e := range extents[1:] {
+		last := &merged[len(merged)-1]
+		if e.Sector == last.Sector+last.Length && e.Flag == last.Flag &&
+			last.Sector/domain == (e.Sector+e.Length-1)/domain {
+
+			last.Length += e.Length
+			if e.SeqNo > last.SeqNo {
+				last.SeqNo = e.SeqNo
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+
+	if len(merged) == len(extents) {
+		return extents
+	}
+
+	for i, e := range merged {
+		writeHeader(i*b.write_item_size, mapproxy.ExtentWithObjectPart{
+			Extent: mapproxy.Extent{
+				Length: blocksToSectors(e.Length, b.cfg().BlockSize),
+				SeqNo:  e.SeqNo,
+				Flag:   e.Flag,
+			},
+			ObjectPart: mapproxy.ObjectPart{Sector: blocksToSectors(e.Sector, b.cfg().BlockSize)},
+		}, metadata)
+	}
+
+	for i := len(merged) * b.write_item_size; i < len(extents)*b.write_item_size; i++ {
+		metadata[i] = 0
+	}
+
+	return merged
+}
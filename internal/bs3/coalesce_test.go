@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Returns the device sector and the length in sectors of the i-th write stored
+// in the object.
+func storedWrite(b *bs3, object []byte, i int) (int64, int64) {
+	item := object[i*b.write_item_size:]
+	return int64(binary.LittleEndian.Uint64(item[0:8])), int64(binary.LittleEndian.Uint64(item[8:16]))
+}
+
+func TestCoalesceAdjacentWrites(t *testing.T) {
+	store := memory.New()
+	cfg := newTestConfig(t)
+	cfg.Write.Coalesce = true
+	b := newTestVolume(t, cfg, store)
+	perBlock := int64(testBlockSize / sectorUnit)
+	domain := int64(testChunkSize / testBlockSize)
+
+	// Three adjacent writes, a write elsewhere and two adjacent writes
+	// crossing the collision domain.
+	chunk := testChunk(b, 1,
+		testWrite{10, testData(1, 1)},
+		testWrite{11, testData(2, 2)},
+		testWrite{13, testData(1, 3)},
+		testWrite{20, testData(1, 4)},
+		testWrite{domain - 1, testData(1, 5)},
+		testWrite{domain, testData(1, 6)},
+	)
+	if err := b.BuseWrite(6, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	object := mustDownload(t, b, b.key.Current()-1)
+	want := [][2]int64{{10, 4}, {20, 1}, {domain - 1, 1}, {domain, 1}, {0, 0}}
+	for i, w := range want {
+		sector, length := storedWrite(b, object, i)
+		if sector != w[0]*perBlock || length != w[1]*perBlock {
+			t.Fatalf("write %d is stored at sector %d of %d sectors, want block %d of %d blocks",
+				i, sector, length, w[0], w[1])
+		}
+	}
+
+	expected := append(append(testData(1, 1), testData(2, 2)...), testData(1, 3)...)
+	expectRead(t, b, 10, expected)
+	expectRead(t, b, 20, testData(1, 4))
+	expectRead(t, b, domain-1, append(testData(1, 5), testData(1, 6)...))
+
+	// The restored volume replays the merged writes.
+	restored := newTestVolume(t, newTestConfig(t), store)
+	expectRead(t, restored, 10, expected)
+	expectRead(t, restored, domain-1, append(testData(1, 5), testData(1, 6)...))
+}
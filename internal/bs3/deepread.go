@@ -0,0 +1,64 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Scans headers of the configured number of the most recent objects for writes
+// of blocks starting at sector with length length, which the extent map does
+// not map. Every such write is logged as a divergence of the map and the
+// backend, e.g. a write missed by the restore. The scan goes from the newest
+// object and stops at a discard of the blocks, since older writes are discarded
+// then. It is a debugging aid, the read returns zeros regardless of the result,
+// so the divergence stays visible and the map is not patched behind the back of
+// the operator. Every unmapped read downloads up to deep_read headers, reads
+// during the lazy restore included, hence it is very expensive.
+func (b *bs3) deepRead(sector, length int64) {
+	header := make([]byte, b.metadata_size)
+	end := sector + length
+
+	last := b.key.Current() - 1
+	for key := last; key >= 0 && key > last-b.cfg().DeepRead; key-- {
+		for i := range header {
+			header[i] = 0
+		}
+
+		size, _, err := b.downloadHeader(key, header, nil)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Deep read of blocks %d+%d could not download header of object %d.",
+				sector, length, key)
+			continue
+		}
+		if size == 0 {
+			continue
+		}
+
+		// Writes in the object are ordered, hence they are examined from the
+		// last one so a discard hides only writes preceding it.
+		extents, err := b.parseHeader(header, key, size)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Deep read of blocks %d+%d could not parse header of object %d.",
+				sector, length, key)
+			continue
+		}
+
+		for i := len(extents) - 1; i >= 0; i-- {
+			e := extents[i]
+			if e.Sector >= end || e.Sector+e.Length <= sector {
+				continue
+			}
+
+			if e.Flag&mapproxy.FlagDiscard != 0 {
+				log.Debug().Msgf("Deep read of blocks %d+%d found their discard in object %d.", sector, length, key)
+				return
+			}
+
+			log.Warn().Msgf("Deep read of unmapped blocks %d+%d found write of blocks %d+%d with sequential number %d "+
+				"in object %d. The extent map diverged from the backend.", sector, length, e.Sector, e.Length, e.SeqNo, key)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// Discards blocks starting at sector with length length. The blocks are
+// unmapped and read as zeros afterwards and utilization of their objects is
+// decremented, hence GC reclaims them immediately.
+//
+// The discard is persisted as a record in the metadata of a new object without
+// any data, so it participates in the prefix consistent roll forward recovery.
+// Otherwise a crash before the next checkpoint would map the discarded blocks
+// again. The object is not deleted by dead GC until a checkpoint covers it.
+// Like writes, discards block while reads are served by the read replica.
+func (b *bs3) BuseDiscard(sector, length int64) error {
+	if err := b.checkDiscard(sector, length); err != nil {
+		return err
+	}
+
+	b.waitPrimary()
+
+	b.discard([]mapproxy.Extent{{Sector: sector, Length: length, Flag: mapproxy.FlagDiscard}})
+
+	return nil
+}
+
+// Discards arbitrarily large range of blocks like BuseDiscard, e.g. all free
+// space of the filesystem reported by an operator. The range is split into
+// records of GC step length, so the map is not locked for too long by one
+// update, and records are packed into as few objects as possible. IO is served
+// in between the objects.
+func (b *bs3) Discard(sector, length int64) error {
+	if err := b.checkDiscard(sector, length); err != nil {
+		return err
+	}
+
+	if b.replicaActive() {
+		return errors.New("reads are served by the read replica, discards are disabled")
+	}
+
+	step := b.cfg().GC.Step
+	if step <= 0 {
+		step = length
+	}
+
+	// The last write item is reserved for the format item.
+	perObject := b.metadata_size/b.write_item_size - 1
+	extents := make([]mapproxy.Extent, 0, perObject)
+	for s := sector; s < sector+length; s += step {
+		l := step
+		if s+l > sector+length {
+			l = sector + length - s
+		}
+
+		extents = append(extents, mapproxy.Extent{Sector: s, Length: l, Flag: mapproxy.FlagDiscard})
+		if len(extents) == perObject {
+			b.discard(extents)
+			extents = extents[:0]
+		}
+	}
+	if len(extents) > 0 {
+		b.discard(extents)
+	}
+
+	log.Info().Msgf("Discarded %d blocks at %d.", length, sector)
+
+	return nil
+}
+
+// Returns error when the range is not within the device.
+func (b *bs3) checkDiscard(sector, length int64) error {
+	if sector < 0 || length <= 0 || sector+length > b.cfg().Size/int64(b.cfg().BlockSize) {
+		return fmt.Errorf("discard of %d blocks at %d is out of the device", length, sector)
+	}
+
+	return nil
+}
+
+// Persists discard records of extents in a new object and applies them to the
+// map one by one. Extents have to fit into the metadata part of the object.
+func (b *bs3) discard(extents []mapproxy.Extent) {
+	b.quiesce.RLock()
+	defer b.quiesce.RUnlock()
+
+	key := b.key.Next()
+	b.keepDiscards(key)
+
+	object := make([]byte, b.metadata_size)
+	for i, e := range extents {
+		writeHeader(i*b.write_item_size, mapproxy.ExtentWithObjectPart{
+			Extent: mapproxy.Extent{
+				Length: blocksToSectors(e.Length, b.cfg().BlockSize),
+				Flag:   e.Flag,
+			},
+			ObjectPart: mapproxy.ObjectPart{Sector: blocksToSectors(e.Sector, b.cfg().BlockSize)},
+		}, object)
+	}
+	b.stampFormat(object)
+
+	// Same as in BuseWrite, the discard has to be persisted before the
+	// map is updated.
+	b.uploadRetry(key, object, true, objproxy.SourceWrite)
+
+	for i := range extents {
+		b.extentMapProxy.Update(extents[i:i+1], b.dataBegin(), key)
+	}
+
+	b.churn.discarded.Add(1)
+	log.Debug().Msgf("Discarded %d extents by object %d.", len(extents), key)
+}
+
+// Protects the object with discard records from dead GC.
+func (b *bs3) keepDiscards(key int64) {
+	b.gcData.reflock.Lock()
+	b.gcData.discards[key] = struct{}{}
+	b.gcData.reflock.Unlock()
+}
+
+// Releases objects with discard records under nextKey of the uploaded
+// checkpoint.
+func (b *bs3) releaseDiscards(nextKey int64) {
+	b.gcData.reflock.Lock()
+	for k := range b.gcData.discards {
+		if k < nextKey {
+			delete(b.gcData.discards, k)
+		}
+	}
+	b.gcData.reflock.Unlock()
+}
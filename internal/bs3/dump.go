@@ -0,0 +1,98 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Writes the report of the whole extent map into w, similarly to filefrag.
+// Every line is one extent, i.e. the longest run of blocks stored contiguously
+// in the same object by the same write:
+//
+//	block length key object_block seqno flag
+//
+// Blocks are logical blocks of the device, object_block is the block within
+// the object including its metadata. Unmapped extents have key "-". The map is
+// walked in pieces of GC step length under the lock of the map proxy and the
+// report is streamed into w, so updates are served in between the pieces and
+// the report is never held in memory. Extents changed during the walk are
+// reported either before or after the change.
+func (b *bs3) DumpMap(w io.Writer) error {
+	if err := b.dumpMap(w); err != nil {
+		return fmt.Errorf("dump of the extent map: %w", err)
+	}
+
+	log.Info().Msg("Extent map dumped.")
+
+	return nil
+}
+
+// Writes the report of the extent map into w. Extents split by the boundary of
+// pieces are joined again.
+func (b *bs3) dumpMap(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	sectors := b.cfg().Size / int64(b.cfg().BlockSize)
+	step := b.cfg().GC.Step
+	if step <= 0 {
+		step = sectors
+	}
+
+	fmt.Fprintf(bw, "# %d blocks of %d bytes\n", sectors, b.cfg().BlockSize)
+	fmt.Fprintln(bw, "# block length key object_block seqno flag")
+
+	var last mapproxy.ExtentWithObjectPart
+	for s := int64(0); s < sectors; s += step {
+		for _, e := range b.extentMapProxy.Extents(s, step) {
+			if continues(last, e) {
+				last.Extent.Length += e.Extent.Length
+				last.ObjectPart.Length += e.ObjectPart.Length
+				continue
+			}
+
+			if last.Extent.Length > 0 {
+				writeExtent(bw, last)
+			}
+			last = e
+		}
+	}
+	if last.Extent.Length > 0 {
+		writeExtent(bw, last)
+	}
+
+	return bw.Flush()
+}
+
+// Returns true when e directly continues the extent last.
+func continues(last, e mapproxy.ExtentWithObjectPart) bool {
+	if last.Extent.Length == 0 ||
+		last.ObjectPart.Key != e.ObjectPart.Key ||
+		last.Extent.SeqNo != e.Extent.SeqNo ||
+		last.Extent.Flag != e.Extent.Flag ||
+		last.Extent.Sector+last.Extent.Length != e.Extent.Sector {
+
+		return false
+	}
+
+	// Unmapped extents have no position in the object.
+	return e.ObjectPart.Key == mapproxy.NotMappedKey ||
+		last.ObjectPart.Sector+last.ObjectPart.Length == e.ObjectPart.Sector
+}
+
+// Writes one line of the report describing extent e.
+func writeExtent(w io.Writer, e mapproxy.ExtentWithObjectPart) {
+	if e.ObjectPart.Key == mapproxy.NotMappedKey {
+		fmt.Fprintf(w, "%d %d - - %d %#x\n", e.Extent.Sector, e.Extent.Length, e.Extent.SeqNo, e.Extent.Flag)
+		return
+	}
+
+	fmt.Fprintf(w, "%d %d %d %d %d %#x\n", e.Extent.Sector, e.Extent.Length, e.ObjectPart.Key,
+		e.ObjectPart.Sector, e.Extent.SeqNo, e.Extent.Flag)
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Sequential numbers of writes are generated by the kernel per collision domain
+// and they start from zero whenever the device is created, i.e. after every
+// restart of the daemon. The extent map resolves conflicting updates by the
+// sequential numbers and garbage collection relies on the equality: the
+// extent moved by GC keeps its sequential number, hence it replaces the
+// mapping only when the sector was not overwritten in the meantime.
+//
+// To keep the comparison meaningful across restarts, every sequential number
+// is stamped with the epoch of the boot in its upper bits before it is stored
+// to the object header and passed to the extent map. The epoch is strictly
+// increasing with every restore, so the invariant is:
+//
+//	Every write served after the restart has a higher sequential number than
+//	any write restored from the checkpoint or replayed from the objects.
+//
+// Hence neither roll forward recovery nor GC moving restored data can ever
+// overwrite newer data written after the restart. Objects written before
+// epochs were introduced have epoch 0.
+
+const (
+	// Number of lower bits of the sequential number used by the kernel.
+	// The rest of the bits, except the sign, holds the epoch.
+	seqNoEpochShift = 48
+
+	seqNoMask = 1<<seqNoEpochShift - 1
+
+	// Maximal epoch fitting into the sequential number.
+	maxEpoch = 1<<(63-seqNoEpochShift) - 1
+)
+
+// Returns epoch of the stamped sequential number.
+func epochOf(seqNo int64) int64 {
+	return seqNo >> seqNoEpochShift
+}
+
+// Stamps the sequential number in the raw write metadata item with the epoch.
+func stampEpoch(item []byte, epoch int64) {
+	seqNo := binary.LittleEndian.Uint64(item[16:24]) & seqNoMask
+	binary.LittleEndian.PutUint64(item[16:24], uint64(epoch)<<seqNoEpochShift|seqNo)
+}
+
+// Moves to the epoch following the newest one seen during restore. It has to
+// be called before any write is served.
+func (b *bs3) nextEpoch() {
+	if b.epoch == maxEpoch {
+		log.Warn().Msg("Maximal epoch of sequential numbers reached. Restored data may take precedence over new writes.")
+		return
+	}
+
+	b.epoch++
+	log.Info().Msgf("Sequential numbers epoch is %d.", b.epoch)
+}
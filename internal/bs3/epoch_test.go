@@ -0,0 +1,38 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+func TestWriteAfterRestartWins(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(1, testChunk(b, 1000, testWrite{5, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+	source := b.key.Current() - 1
+
+	// The kernel restarts sequential numbers from zero, but the epoch
+	// of the restarted volume is higher.
+	restarted := newTestVolume(t, newTestConfig(t), store)
+	if restarted.epoch <= b.epoch {
+		t.Fatalf("epoch %d after restart is not higher than %d", restarted.epoch, b.epoch)
+	}
+
+	// GC copies the restored data while they are overwritten by a new
+	// write with lower sequential number from the kernel.
+	writeList := restarted.getCompleteWriteList(map[int64]struct{}{source: {}}, restarted.cfg().GC.Step)
+	if err := restarted.BuseWrite(1, testChunk(restarted, 1, testWrite{5, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	restarted.collectWriteList(writeList)
+	expectRead(t, restarted, 5, testData(1, 2))
+
+	// Replay of all objects keeps the new write.
+	replayed := newTestVolume(t, newTestConfig(t), store)
+	expectRead(t, replayed, 5, testData(1, 2))
+}
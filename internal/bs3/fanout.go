@@ -0,0 +1,96 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// Numbers of download goroutines of all volumes, published under "fanout" in
+// the metrics.
+var fanoutMetrics = expvar.NewMap("fanout")
+
+// Limit of goroutines downloading object parts. Every part gets its own
+// goroutine, hence a read of a badly fragmented range or a huge GC run would
+// spawn tens of thousands of them. The goroutines only wait for the downloaders
+// of the object store proxy most of the time, so the limit can be much higher
+// than the number of downloaders without any loss of throughput. Reads and GC
+// have their own limits, so a huge GC run holding all its slots does not stall
+// reads.
+type fanout struct {
+	// Free slots for goroutines, nil means no limit.
+	slots chan struct{}
+
+	// Current number of goroutines and its maximum since the start.
+	// Accessed atomically.
+	current int64
+	peak    int64
+}
+
+// Returns fanout limited to limit goroutines. 0 means no limit.
+func newFanout(limit int) *fanout {
+	f := new(fanout)
+	if limit > 0 {
+		f.slots = make(chan struct{}, limit)
+	}
+
+	return f
+}
+
+// Runs fn in a new goroutine added to wg. Blocks while the limit of download
+// goroutines is reached. fn must not spawn goroutines by the same fanout
+// itself, otherwise all slots could be held by goroutines waiting for a free
+// one.
+func (f *fanout) goDownload(wg *sync.WaitGroup, fn func()) {
+	if f.slots != nil {
+		f.slots <- struct{}{}
+	}
+
+	current := atomic.AddInt64(&f.current, 1)
+	for peak := atomic.LoadInt64(&f.peak); current > peak; peak = atomic.LoadInt64(&f.peak) {
+		if atomic.CompareAndSwapInt64(&f.peak, peak, current) {
+			break
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		fn()
+
+		atomic.AddInt64(&f.current, -1)
+		if f.slots != nil {
+			<-f.slots
+		}
+	}()
+}
+
+// Numbers of download goroutines of one fanout in the metrics.
+type fanoutState struct {
+	Current int64 `json:"current"`
+	Peak    int64 `json:"peak"`
+	Limit   int   `json:"limit"`
+}
+
+// Returns numbers of download goroutines for the metrics.
+func (f *fanout) state() fanoutState {
+	return fanoutState{
+		Current: atomic.LoadInt64(&f.current),
+		Peak:    atomic.LoadInt64(&f.peak),
+		Limit:   cap(f.slots),
+	}
+}
+
+// Returns numbers of download goroutines of reads and GC for the metrics.
+func (b *bs3) fanoutState() interface{} {
+	return struct {
+		Reads fanoutState `json:"reads"`
+		GC    fanoutState `json:"gc"`
+	}{
+		Reads: b.readFanout.state(),
+		GC:    b.gcFanout.state(),
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+func TestGCFanoutSeparate(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Read.MaxFanout = 1
+	cfg.GC.MaxFanout = 1
+	b := newTestVolume(t, cfg, memory.New())
+
+	// GC holds all its slots.
+	var gc sync.WaitGroup
+	release := make(chan struct{})
+	b.gcFanout.goDownload(&gc, func() { <-release })
+	defer gc.Wait()
+	defer close(release)
+
+	read := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		b.readFanout.goDownload(&wg, func() {})
+		wg.Wait()
+		close(read)
+	}()
+
+	select {
+	case <-read:
+	case <-time.After(10 * time.Second):
+		t.Fatal("read waits for a slot held by GC")
+	}
+	if state := b.gcFanout.state(); state.Current != 1 || state.Limit != 1 {
+		t.Fatalf("GC fanout is %+v", state)
+	}
+}
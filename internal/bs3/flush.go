@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Flush requests of the kernel are handled by the buse library and they never
+// reach bs3. With durable flushes the library acknowledges the flush after all
+// writes in flight on the queue returned from BuseWrite. A synchronous write
+// returns after its object is uploaded, hence the flush is a durable fence.
+// Otherwise the flush is acknowledged immediately and it is only a barrier.
+// Ordering of writes around it is still guaranteed, since objects are uploaded
+// under increasing keys and the recovery replays only the prefix of them
+// without any missing object.
+//
+// Asynchronous writes return before the upload, so the flush of the kernel is
+// never durable with them. Flush() gives the durable fence explicitly, e.g.
+// for the admin command.
+
+// Returns when all writes acknowledged before the call are durable on the
+// backend, when flushes are durable. Otherwise it returns immediately, since
+// the flush is only a barrier.
+func (b *bs3) Flush() error {
+	if !b.cfg().Write.Durable {
+		return nil
+	}
+
+	// Synchronous writes are uploaded when they are acknowledged.
+	if b.staging.objects == nil {
+		return nil
+	}
+
+	// Objects of all writes acknowledged so far have lower keys.
+	target := b.key.Current()
+
+	b.staging.mutex.Lock()
+	defer b.staging.mutex.Unlock()
+
+	for b.stagedBelow(target) {
+		b.staging.uploaded.Wait()
+	}
+
+	log.Debug().Msgf("Flushed objects under %d.", target)
+
+	return nil
+}
+
+// Returns true when an object with key lower than target is staged. Must be
+// called with the staging mutex held.
+func (b *bs3) stagedBelow(target int64) bool {
+	for k := range b.staging.objects {
+		if k < target {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Memory backend whose uploads wait for the release while held is set.
+type heldStore struct {
+	*memory.Memory
+
+	held    int32
+	release chan struct{}
+}
+
+func (s *heldStore) Upload(key int64, buf []byte, source objproxy.Source) error {
+	if atomic.LoadInt32(&s.held) == 1 {
+		<-s.release
+	}
+
+	return s.Memory.Upload(key, buf, source)
+}
+
+// Returns volume with asynchronous writes over the held store and the
+// channel closed when Flush() returns after the write of one block. The
+// upload of the block is held.
+func flushAfterWrite(t *testing.T, durable bool) (*heldStore, chan struct{}) {
+	t.Helper()
+
+	store := &heldStore{Memory: memory.New(), release: make(chan struct{})}
+	cfg := newTestConfig(t)
+	cfg.Write.Async = true
+	cfg.Write.Durable = durable
+	b := newTestVolume(t, cfg, store)
+
+	atomic.StoreInt32(&store.held, 1)
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		if err := b.Flush(); err != nil {
+			t.Error(err)
+		}
+		close(flushed)
+	}()
+
+	return store, flushed
+}
+
+func TestDurableFlushWaitsForUpload(t *testing.T) {
+	store, flushed := flushAfterWrite(t, true)
+
+	select {
+	case <-flushed:
+		t.Fatal("durable flush returned before the upload")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(store.release)
+	<-flushed
+	if keys := storedKeys(t, store); len(keys) != 1 {
+		t.Fatalf("flush returned with objects %v uploaded", keys)
+	}
+}
+
+func TestBarrierFlushDoesNotWait(t *testing.T) {
+	store, flushed := flushAfterWrite(t, false)
+	defer close(store.release)
+
+	select {
+	case <-flushed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("barrier flush waits for the upload")
+	}
+	if keys := storedKeys(t, store); len(keys) != 0 {
+		t.Fatalf("objects %v were uploaded before the release", keys)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Version of the format of objects and checkpoints written by this
+	// bs3. It has to be increased whenever a change of the format cannot
+	// be read correctly by older versions. Objects and checkpoints with
+	// higher version are refused during restore.
+	//
+	// 1: format item in objects and version in checkpoint trailers
+	// 2: headers of objects written by GC are in sectors, not in blocks
+	// 3: serialized map in checkpoints has the accounting of objects and
+	//    the sectors in separate sections and the layout of sectors
+	formatVersion = 3
+
+	// First format version where all writes in object headers are
+	// aligned to blocks. Older objects written by GC with block size
+	// other than 512 have headers in blocks instead of sectors.
+	alignedFormatVersion = 2
+
+	// Magic in the sector field of the format item.
+	formatMagic = "bs3fmt\x00\x00"
+)
+
+// Stores the format item into the last write item of the object header. The
+// item has zero length, hence the roll forward recovery, including the one of
+// older versions, stops on it as on the end of the header. The last item is
+// always free, since every write has at least one block of data and the
+// header has an item for every block of the chunk including the header
+// itself. Discards have no data and they leave the last item free explicitly.
+//
+// Layout of the format item, all values are little endian:
+//
+//	[0:8]   magic
+//	[8:16]  zero length
+//	[16:24] format version
+//	[24:32] reserved, zeroed
+func (b *bs3) stampFormat(object []byte) {
+	item := object[b.metadata_size-b.write_item_size : b.metadata_size]
+
+	copy(item[0:8], formatMagic)
+	binary.LittleEndian.PutUint64(item[8:], 0)
+	binary.LittleEndian.PutUint64(item[16:], formatVersion)
+	binary.LittleEndian.PutUint64(item[24:], 0)
+}
+
+// Returns format version of the object with header. Objects without the format
+// item were written before the format was versioned and their version is 0.
+func (b *bs3) objectFormat(header []byte) int64 {
+	item := header[b.metadata_size-b.write_item_size : b.metadata_size]
+	if string(item[0:8]) != formatMagic {
+		return 0
+	}
+
+	return int64(binary.LittleEndian.Uint64(item[16:]))
+}
+
+// Refuses to continue when the format version of what is newer than the one
+// supported by this bs3. Misparsing it could silently corrupt the volume, hence
+// it is not possible to continue without it.
+func checkFormat(version int64, what string) {
+	if err := formatError(version, what); err != nil {
+		log.Panic().Err(err).Send()
+	}
+}
+
+// Returns error when the format version of what is newer than the one supported
+// by this bs3.
+func formatError(version int64, what string) error {
+	if version > formatVersion {
+		return fmt.Errorf("%s has format version %d, but this bs3 supports format versions up to %d. "+
+			"The volume was written by a newer bs3, upgrade bs3 to open it", what, version, formatVersion)
+	}
+
+	return nil
+}
+
+// Refuses checkpoint chains containing a checkpoint of newer format.
+func checkCheckpointFormat(chain []checkpointObject) {
+	for _, c := range chain {
+		checkFormat(c.trailer.version, fmt.Sprintf("Checkpoint object %d", c.key))
+	}
+}
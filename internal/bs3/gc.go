@@ -4,15 +4,16 @@ package bs3
 
 import (
 	"encoding/binary"
+	"errors"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/asch/bs3/internal/bs3/key"
 	"github.com/asch/bs3/internal/bs3/mapproxy"
-	"github.com/asch/bs3/internal/config"
+	"github.com/asch/bs3/internal/bs3/objproxy"
 
 	"github.com/rs/zerolog/log"
 )
@@ -27,6 +28,11 @@ const (
 	// optimization of memory allocation, in the worst case reallocation
 	// occurs.
 	typicalExtentsPerGCObject = 64
+
+	// Number of new objects composed and uploaded at once by threshold GC
+	// with time budget and by locality GC. The budget is checked between
+	// the steps of the scan of the map.
+	gcBatchObjects = 16
 )
 
 // Select objects viable for threshold GC. When an object utilization is under
@@ -37,8 +43,8 @@ func (b *bs3) filterKeysToCollect(utilization map[int64]int64, ratio float64) ma
 	collect := make(map[int64]struct{})
 
 	for k, v := range utilization {
-		used := v * int64(config.Cfg.BlockSize)
-		r := float64(used) / float64(config.Cfg.Write.ChunkSize)
+		used := v * int64(b.cfg().BlockSize)
+		r := float64(used) / float64(b.cfg().Write.ChunkSize)
 		if r < ratio {
 			collect[k] = struct{}{}
 		}
@@ -59,10 +65,18 @@ func (b *bs3) filterKeysToCollect(utilization map[int64]int64, ratio float64) ma
 func (b *bs3) getCompleteWriteList(keys map[int64]struct{}, stepSize int64) []mapproxy.ExtentWithObjectPart {
 	completeWriteList := make([]mapproxy.ExtentWithObjectPart, 0, 128)
 
-	sectors := config.Cfg.Size / int64(config.Cfg.BlockSize)
+	sectors := b.cfg().Size / int64(b.cfg().BlockSize)
 
 	for i := int64(0); i < sectors; i += stepSize {
-		ci := b.extentMapProxy.ExtentsInObjects(int64(i), stepSize, keys)
+		// The device size does not have to be a multiple of the step,
+		// so the last step is shortened to end exactly at the device
+		// end instead of relying on the map to clamp it.
+		length := stepSize
+		if i+length > sectors {
+			length = sectors - i
+		}
+
+		ci := b.extentMapProxy.ExtentsInObjects(i, length, keys)
 
 		if len(ci) == 0 {
 			continue
@@ -75,11 +89,16 @@ func (b *bs3) getCompleteWriteList(keys map[int64]struct{}, stepSize int64) []ma
 	return completeWriteList
 }
 
-// Removes currently downloaded objects from the list of dead objects.
+// Removes currently downloaded objects and objects with discard records not
+// covered by checkpoint from the list of dead objects.
 func (b *bs3) filterDownloadingObjects(deadObjects map[int64]struct{}) {
 	b.gcData.reflock.Lock()
 	defer b.gcData.reflock.Unlock()
 
+	for k := range b.gcData.discards {
+		delete(deadObjects, k)
+	}
+
 	for k, v := range b.gcData.refcounter {
 		if v == 0 {
 			delete(b.gcData.refcounter, k)
@@ -94,22 +113,137 @@ func (b *bs3) filterDownloadingObjects(deadObjects map[int64]struct{}) {
 
 // Runs threshold GC. It makes all objects with live data ratio under the
 // threshold dead by copying their live data into new object. These objects are
-// deleted during the regular dead GC run.
+// deleted during the regular dead GC run. The run is limited by the configured
+// time budget.
 func (b *bs3) gcThreshold(stepSize int64, threshHold float64) {
 	liveObjects := b.extentMapProxy.ObjectsUtilization()
 	keysToCollect := b.filterKeysToCollect(liveObjects, threshHold)
-	completeWritelist := b.getCompleteWriteList(keysToCollect, stepSize)
-	objects, extents := b.composeObjects(completeWritelist)
+
+	var deadline time.Time
+	if b.cfg().GC.MaxDurationSec > 0 {
+		deadline = time.Now().Add(time.Duration(b.cfg().GC.MaxDurationSec) * time.Second)
+	}
+	b.collect(keysToCollect, stepSize, deadline)
+}
+
+// Copies live data of objects with keys into new objects, which makes them
+// dead. Only one collection runs at a time, since concurrent ones would copy
+// the same data.
+//
+// Foreground writes are served while the data are copied. The copied extents
+// are relocated to the new objects only when they still map to the place they
+// were copied from, otherwise the write won and the copy is dead.
+//
+// With non-zero deadline, the run is limited by it, see collectUntil().
+func (b *bs3) collect(keys map[int64]struct{}, stepSize int64, deadline time.Time) {
+	b.gcData.collecting.Lock()
+	defer b.gcData.collecting.Unlock()
+
+	if !deadline.IsZero() {
+		b.collectUntil(keys, stepSize, deadline)
+		return
+	}
+
+	b.collectWriteList(b.getCompleteWriteList(keys, stepSize))
+}
+
+// Copies live data of objects with keys into new objects until the deadline.
+// The map is scanned from the cursor, where the previous run stopped, to the
+// device end and then from the beginning back to the cursor. Scanned extents
+// are copied in batches for about gcBatchObjects new objects, so the scan does
+// not need memory for the whole device. The deadline is checked between the
+// steps of the scan and at least one step is scanned. When it passes, the
+// extents scanned so far are copied and the cursor is moved to the first block
+// not scanned, so the next run continues there even when it selects other
+// objects. The deadline can be exceeded by the copy of the last batch.
+//
+// Source objects are dead only when all their extents were copied. Objects
+// with extents behind the cursor keep the lower utilization, so the next run
+// selects them again. The cursor is kept in memory only, a restarted daemon
+// scans from the beginning. The progress is in the map, which is persisted by
+// the checkpoint and by the objects written by GC, so nothing is lost on
+// crash.
+func (b *bs3) collectUntil(keys map[int64]struct{}, stepSize int64, deadline time.Time) {
+	sectors := b.cfg().Size / int64(b.cfg().BlockSize)
+	limit := int64(gcBatchObjects * (b.cfg().Write.ChunkSize - b.metadata_size) / b.cfg().BlockSize)
+	start := b.gcData.cursor
+
+	writeList := make([]mapproxy.ExtentWithObjectPart, 0, 128)
+	var blocks int64
+	for scanned := int64(0); scanned < sectors; {
+		if scanned > 0 && time.Now().After(deadline) {
+			if len(writeList) > 0 {
+				b.collectWriteList(writeList)
+			}
+			b.gcData.cursor = (start + scanned) % sectors
+			log.Info().Msgf("GC time budget exceeded at block %d. The next run continues from there.", b.gcData.cursor)
+			return
+		}
+
+		// Steps end at the device end and at the start of the
+		// scan.
+		i := (start + scanned) % sectors
+		length := stepSize
+		if length > sectors-i {
+			length = sectors - i
+		}
+		if length > sectors-scanned {
+			length = sectors - scanned
+		}
+
+		for _, g := range b.extentMapProxy.ExtentsInObjects(i, length, keys) {
+			writeList = append(writeList, g)
+			blocks += g.Extent.Length
+		}
+		scanned += length
+
+		if blocks >= limit {
+			b.collectWriteList(writeList)
+			writeList = writeList[:0]
+			blocks = 0
+		}
+	}
+
+	if len(writeList) > 0 {
+		b.collectWriteList(writeList)
+	}
+}
+
+// Copies extents of the write list into new objects and relocates them. Every
+// object gets its key once and the upload is retried under it, see
+// uploadRetry(), so the extents are relocated only to an uploaded object and
+// the sequence of keys has no holes. Every object is reported at the trace
+// level, see reportGCRewrite().
+func (b *bs3) collectWriteList(writeList []mapproxy.ExtentWithObjectPart) {
+	objects, extents := b.composeObjects(writeList)
+
+	var utilization, sizes map[int64]int64
+	if b.gcRewritesReported() {
+		utilization = b.extentMapProxy.ObjectsUtilization()
+		sizes = b.extentMapProxy.ObjectSizes()
+	}
 
 	for i := range objects {
-		key := key.Next()
+		key := b.key.Next()
+
+		b.stampFormat(objects[i])
+		b.uploadRetry(key, objects[i], false, objproxy.SourceGC)
+
+		lost := b.extentMapProxy.Relocate(extents[i], b.dataBegin(), key)
+		if lost > 0 {
+			log.Debug().Msgf("GC object %d lost %d blocks overwritten during the copy.", key, lost)
+		}
 
-		err := b.objectStoreProxy.Upload(key, objects[i], false)
-		if err != nil {
-			log.Info().Err(err).Send()
+		var blocks int64
+		for _, e := range extents[i] {
+			blocks += e.Extent.Length
 		}
+		b.recordObjectSize(blocks)
+		b.churn.collected.Add(1)
 
-		b.extentMapProxy.Update(extents[i], int64(b.metadata_size/config.Cfg.BlockSize), key)
+		if utilization != nil {
+			b.reportGCRewrite(key, extents[i], utilization, sizes)
+		}
 	}
 }
 
@@ -117,16 +251,43 @@ func (b *bs3) gcThreshold(stepSize int64, threshHold float64) {
 // The object cannot be deleted on the backend, because the sequence number
 // would be missing in the recovery process where we need continuous range of
 // keys.
+//
+// With object lock the empty object would be just a new version of the object
+// while the old one is retained anyway. Hence dead objects are only removed
+// from the map and the space is reclaimed by the bucket lifecycle rules after
+// the retention period.
+//
+// Emptying of the objects and their removal from the map is atomic with
+// respect to checkpoints. Nothing is done when there are fewer dead objects
+// than the configured minimum, they wait for the next round.
 func (b *bs3) removeNonReferencedDeadObjects() {
+	b.gcData.removing.Lock()
+	defer b.gcData.removing.Unlock()
+
 	deadObjects := b.extentMapProxy.DeadObjects()
+	if int64(len(deadObjects)) < b.cfg().GC.DeadMinObjects {
+		return
+	}
 	b.filterDownloadingObjects(deadObjects)
-	for k := range deadObjects {
-		err := b.objectStoreProxy.Upload(k, []byte{}, false)
-		if err != nil {
-			log.Info().Err(err).Send()
+	b.filterStagedObjects(deadObjects)
+
+	if r := b.estimateReclaimable(deadObjects, b.cfg().GC.ProbeSizes); r.Objects > 0 {
+		log.Info().Msgf("Dead GC removes %d objects with approximately %d bytes, size of %d objects is unknown.",
+			r.Objects, r.Bytes, r.Unknown)
+	}
+
+	if b.cfg().S3.LockMode == "" {
+		for k := range deadObjects {
+			err := b.objectStoreProxy.Upload(k, []byte{}, false, objproxy.SourceGC)
+			if err != nil {
+				log.Info().Err(err).Send()
+				continue
+			}
+			b.churn.emptied.Add(1)
 		}
 	}
 	b.extentMapProxy.DeleteDeadObjects(deadObjects)
+	b.churn.removed.Add(int64(len(deadObjects)))
 }
 
 // Register SIGUSR1 as a trigger for threshold GC.
@@ -136,24 +297,96 @@ func (b *bs3) registerSigUSR1Handler() {
 
 	go func() {
 		for range gcChan {
-			log.Info().Msgf("Threshold GC started with threshold %1.2f.", config.Cfg.GC.LiveData)
-			b.gcThreshold(config.Cfg.GC.Step, config.Cfg.GC.LiveData)
-			log.Info().Msg("Threshold GC finished.")
+			b.warming.Wait()
+			b.runGCThreshold(b.cfg().GC.LiveData)
 		}
 	}()
 }
 
-// Dead GC infinite loop. Highly efficient hence running regularly.
+// Runs threshold GC with threshold, or locality GC when it is the configured
+// mode, unless the device is being stopped. The run waits until the device is
+// idle, see waitIdle().
+func (b *bs3) runGCThreshold(threshold float64) {
+	select {
+	case <-b.stopping:
+		log.Info().Msg("Device is being stopped. Threshold GC skipped.")
+		return
+	default:
+	}
+
+	if !b.waitIdle() {
+		log.Info().Msg("Device is being stopped. Deferred threshold GC skipped.")
+		return
+	}
+
+	if b.replicaActive() {
+		log.Info().Msg("Reads are served by the read replica. Threshold GC skipped.")
+		return
+	}
+
+	b.quiesce.RLock()
+	b.gcByMode(threshold)
+	if b.cfg().GC.DeadManual {
+		b.deadRound()
+	}
+	b.quiesce.RUnlock()
+}
+
+// Dead GC infinite loop. Highly efficient hence running regularly. It is not
+// started when dead GC is manual.
 func (b *bs3) gcDead() {
+	b.warming.Wait()
+
 	for {
-		time.Sleep(time.Duration(config.Cfg.GC.Wait) * time.Second)
+		time.Sleep(time.Duration(b.cfg().GC.Wait) * time.Second)
+
+		if !b.waitIdle() || b.replicaActive() {
+			continue
+		}
 
-		log.Trace().Msg("Dead GC started.")
-		b.removeNonReferencedDeadObjects()
-		log.Trace().Msg("Dead GC finished.")
+		b.quiesce.RLock()
+		b.deadRound()
+		b.quiesce.RUnlock()
 	}
 }
 
+// Runs one round of dead GC followed by coalescing of small objects when it is
+// enabled. The caller has to hold quiesce for reading.
+func (b *bs3) deadRound() {
+	log.Trace().Msg("Dead GC started.")
+	b.removeNonReferencedDeadObjects()
+	log.Trace().Msg("Dead GC finished.")
+	if b.cfg().GC.SmallRatio > 0 {
+		b.gcSmall()
+	}
+}
+
+// Runs one round of dead GC on demand and returns when it finishes. It is the
+// only way to remove dead objects besides threshold GC when dead GC is manual.
+func (b *bs3) CollectDead() error {
+	select {
+	case <-b.stopping:
+		return errors.New("device is being stopped")
+	default:
+	}
+
+	b.warming.Wait()
+
+	if b.replicaActive() {
+		return errors.New("reads are served by the read replica, GC is disabled")
+	}
+
+	if b.paused() {
+		return errors.New("IO is paused, GC is disabled")
+	}
+
+	b.quiesce.RLock()
+	b.deadRound()
+	b.quiesce.RUnlock()
+
+	return nil
+}
+
 // Stores raw values of individual write into metadata part of the object.
 func writeHeader(metadataFrontier int, g mapproxy.ExtentWithObjectPart, object []byte) {
 	binary.LittleEndian.PutUint64(object[metadataFrontier:], uint64(g.ObjectPart.Sector))
@@ -169,55 +402,163 @@ func writeHeader(metadataFrontier int, g mapproxy.ExtentWithObjectPart, object [
 	metadataFrontier += 8
 }
 
+// Part of the source object covering several of its extents copied by one GC
+// run. It is downloaded by a single request instead of a request per extent.
+type gcSpan struct {
+	first, end int64
+	extents    int
+	data       []byte
+}
+
+// Extent of the new object which is served from the downloaded span.
+type gcSpanCopy struct {
+	span   *gcSpan
+	sector int64
+	dst    []byte
+}
+
+// Returns spans of source objects of the write list sorted by sectors. Source
+// objects contributing at least minExtents extents are covered by a single
+// span when gaps between the extents are at most gapRatio of the span, i.e.
+// the amplification of the download is bounded. Otherwise only adjacent
+// extents are coalesced, so the object is downloaded by the minimal number of
+// requests without any gaps. Extents not coalesced with any other are not in
+// spans. Sectors of spans are in blocks relative to the object beginning.
+func gcSpans(writeList []mapproxy.ExtentWithObjectPart, minExtents int, gapRatio float64) map[int64][]*gcSpan {
+	spans := make(map[int64][]*gcSpan)
+	if minExtents == 0 {
+		return spans
+	}
+
+	sources := make(map[int64][]mapproxy.Extent)
+	for _, g := range writeList {
+		sources[g.ObjectPart.Key] = append(sources[g.ObjectPart.Key], g.Extent)
+	}
+
+	for key, e := range sources {
+		sort.Slice(e, func(i, j int) bool { return e[i].Sector < e[j].Sector })
+
+		whole := &gcSpan{first: e[0].Sector, end: e[0].Sector, extents: len(e)}
+		adjacent := make([]*gcSpan, 0)
+		var live int64
+
+		for _, x := range e {
+			live += x.Length
+			if x.Sector+x.Length > whole.end {
+				whole.end = x.Sector + x.Length
+			}
+
+			if n := len(adjacent); n > 0 && x.Sector <= adjacent[n-1].end {
+				s := adjacent[n-1]
+				if x.Sector+x.Length > s.end {
+					s.end = x.Sector + x.Length
+				}
+				s.extents++
+				continue
+			}
+
+			adjacent = append(adjacent, &gcSpan{first: x.Sector, end: x.Sector + x.Length, extents: 1})
+		}
+
+		gaps := whole.end - whole.first - live
+		if len(e) >= minExtents && float64(gaps) <= gapRatio*float64(whole.end-whole.first) {
+			spans[key] = []*gcSpan{whole}
+			continue
+		}
+
+		for _, s := range adjacent {
+			if s.extents > 1 {
+				spans[key] = append(spans[key], s)
+			}
+		}
+	}
+
+	return spans
+}
+
+// Returns span from sorted spans covering the extent or nil when there is no
+// such span.
+func findSpan(spans []*gcSpan, e mapproxy.Extent) *gcSpan {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].end > e.Sector })
+	if i < len(spans) && spans[i].first <= e.Sector && e.Sector+e.Length <= spans[i].end {
+		return spans[i]
+	}
+
+	return nil
+}
+
+// Extent of the new object with checksum of the source write.
+type gcChecked struct {
+	g    mapproxy.ExtentWithObjectPart
+	data []byte
+}
+
 // Traverse the list of all extents which are going to be copied into new fresh
 // object(s). It downloads necessary parts and constructs new objects for the
 // complete list. All objects are then uploaded and map updated.
-func (b *bs3) composeObjects(writeList []mapproxy.ExtentWithObjectPart) ([][]byte, [][]mapproxy.Extent) {
+//
+// Extents of the same source object are coalesced into spans by gcSpans(),
+// which are downloaded by one request each, and the extents are copied from
+// them afterwards. Other extents are downloaded individually. Extents with
+// checksum are verified and no objects are returned when any of them does not
+// match.
+//
+// The extents of the write list are returned grouped by the new objects, so
+// they can be relocated only when they were not overwritten in the meantime.
+func (b *bs3) composeObjects(writeList []mapproxy.ExtentWithObjectPart) ([][]byte, [][]mapproxy.ExtentWithObjectPart) {
 	var wg sync.WaitGroup
 
 	metadataFrontier := 0
 	dataFrontier := b.metadata_size
 
 	objects := make([][]byte, 0, typicalNewObjectsPerGC)
-	extents := make([][]mapproxy.Extent, 0, typicalNewObjectsPerGC)
+	extents := make([][]mapproxy.ExtentWithObjectPart, 0, typicalNewObjectsPerGC)
+
+	object := make([]byte, b.cfg().Write.ChunkSize)
+	currentObjectExtents := make([]mapproxy.ExtentWithObjectPart, 0, typicalExtentsPerGCObject)
 
-	object := make([]byte, config.Cfg.Write.ChunkSize)
-	currentObjectExtents := make([]mapproxy.Extent, 0, typicalExtentsPerGCObject)
+	spans := gcSpans(writeList, b.cfg().GC.SpanExtents, b.cfg().GC.SpanGapRatio)
+	copies := make([]gcSpanCopy, 0)
+	checked := make([]gcChecked, 0)
+	requests := 0
 
 	for _, g := range writeList {
-		if uint64(dataFrontier)+uint64(g.Extent.Length)*uint64(config.Cfg.BlockSize) > uint64(config.Cfg.Write.ChunkSize) {
+		if uint64(dataFrontier)+uint64(g.Extent.Length)*uint64(b.cfg().BlockSize) > uint64(b.cfg().Write.ChunkSize) {
 			objects = append(objects, object)
 			extents = append(extents, currentObjectExtents)
 
-			object = make([]byte, config.Cfg.Write.ChunkSize)
-			currentObjectExtents = make([]mapproxy.Extent, 0, typicalExtentsPerGCObject)
+			object = make([]byte, b.cfg().Write.ChunkSize)
+			currentObjectExtents = make([]mapproxy.ExtentWithObjectPart, 0, typicalExtentsPerGCObject)
 
 			metadataFrontier = 0
 			dataFrontier = b.metadata_size
 		}
 
-		writeHeader(metadataFrontier, g, object)
+		// The header is in sectors as the one of writes, the write
+		// list is in blocks.
+		item := g
+		item.ObjectPart.Sector = blocksToSectors(g.ObjectPart.Sector, b.cfg().BlockSize)
+		item.Extent.Length = blocksToSectors(g.Extent.Length, b.cfg().BlockSize)
+		writeHeader(metadataFrontier, item, object)
 		metadataFrontier += b.write_item_size
 
-		data := object[dataFrontier : int64(dataFrontier)+g.Extent.Length*int64(config.Cfg.BlockSize)]
-		wg.Add(1)
-		go func(g mapproxy.ExtentWithObjectPart) {
-			defer wg.Done()
-			err := b.objectStoreProxy.Download(g.ObjectPart.Key, data, g.Extent.Sector*int64(config.Cfg.BlockSize), true)
-			if err != nil {
-				log.Info().Err(err).Send()
-			}
-		}(g)
+		data := object[dataFrontier : int64(dataFrontier)+g.Extent.Length*int64(b.cfg().BlockSize)]
+		if s := findSpan(spans[g.ObjectPart.Key], g.Extent); s != nil {
+			copies = append(copies, gcSpanCopy{s, g.Extent.Sector, data})
+		} else {
+			requests++
+			g := g
+			b.gcFanout.goDownload(&wg, func() {
+				b.downloadForGC(g.ObjectPart.Key, data, g.Extent.Sector)
+			})
+		}
 
-		extent := mapproxy.Extent{
-			Sector: g.ObjectPart.Sector,
-			Length: g.Extent.Length,
-			SeqNo:  g.Extent.SeqNo,
-			Flag:   g.Extent.Flag,
+		if g.Extent.Flag&checksumFlag != 0 {
+			checked = append(checked, gcChecked{g, data})
 		}
 
-		currentObjectExtents = append(currentObjectExtents, extent)
-		dataFrontier += int(g.Extent.Length) * config.Cfg.BlockSize
+		currentObjectExtents = append(currentObjectExtents, g)
+		dataFrontier += int(g.Extent.Length) * b.cfg().BlockSize
 	}
 
 	if len(currentObjectExtents) > 0 {
@@ -225,7 +566,61 @@ func (b *bs3) composeObjects(writeList []mapproxy.ExtentWithObjectPart) ([][]byt
 		extents = append(extents, currentObjectExtents)
 	}
 
+	for key, objectSpans := range spans {
+		for _, s := range objectSpans {
+			requests++
+			s.data = make([]byte, (s.end-s.first)*int64(b.cfg().BlockSize))
+			key, s := key, s
+			b.gcFanout.goDownload(&wg, func() {
+				b.downloadForGC(key, s.data, s.first)
+			})
+		}
+	}
+
 	wg.Wait()
 
+	for _, c := range copies {
+		copy(c.dst, c.span.data[(c.sector-c.span.first)*int64(b.cfg().BlockSize):])
+	}
+
+	log.Debug().Msgf("GC composed %d objects from %d extents with %d download requests.",
+		len(objects), len(writeList), requests)
+
+	if !b.verifyForGC(checked) {
+		return nil, nil
+	}
+
 	return objects, extents
 }
+
+// Downloads data of the object key starting at sector in blocks with low
+// priority.
+func (b *bs3) downloadForGC(key int64, data []byte, sector int64) {
+	if b.readStaged(key, data, sector) {
+		return
+	}
+
+	err := b.objectStoreProxy.Download(key, data, sector*int64(b.cfg().BlockSize), true)
+	if err != nil {
+		log.Info().Err(err).Send()
+	}
+}
+
+// Verifies checksums of the extents copied by GC. Extents not matching are
+// downloaded again individually. Returns false when any of them still does not
+// match, hence the corrupted data are not spread into new objects and the
+// source objects stay untouched.
+func (b *bs3) verifyForGC(checked []gcChecked) bool {
+	for _, c := range checked {
+		for retry := 0; !b.checksumValid(c.g.Extent.Flag, c.data); retry++ {
+			if retry == checksumRetries {
+				log.Error().Msgf("Data of object %d at block %d do not match the checksum. GC aborted.",
+					c.g.ObjectPart.Key, c.g.Extent.Sector)
+				return false
+			}
+			b.downloadForGC(c.g.ObjectPart.Key, c.data, c.g.Extent.Sector)
+		}
+	}
+
+	return true
+}
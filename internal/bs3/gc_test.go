@@ -0,0 +1,255 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Memory backend whose downloads wait for the release once gated is set.
+type gatedStore struct {
+	*memory.Memory
+
+	gated      int32
+	downloaded chan struct{}
+	release    chan struct{}
+}
+
+func (s *gatedStore) DownloadAt(key int64, buf []byte, offset int64) error {
+	err := s.Memory.DownloadAt(key, buf, offset)
+	if atomic.CompareAndSwapInt32(&s.gated, 1, 0) {
+		s.downloaded <- struct{}{}
+		<-s.release
+	}
+
+	return err
+}
+
+// Memory backend whose first upload accepted by gate after gated is set waits
+// for the release.
+type gatedUploadsStore struct {
+	*memory.Memory
+
+	gate      func(key int64, buf []byte) bool
+	gated     int32
+	uploading chan struct{}
+	release   chan struct{}
+}
+
+func (s *gatedUploadsStore) Upload(key int64, buf []byte, source objproxy.Source) error {
+	if s.gate(key, buf) && atomic.CompareAndSwapInt32(&s.gated, 1, 0) {
+		s.uploading <- struct{}{}
+		<-s.release
+	}
+
+	return s.Memory.Upload(key, buf, source)
+}
+
+// Returns volume over the gated store with two writes of block 0, so the
+// object of the first one is dead. Returns its key as well.
+func newDeadObjectVolume(t *testing.T, gate func(key int64, buf []byte) bool) (*bs3, *gatedUploadsStore, int64) {
+	t.Helper()
+
+	store := &gatedUploadsStore{
+		Memory:    memory.New(),
+		gate:      gate,
+		uploading: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	b := newTestVolume(t, newTestConfig(t), store)
+	for i := int64(0); i < 2; i++ {
+		if err := b.BuseWrite(1, testChunk(b, 10*(i+1), testWrite{0, testData(1, byte(i+1))})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return b, store, b.key.Current() - 2
+}
+
+func TestCollectResumesAtCursor(t *testing.T) {
+	const step = 64
+
+	b := newTestVolume(t, newTestConfig(t), memory.New())
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{0, testData(1, 1)}, testWrite{200, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	source := b.key.Current() - 1
+	keys := map[int64]struct{}{source: {}}
+
+	// The deadline passed, so the run scans just one step and copies the
+	// block found there.
+	b.collect(keys, step, time.Now())
+	if b.gcData.cursor != step {
+		t.Fatalf("cursor is at block %d after one step", b.gcData.cursor)
+	}
+	if used := b.extentMapProxy.ObjectsUtilization()[source]; used != 1 {
+		t.Fatalf("source object has %d live blocks after the first run", used)
+	}
+
+	// The next run continues from the cursor and wraps around.
+	b.collect(keys, step, time.Now().Add(time.Hour))
+	if _, ok := b.extentMapProxy.ObjectsUtilization()[source]; ok {
+		t.Fatal("source object is alive after the whole map was scanned")
+	}
+	if b.gcData.cursor != step {
+		t.Fatalf("cursor moved to block %d by the complete run", b.gcData.cursor)
+	}
+
+	expectRead(t, b, 0, testData(1, 1))
+	expectRead(t, b, 200, testData(1, 2))
+}
+
+func TestCollectLastPartialStep(t *testing.T) {
+	const step = 1000
+
+	b := newTestVolume(t, newTestConfig(t), memory.New())
+	last := b.cfg().Size/int64(b.cfg().BlockSize) - 1
+	if (last+1)%step == 0 {
+		t.Fatalf("device of %d blocks is a multiple of the step", last+1)
+	}
+
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{0, testData(1, 1)}, testWrite{last, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	source := b.key.Current() - 1
+	keys := map[int64]struct{}{source: {}}
+
+	writeList := b.getCompleteWriteList(keys, step)
+	if len(writeList) != 2 || writeList[1].ObjectPart.Sector != last || writeList[1].Extent.Length != 1 {
+		t.Fatalf("write list %+v misses the last block", writeList)
+	}
+
+	b.collect(keys, step, time.Time{})
+	if _, ok := b.extentMapProxy.ObjectsUtilization()[source]; ok {
+		t.Fatal("source object is alive after the whole map was scanned")
+	}
+	expectRead(t, b, last, testData(1, 2))
+}
+
+func TestCollectLosesToWrite(t *testing.T) {
+	store := &gatedStore{
+		Memory:     memory.New(),
+		downloaded: make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{0, testData(1, 1)}, testWrite{200, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	source := b.key.Current() - 1
+
+	// Block 0 is overwritten after GC downloaded the source object and
+	// before it relocates the copy.
+	atomic.StoreInt32(&store.gated, 1)
+	done := make(chan struct{})
+	go func() {
+		b.collect(map[int64]struct{}{source: {}}, b.cfg().GC.Step, time.Time{})
+		close(done)
+	}()
+	<-store.downloaded
+	if err := b.BuseWrite(1, testChunk(b, 10, testWrite{0, testData(1, 3)})); err != nil {
+		t.Fatal(err)
+	}
+	store.release <- struct{}{}
+	<-done
+
+	if _, ok := b.extentMapProxy.ObjectsUtilization()[source]; ok {
+		t.Fatal("source object is alive after the collection")
+	}
+	expectRead(t, b, 0, testData(1, 3))
+	expectRead(t, b, 200, testData(1, 2))
+
+	// The restored volume replays the GC object before the write, which
+	// has the higher sequential number.
+	restored := newTestVolume(t, newTestConfig(t), store)
+	expectRead(t, restored, 0, testData(1, 3))
+	expectRead(t, restored, 200, testData(1, 2))
+}
+
+func TestCheckpointDuringDeadGC(t *testing.T) {
+	b, store, dead := newDeadObjectVolume(t, func(key int64, buf []byte) bool {
+		return len(buf) == 0
+	})
+
+	// The checkpoint is requested after the dead object was emptied on
+	// the backend and before it is removed from the map.
+	atomic.StoreInt32(&store.gated, 1)
+	collected := make(chan error)
+	go func() {
+		collected <- b.CollectDead()
+	}()
+	<-store.uploading
+
+	checkpointed := make(chan error)
+	go func() {
+		checkpointed <- b.Checkpoint()
+	}()
+	select {
+	case <-checkpointed:
+		t.Fatal("checkpoint was taken in the middle of dead GC")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	store.release <- struct{}{}
+	if err := <-collected; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-checkpointed; err != nil {
+		t.Fatal(err)
+	}
+
+	// The checkpoint agrees with the backend, the emptied object is
+	// neither referenced nor dead in the restored map.
+	restored := newTestVolume(t, newTestConfig(t), store)
+	if _, ok := restored.extentMapProxy.DeadObjects()[dead]; ok {
+		t.Fatal("emptied object is dead in the checkpoint")
+	}
+	if _, ok := restored.extentMapProxy.ObjectsUtilization()[dead]; ok {
+		t.Fatal("emptied object is referenced by the checkpoint")
+	}
+	expectRead(t, restored, 0, testData(1, 2))
+}
+
+func TestDeadGCDuringCheckpointUpload(t *testing.T) {
+	b, store, dead := newDeadObjectVolume(t, func(key int64, buf []byte) bool {
+		return key == checkpointKey
+	})
+
+	// The dead GC is requested while the checkpoint with the dead object
+	// is uploaded.
+	atomic.StoreInt32(&store.gated, 1)
+	checkpointed := make(chan error)
+	go func() {
+		checkpointed <- b.Checkpoint()
+	}()
+	<-store.uploading
+
+	collected := make(chan error)
+	go func() {
+		collected <- b.CollectDead()
+	}()
+	select {
+	case <-collected:
+		t.Fatal("dead GC ran during the upload of the checkpoint")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if size, err := store.GetObjectSize(dead); err != nil || size == 0 {
+		t.Fatalf("dead object was emptied during the upload of the checkpoint, size %d, error %v", size, err)
+	}
+
+	store.release <- struct{}{}
+	if err := <-checkpointed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-collected; err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.GetObjectSize(dead); err != nil || size != 0 {
+		t.Fatalf("dead object was not emptied, size %d, error %v", size, err)
+	}
+}
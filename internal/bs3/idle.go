@@ -0,0 +1,78 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Deferral states of GC of all volumes, published under "gc_idle" in the
+// metrics.
+var gcIdleMetrics = expvar.NewMap("gc_idle")
+
+// Foreground IO activity used to run GC only when the device is idle. The
+// proxies already prefer foreground requests to GC ones, this defers whole GC
+// runs, so they do not compete with the foreground IO at all.
+type idle struct {
+	// Time of the last read or write in ns since the epoch.
+	lastIO int64
+
+	// 1 when a GC run waits for the device to become idle.
+	deferred int32
+}
+
+// Records foreground IO.
+func (b *bs3) touchIO() {
+	atomic.StoreInt64(&b.idle.lastIO, time.Now().UnixNano())
+}
+
+// Waits until there was no foreground IO for the configured idle window.
+// Returns false when the device is being stopped meanwhile, hence the GC run
+// should be skipped. Returns true immediately when the window is 0.
+func (b *bs3) waitIdle() bool {
+	for {
+		window := time.Duration(b.cfg().GC.IdleWindowSec) * time.Second
+		since := time.Since(time.Unix(0, atomic.LoadInt64(&b.idle.lastIO)))
+		if window <= 0 || since >= window {
+			if atomic.SwapInt32(&b.idle.deferred, 0) != 0 {
+				log.Debug().Msg("Device is idle. Deferred GC started.")
+			}
+			return true
+		}
+
+		if atomic.SwapInt32(&b.idle.deferred, 1) == 0 {
+			log.Debug().Msgf("Foreground IO %s ago. GC deferred until the device is idle for %s.",
+				since.Round(time.Millisecond), window)
+		}
+
+		timer := time.NewTimer(window - since)
+		select {
+		case <-timer.C:
+		case <-b.stopping:
+			timer.Stop()
+			atomic.StoreInt32(&b.idle.deferred, 0)
+			return false
+		}
+	}
+}
+
+// Returns deferral state for the metrics, i.e. whether GC waits for the device
+// to become idle and how many seconds ago the last foreground IO was.
+func (b *bs3) gcIdleState() interface{} {
+	state := struct {
+		Deferred bool    `json:"deferred"`
+		Seconds  float64 `json:"seconds"`
+	}{
+		Deferred: atomic.LoadInt32(&b.idle.deferred) != 0,
+	}
+
+	if last := atomic.LoadInt64(&b.idle.lastIO); last != 0 {
+		state.Seconds = time.Since(time.Unix(0, last)).Seconds()
+	}
+
+	return state
+}
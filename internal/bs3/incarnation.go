@@ -0,0 +1,61 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Incarnation of the volume increases whenever the key space is reset, i.e.
+// with every restore, which deletes objects after the first missing one and
+// writes new objects under their keys, and with every rebuild of the map. It
+// is stored in the checkpoint trailer and, when enabled, in the metadata of
+// every uploaded object. Since keys are assigned in increasing order, the
+// incarnations of consecutive objects never decrease. The invariant is:
+//
+//	Object with lower incarnation than the checkpoint or than its
+//	predecessor survived a reset of the key space and it is not part of
+//	the volume.
+//
+// Such object is left behind e.g. when the deletion of successors of the
+// missing object fails or when the object was invisible on an eventually
+// consistent backend during the restore. Roll forward recovery stops at it as
+// if it was missing, so it is never replayed. Objects without incarnation, i.e.
+// uploaded with the incarnation disabled or by older versions, have
+// incarnation 0 and they are always accepted.
+//
+// The incarnation is unrelated to the epoch of sequential numbers. The epoch
+// orders writes, while the incarnation identifies objects.
+
+// Returns true when the object with key and incarnation is stale and the roll
+// forward recovery has to stop before it. Otherwise the current incarnation is
+// raised to the incarnation of the object.
+func (b *bs3) staleIncarnation(key, incarnation int64) bool {
+	if incarnation == 0 {
+		return false
+	}
+
+	if b.cfg().Incarnation && incarnation < b.incarnation {
+		log.Warn().Msgf("->Object %d is from incarnation %d older than %d. It is ignored with all its successors.",
+			key, incarnation, b.incarnation)
+		return true
+	}
+
+	if incarnation > b.incarnation {
+		b.incarnation = incarnation
+	}
+
+	return false
+}
+
+// Moves to the next incarnation and tags all objects uploaded afterwards with
+// it. It has to be called after the key space is reset and before any object
+// is uploaded.
+func (b *bs3) nextIncarnation() {
+	b.incarnation++
+
+	if b.cfg().Incarnation {
+		b.objectStoreProxy.Instance.SetIncarnation(b.incarnation)
+		log.Info().Msgf("Volume incarnation is %d.", b.incarnation)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	// Bytes of objects of writes being uploaded of all volumes, published
+	// under "inflight" in the metrics.
+	inflightMetrics = expvar.NewMap("inflight")
+
+	// Throttling of writes of all volumes, published under "throttle" in
+	// the metrics.
+	throttleMetrics = expvar.NewMap("throttle")
+)
+
+// Bytes of objects of writes being uploaded. Objects uploaded synchronously
+// are usually in the shared memory of the kernel, but objects modified by
+// read-modify-write, padding or asynchronous writes are copies on the heap and
+// they are pinned until the upload succeeds, which can take long with a slow
+// backend. The writes block when the configured maximum is reached, so the
+// memory stays bounded.
+type inflight struct {
+	mutex sync.Mutex
+
+	// Signaled with the mutex whenever bytes decrease.
+	released *sync.Cond
+
+	bytes int64
+
+	// Delay in ms applied to the last write, the number of delayed writes
+	// and the sum of their delays in ms.
+	delay     expvar.Int
+	throttled expvar.Int
+	delayed   expvar.Int
+}
+
+// Waits until size bytes fit under the configured maximum and adds them to the
+// bytes in flight. An object bigger than the maximum is admitted when nothing
+// else is in flight, so it cannot block forever.
+func (b *bs3) acquireInflight(size int64) {
+	b.inflight.mutex.Lock()
+	defer b.inflight.mutex.Unlock()
+
+	limit := b.cfg().Write.MaxInflight
+	for limit > 0 && b.inflight.bytes > 0 && b.inflight.bytes+size > limit {
+		b.inflight.released.Wait()
+	}
+	b.inflight.bytes += size
+}
+
+// Removes size bytes of the uploaded object from the bytes in flight.
+func (b *bs3) releaseInflight(size int64) {
+	b.inflight.mutex.Lock()
+	b.inflight.bytes -= size
+	b.inflight.released.Broadcast()
+	b.inflight.mutex.Unlock()
+}
+
+// Delays the acknowledgement of the write when the bytes in flight exceed the
+// configured watermark, so the kernel slows down before writes block on the
+// maximum. The delay grows linearly from zero at the watermark to the
+// configured maximal delay at the maximum in flight, or at twice the watermark
+// when there is no maximum.
+func (b *bs3) throttle() {
+	watermark := b.cfg().Write.ThrottleWatermark
+	maxDelay := time.Duration(b.cfg().Write.ThrottleMaxDelayMs) * time.Millisecond
+	if watermark <= 0 || maxDelay <= 0 {
+		return
+	}
+
+	b.inflight.mutex.Lock()
+	over := b.inflight.bytes - watermark
+	b.inflight.mutex.Unlock()
+
+	if over <= 0 {
+		b.inflight.delay.Set(0)
+		return
+	}
+
+	span := watermark
+	if limit := b.cfg().Write.MaxInflight; limit > watermark {
+		span = limit - watermark
+	}
+
+	delay := maxDelay
+	if over < span {
+		delay = time.Duration(float64(maxDelay) * float64(over) / float64(span))
+	}
+
+	b.inflight.delay.Set(delay.Milliseconds())
+	b.inflight.throttled.Add(1)
+	b.inflight.delayed.Add(delay.Milliseconds())
+	time.Sleep(delay)
+}
+
+// Publishes throttling of writes under name in the metrics.
+func (b *bs3) publishThrottle(name string) {
+	m := new(expvar.Map).Init()
+	m.Set("delay_ms", &b.inflight.delay)
+	m.Set("throttled", &b.inflight.throttled)
+	m.Set("delayed_ms", &b.inflight.delayed)
+	throttleMetrics.Set(name, m)
+}
+
+// Returns bytes in flight for the metrics.
+func (b *bs3) inflightBytes() interface{} {
+	b.inflight.mutex.Lock()
+	defer b.inflight.mutex.Unlock()
+
+	return b.inflight.bytes
+}
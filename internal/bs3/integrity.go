@@ -0,0 +1,373 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// With the integrity option, every checkpoint object carries the Merkle root of
+// its serialized map in the trailer and the root is verified when the
+// checkpoint is downloaded during the restore. The root is in the same object
+// as the map, hence it detects corruption, but not deliberate modification.
+// With the integrity log, the root of every checkpoint object is appended to
+// the log object as well, and every record of the log is chained with the hash
+// of the previous one. A checkpoint modified without its record, or a record
+// modified without the rest of the chain, is detected. The chain is not keyed,
+// so anyone with write access to the bucket can recompute all of it. Only the
+// head of the chain compared with a copy kept outside of the bucket, see
+// bs3-verify, detects that.
+//
+// Once the integrity is enabled, every checkpoint object has to have the root
+// and, with the log, the log has to exist and list it. A missing root or log is
+// refused, so they cannot be removed to skip the verification. The integrity
+// adopt option accepts them once, when the integrity is enabled on an existing
+// volume.
+//
+// The map restored from its local copy is not downloaded, hence it is not
+// verified.
+
+const (
+	// Size of the leaves of the Merkle tree over the serialized map.
+	merkleLeafSize = 1 << 20
+
+	// Key of the integrity log. It is right above the keys of shards, far
+	// below any reachable key of a delta.
+	integrityLogKey = shardKeyBase + 1
+
+	// Key of the salt of the encryption key. It is right above the key of
+	// the integrity log.
+	encryptionSaltKey = integrityLogKey + 1
+
+	// Size of one record of the integrity log.
+	integrityRecordSize = 88
+)
+
+// SHA-256 Merkle root of the serialized map. Zero means no root, e.g. in
+// checkpoints taken without the integrity option.
+type merkleRoot [sha256.Size]byte
+
+// Returns true for the zero root.
+func (r merkleRoot) isZero() bool {
+	return r == merkleRoot{}
+}
+
+// Returns the root in hex.
+func (r merkleRoot) String() string {
+	return fmt.Sprintf("%x", r[:])
+}
+
+// Integrity log of the volume loaded during the restore.
+type integrity struct {
+	records []integrityRecord
+	log     []byte
+
+	// The log exists on the backend.
+	logged bool
+}
+
+// Returns Merkle root of data split into leaves of merkleLeafSize. Leaves are
+// hashed in parallel by all CPUs. Leaves and inner nodes are hashed with
+// different prefixes, so a leaf can never pass for a node. The last node of a
+// level with odd number of nodes is promoted to the next level.
+func computeMerkleRoot(data []byte) merkleRoot {
+	leaves := (len(data) + merkleLeafSize - 1) / merkleLeafSize
+	if leaves == 0 {
+		leaves = 1
+	}
+
+	level := make([]merkleRoot, leaves)
+	next := make(chan int, leaves)
+	for i := range level {
+		next <- i
+	}
+	close(next)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				end := (i + 1) * merkleLeafSize
+				if end > len(data) {
+					end = len(data)
+				}
+				level[i] = hashMerkleNode(0, data[i*merkleLeafSize:end])
+			}
+		}()
+	}
+	wg.Wait()
+
+	for len(level) > 1 {
+		parents := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				parents = append(parents, level[i])
+				continue
+			}
+			parents = append(parents, hashMerkleNode(1, level[i][:], level[i+1][:]))
+		}
+		level = parents
+	}
+
+	return level[0]
+}
+
+// Returns SHA-256 of prefix followed by parts.
+func hashMerkleNode(prefix byte, parts ...[]byte) merkleRoot {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	var r merkleRoot
+	h.Sum(r[:0])
+
+	return r
+}
+
+// Record of the integrity log. Layout of the record, all values are little
+// endian:
+//
+//	[0:8]   generation of the checkpoint chain
+//	[8:16]  position in the checkpoint chain, 0 for the base
+//	[16:24] next unassigned object key at the time of checkpoint
+//	[24:56] Merkle root of the serialized map
+//	[56:88] SHA-256 of byte 2, [56:88] of the previous record, zeros for
+//	        the first one, and [0:56] of this record
+type integrityRecord struct {
+	generation int64
+	delta      int64
+	nextKey    int64
+	root       merkleRoot
+}
+
+// Appends the record chained with the last record of raw to raw.
+func appendIntegrityRecord(raw []byte, r integrityRecord) []byte {
+	item := make([]byte, integrityRecordSize)
+	binary.LittleEndian.PutUint64(item[0:], uint64(r.generation))
+	binary.LittleEndian.PutUint64(item[8:], uint64(r.delta))
+	binary.LittleEndian.PutUint64(item[16:], uint64(r.nextKey))
+	copy(item[24:56], r.root[:])
+
+	prev := make([]byte, sha256.Size)
+	if len(raw) > 0 {
+		prev = raw[len(raw)-integrityRecordSize+56:]
+	}
+	chain := hashMerkleNode(2, prev, item[:56])
+	copy(item[56:], chain[:])
+
+	return append(raw, item...)
+}
+
+// Parses the integrity log and verifies the chain of its records. Returns error
+// when the log is truncated or any record was modified.
+func parseIntegrityLog(raw []byte) ([]integrityRecord, error) {
+	if len(raw)%integrityRecordSize != 0 {
+		return nil, fmt.Errorf("integrity log has %d bytes, which is not a multiple of the record size", len(raw))
+	}
+
+	records := make([]integrityRecord, 0, len(raw)/integrityRecordSize)
+	var rebuilt []byte
+	for off := 0; off < len(raw); off += integrityRecordSize {
+		item := raw[off : off+integrityRecordSize]
+		r := integrityRecord{
+			generation: int64(binary.LittleEndian.Uint64(item[0:])),
+			delta:      int64(binary.LittleEndian.Uint64(item[8:])),
+			nextKey:    int64(binary.LittleEndian.Uint64(item[16:])),
+		}
+		copy(r.root[:], item[24:56])
+
+		rebuilt = appendIntegrityRecord(rebuilt, r)
+		if !bytes.Equal(rebuilt[off:], item) {
+			return nil, fmt.Errorf("record %d of the integrity log breaks the chain", off/integrityRecordSize)
+		}
+
+		records = append(records, r)
+	}
+
+	return records, nil
+}
+
+// Downloads and parses the integrity log. Returns false when there is no log.
+// Any other failure of the backend is an error, so the log is never taken as
+// missing by mistake.
+func (b *bs3) downloadIntegrityLog() ([]integrityRecord, []byte, bool, error) {
+	size, err := b.objectStoreProxy.Instance.GetObjectSize(integrityLogKey)
+	if errors.Is(err, objproxy.ErrNotFound) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("size of the integrity log cannot be read: %w", err)
+	}
+
+	raw := make([]byte, size)
+	if err := b.objectStoreProxy.Download(integrityLogKey, raw, 0, false); err != nil {
+		return nil, nil, false, fmt.Errorf("download of the integrity log failed: %w", err)
+	}
+
+	records, err := parseIntegrityLog(raw)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return records, raw, true, nil
+}
+
+// Loads the integrity log before the checkpoint is restored, so the checkpoint
+// can be verified against it and the next checkpoint appended to it. The
+// daemon refuses to start when the log is corrupted or cannot be downloaded.
+// Missing log is refused by checkRequiredIntegrity() once the checkpoint is
+// found.
+func (b *bs3) loadIntegrityLog() {
+	if !b.cfg().Integrity || !b.cfg().IntegrityLog {
+		return
+	}
+
+	records, raw, ok, err := b.downloadIntegrityLog()
+	if err != nil {
+		log.Panic().Err(err).Msg("->Integrity log cannot be loaded. Refusing to start.")
+	}
+	if !ok {
+		log.Warn().Msg("->Integrity log not found.")
+		return
+	}
+
+	b.integrity.records = records
+	b.integrity.log = raw
+	b.integrity.logged = true
+
+	log.Info().Msgf("->Integrity log with %d records loaded.", len(records))
+}
+
+// Appends the root of the checkpoint object with trailer t to the integrity log
+// and uploads the whole log. The log is kept in memory only when the upload
+// succeeds.
+func (b *bs3) logIntegrity(t checkpointTrailer) error {
+	raw := appendIntegrityRecord(append([]byte(nil), b.integrity.log...), integrityRecord{
+		generation: t.generation,
+		delta:      t.delta,
+		nextKey:    t.nextKey,
+		root:       t.root,
+	})
+
+	if err := b.objectStoreProxy.Upload(integrityLogKey, raw, false, objproxy.SourceCheckpoint); err != nil {
+		return err
+	}
+
+	b.integrity.log = raw
+	b.integrity.logged = true
+
+	return nil
+}
+
+// Returns error when the serialized map body of the checkpoint object c does not
+// match the root in its trailer or its record in records. Records are checked
+// only when logged is true, i.e. the integrity log exists. Objects without the
+// root are an error when required or logged is true, otherwise they are not
+// checked.
+func checkIntegrity(c checkpointObject, body []byte, records []integrityRecord, required, logged bool) error {
+	want := c.trailer.root
+	if want.isZero() {
+		if required || logged {
+			return fmt.Errorf("checkpoint object %d has no Merkle root", c.key)
+		}
+		return nil
+	}
+
+	if got := computeMerkleRoot(body); got != want {
+		return fmt.Errorf("checkpoint object %d has Merkle root %s, but its trailer records %s", c.key, got, want)
+	}
+
+	if !logged {
+		return nil
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if r.generation != c.trailer.generation || r.delta != c.trailer.delta {
+			continue
+		}
+		if r.root != want || r.nextKey != c.trailer.nextKey {
+			return fmt.Errorf("checkpoint object %d does not match its record in the integrity log", c.key)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("checkpoint object %d has no record in the integrity log", c.key)
+}
+
+// Returns true when every object of the checkpoint chain has to have the root,
+// i.e. the integrity is enabled and not adopted. The daemon refuses to start
+// when the integrity log is enabled, but it does not exist, unless it is
+// adopted.
+func (b *bs3) checkRequiredIntegrity() bool {
+	if !b.cfg().Integrity {
+		return false
+	}
+
+	if b.cfg().IntegrityAdopt {
+		log.Warn().Msg("->Integrity adopted. Checkpoint without Merkle roots or integrity log is accepted " +
+			"and the next checkpoint starts them. Disable integrity_adopt afterwards.")
+		return false
+	}
+
+	if b.cfg().IntegrityLog && !b.integrity.logged {
+		log.Panic().Msg("->Integrity log not found, but the integrity log is enabled. Refusing to start. " +
+			"Enable integrity_adopt once when the log is enabled on an existing volume.")
+	}
+
+	return true
+}
+
+// Verifies every object of the checkpoint chain on the backend against the
+// Merkle root in its trailer and against the integrity log when it exists.
+// Returns error on the first mismatch, or when an object has no root. Nothing is
+// modified, so it can be run against the bucket of a running volume.
+func (b *bs3) VerifyCheckpoint() error {
+	chain, ok := b.findCheckpointChain()
+	if !ok {
+		return errors.New("no checkpoint found")
+	}
+
+	records, raw, logged, err := b.downloadIntegrityLog()
+	if err != nil {
+		return err
+	}
+	if logged {
+		log.Info().Msgf("Integrity log with %d records verified. Head of the chain is %x.",
+			len(records), raw[len(raw)-sha256.Size:])
+	} else {
+		log.Warn().Msg("Integrity log not found. Checkpoint is verified only against roots in its trailers.")
+	}
+
+	for _, c := range chain {
+		if c.trailer.root.isZero() {
+			return fmt.Errorf("checkpoint object %d has no Merkle root", c.key)
+		}
+
+		body, err := b.downloadCheckpointBody(c)
+		if err != nil {
+			return err
+		}
+		if err := checkIntegrity(c, body, records, true, logged); err != nil {
+			return err
+		}
+
+		log.Info().Msgf("Checkpoint object %d matches Merkle root %s.", c.key, c.trailer.root)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"testing"
+)
+
+func TestIntegrityLogChain(t *testing.T) {
+	var raw []byte
+	for i := int64(0); i < 3; i++ {
+		raw = appendIntegrityRecord(raw, integrityRecord{generation: 1, delta: i, nextKey: 10 + i})
+	}
+
+	records, err := parseIntegrityLog(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[2].nextKey != 12 {
+		t.Fatalf("parsed records %+v", records)
+	}
+
+	modified := append([]byte(nil), raw...)
+	modified[integrityRecordSize+16]++
+	if _, err := parseIntegrityLog(modified); err == nil {
+		t.Fatal("modified record does not break the chain")
+	}
+
+	if _, err := parseIntegrityLog(raw[:len(raw)-1]); err == nil {
+		t.Fatal("truncated log accepted")
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	body := []byte("serialized map")
+	root := computeMerkleRoot(body)
+	record := integrityRecord{generation: 1, delta: 0, nextKey: 5, root: root}
+	c := checkpointObject{key: checkpointKey, trailer: checkpointTrailer{generation: 1, nextKey: 5, root: root}}
+
+	tests := []struct {
+		name     string
+		c        checkpointObject
+		body     []byte
+		records  []integrityRecord
+		required bool
+		logged   bool
+		ok       bool
+	}{
+		{"root matches", c, body, nil, true, false, true},
+		{"record matches", c, body, []integrityRecord{record}, true, true, true},
+		{"body modified", c, []byte("modified map"), nil, true, false, false},
+		{"record missing", c, body, nil, true, true, false},
+		{"no root, not required", checkpointObject{key: checkpointKey}, body, nil, false, false, true},
+		{"no root, required", checkpointObject{key: checkpointKey}, body, nil, true, false, false},
+		{"no root, logged", checkpointObject{key: checkpointKey}, body, []integrityRecord{record}, false, true, false},
+	}
+
+	for _, tt := range tests {
+		err := checkIntegrity(tt.c, tt.body, tt.records, tt.required, tt.logged)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+}
@@ -1,44 +1,47 @@
 // Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
 
-// Package for synchronized access to the object key counter.
+// Package for synchronized access to the object key counters. Every volume
+// has its own counter, there is no package level state.
 package key
 
 import (
 	"sync"
 )
 
-var (
+// Counter of object keys. Zero value is a counter starting at key 0. It must
+// not be copied after first use.
+type Counter struct {
 	key   int64
 	mutex sync.Mutex
-)
+}
 
 // Returns value of currently unassigned key. It is forbidden to use this key
 // for creating a new object withou calling Next() function. I.e. this key can
 // be used for the next object.
-func Current() int64 {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (c *Counter) Current() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	return key
+	return c.key
 }
 
 // Returns value of currently unassigned key and increments, hence the key
 // variable contains unassigned key again.. I.e. this key can be used for the
 // next object.
-func Next() int64 {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (c *Counter) Next() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	tmp := key
-	key++
+	tmp := c.key
+	c.key++
 
 	return tmp
 }
 
 // Replaces the value of the next unassigned key.
-func Replace(newKey int64) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (c *Counter) Replace(newKey int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	key = newKey
+	c.key = newKey
 }
@@ -0,0 +1,123 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// GC modes selecting what the threshold GC trigger runs.
+	gcModeThreshold = "threshold"
+	gcModeLocality  = "locality"
+
+	// Minimal number of objects a region has to be spread over to be
+	// compacted. Compacted region is spread over at most two objects,
+	// hence it is never compacted again until it is overwritten.
+	minLocalityObjects = 3
+)
+
+// Runs GC selected by the configured mode with threshold used by the
+// threshold GC.
+func (b *bs3) gcByMode(threshold float64) {
+	switch b.cfg().GC.Mode {
+	case gcModeLocality:
+		log.Info().Msgf("Locality GC started with %d objects per region.", b.localityObjects())
+		b.gcLocality()
+		log.Info().Msg("Locality GC finished.")
+	default:
+		if b.cfg().GC.Mode != gcModeThreshold {
+			log.Warn().Msgf("Unknown GC mode %q. Threshold GC is used.", b.cfg().GC.Mode)
+		}
+		log.Info().Msgf("Threshold GC started with threshold %1.2f.", threshold)
+		b.gcThreshold(b.cfg().GC.Step, threshold)
+		log.Info().Msg("Threshold GC finished.")
+	}
+}
+
+// Returns the number of objects over which a region has to be spread to be
+// compacted by locality GC.
+func (b *bs3) localityObjects() int {
+	if b.cfg().GC.LocalityObjects < minLocalityObjects {
+		return minLocalityObjects
+	}
+
+	return b.cfg().GC.LocalityObjects
+}
+
+// Runs locality GC. Unlike threshold GC, it does not reclaim space but it
+// consolidates logically adjacent sectors into the same objects regardless of
+// utilization of the objects, so large sequential reads need fewer requests.
+//
+// The device is divided into regions of the size of the data part of an
+// object. Live extents of every region spread over too many objects are copied
+// into new objects in the sector order, so the region ends up in one or two
+// objects. The source objects stay alive with the rest of their data and they
+// are left to the threshold and dead GC.
+//
+// The run is limited by the configured time budget the same way as the
+// threshold GC. Regions are processed in batches and the next run starts from
+// the beginning, where already compacted regions are skipped.
+func (b *bs3) gcLocality() {
+	b.gcData.collecting.Lock()
+	defer b.gcData.collecting.Unlock()
+
+	var deadline time.Time
+	if b.cfg().GC.MaxDurationSec > 0 {
+		deadline = time.Now().Add(time.Duration(b.cfg().GC.MaxDurationSec) * time.Second)
+	}
+
+	region := int64((b.cfg().Write.ChunkSize - b.metadata_size) / b.cfg().BlockSize)
+	limit := gcBatchObjects * region
+	sectors := b.cfg().Size / int64(b.cfg().BlockSize)
+	objects := b.localityObjects()
+
+	writeList := make([]mapproxy.ExtentWithObjectPart, 0, 128)
+	var blocks, compacted int64
+	for s := int64(0); s < sectors; s += region {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Info().Msgf("GC time budget exceeded at block %d. The rest is compacted by the next run.", s)
+			break
+		}
+
+		keys := b.regionObjects(s, region)
+		if len(keys) < objects {
+			continue
+		}
+
+		for _, g := range b.extentMapProxy.ExtentsInObjects(s, region, keys) {
+			writeList = append(writeList, g)
+			blocks += g.Extent.Length
+		}
+		compacted++
+
+		if blocks >= limit {
+			b.collectWriteList(writeList)
+			writeList = writeList[:0]
+			blocks = 0
+		}
+	}
+
+	if len(writeList) > 0 {
+		b.collectWriteList(writeList)
+	}
+
+	log.Info().Msgf("Locality GC compacted %d regions.", compacted)
+}
+
+// Returns keys of objects where the live data of the region of length blocks
+// starting at sector are stored.
+func (b *bs3) regionObjects(sector, length int64) map[int64]struct{} {
+	keys := make(map[int64]struct{})
+	for _, p := range b.extentMapProxy.Lookup(sector, length) {
+		if p.Key >= 0 {
+			keys[p.Key] = struct{}{}
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Latency of one download from slowStore, roughly the latency of a request to
+// the s3 backend.
+const testDownloadLatency = time.Millisecond
+
+// Memory backend with the latency of every download. It counts the downloads.
+type slowStore struct {
+	*memory.Memory
+
+	downloads int64
+}
+
+func (s *slowStore) DownloadAt(key int64, buf []byte, offset int64) error {
+	atomic.AddInt64(&s.downloads, 1)
+	time.Sleep(testDownloadLatency)
+
+	return s.Memory.DownloadAt(key, buf, offset)
+}
+
+// Returns volume over store with the first region of the device scattered
+// over stride objects. Every object has every stride-th block of the region,
+// hence no two adjacent blocks are in the same object.
+func newScatteredVolume(tb testing.TB, store *slowStore, stride int64) (*bs3, int64) {
+	tb.Helper()
+
+	vol := newTestVolume(tb, newTestConfig(tb), store)
+	region := int64((vol.cfg().Write.ChunkSize - vol.metadata_size) / vol.cfg().BlockSize)
+	for i := int64(0); i < stride; i++ {
+		var writes []testWrite
+		for block := i; block < region; block += stride {
+			writes = append(writes, testWrite{block, testData(1, byte(i+1))})
+		}
+		if err := vol.BuseWrite(int64(len(writes)), testChunk(vol, 1+i*region, writes...)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return vol, region
+}
+
+func TestLocalityCompactsRegion(t *testing.T) {
+	store := &slowStore{Memory: memory.New()}
+	vol, region := newScatteredVolume(t, store, 8)
+	want := make([]byte, region*testBlockSize)
+	for block := int64(0); block < region; block++ {
+		copy(want[block*testBlockSize:], testData(1, byte(block%8+1)))
+	}
+
+	vol.gcLocality()
+	if keys := vol.regionObjects(0, region); len(keys) > 2 {
+		t.Fatalf("compacted region is spread over %d objects", len(keys))
+	}
+
+	atomic.StoreInt64(&store.downloads, 0)
+	expectRead(t, vol, 0, want)
+	if store.downloads > 2 {
+		t.Fatalf("read of the compacted region took %d downloads", store.downloads)
+	}
+}
+
+// Sequential read of the region scattered over objects, before and after the
+// locality GC. Downloads of a read run in parallel, so the latency depends on
+// the number of downloads only partially. Fewer downloads mean fewer requests
+// paid for and less load of the backend, hence the number of downloads is
+// reported as well.
+func BenchmarkSequentialRead(b *testing.B) {
+	for _, compacted := range []bool{false, true} {
+		name := "scattered"
+		if compacted {
+			name = "compacted"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			store := &slowStore{Memory: memory.New()}
+			vol, region := newScatteredVolume(b, store, 8)
+			if compacted {
+				vol.gcLocality()
+			}
+			chunk := make([]byte, region*testBlockSize)
+
+			atomic.StoreInt64(&store.downloads, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := vol.BuseRead(0, region, chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&store.downloads))/float64(b.N), "downloads/op")
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Exports the extent map into w, e.g. for backups or to compare two maps
+// offline. The export has the format of the base checkpoint object, i.e. the
+// serialized map followed by the checkpoint trailer, hence a base checkpoint
+// object downloaded from the bucket can be imported as well. IO is paused until
+// writes and GC in flight are in the map, like for the forced checkpoint, unless
+// it is already paused. The map is written into w after IO is resumed, so a
+// slow reader does not block IO. The serialization restarts the delta tracking
+// of the map, so the next checkpoint is the full one.
+func (b *bs3) ExportMap(w io.Writer) error {
+	export, nextKey := b.exportMap()
+
+	if _, err := w.Write(export); err != nil {
+		return fmt.Errorf("export of the extent map: %w", err)
+	}
+
+	log.Info().Msgf("Extent map exported. Last object is %d.", nextKey)
+
+	return nil
+}
+
+// Returns the serialized map with the checkpoint trailer and the next key
+// stored in the trailer.
+func (b *bs3) exportMap() ([]byte, int64) {
+	b.warming.Wait()
+
+	defer b.quiesceMaintenance()()
+
+	b.gcData.removing.Lock()
+	defer b.gcData.removing.Unlock()
+
+	trailer := checkpointTrailer{
+		version:     formatVersion,
+		nextKey:     b.key.Current(),
+		volumeID:    b.volumeID,
+		epoch:       b.epoch,
+		incarnation: b.incarnation,
+	}
+	b.stampFingerprint(&trailer)
+	dump := b.extentMapProxy.Serialize()
+	b.checkpointGeneration = 0
+	if b.cfg().Integrity {
+		trailer.root = computeMerkleRoot(dump)
+	}
+
+	return append(dump, trailer.marshal()...), trailer.nextKey
+}
+
+// Replaces the extent map by the one exported by ExportMap() and read from r.
+// IO has to be paused, since the live map is replaced as a whole. The export is
+// refused when it has newer format, its fingerprint does not match the
+// configuration, it belongs to another volume or it references objects which
+// were not uploaded yet or which are missing or empty in the bucket, e.g.
+// because GC moved their data after the export and dead GC emptied them.
+// Objects uploaded after the export are not in the imported map, so their data
+// are lost for the device. They are registered as dead, so dead GC reclaims
+// them. The next checkpoint is the full one and the imported map starts the
+// next incarnation.
+func (b *bs3) ImportMap(r io.Reader) error {
+	b.pause.mutex.Lock()
+	defer b.pause.mutex.Unlock()
+
+	if b.pause.resume == nil {
+		return errors.New("IO has to be paused for the import of the extent map")
+	}
+
+	b.gcData.removing.Lock()
+	defer b.gcData.removing.Unlock()
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("import of the extent map: %w", err)
+	}
+
+	body, t, ok := splitCheckpoint(raw)
+	if err := b.checkImport(t, ok); err != nil {
+		return fmt.Errorf("import of the extent map: %w", err)
+	}
+	if !t.root.isZero() && computeMerkleRoot(body) != t.root {
+		return fmt.Errorf("import of the extent map: map does not match its Merkle root %s", t.root)
+	}
+
+	staging := b.extentMapProxy.Instance.Empty()
+	if nextKey := staging.DeserializeAndReturnNextKey(body); nextKey > b.key.Current() {
+		return fmt.Errorf("import of the extent map: map references object %d, but the last object is %d",
+			nextKey-1, b.key.Current())
+	}
+
+	first := b.dataBegin()
+	end := int64((b.metadata_size + b.cfg().Write.ChunkSize) / b.cfg().BlockSize)
+	if _, err := staging.Verify(first, end); err != nil {
+		return fmt.Errorf("import of the extent map: %w", err)
+	}
+
+	inventory, err := b.checkImportedObjects(staging)
+	if err != nil {
+		return fmt.Errorf("import of the extent map: %w", err)
+	}
+
+	if t.nextKey < b.key.Current() {
+		for key := t.nextKey; key < b.key.Current(); key++ {
+			if inventory[key] > 0 {
+				staging.Update(nil, 0, key)
+			}
+		}
+		log.Warn().Msgf("Imported extent map does not contain objects %d to %d uploaded after its export. They are dead now.",
+			t.nextKey, b.key.Current()-1)
+	}
+
+	b.extentMapProxy.Replace(staging, b.cfg().Size/int64(b.cfg().BlockSize))
+	b.checkpointGeneration = 0
+	b.nextIncarnation()
+
+	log.Info().Msg("Extent map imported.")
+
+	return nil
+}
+
+// Returns error when the map with trailer t cannot be imported. The trailer is
+// missing when ok is false.
+func (b *bs3) checkImport(t checkpointTrailer, ok bool) error {
+	switch {
+	case !ok:
+		return errors.New("input is not an exported extent map")
+	case t.version > formatVersion:
+		return fmt.Errorf("format version %d is newer than supported %d", t.version, formatVersion)
+	case t.shards > 0 || t.delta > 0:
+		return errors.New("sharded checkpoints and deltas cannot be imported")
+	case !t.volumeID.isZero() && !b.volumeID.isZero() && t.volumeID != b.volumeID:
+		return fmt.Errorf("map belongs to volume %s, not to %s", t.volumeID, b.volumeID)
+	case t.nextKey > b.key.Current():
+		return fmt.Errorf("map was exported at object %d, but the last object is %d", t.nextKey, b.key.Current())
+	}
+
+	if err := b.checkFingerprint(t); err != nil {
+		return fmt.Errorf("map was exported with %w", err)
+	}
+
+	return nil
+}
+
+// Returns error when some object referenced by the imported map is missing or
+// empty on the backend. The backend is listed once and the listing is returned
+// as the inventory of object sizes.
+func (b *bs3) checkImportedObjects(staging mapproxy.ExtentMapper) (map[int64]int64, error) {
+	inventory := make(map[int64]int64)
+	err := b.objectStoreProxy.Instance.ListKeys(func(key, size int64) bool {
+		inventory[key] = size
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("objects cannot be listed: %w", err)
+	}
+
+	for key := range staging.ObjectsUtilization() {
+		if inventory[key] == 0 {
+			return nil, fmt.Errorf("map references object %d which is missing or empty", key)
+		}
+	}
+
+	return inventory, nil
+}
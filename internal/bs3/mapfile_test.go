@@ -0,0 +1,75 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Returns volume with data written at block 10 and the map exported after the
+// write.
+func exportedVolume(t *testing.T) (*bs3, *memory.Memory, []byte) {
+	t.Helper()
+
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{10, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	var export bytes.Buffer
+	if err := b.ExportMap(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	return b, store, export.Bytes()
+}
+
+// Imports the exported map with paused IO.
+func importMap(b *bs3, export []byte) error {
+	if err := b.Pause(); err != nil {
+		return err
+	}
+	defer b.Resume()
+
+	return b.ImportMap(bytes.NewReader(export))
+}
+
+func TestImportMap(t *testing.T) {
+	b, _, export := exportedVolume(t)
+
+	if err := b.BuseWrite(1, testChunk(b, 10, testWrite{10, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := importMap(b, export); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRead(t, b, 10, testData(1, 1))
+	if _, ok := b.extentMapProxy.DeadObjects()[1]; !ok {
+		t.Fatal("object uploaded after the export is not dead")
+	}
+}
+
+func TestImportMapRefused(t *testing.T) {
+	b, store, export := exportedVolume(t)
+
+	if err := b.ImportMap(bytes.NewReader(export)); err == nil {
+		t.Fatal("map imported without paused IO")
+	}
+
+	if err := importMap(b, export[:len(export)-1]); err == nil {
+		t.Fatal("truncated map imported")
+	}
+
+	// Dead GC empties objects whose data were moved by GC.
+	store.Upload(0, nil, objproxy.SourceGC)
+	if err := importMap(b, export); err == nil {
+		t.Fatal("map referencing an empty object imported")
+	}
+}
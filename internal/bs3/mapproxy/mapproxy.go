@@ -7,11 +7,16 @@
 package mapproxy
 
 import (
+	"expvar"
 	"time"
 )
 
 const (
 	NotMappedKey = -1
+
+	// Flag of the extent which discards its sectors instead of mapping
+	// them. Such extent has no data in the object.
+	FlagDiscard = 1 << 30
 )
 
 // Provides mapping from logical extents presented in the system to the
@@ -20,15 +25,31 @@ const (
 // restoration.
 type ExtentMapper interface {
 	Update(extents []Extent, startOfDataSectors, key int64)
+	Relocate(extents []ExtentWithObjectPart, startOfDataSectors, key int64) int64
 	Lookup(sector, length int64) []ObjectPart
 	FindExtentsWithKeys(sector, length int64, keys map[int64]struct{}) []ExtentWithObjectPart
+	Extents(sector, length int64) []ExtentWithObjectPart
 	DeleteFromDeadObjects(deadObjects map[int64]struct{})
 	DeleteFromUtilization(keys map[int64]struct{})
 	GetMaxKey() int64
 	ObjectsUtilization() map[int64]int64
+	LiveObjects() int64
+	ObjectSizes() map[int64]int64
 	DeadObjects() map[int64]struct{}
+	DeadObjectSizes() map[int64]int64
 	DeserializeAndReturnNextKey(buf []byte) int64
 	Serialize() []byte
+	SerializeDelta() []byte
+	DeserializeDelta(buf []byte)
+	Empty() ExtentMapper
+	Warm(checkpoint ExtentMapper, sector, length int64)
+	WarmFinish(checkpoint ExtentMapper)
+	Reset()
+	UseLocal(generation, delta int64) bool
+	SaveLocal(generation, delta int64) error
+	Verify(first, end int64) (int64, error)
+	Summary() Summary
+	Type() string
 }
 
 // Proxy to the ExtentMapper. It serializes and prioritizes requests comming to
@@ -47,6 +68,10 @@ type ExtentMapProxy struct {
 
 	// General low priority channel used for multiple types of requests.
 	lockChan chan lockRequest
+
+	// Statistics of the high priority channels.
+	updateStats channelStats
+	lookupStats channelStats
 }
 
 // Mapping from the logical extent to the extent in the object.
@@ -66,7 +91,8 @@ type Extent struct {
 	// Sequential number of write which wrote this extent
 	SeqNo int64
 
-	// Reserved for future usage.
+	// Flag of the write. It carries the checksum of the write data when
+	// checksums are enabled.
 	Flag int64
 }
 
@@ -80,11 +106,33 @@ type ObjectPart struct {
 
 	// Object where the extent is located.
 	Key int64
+
+	// Flag of the write when the part belongs to a single write, 0
+	// otherwise.
+	Flag int64
+}
+
+// Key invariants of the map. They are compared before and after a round-trip
+// of the serialized map.
+type Summary struct {
+	// Number of mapped sectors.
+	Sectors int64
+
+	// The highest key of a live object.
+	MaxKey int64
+
+	// Number of live and dead objects.
+	LiveObjects int64
+	DeadObjects int64
+
+	// Sum of utilizations of all live objects.
+	Utilization int64
 }
 
 // Returns proxy which can be directly used. It spawns one worker which handles
-// all serialized and prioritized requests.
-func New(instance ExtentMapper, idleTimeout time.Duration) ExtentMapProxy {
+// all serialized and prioritized requests. Statistics of the proxy are
+// published in the metrics under name.
+func New(instance ExtentMapper, idleTimeout time.Duration, name string) ExtentMapProxy {
 	updateChan := make(chan updateRequest)
 	lookupChan := make(chan lookupRequest)
 	keyedExtentsChan := make(chan keyedExtentsRequest)
@@ -97,8 +145,15 @@ func New(instance ExtentMapper, idleTimeout time.Duration) ExtentMapProxy {
 		lookupChan:       lookupChan,
 		keyedExtentsChan: keyedExtentsChan,
 		lockChan:         lockChan,
+		updateStats:      newChannelStats(),
+		lookupStats:      newChannelStats(),
 	}
 
+	stats := new(expvar.Map).Init()
+	m.updateStats.publish(stats, "update")
+	m.lookupStats.publish(stats, "lookup")
+	metrics.Set(name, stats)
+
 	go m.worker()
 
 	return m
@@ -107,16 +162,48 @@ func New(instance ExtentMapper, idleTimeout time.Duration) ExtentMapProxy {
 // Updates all extents specified in extents. startOfDataSectors is the first
 // sector in the object with real data and key is the key of the object.
 func (p *ExtentMapProxy) Update(extents []Extent, startOfDataSectors, key int64) {
+	defer p.updateStats.observe(time.Now())
+
+	done := make(chan struct{})
+	p.updateStats.blocked.Add(1)
+	p.updateChan <- updateRequest{extents: extents, startOfDataSectors: startOfDataSectors, key: key, done: done}
+	p.updateStats.blocked.Add(-1)
+	<-done
+}
+
+// Returns after all Update requests accepted by the worker before the barrier
+// were applied. Updates are processed by a single worker in the order of
+// acceptance, hence the barrier passing through the same channel fences all of
+// them. Update requests sent concurrently with the barrier may be applied
+// before or after it.
+func (p *ExtentMapProxy) Barrier() {
 	done := make(chan struct{})
-	p.updateChan <- updateRequest{extents, startOfDataSectors, key, done}
+	p.updateChan <- updateRequest{done: done, barrier: true}
 	<-done
 }
 
+// Relocates extents copied by GC to the object with key. Extents overwritten
+// since they were copied are not relocated and the number of such sectors is
+// returned. It has low priority, since GC does not block foreground writes.
+func (p *ExtentMapProxy) Relocate(extents []ExtentWithObjectPart, startOfDataSectors, key int64) int64 {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	return p.Instance.Relocate(extents, startOfDataSectors, key)
+}
+
 // Finds all pieces from which the logical extent starting from sector with
 // length length can be reconstructed.
 func (p *ExtentMapProxy) Lookup(sector, length int64) []ObjectPart {
+	defer p.lookupStats.observe(time.Now())
+
 	reply := make(chan []ObjectPart)
+	p.lookupStats.blocked.Add(1)
 	p.lookupChan <- lookupRequest{sector, length, reply}
+	p.lookupStats.blocked.Add(-1)
 	return <-reply
 }
 
@@ -128,6 +215,20 @@ func (p *ExtentMapProxy) ExtentsInObjects(sector, length int64, keys map[int64]s
 	return <-reply
 }
 
+// Returns all extents, including unmapped ones, of the range starting at sector
+// with length length. It has low priority and it is meant for inspection of
+// the map, so large ranges should be walked in smaller pieces to not block
+// updates for too long.
+func (p *ExtentMapProxy) Extents(sector, length int64) []ExtentWithObjectPart {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	return p.Instance.Extents(sector, length)
+}
+
 // Returns all dead objects. I.e. objects without any live data.
 func (p *ExtentMapProxy) DeadObjects() map[int64]struct{} {
 	done := make(chan struct{})
@@ -138,6 +239,16 @@ func (p *ExtentMapProxy) DeadObjects() map[int64]struct{} {
 	return tmp
 }
 
+// Returns sizes of dead objects in blocks, where known.
+func (p *ExtentMapProxy) DeadObjectSizes() map[int64]int64 {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	tmp := p.Instance.DeadObjectSizes()
+	<-done
+
+	return tmp
+}
+
 // Returns all objects utilization. I.e. number of non-dead sectors in each
 // non-dead object.
 func (p *ExtentMapProxy) ObjectsUtilization() map[int64]int64 {
@@ -149,6 +260,26 @@ func (p *ExtentMapProxy) ObjectsUtilization() map[int64]int64 {
 	return tmp
 }
 
+// Returns number of objects with live data.
+func (p *ExtentMapProxy) LiveObjects() int64 {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	tmp := p.Instance.LiveObjects()
+	<-done
+
+	return tmp
+}
+
+// Returns sizes of all non-dead objects in blocks when they were created.
+func (p *ExtentMapProxy) ObjectSizes() map[int64]int64 {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	tmp := p.Instance.ObjectSizes()
+	<-done
+
+	return tmp
+}
+
 // Returns highest object key contained in the map.
 func (p *ExtentMapProxy) GetMaxKey() int64 {
 	done := make(chan struct{})
@@ -182,11 +313,127 @@ func (p *ExtentMapProxy) DeleteDeadObjects(deadObjects map[int64]struct{}) {
 	p.Instance.DeleteFromDeadObjects(deadObjects)
 }
 
+// Returns serialized map. The map is locked during the serialization, so it is
+// consistent even when GC runs concurrently.
+func (p *ExtentMapProxy) Serialize() []byte {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	tmp := p.Instance.Serialize()
+	<-done
+
+	return tmp
+}
+
+// Returns serialized changes since the last serialization or nil when the
+// delta is not worth it. The map is locked during the serialization.
+func (p *ExtentMapProxy) SerializeDelta() []byte {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	tmp := p.Instance.SerializeDelta()
+	<-done
+
+	return tmp
+}
+
+// Returns serialized map, or its delta when delta is true, together with the
+// summary of the map taken under the same lock, so the summary describes
+// exactly the serialized state.
+func (p *ExtentMapProxy) SerializeWithSummary(delta bool) ([]byte, Summary) {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	if delta {
+		return p.Instance.SerializeDelta(), p.Instance.Summary()
+	}
+
+	return p.Instance.Serialize(), p.Instance.Summary()
+}
+
+// Fills sectors from sector with length length which were not written yet
+// with values from the checkpoint map. Used for lazy restore of the checkpoint.
+func (p *ExtentMapProxy) Warm(checkpoint ExtentMapper, sector, length int64) {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	p.Instance.Warm(checkpoint, sector, length)
+}
+
+// Finishes lazy restore of the checkpoint by reconciling objects accounting
+// with the checkpoint map. It has to be called after all sectors were warmed.
+func (p *ExtentMapProxy) WarmFinish(checkpoint ExtentMapper) {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	p.Instance.WarmFinish(checkpoint)
+}
+
+// Replaces all the mapping of the map with length sectors by the staging map
+// under a single lock, so no other request, e.g. the serialization of the
+// checkpoint, sees the map empty or partially replaced.
+func (p *ExtentMapProxy) Replace(staging ExtentMapper, length int64) {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	p.Instance.Reset()
+	p.Instance.Warm(staging, 0, length)
+	p.Instance.WarmFinish(staging)
+}
+
+// Discards all the mapping, the map is empty afterwards.
+func (p *ExtentMapProxy) Reset() {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	p.Instance.Reset()
+}
+
+// Restores the map from its local copy when it corresponds to the checkpoint
+// with generation and delta. Returns false and empties the map otherwise.
+func (p *ExtentMapProxy) UseLocal(generation, delta int64) bool {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	return p.Instance.UseLocal(generation, delta)
+}
+
+// Persists the local copy of the map as the checkpoint with generation and
+// delta.
+func (p *ExtentMapProxy) SaveLocal(generation, delta int64) error {
+	done := make(chan struct{})
+	p.lockChan <- lockRequest{done}
+	defer func() {
+		<-done
+	}()
+
+	return p.Instance.SaveLocal(generation, delta)
+}
+
 type updateRequest struct {
 	extents            []Extent
 	startOfDataSectors int64
 	key                int64
 	done               chan struct{}
+
+	// Barrier does not update the map, it is just acknowledged.
+	barrier bool
 }
 
 // Internal request structures just for wrapping the function calls into the
@@ -241,7 +488,9 @@ func (p *ExtentMapProxy) worker() {
 }
 
 func (p *ExtentMapProxy) update(r updateRequest) {
-	p.Instance.Update(r.extents, r.startOfDataSectors, r.key)
+	if !r.barrier {
+		p.Instance.Update(r.extents, r.startOfDataSectors, r.key)
+	}
 	r.done <- struct{}{}
 }
 
@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package mapproxy
+
+import (
+	"expvar"
+	"time"
+)
+
+// Statistics of channels of all proxies, published under "mapproxy" in the
+// metrics.
+var metrics = expvar.NewMap("mapproxy")
+
+// Upper bounds of buckets of the wait time histogram. The last bucket is
+// unbounded.
+var waitBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Statistics of one request channel. The wait is the time between sending the
+// request and receiving the reply, i.e. it includes the time spent in the
+// queue of blocked senders while the worker serves other requests.
+type channelStats struct {
+	// Number of goroutines blocked on sending into the channel.
+	blocked *expvar.Int
+
+	// Histogram of wait times.
+	wait *expvar.Map
+}
+
+func newChannelStats() channelStats {
+	return channelStats{
+		blocked: new(expvar.Int),
+		wait:    new(expvar.Map).Init(),
+	}
+}
+
+// Publishes the statistics of the channel under name into stats.
+func (c channelStats) publish(stats *expvar.Map, name string) {
+	m := new(expvar.Map).Init()
+	m.Set("blocked", c.blocked)
+	m.Set("wait", c.wait)
+	stats.Set(name, m)
+}
+
+// Counts the request sent at start into the wait time histogram.
+func (c channelStats) observe(start time.Time) {
+	wait := time.Since(start)
+	for _, b := range waitBuckets {
+		if wait <= b {
+			c.wait.Add(b.String(), 1)
+			return
+		}
+	}
+	c.wait.Add("inf", 1)
+}
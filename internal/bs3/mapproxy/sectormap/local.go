@@ -0,0 +1,295 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package sectormap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"unsafe"
+)
+
+// Size of SectorMetadata in the mapped file.
+const sectorMetadataSize = int64(unsafe.Sizeof(SectorMetadata{}))
+
+// Local copy of the map. Sectors are stored directly in the memory-mapped file,
+// hence the kernel pages them in and out as needed and they survive restarts.
+// The file is valid only together with the state file written next to it after
+// a successful checkpoint. The state file identifies the checkpoint the
+// sectors correspond to and it is removed before the first change of the
+// sectors after it, so the sectors are never mistaken for the checkpoint
+// after a crash.
+type local struct {
+	path string
+	data []byte
+
+	// State loaded from the state file when the map was opened. It is nil
+	// when the state file was missing or invalid and the sectors were
+	// initialized as not mapped.
+	candidate *localState
+
+	// The sectors did not change since the last serialization.
+	clean bool
+
+	// The state file exists and it corresponds to the sectors.
+	saved bool
+}
+
+// Content of the state file. The sectors are in the mapped file and
+// everything else is here.
+type localState struct {
+	Length int64
+
+	// Layout of sectors in the mapped file, see sectorLayout. State files
+	// written before the layout was recorded have zero, which is layout 1.
+	Layout int64
+
+	Generation      int64
+	Delta           int64
+	ObjUtilizations map[int64]int64
+	DeadObjs        map[int64]struct{}
+	ObjSizes        map[int64]int64
+}
+
+// Returns new instance of the sector map with sectors stored in the
+// memory-mapped file at path. The file is created or resized as needed. When
+// the file is valid, its content is kept until UseLocal() decides whether it
+// corresponds to the checkpoint on the backend.
+func NewMapped(length int64, path string) (*SectorMap, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	candidate := loadLocalState(path + ".state")
+	if candidate != nil && (candidate.Length != length || !localLayout(candidate.Layout)) {
+		candidate = nil
+	}
+
+	if err := f.Truncate(length * sectorMetadataSize); err != nil {
+		return nil, err
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(length*sectorMetadataSize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap of %s failed: %w", path, err)
+	}
+
+	var sectors []SectorMetadata
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&sectors))
+	h.Data = uintptr(unsafe.Pointer(&data[0]))
+	h.Len = int(length)
+	h.Cap = int(length)
+
+	m := SectorMap{
+		Sectors:         sectors,
+		ObjUtilizations: make(map[int64]int64),
+		DeadObjs:        make(map[int64]struct{}),
+		ObjSizes:        make(map[int64]int64),
+		dirty:           make([]uint64, (length+63)/64),
+		local: &local{
+			path:      path,
+			data:      data,
+			candidate: candidate,
+		},
+	}
+
+	if candidate == nil {
+		for i := range m.Sectors {
+			m.Sectors[i] = SectorMetadata{Key: notMappedKey}
+		}
+	}
+
+	return &m, nil
+}
+
+// Returns true when sectors in the mapped file with layout can be used as is.
+// Otherwise the map is restored from the checkpoint.
+func localLayout(layout int64) bool {
+	return layout == sectorLayout || (layout == 0 && sectorLayout == 1)
+}
+
+// Returns state from the state file at path or nil when it is missing or
+// invalid.
+func loadLocalState(path string) *localState {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var s localState
+	if gob.NewDecoder(bytes.NewReader(buf)).Decode(&s) != nil {
+		return nil
+	}
+
+	return &s
+}
+
+// Returns true when the local copy of the map corresponds to the checkpoint
+// with generation and delta and the map was restored from it. Otherwise the
+// local copy is discarded and the map is empty. Maps without the local copy
+// always return false.
+func (m *SectorMap) UseLocal(generation, delta int64) bool {
+	if m.local == nil {
+		return false
+	}
+
+	c := m.local.candidate
+	m.local.candidate = nil
+
+	if c != nil && generation != 0 && c.Generation == generation && c.Delta == delta {
+		m.ObjUtilizations = c.ObjUtilizations
+		m.DeadObjs = c.DeadObjs
+		m.ObjSizes = c.ObjSizes
+		m.initMaps()
+
+		// Sequential numbers are zeroed as in the deserialization of
+		// the checkpoint. The state file is kept, since it describes
+		// the checkpoint and the change is the same on both sides.
+		for i := range m.Sectors {
+			m.Sectors[i].SeqNo = 0
+		}
+		m.local.clean = true
+		m.local.saved = true
+
+		return true
+	}
+
+	m.invalidateLocal()
+	if c != nil {
+		for i := range m.Sectors {
+			m.Sectors[i] = SectorMetadata{Key: notMappedKey}
+		}
+	}
+
+	return false
+}
+
+// Persists the local copy of the map as the checkpoint with generation and
+// delta. It is done only when the sectors did not change since the last
+// serialization, i.e. they are exactly the uploaded checkpoint. Maps without
+// the local copy do nothing.
+func (m *SectorMap) SaveLocal(generation, delta int64) error {
+	if m.local == nil || !m.local.clean {
+		return nil
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&m.local.data[0])), uintptr(len(m.local.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("msync of %s failed: %w", m.local.path, errno)
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(localState{
+		Length:          int64(len(m.Sectors)),
+		Layout:          sectorLayout,
+		Generation:      generation,
+		Delta:           delta,
+		ObjUtilizations: m.ObjUtilizations,
+		DeadObjs:        m.DeadObjs,
+		ObjSizes:        m.ObjSizes,
+	})
+	if err != nil {
+		return err
+	}
+
+	state := m.local.path + ".state"
+	if err := writeFileSync(state+".tmp", buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(state+".tmp", state); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(state)); err != nil {
+		return err
+	}
+
+	m.local.saved = true
+
+	return nil
+}
+
+// Removes the state file, since the sectors are going to change. It has to be
+// called before the change, otherwise the changed sectors could be written
+// back by the kernel and used together with the state file after a crash.
+func (m *SectorMap) invalidateLocal() {
+	if m.local == nil {
+		return
+	}
+
+	m.local.clean = false
+	if !m.local.saved {
+		return
+	}
+
+	state := m.local.path + ".state"
+	if err := os.Remove(state); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	if err := syncDir(filepath.Dir(state)); err != nil {
+		panic(err)
+	}
+	m.local.saved = false
+}
+
+// Marks the sectors as equal to the serialized map.
+func (m *SectorMap) markLocalClean() {
+	if m.local != nil {
+		m.local.clean = true
+	}
+}
+
+// Copies sectors back into the mapped file when the decoder replaced them
+// with a newly allocated array.
+func (m *SectorMap) remapLocal() {
+	if m.local == nil {
+		return
+	}
+
+	var sectors []SectorMetadata
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&sectors))
+	h.Data = uintptr(unsafe.Pointer(&m.local.data[0]))
+	h.Len = len(m.local.data) / int(sectorMetadataSize)
+	h.Cap = h.Len
+
+	if &sectors[0] != &m.Sectors[0] {
+		copy(sectors, m.Sectors)
+	}
+	m.Sectors = sectors
+}
+
+// Writes data into the file at path and syncs it.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Syncs the directory, so the renames and removals in it are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package sectormap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+)
+
+// Magic at the beginning of the map serialized in sections. Maps serialized
+// before the sections were introduced are a single gob of SectorMap or of
+// sectorMapDelta with the layout 1 of sectors.
+const sectionsMagic = "bs3map\x00\x01"
+
+// Size of the magic, of the length of the accounting section and of the layout
+// of sectors.
+const sectionsHeaderSize = 24
+
+// Layout of SectorMetadata in the sectors section. It has to be increased
+// whenever a field of SectorMetadata is added, removed or changed, and the
+// decoder of the previous layout has to be kept in sectorDecoders. It decodes
+// the sectors into the previous structure and converts them, so the maps
+// serialized by older versions are restored with new fields zeroed. Maps with
+// newer layout are refused, since fields unknown to this version would be lost
+// by the next serialization.
+//
+// 1: Sector, Key, SeqNo and Flag
+const sectorLayout = 1
+
+// Decoders of the sectors section by its layout. The section is gob of
+// []SectorMetadata for the map and gob of deltaSectors for the delta, hence
+// indices are nil for the map. Decoders reuse the memory of sectors.
+var sectorDecoders = map[uint64]func(buf []byte, indices *[]int64, sectors *[]SectorMetadata) error{
+	1: decodeSectorsV1,
+}
+
+// Accounting of objects in the map. It is the first section of both the
+// serialized map and its delta, which carries the complete accounting, hence
+// it can be loaded by LoadAccounting() without decoding the sectors, e.g. by
+// tools inspecting or repairing the accounting.
+type Accounting struct {
+	ObjUtilizations map[int64]int64
+	DeadObjs        map[int64]struct{}
+	ObjSizes        map[int64]int64
+}
+
+// Sectors of the delta, the second section of the serialized delta.
+type deltaSectors struct {
+	Indices []int64
+	Sectors []SectorMetadata
+}
+
+// Returns accounting and sectors serialized in sections. Layout, all values are
+// little endian:
+//
+//	[0:8]   magic
+//	[8:16]  length of the accounting section
+//	[16:24] layout of sectors, see sectorLayout
+//	[24:]   gob of Accounting followed by gob of sectors
+func encodeSections(a *Accounting, sectors interface{}) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, sectionsHeaderSize))
+
+	gob.NewEncoder(&buf).Encode(a)
+	accountingSize := buf.Len() - sectionsHeaderSize
+	gob.NewEncoder(&buf).Encode(sectors)
+
+	b := buf.Bytes()
+	copy(b[0:8], sectionsMagic)
+	binary.LittleEndian.PutUint64(b[8:], uint64(accountingSize))
+	binary.LittleEndian.PutUint64(b[16:], sectorLayout)
+
+	return b
+}
+
+// Splits buf serialized by encodeSections() into the accounting and the sectors
+// sections and returns the layout of sectors. Returns false when buf is not in
+// sections.
+func splitSections(buf []byte) (accounting, sectors []byte, layout uint64, ok bool) {
+	if len(buf) < sectionsHeaderSize || string(buf[0:8]) != sectionsMagic {
+		return nil, nil, 0, false
+	}
+
+	size := binary.LittleEndian.Uint64(buf[8:])
+	if size > uint64(len(buf)-sectionsHeaderSize) {
+		return nil, nil, 0, false
+	}
+
+	end := sectionsHeaderSize + int(size)
+
+	return buf[sectionsHeaderSize:end], buf[end:], binary.LittleEndian.Uint64(buf[16:]), true
+}
+
+// Decodes the sectors section with layout by its decoder from sectorDecoders.
+// Returns error when the layout is not supported, i.e. the map was serialized
+// by a newer version.
+func decodeSectors(buf []byte, layout uint64, indices *[]int64, sectors *[]SectorMetadata) error {
+	decode, ok := sectorDecoders[layout]
+	if !ok {
+		return fmt.Errorf("sectors of the serialized map have layout %d, but the newest supported layout is %d, "+
+			"the map was serialized by a newer bs3", layout, sectorLayout)
+	}
+
+	if err := decode(buf, indices, sectors); err != nil {
+		return fmt.Errorf("sectors of the serialized map with layout %d: %w", layout, err)
+	}
+
+	return nil
+}
+
+// Decodes sectors with layout 1, which is the current SectorMetadata.
+func decodeSectorsV1(buf []byte, indices *[]int64, sectors *[]SectorMetadata) error {
+	dec := gob.NewDecoder(bytes.NewReader(buf))
+	if indices == nil {
+		return dec.Decode(sectors)
+	}
+
+	d := deltaSectors{Sectors: *sectors}
+	err := dec.Decode(&d)
+	*indices, *sectors = d.Indices, d.Sectors
+
+	return err
+}
+
+// Returns accounting of objects of the map or of its delta serialized by
+// Serialize() or SerializeDelta() without decoding the sectors. Maps serialized
+// before the sections were introduced are decoded whole, but the sectors are
+// skipped, so they are not allocated.
+func LoadAccounting(buf []byte) (Accounting, error) {
+	var a Accounting
+
+	if accounting, _, _, ok := splitSections(buf); ok {
+		buf = accounting
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&a); err != nil {
+		return a, fmt.Errorf("serialized map has no accounting of objects: %w", err)
+	}
+
+	if a.ObjUtilizations == nil {
+		a.ObjUtilizations = make(map[int64]int64)
+	}
+	if a.DeadObjs == nil {
+		a.DeadObjs = make(map[int64]struct{})
+	}
+	if a.ObjSizes == nil {
+		a.ObjSizes = make(map[int64]int64)
+	}
+
+	return a, nil
+}
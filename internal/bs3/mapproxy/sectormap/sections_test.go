@@ -0,0 +1,146 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package sectormap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Returns map of 16 sectors with blocks 2 and 3 in object 1 and block 7 in
+// object 2.
+func newTestMap() *SectorMap {
+	m := New(16)
+	m.Update([]mapproxy.Extent{{Sector: 2, Length: 2, SeqNo: 1}}, 0, 1)
+	m.Update([]mapproxy.Extent{{Sector: 7, Length: 1, SeqNo: 2}}, 0, 2)
+
+	return m
+}
+
+// Fails the test when the map m differs from the one of newTestMap().
+func expectTestMap(t *testing.T, m *SectorMap) {
+	t.Helper()
+
+	for i, s := range m.Sectors {
+		want := int64(notMappedKey)
+		switch i {
+		case 2, 3:
+			want = 1
+		case 7:
+			want = 2
+		}
+		if s.Key != want {
+			t.Fatalf("sector %d is in object %d, want %d", i, s.Key, want)
+		}
+	}
+	if m.ObjUtilizations[1] != 2 || m.ObjUtilizations[2] != 1 {
+		t.Fatalf("utilization of objects is %v", m.ObjUtilizations)
+	}
+}
+
+// Runs fn and fails the test when it does not panic.
+func expectPanic(t *testing.T, fn func()) {
+	t.Helper()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("invalid serialized map was deserialized")
+		}
+	}()
+	fn()
+}
+
+func TestSectionsRoundTrip(t *testing.T) {
+	buf := newTestMap().Serialize()
+	if _, _, layout, ok := splitSections(buf); !ok || layout != sectorLayout {
+		t.Fatalf("map is not serialized in sections of layout %d", sectorLayout)
+	}
+
+	m := New(16)
+	if next := m.DeserializeAndReturnNextKey(buf); next != 3 {
+		t.Fatalf("next key is %d", next)
+	}
+	expectTestMap(t, m)
+
+	a, err := LoadAccounting(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ObjUtilizations[1] != 2 || a.ObjUtilizations[2] != 1 {
+		t.Fatalf("accounting is %+v", a)
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	m := newTestMap()
+	base := m.Serialize()
+	m.Update([]mapproxy.Extent{{Sector: 3, Length: 1, SeqNo: 3}}, 0, 3)
+	delta := m.SerializeDelta()
+
+	restored := New(16)
+	restored.DeserializeAndReturnNextKey(base)
+	restored.DeserializeDelta(delta)
+	if restored.Sectors[3].Key != 3 || restored.ObjUtilizations[1] != 1 || restored.ObjUtilizations[3] != 1 {
+		t.Fatalf("delta was not applied, sector 3 is in object %d, utilization %v",
+			restored.Sectors[3].Key, restored.ObjUtilizations)
+	}
+}
+
+func TestMapWithoutSections(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(newTestMap()); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(16)
+	m.DeserializeAndReturnNextKey(buf.Bytes())
+	expectTestMap(t, m)
+
+	if a, err := LoadAccounting(buf.Bytes()); err != nil || a.ObjUtilizations[1] != 2 {
+		t.Fatalf("accounting is %+v, error %v", a, err)
+	}
+}
+
+func TestDeltaWithoutSections(t *testing.T) {
+	m := newTestMap()
+	d := sectorMapDelta{
+		Indices:         []int64{3},
+		Sectors:         []SectorMetadata{{Sector: 0, Key: 3}},
+		ObjUtilizations: map[int64]int64{1: 1, 2: 1, 3: 1},
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	m.DeserializeDelta(buf.Bytes())
+	if m.Sectors[3].Key != 3 || m.ObjUtilizations[3] != 1 {
+		t.Fatal("delta without sections was not applied")
+	}
+}
+
+func TestNewerLayoutRefused(t *testing.T) {
+	m := newTestMap()
+	buf := m.Serialize()
+	binary.LittleEndian.PutUint64(buf[16:], sectorLayout+1)
+	expectPanic(t, func() { New(16).DeserializeAndReturnNextKey(buf) })
+
+	m.Update([]mapproxy.Extent{{Sector: 3, Length: 1, SeqNo: 3}}, 0, 3)
+	delta := m.SerializeDelta()
+	binary.LittleEndian.PutUint64(delta[16:], sectorLayout+1)
+	expectPanic(t, func() { newTestMap().DeserializeDelta(delta) })
+}
+
+func TestInvalidAccountingRefused(t *testing.T) {
+	buf := newTestMap().Serialize()
+	size := binary.LittleEndian.Uint64(buf[8:])
+	for i := sectionsHeaderSize; i < sectionsHeaderSize+int(size); i++ {
+		buf[i] = 0xff
+	}
+
+	expectPanic(t, func() { New(16).DeserializeAndReturnNextKey(buf) })
+}
@@ -8,6 +8,9 @@ package sectormap
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
 
 	"github.com/asch/bs3/internal/bs3/mapproxy"
 )
@@ -19,6 +22,10 @@ const (
 	typicalObjectPartsPerLookup = 64
 
 	notMappedKey = -1
+
+	// Identifier of the map stored in checkpoints. It is part of the format
+	// of checkpoints, hence it must not change.
+	mapType = "sectormap"
 )
 
 // Description of the sector. It provides information about corresponding
@@ -55,6 +62,29 @@ type SectorMap struct {
 	Sectors         []SectorMetadata
 	ObjUtilizations map[int64]int64
 	DeadObjs        map[int64]struct{}
+
+	// Number of data blocks of objects when they were created. Objects
+	// from checkpoints written before the sizes were recorded are missing.
+	ObjSizes map[int64]int64
+
+	// Bitmap of sectors changed since the last serialization. It is used
+	// for delta serialization and it is not serialized itself.
+	dirty []uint64
+
+	// Local copy of the map in the memory-mapped file, nil for maps kept
+	// only in memory.
+	local *local
+}
+
+// Delta of the map against its last serialization. It contains only changed
+// sectors but complete object utilizations and dead objects, since they are
+// small compared to the sectors.
+type sectorMapDelta struct {
+	Indices         []int64
+	Sectors         []SectorMetadata
+	ObjUtilizations map[int64]int64
+	DeadObjs        map[int64]struct{}
+	ObjSizes        map[int64]int64
 }
 
 // Returns new instance of the sector map. The map should not be used directly because it does not
@@ -72,6 +102,8 @@ func New(length int64) *SectorMap {
 		Sectors:         sectors,
 		ObjUtilizations: objectUtilization,
 		DeadObjs:        deadObjects,
+		ObjSizes:        make(map[int64]int64),
+		dirty:           make([]uint64, (length+63)/64),
 	}
 
 	return &s
@@ -79,14 +111,22 @@ func New(length int64) *SectorMap {
 
 // Updates sectors in the map with new values from extents. startOfDataSectors
 // is the first sector with data in the object and key is the key of the
-// object.
+// object. Discard extents have no data in the object.
 func (m *SectorMap) Update(extents []mapproxy.Extent, startOfDataSectors, key int64) {
+	m.invalidateLocal()
 	m.ObjUtilizations[key] = 0
 
+	var size int64
 	for _, e := range extents {
+		if e.Flag&mapproxy.FlagDiscard != 0 {
+			m.discardExtent(e)
+			continue
+		}
 		m.updateExtent(e, startOfDataSectors, key)
 		startOfDataSectors += e.Length
+		size += e.Length
 	}
+	m.ObjSizes[key] = size
 
 	// Because of GC we can add object which will never update the map
 	// because all write records are old
@@ -96,6 +136,44 @@ func (m *SectorMap) Update(extents []mapproxy.Extent, startOfDataSectors, key in
 	}
 }
 
+// Relocates extents copied by GC to the object with key. Extents are the ones
+// returned by FindExtentsWithKeys(), i.e. the object part has the logical
+// sector and the source key, while the extent has the source sector in the
+// object and the sequential number. Every sector is compared and swapped: it is
+// moved to the new object only when it still maps to the place it was copied
+// from with the same sequential number. Otherwise it was overwritten or
+// discarded in the meantime, the foreground write won and the copy is dead.
+// Returns the number of sectors which were not relocated.
+func (m *SectorMap) Relocate(extents []mapproxy.ExtentWithObjectPart, startOfDataSectors, key int64) int64 {
+	m.invalidateLocal()
+	m.ObjUtilizations[key] = 0
+
+	var size, lost int64
+	for _, e := range extents {
+		for i := int64(0); i < e.Extent.Length; i++ {
+			sector := e.ObjectPart.Sector + i
+			s := &m.Sectors[sector]
+			if s.Key != e.ObjectPart.Key || s.Sector != e.Extent.Sector+i || s.SeqNo != e.Extent.SeqNo {
+				lost++
+				continue
+			}
+
+			m.updateSector(key, s, startOfDataSectors+i, e.Extent)
+			m.markDirty(sector)
+		}
+		startOfDataSectors += e.Extent.Length
+		size += e.Extent.Length
+	}
+	m.ObjSizes[key] = size
+
+	if m.ObjUtilizations[key] == 0 {
+		delete(m.ObjUtilizations, key)
+		m.DeadObjs[key] = struct{}{}
+	}
+
+	return lost
+}
+
 // Updates the information about objects utilizations for given sector.
 func (m *SectorMap) updateUtilization(key int64, s *SectorMetadata) {
 	// Increment cannot be done at once because GC can
@@ -120,22 +198,62 @@ func (m *SectorMap) updateSector(key int64, s *SectorMetadata, targetSector int6
 	s.Flag = e.Flag
 }
 
+// Marks sector as changed since the last serialization.
+func (m *SectorMap) markDirty(sector int64) {
+	m.dirty[sector/64] |= 1 << uint(sector%64)
+}
+
+// Forgets all changes since the last serialization.
+func (m *SectorMap) clearDirty() {
+	for i := range m.dirty {
+		m.dirty[i] = 0
+	}
+}
+
 // Updates an extent. It checks whether the write is actually newer than write
-// already in the map. Like this we always keep the map consistent.
+// already in the map. Like this we always keep the map consistent. Sequential
+// numbers are stamped with the epoch of the run by the caller, hence they are
+// comparable also across restarts.
 func (m *SectorMap) updateExtent(e mapproxy.Extent, startOfDataSectors, key int64) {
 	targetSector := startOfDataSectors
 	for i := e.Sector; i < e.Sector+e.Length; i++ {
 		s := &m.Sectors[i]
 		if s.SeqNo <= e.SeqNo { // Equality because of GC
 			m.updateSector(key, s, targetSector, e)
+			m.markDirty(i)
 		}
 		targetSector++
 	}
 }
 
+// Unmaps sectors of the discarded extent and decrements utilization of their
+// objects. The discard has no sequential number from the kernel, hence it
+// applies to whatever is mapped and it bumps the sequential number of every
+// sector by one. The next write of the sector has at least the same number and
+// it is mapped again, while the discarded write moved by GC in the meantime
+// has a lower number and it is ignored.
+func (m *SectorMap) discardExtent(e mapproxy.Extent) {
+	for i := e.Sector; i < e.Sector+e.Length; i++ {
+		s := &m.Sectors[i]
+		if s.Key != notMappedKey {
+			m.ObjUtilizations[s.Key]--
+			if m.ObjUtilizations[s.Key] == 0 {
+				delete(m.ObjUtilizations, s.Key)
+				m.DeadObjs[s.Key] = struct{}{}
+			}
+		}
+
+		s.Sector = 0
+		s.Key = notMappedKey
+		s.SeqNo++
+		s.Flag = 0
+		m.markDirty(i)
+	}
+}
+
 // Returns longest possible extent in the object starting at startSector with
-// maximal length length. This means that the extent has the same key and
-// sequential number.
+// maximal length length. This means that the extent has the same key,
+// sequential number and flag.
 func (m *SectorMap) getExtent(startSector, length uint64) mapproxy.Extent {
 	s := m.Sectors[startSector]
 	e := mapproxy.Extent{
@@ -150,6 +268,7 @@ func (m *SectorMap) getExtent(startSector, length uint64) mapproxy.Extent {
 			i >= startSector+length ||
 			m.Sectors[i].Key != m.Sectors[i-1].Key ||
 			m.Sectors[i].SeqNo != e.SeqNo ||
+			m.Sectors[i].Flag != e.Flag ||
 			m.Sectors[i-1].Sector != m.Sectors[i].Sector-1 {
 
 			break
@@ -162,11 +281,21 @@ func (m *SectorMap) getExtent(startSector, length uint64) mapproxy.Extent {
 }
 
 // Returns all ObjectParts from which extent starting at sector with length
-// length can be reconstructed.
+// length can be reconstructed. Parts belonging to a single write carry its
+// flag. The extent is clamped to the map, hence parts cover only its portion
+// within the map.
 func (m *SectorMap) Lookup(sector, length int64) []mapproxy.ObjectPart {
 	parts := make([]mapproxy.ObjectPart, 0, typicalObjectPartsPerLookup)
+	if sector < 0 || sector >= int64(len(m.Sectors)) || length <= 0 {
+		return parts
+	}
+	if sector+length > int64(len(m.Sectors)) {
+		length = int64(len(m.Sectors)) - sector
+	}
+
 	s := m.Sectors[sector].Sector
 	l := int64(1)
+	single := true
 	for i := int64(1); i < length; i++ {
 		id := sector + i
 		// The next sector is not from the same extent. Store part into
@@ -175,31 +304,51 @@ func (m *SectorMap) Lookup(sector, length int64) []mapproxy.ObjectPart {
 			m.Sectors[id].Sector != m.Sectors[id-1].Sector+1) &&
 			(m.Sectors[id].Key != -1 || m.Sectors[id-1].Key != notMappedKey) {
 
-			parts = append(parts, mapproxy.ObjectPart{
-				Sector: s,
-				Length: l,
-				Key:    m.Sectors[id-1].Key,
-			})
+			parts = append(parts, m.objectPart(s, l, id-1, single))
 			s = m.Sectors[id].Sector
 			l = 1
+			single = true
 		} else {
 			l++
+			single = single &&
+				m.Sectors[id].SeqNo == m.Sectors[id-1].SeqNo &&
+				m.Sectors[id].Flag == m.Sectors[id-1].Flag
 		}
 	}
-	parts = append(parts, mapproxy.ObjectPart{
+	parts = append(parts, m.objectPart(s, l, sector+length-1, single))
+	return parts
+}
+
+// Returns ObjectPart starting at sector s with length l in the object of the
+// last sector of the part. The flag is set only if the part belongs to a
+// single write.
+func (m *SectorMap) objectPart(s, l, last int64, single bool) mapproxy.ObjectPart {
+	op := mapproxy.ObjectPart{
 		Sector: s,
 		Length: l,
-		Key:    m.Sectors[sector+length-1].Key,
-	})
-	return parts
+		Key:    m.Sectors[last].Key,
+	}
+	if single {
+		op.Flag = m.Sectors[last].Flag
+	}
+
+	return op
 }
 
 // Returns all extents and objectparts starting from sector with length length
-// that are stored in any of keys in keys.
+// that are stored in any of keys in keys. The range is clamped to the map like
+// in Lookup(), hence the last partial range of the device is scanned up to the
+// last sector and extents never reach past it.
 func (m *SectorMap) FindExtentsWithKeys(sector, length int64, keys map[int64]struct{}) []mapproxy.ExtentWithObjectPart {
 	ci := make([]mapproxy.ExtentWithObjectPart, 0, typicalObjectPartsPerLookup)
+	if sector < 0 || sector >= int64(len(m.Sectors)) || length <= 0 {
+		return ci
+	}
+	if sector+length > int64(len(m.Sectors)) {
+		length = int64(len(m.Sectors)) - sector
+	}
 
-	for i := sector; i < sector+length && i < int64(len(m.Sectors)); {
+	for i := sector; i < sector+length; {
 		key := m.Sectors[i].Key
 		_, ok := keys[key]
 		extent := m.getExtent(uint64(i), uint64(sector+length-i))
@@ -220,6 +369,35 @@ func (m *SectorMap) FindExtentsWithKeys(sector, length int64, keys map[int64]str
 	return ci
 }
 
+// Returns all extents of the range starting at sector with length length,
+// including unmapped ones, in the sector order. Extent is the logical extent and
+// object part is where it is stored. Extents are the longest runs of the same
+// key, sequential number and flag with contiguous sectors in the object.
+func (m *SectorMap) Extents(sector, length int64) []mapproxy.ExtentWithObjectPart {
+	extents := make([]mapproxy.ExtentWithObjectPart, 0, typicalObjectPartsPerLookup)
+
+	for i := sector; i < sector+length && i < int64(len(m.Sectors)); {
+		e := m.getExtent(uint64(i), uint64(sector+length-i))
+		extents = append(extents, mapproxy.ExtentWithObjectPart{
+			Extent: mapproxy.Extent{
+				Sector: i,
+				Length: e.Length,
+				SeqNo:  e.SeqNo,
+				Flag:   e.Flag,
+			},
+			ObjectPart: mapproxy.ObjectPart{
+				Sector: e.Sector,
+				Length: e.Length,
+				Key:    m.Sectors[i].Key,
+				Flag:   e.Flag,
+			},
+		})
+		i += e.Length
+	}
+
+	return extents
+}
+
 // Returns copy of deadObjects. These are objects with no valid data which can
 // be deleted.
 func (m *SectorMap) DeadObjects() map[int64]struct{} {
@@ -256,22 +434,177 @@ func (m *SectorMap) ObjectsUtilization() map[int64]int64 {
 	return objectUtilization
 }
 
-// Returns serialized version of the map with go gobs.
+// Returns number of objects with non-dead sectors.
+func (m *SectorMap) LiveObjects() int64 {
+	return int64(len(m.ObjUtilizations))
+}
+
+// Returns copy of sizes of live objects in blocks. Objects with unknown size
+// are missing.
+func (m *SectorMap) ObjectSizes() map[int64]int64 {
+	sizes := make(map[int64]int64)
+
+	for k := range m.ObjUtilizations {
+		if size, ok := m.ObjSizes[k]; ok {
+			sizes[k] = size
+		}
+	}
+
+	return sizes
+}
+
+// Returns copy of sizes of dead objects in blocks. Objects with unknown size
+// are missing.
+func (m *SectorMap) DeadObjectSizes() map[int64]int64 {
+	sizes := make(map[int64]int64)
+
+	for k := range m.DeadObjs {
+		if size, ok := m.ObjSizes[k]; ok {
+			sizes[k] = size
+		}
+	}
+
+	return sizes
+}
+
+// Returns summary of the map. It is a full scan of the map.
+func (m *SectorMap) Summary() mapproxy.Summary {
+	s := mapproxy.Summary{
+		MaxKey:      m.GetMaxKey(),
+		LiveObjects: int64(len(m.ObjUtilizations)),
+		DeadObjects: int64(len(m.DeadObjs)),
+	}
+
+	for i := range m.Sectors {
+		if m.Sectors[i].Key != notMappedKey {
+			s.Sectors++
+		}
+	}
+
+	for _, u := range m.ObjUtilizations {
+		s.Utilization += u
+	}
+
+	return s
+}
+
+// Returns serialized version of the map with go gobs. The accounting of objects
+// and the sectors are separate sections, see encodeSections().
 func (m *SectorMap) Serialize() []byte {
-	var buf bytes.Buffer
+	buf := encodeSections(m.accounting(), m.Sectors)
+	m.clearDirty()
+	m.markLocalClean()
+
+	return buf
+}
+
+// Returns accounting of objects of the map. The maps are shared with the map.
+func (m *SectorMap) accounting() *Accounting {
+	return &Accounting{
+		ObjUtilizations: m.ObjUtilizations,
+		DeadObjs:        m.DeadObjs,
+		ObjSizes:        m.ObjSizes,
+	}
+}
+
+// Returns serialized delta of the map against the last serialization, i.e.
+// sectors changed since then. Returns nil when more than a quarter of sectors
+// changed, since the full serialization is cheaper then.
+func (m *SectorMap) SerializeDelta() []byte {
+	d := sectorMapDelta{
+		Indices:         make([]int64, 0),
+		Sectors:         make([]SectorMetadata, 0),
+		ObjUtilizations: m.ObjUtilizations,
+		DeadObjs:        m.DeadObjs,
+		ObjSizes:        m.ObjSizes,
+	}
+
+	for w, bits := range m.dirty {
+		for bit := 0; bits != 0; bit, bits = bit+1, bits>>1 {
+			if bits&1 == 0 {
+				continue
+			}
+
+			i := int64(w*64 + bit)
+			d.Indices = append(d.Indices, i)
+			d.Sectors = append(d.Sectors, m.Sectors[i])
+		}
+
+		if len(d.Indices) > len(m.Sectors)/4 {
+			return nil
+		}
+	}
+
+	buf := encodeSections(m.accounting(), &deltaSectors{d.Indices, d.Sectors})
+	m.clearDirty()
+	m.markLocalClean()
+
+	return buf
+}
+
+// Applies delta serialized by SerializeDelta() on top of the map. Deltas have
+// to be applied in the same order as they were serialized. Sectors out of the
+// map, i.e. when the device was shrinked, are skipped. Sequential numbers are
+// zeroed as in DeserializeAndReturnNextKey(). Panics when the accounting cannot
+// be decoded or the layout of sectors is not supported, see sectorLayout.
+func (m *SectorMap) DeserializeDelta(buf []byte) {
+	m.invalidateLocal()
+
+	var d sectorMapDelta
+
+	if _, sectors, layout, ok := splitSections(buf); ok {
+		a, err := LoadAccounting(buf)
+		if err != nil {
+			log.Panic().Err(err).Msg("Delta of the map cannot be deserialized.")
+		}
+		var s deltaSectors
+		if err := decodeSectors(sectors, layout, &s.Indices, &s.Sectors); err != nil {
+			log.Panic().Err(err).Msg("Delta of the map cannot be deserialized.")
+		}
+		d = sectorMapDelta{s.Indices, s.Sectors, a.ObjUtilizations, a.DeadObjs, a.ObjSizes}
+	} else {
+		gob.NewDecoder(bytes.NewReader(buf)).Decode(&d)
+	}
 
-	encoder := gob.NewEncoder(&buf)
-	encoder.Encode(m)
+	for j, i := range d.Indices {
+		if i >= int64(len(m.Sectors)) {
+			continue
+		}
+		m.Sectors[i] = d.Sectors[j]
+		m.Sectors[i].SeqNo = 0
+	}
+
+	m.ObjUtilizations = d.ObjUtilizations
+	m.DeadObjs = d.DeadObjs
+	m.ObjSizes = d.ObjSizes
 
-	return buf.Bytes()
+	m.initMaps()
+}
+
+// Allocates maps of objects which were not present in the decoded checkpoint,
+// since gob does not transmit empty maps.
+func (m *SectorMap) initMaps() {
+	if m.ObjUtilizations == nil {
+		m.ObjUtilizations = make(map[int64]int64)
+	}
+	if m.DeadObjs == nil {
+		m.DeadObjs = make(map[int64]struct{})
+	}
+	if m.ObjSizes == nil {
+		m.ObjSizes = make(map[int64]int64)
+	}
 }
 
 // Deserialized map from buf which was previously serialized by Serialize(). It
 // restored map and structures representing object utilization and dead
 // objects. During deserialization all sequential numbers are zeroed because
 // most they are not needed and most probably BUSE starts from 0 since it was
-// restarted. The map supports device size change.
+// restarted. The map supports device size change. Panics when the accounting
+// cannot be decoded or the layout of sectors is not supported, see
+// sectorLayout.
 func (m *SectorMap) DeserializeAndReturnNextKey(buf []byte) int64 {
+	m.invalidateLocal()
+
 	// Size of the allocated map
 	intendedSize := len(m.Sectors)
 
@@ -280,8 +613,28 @@ func (m *SectorMap) DeserializeAndReturnNextKey(buf []byte) int64 {
 	//    intended size.
 	// 2) In case of larger checkpointed map, i.e. we shrinked the device,
 	//    the map would be enlarged and we need to resize it to its inteded size.
-	decoder := gob.NewDecoder(bytes.NewReader(buf))
-	decoder.Decode(m)
+	//
+	// Gob does not transmit zero values and decoding into existing sectors
+	// keeps their current values, hence the sectors have to be zeroed
+	// first. Otherwise sectors of the object with key 0 would stay not
+	// mapped.
+	for i := range m.Sectors {
+		m.Sectors[i] = SectorMetadata{}
+	}
+
+	if _, sectors, layout, ok := splitSections(buf); ok {
+		a, err := LoadAccounting(buf)
+		if err != nil {
+			log.Panic().Err(err).Msg("Map cannot be deserialized.")
+		}
+		m.ObjUtilizations, m.DeadObjs, m.ObjSizes = a.ObjUtilizations, a.DeadObjs, a.ObjSizes
+		if err := decodeSectors(sectors, layout, nil, &m.Sectors); err != nil {
+			log.Panic().Err(err).Msg("Map cannot be deserialized.")
+		}
+	} else {
+		gob.NewDecoder(bytes.NewReader(buf)).Decode(m)
+	}
+	decodedSize := len(m.Sectors)
 
 	if intendedSize < len(m.Sectors) {
 		// Create new map with smaller size and copy the intended range
@@ -296,6 +649,9 @@ func (m *SectorMap) DeserializeAndReturnNextKey(buf []byte) int64 {
 		// one and it the len was set according to the decoded
 		// (smaller) map. We just change len to its full size.
 		m.Sectors = m.Sectors[:cap(m.Sectors)]
+		for i := decodedSize; i < len(m.Sectors); i++ {
+			m.Sectors[i].Key = notMappedKey
+		}
 	}
 
 	var maxKey int64 = notMappedKey
@@ -309,9 +665,125 @@ func (m *SectorMap) DeserializeAndReturnNextKey(buf []byte) int64 {
 		m.Sectors[i].SeqNo = 0
 	}
 
+	m.initMaps()
+	m.remapLocal()
+
 	return maxKey + 1
 }
 
+// Verifies consistency of the map, e.g. after it was restored from a possibly
+// corrupted checkpoint. Mapped sectors have to point into the data part of the
+// object, i.e. between first and end, and within the recorded object size.
+// Returns error when they do not, since such mapping cannot be repaired.
+// Object utilizations and dead objects are recomputed from the sectors and
+// the number of objects whose accounting was repaired is returned.
+func (m *SectorMap) Verify(first, end int64) (int64, error) {
+	utilization := make(map[int64]int64)
+
+	for i, s := range m.Sectors {
+		if s.Key == notMappedKey {
+			continue
+		}
+
+		if s.Key < 0 || s.Sector < first || s.Sector >= end {
+			return 0, fmt.Errorf("sector %d is mapped to sector %d of object %d out of its data", i, s.Sector, s.Key)
+		}
+		if size, ok := m.ObjSizes[s.Key]; ok && s.Sector >= first+size {
+			return 0, fmt.Errorf("sector %d is mapped to sector %d of object %d with %d blocks of data", i, s.Sector, s.Key, size)
+		}
+
+		utilization[s.Key]++
+	}
+
+	repaired := make(map[int64]struct{})
+	for k, u := range m.ObjUtilizations {
+		if utilization[k] != u {
+			repaired[k] = struct{}{}
+		}
+		if _, ok := utilization[k]; !ok {
+			m.DeadObjs[k] = struct{}{}
+		}
+	}
+	for k, u := range utilization {
+		if m.ObjUtilizations[k] != u {
+			repaired[k] = struct{}{}
+		}
+		if _, ok := m.DeadObjs[k]; ok {
+			delete(m.DeadObjs, k)
+			repaired[k] = struct{}{}
+		}
+	}
+	m.ObjUtilizations = utilization
+
+	return int64(len(repaired)), nil
+}
+
+// Returns identifier of the map, which checkpoints of the map are tagged by.
+func (m *SectorMap) Type() string {
+	return mapType
+}
+
+// Returns new empty map of the same size. It is used as a staging map for lazy
+// restore of the checkpoint.
+func (m *SectorMap) Empty() mapproxy.ExtentMapper {
+	return New(int64(len(m.Sectors)))
+}
+
+// Discards all the mapping. All sectors are marked dirty, since every one of
+// them possibly changed since the last checkpoint.
+func (m *SectorMap) Reset() {
+	m.invalidateLocal()
+	for i := range m.Sectors {
+		m.Sectors[i] = SectorMetadata{Key: notMappedKey}
+	}
+	for i := range m.dirty {
+		m.dirty[i] = ^uint64(0)
+	}
+
+	m.ObjUtilizations = make(map[int64]int64)
+	m.DeadObjs = make(map[int64]struct{})
+	m.ObjSizes = make(map[int64]int64)
+}
+
+// Copies sectors starting from sector with length length from the checkpoint
+// map, which has to be SectorMap. Only sectors which are not mapped are
+// copied, because every mapped sector was written after the checkpoint and
+// hence it is newer.
+func (m *SectorMap) Warm(checkpoint mapproxy.ExtentMapper, sector, length int64) {
+	c := checkpoint.(*SectorMap)
+	m.invalidateLocal()
+
+	for i := sector; i < sector+length && i < int64(len(m.Sectors)); i++ {
+		s := &m.Sectors[i]
+		if s.Key != notMappedKey || c.Sectors[i].Key == notMappedKey {
+			continue
+		}
+
+		*s = c.Sectors[i]
+		m.ObjUtilizations[s.Key]++
+	}
+}
+
+// Finishes warming of the map from the checkpoint map. Objects from the
+// checkpoint which did not get any sector were completely overwritten in the
+// meantime and hence they are dead. Dead objects from the checkpoint are still
+// dead.
+func (m *SectorMap) WarmFinish(checkpoint mapproxy.ExtentMapper) {
+	c := checkpoint.(*SectorMap)
+
+	for k := range c.ObjUtilizations {
+		if _, ok := m.ObjUtilizations[k]; !ok {
+			m.DeadObjs[k] = struct{}{}
+		} else if size, ok := c.ObjSizes[k]; ok {
+			m.ObjSizes[k] = size
+		}
+	}
+
+	for k := range c.DeadObjs {
+		m.DeadObjs[k] = struct{}{}
+	}
+}
+
 // Deletes objects with keys from object utilizations.
 func (m *SectorMap) DeleteFromUtilization(keys map[int64]struct{}) {
 	for k := range keys {
@@ -319,12 +791,14 @@ func (m *SectorMap) DeleteFromUtilization(keys map[int64]struct{}) {
 	}
 }
 
-// Deletes objects with keys from deadObjects from dead objects.
+// Deletes objects with keys from deadObjects from dead objects. They are
+// deleted from the backend, hence their sizes are forgotten too.
 func (m *SectorMap) DeleteFromDeadObjects(deadObjects map[int64]struct{}) {
 	for k := range deadObjects {
 		_, ok := m.DeadObjs[k]
 		if ok {
 			delete(m.DeadObjs, k)
+			delete(m.ObjSizes, k)
 		}
 	}
 }
@@ -0,0 +1,98 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package sectormap
+
+import (
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+func TestFindExtentsWithKeysEnd(t *testing.T) {
+	m := New(10)
+	m.Update([]mapproxy.Extent{{Sector: 8, Length: 2, SeqNo: 1}}, 0, 1)
+	keys := map[int64]struct{}{1: {}}
+
+	tests := []struct {
+		sector, length int64
+		found          int64
+	}{
+		{0, 10, 2},
+		{6, 3, 1},
+		{6, 8, 2},
+		{9, 4, 1},
+		{10, 4, 0},
+	}
+	for _, tt := range tests {
+		var found int64
+		for _, e := range m.FindExtentsWithKeys(tt.sector, tt.length, keys) {
+			if e.ObjectPart.Sector < tt.sector || e.ObjectPart.Sector+e.Extent.Length > 10 {
+				t.Fatalf("range %d+%d returned extent %+v out of the range", tt.sector, tt.length, e)
+			}
+			found += e.Extent.Length
+		}
+		if found != tt.found {
+			t.Fatalf("range %d+%d found %d blocks, want %d", tt.sector, tt.length, found, tt.found)
+		}
+	}
+}
+
+func TestLookupClamped(t *testing.T) {
+	m := New(10)
+	m.Update([]mapproxy.Extent{{Sector: 8, Length: 2, SeqNo: 1}}, 0, 1)
+
+	tests := []struct {
+		sector, length int64
+		found          int64
+	}{
+		{8, 2, 2},
+		{8, 5, 2},
+		{0, 100, 10},
+		{10, 1, 0},
+		{-1, 2, 0},
+	}
+	for _, tt := range tests {
+		var found int64
+		for _, p := range m.Lookup(tt.sector, tt.length) {
+			found += p.Length
+		}
+		if found != tt.found {
+			t.Fatalf("lookup of %d+%d returned %d blocks, want %d", tt.sector, tt.length, found, tt.found)
+		}
+	}
+}
+
+func TestRelocateComparesAndSwaps(t *testing.T) {
+	m := New(10)
+	m.Update([]mapproxy.Extent{{Sector: 0, Length: 4, SeqNo: 1}}, 0, 1)
+	keys := map[int64]struct{}{1: {}}
+	copied := m.FindExtentsWithKeys(0, 10, keys)
+
+	// Block 1 is overwritten after the copy and block 2 is discarded.
+	m.Update([]mapproxy.Extent{{Sector: 1, Length: 1, SeqNo: 2}}, 0, 2)
+	m.Update([]mapproxy.Extent{{Sector: 2, Length: 1, SeqNo: 3, Flag: mapproxy.FlagDiscard}}, 0, 3)
+
+	if lost := m.Relocate(copied, 0, 4); lost != 2 {
+		t.Fatalf("relocation lost %d blocks, want 2", lost)
+	}
+	for i, want := range []int64{4, 2, notMappedKey, 4} {
+		if m.Sectors[i].Key != want {
+			t.Fatalf("block %d is in object %d, want %d", i, m.Sectors[i].Key, want)
+		}
+	}
+	if _, ok := m.ObjUtilizations[1]; ok {
+		t.Fatal("source object is alive after the relocation")
+	}
+	if m.ObjUtilizations[4] != 2 {
+		t.Fatalf("new object has %d live blocks, want 2", m.ObjUtilizations[4])
+	}
+
+	// The second copy of the same blocks is dead at once, since they were
+	// moved by the first one.
+	if lost := m.Relocate(copied, 0, 5); lost != 4 {
+		t.Fatalf("second relocation lost %d blocks, want 4", lost)
+	}
+	if _, ok := m.DeadObjs[5]; !ok {
+		t.Fatal("object without relocated blocks is not dead")
+	}
+}
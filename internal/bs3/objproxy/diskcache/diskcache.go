@@ -0,0 +1,662 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package diskcache implements ObjectUploadDownloaderAt decorator which keeps
+// blocks downloaded from the backend in a local directory, so they are not
+// downloaded again, even after a restart of the daemon.
+//
+// Every object has its own sparse file named by the key of the object, where
+// the blocks are stored at their offsets in the object. Blocks are units of
+// the block size starting at the offset in the object, e.g. the sealed
+// segments after the header of encrypted objects, so the cache below the
+// encryption keeps ciphertext only. The index tracks which
+// blocks of which objects are cached and their recency. It is persisted to the
+// directory periodically, after the data it references are synced. Files not
+// referenced by the index are removed when the cache is opened, hence data
+// cached after the last save are lost on crash, but they are never trusted.
+//
+// Objects are immutable, except that a key can be uploaded again, e.g. an
+// empty object replaces the dead one or keys after the prefix gap are reused
+// after a crash. All uploads go through the decorator, which drops the object
+// from the cache and persists the index before the upload. It drops the object
+// again after the upload, so the data of the previous object downloaded
+// meanwhile are not cached. Blocks of the object downloaded while it is
+// dropped are not cached, since they can be the old ones. Objects kept from
+// the previous run are verified once by their size and incarnation before
+// they are used, which catches keys changed by somebody else in the meantime.
+package diskcache
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"errors"
+	"expvar"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+const (
+	// Name of the index file in the cache directory.
+	indexName = "index"
+
+	// Version of the index layout. Index of other version is discarded
+	// together with the cached data.
+	indexVersion = 2
+
+	// Period of saving the index when it changed.
+	saveInterval = 10 * time.Second
+)
+
+// Statistics of all disk caches, published under "diskcache" in the metrics.
+var metrics = expvar.NewMap("diskcache")
+
+// Cached object. Exported fields are persisted in the index.
+type entry struct {
+	Key int64
+
+	// Size and incarnation of the object when it was cached, used for the
+	// verification after restart.
+	Size        int64
+	Incarnation int64
+
+	// Bitmap of cached blocks.
+	Blocks []uint64
+
+	// Number of cached blocks.
+	Cached int64
+
+	// Entries loaded from the index are verified before the first use.
+	verified bool
+
+	element *list.Element
+}
+
+// Returns true when all n blocks starting at first are cached.
+func (e *entry) has(first, n int64) bool {
+	for i := first; i < first+n; i++ {
+		if i/64 >= int64(len(e.Blocks)) || e.Blocks[i/64]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Marks n blocks starting at first as cached. Returns number of newly cached
+// blocks.
+func (e *entry) add(first, n int64) int64 {
+	var added int64
+	for i := first; i < first+n; i++ {
+		for i/64 >= int64(len(e.Blocks)) {
+			e.Blocks = append(e.Blocks, 0)
+		}
+		if e.Blocks[i/64]&(1<<(i%64)) == 0 {
+			e.Blocks[i/64] |= 1 << (i % 64)
+			added++
+		}
+	}
+	e.Cached += added
+
+	return added
+}
+
+// Persisted index. Entries are ordered from the most recently used.
+type index struct {
+	Version   int
+	Identity  string
+	BlockSize int
+	Offset    int64
+	Entries   []*entry
+}
+
+// Downloads of one object from the backend in flight.
+type flight struct {
+	downloads int
+
+	// Increased when the object is dropped from the cache. Downloads
+	// started before store nothing.
+	generation uint64
+}
+
+// Disk cache decorator.
+type DiskCache struct {
+	backend   objproxy.ObjectUploadDownloaderAt
+	dir       string
+	blockSize int64
+	offset    int64
+	capacity  int64
+	identity  string
+
+	mutex   sync.Mutex
+	entries map[int64]*entry
+	lru     *list.List
+	size    int64
+
+	// Objects with data written since the last save and whether the index
+	// changed since then.
+	dirty   map[int64]struct{}
+	changed bool
+
+	// Downloads in flight by the key of the object.
+	flights map[int64]*flight
+
+	// Held for reading by stores of downloaded blocks and for writing by
+	// drops of objects, so no store is between the check of its
+	// generation and the insertion of its blocks when the object is
+	// dropped.
+	dropping sync.RWMutex
+
+	// Serializes saves of the index.
+	saving sync.Mutex
+
+	bytes     *expvar.Int
+	hits      *expvar.Int
+	misses    *expvar.Int
+	evictions *expvar.Int
+}
+
+// Options to use in New() function.
+type Options struct {
+	Backend objproxy.ObjectUploadDownloaderAt
+
+	// Directory of the cache. It is created when it does not exist.
+	Dir string
+
+	// Size of cached blocks, e.g. the block size of the volume or the size
+	// of sealed segments of encrypted objects.
+	BlockSize int
+
+	// Offset of the first block in objects, e.g. the size of the header
+	// of encrypted objects.
+	Offset int64
+
+	// Maximal size of cached data in bytes.
+	Capacity int64
+
+	// Name of the cache in the metrics, e.g. the bucket and the name
+	// prefix.
+	Name string
+
+	// Identity of the objects in the index, e.g. the endpoint, the bucket,
+	// the name prefix, the key base and the volume ID. Cache of other
+	// identity found in the directory is discarded.
+	Identity string
+}
+
+// Opens the cache in the directory. Cached data are kept when the index in the
+// directory belongs to the same identity, block size and offset.
+func New(o Options) (*DiskCache, error) {
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		backend:   o.Backend,
+		dir:       o.Dir,
+		blockSize: int64(o.BlockSize),
+		offset:    o.Offset,
+		capacity:  o.Capacity,
+		identity:  o.Identity,
+		entries:   make(map[int64]*entry),
+		flights:   make(map[int64]*flight),
+		lru:       list.New(),
+		dirty:     make(map[int64]struct{}),
+		bytes:     new(expvar.Int),
+		hits:      new(expvar.Int),
+		misses:    new(expvar.Int),
+		evictions: new(expvar.Int),
+	}
+
+	c.load()
+	if err := c.removeUnreferenced(); err != nil {
+		return nil, err
+	}
+	c.evict(c.capacity)
+
+	stats := new(expvar.Map).Init()
+	stats.Set("bytes", c.bytes)
+	stats.Set("hits", c.hits)
+	stats.Set("misses", c.misses)
+	stats.Set("evictions", c.evictions)
+	metrics.Set(o.Name, stats)
+
+	log.Info().Msgf("Disk cache %s opened with %d objects and %d bytes.", o.Dir, len(c.entries), c.size)
+
+	go c.saver()
+
+	return c, nil
+}
+
+// Drops the object from the cache, uploads it and drops it again.
+func (c *DiskCache) Upload(key int64, buf []byte, source objproxy.Source) error {
+	matches := func(k int64) bool { return k == key }
+	if err := c.invalidate(matches); err != nil {
+		return err
+	}
+
+	if err := c.backend.Upload(key, buf, source); err != nil {
+		return err
+	}
+
+	return c.invalidate(matches)
+}
+
+// Downloads data from the cache when all requested blocks are cached,
+// otherwise from the backend and the blocks are cached. Requests not aligned
+// to blocks and checkpoints, whose keys are reused, bypass the cache.
+func (c *DiskCache) DownloadAt(key int64, buf []byte, offset int64) error {
+	offset -= c.offset
+	if key < 0 || len(buf) == 0 || offset < 0 || offset%c.blockSize != 0 || int64(len(buf))%c.blockSize != 0 {
+		return c.backend.DownloadAt(key, buf, offset+c.offset)
+	}
+
+	first := offset / c.blockSize
+	n := int64(len(buf)) / c.blockSize
+
+	if c.read(key, buf, first, n) {
+		c.hits.Add(1)
+		return nil
+	}
+	c.misses.Add(1)
+
+	generation := c.startFlight(key)
+	defer c.endFlight(key)
+
+	if err := c.backend.DownloadAt(key, buf, offset+c.offset); err != nil {
+		return err
+	}
+
+	c.store(key, buf, first, n, generation)
+
+	return nil
+}
+
+// Registers the download of the object key in flight and returns its current
+// generation.
+func (c *DiskCache) startFlight(key int64) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	f, ok := c.flights[key]
+	if !ok {
+		f = new(flight)
+		c.flights[key] = f
+	}
+	f.downloads++
+
+	return f.generation
+}
+
+// Unregisters the download of the object key in flight.
+func (c *DiskCache) endFlight(key int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	f := c.flights[key]
+	if f.downloads--; f.downloads == 0 {
+		delete(c.flights, key)
+	}
+}
+
+func (c *DiskCache) GetObjectSize(key int64) (int64, error) {
+	return c.backend.GetObjectSize(key)
+}
+
+func (c *DiskCache) GetObjectInfo(key int64) (int64, int64, error) {
+	return c.backend.GetObjectInfo(key)
+}
+
+func (c *DiskCache) SetIncarnation(incarnation int64) {
+	c.backend.SetIncarnation(incarnation)
+}
+
+// Sets the timeout at the backend. Reads of cached blocks are local, hence
+// they have no timeout.
+func (c *DiskCache) SetTimeout(timeout time.Duration) {
+	c.backend.SetTimeout(timeout)
+}
+
+// Drops the object and all its successors from the cache and deletes them.
+func (c *DiskCache) DeleteKeyAndSuccessors(key int64) error {
+	if err := c.invalidate(func(k int64) bool { return k >= key }); err != nil {
+		return err
+	}
+
+	return c.backend.DeleteKeyAndSuccessors(key)
+}
+
+func (c *DiskCache) ListKeys(fn func(key, size int64) bool) error {
+	return c.backend.ListKeys(fn)
+}
+
+// Reads n cached blocks of the object key starting at first into buf. Returns
+// false when any of them is not cached or the object failed verification.
+func (c *DiskCache) read(key int64, buf []byte, first, n int64) bool {
+	c.mutex.Lock()
+	e, ok := c.entries[key]
+	if !ok || !e.has(first, n) {
+		c.mutex.Unlock()
+		return false
+	}
+	c.lru.MoveToFront(e.element)
+	verified := e.verified
+	c.mutex.Unlock()
+
+	if !verified && !c.verify(e) {
+		return false
+	}
+
+	f, err := os.Open(c.path(key))
+	if err == nil {
+		_, err = f.ReadAt(buf, first*c.blockSize)
+		f.Close()
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Reading of object %d from the disk cache failed.", key)
+		c.drop(e)
+		return false
+	}
+
+	return true
+}
+
+// Verifies the entry loaded from the index against the backend. The entry is
+// dropped when the object changed.
+func (c *DiskCache) verify(e *entry) bool {
+	size, incarnation, err := c.backend.GetObjectInfo(e.Key)
+	if err != nil || size != e.Size || incarnation != e.Incarnation {
+		log.Debug().Msgf("Object %d changed since it was cached. Dropped from the disk cache.", e.Key)
+		c.drop(e)
+		return false
+	}
+
+	c.mutex.Lock()
+	e.verified = true
+	c.mutex.Unlock()
+
+	return true
+}
+
+// Stores n blocks of the object key starting at first from buf downloaded in
+// the generation of the object. Nothing is stored when the object was dropped
+// since then. Failures are only logged, since the data were already
+// downloaded.
+func (c *DiskCache) store(key int64, buf []byte, first, n int64, generation uint64) {
+	c.mutex.Lock()
+	_, ok := c.entries[key]
+	c.mutex.Unlock()
+
+	var size, incarnation int64
+	if !ok {
+		var err error
+		size, incarnation, err = c.backend.GetObjectInfo(key)
+		if err != nil {
+			return
+		}
+	}
+
+	c.dropping.RLock()
+	defer c.dropping.RUnlock()
+
+	c.mutex.Lock()
+	current := c.flights[key].generation
+	c.mutex.Unlock()
+	if current != generation {
+		return
+	}
+
+	f, err := os.OpenFile(c.path(key), os.O_WRONLY|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.WriteAt(buf, first*c.blockSize)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Writing of object %d to the disk cache failed.", key)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		e = &entry{Key: key, Size: size, Incarnation: incarnation, verified: true}
+		e.element = c.lru.PushFront(e)
+		c.entries[key] = e
+	}
+	c.lru.MoveToFront(e.element)
+	c.size += e.add(first, n) * c.blockSize
+	c.dirty[key] = struct{}{}
+	c.changed = true
+
+	c.evict(c.capacity)
+}
+
+// Evicts the least recently used objects until the size of cached data is at
+// most target. Must be called with mutex held.
+func (c *DiskCache) evict(target int64) {
+	for c.size > target {
+		e := c.lru.Back().Value.(*entry)
+		c.remove(e)
+		c.evictions.Add(1)
+	}
+
+	c.bytes.Set(c.size)
+}
+
+// Removes the entry and its file. Must be called with mutex held.
+func (c *DiskCache) remove(e *entry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.Key)
+	delete(c.dirty, e.Key)
+	c.size -= e.Cached * c.blockSize
+	c.changed = true
+
+	os.Remove(c.path(e.Key))
+}
+
+// Removes the entry unless it was already removed or replaced.
+func (c *DiskCache) drop(e *entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries[e.Key] == e {
+		c.remove(e)
+		c.bytes.Set(c.size)
+	}
+}
+
+// Removes all objects with keys matching fn and saves the index, so the
+// objects are not used after restart even when the daemon crashes right
+// after their upload. Downloads of the objects in flight store nothing.
+func (c *DiskCache) invalidate(fn func(key int64) bool) error {
+	c.dropping.Lock()
+	c.mutex.Lock()
+	for k, f := range c.flights {
+		if fn(k) {
+			f.generation++
+		}
+	}
+	removed := false
+	for k, e := range c.entries {
+		if fn(k) {
+			c.remove(e)
+			removed = true
+		}
+	}
+	c.bytes.Set(c.size)
+	c.mutex.Unlock()
+	c.dropping.Unlock()
+
+	if !removed {
+		return nil
+	}
+
+	return c.save()
+}
+
+// Periodically saves the index when it changed.
+func (c *DiskCache) saver() {
+	for range time.Tick(saveInterval) {
+		c.mutex.Lock()
+		changed := c.changed
+		c.mutex.Unlock()
+
+		if changed {
+			if err := c.save(); err != nil {
+				log.Warn().Err(err).Msg("Saving of the disk cache index failed.")
+			}
+		}
+	}
+}
+
+// Syncs data written since the last save and atomically replaces the index.
+func (c *DiskCache) save() error {
+	c.saving.Lock()
+	defer c.saving.Unlock()
+
+	c.mutex.Lock()
+	idx := index{
+		Version:   indexVersion,
+		Identity:  c.identity,
+		BlockSize: int(c.blockSize),
+		Offset:    c.offset,
+		Entries:   make([]*entry, 0, len(c.entries)),
+	}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := *el.Value.(*entry)
+		e.Blocks = append([]uint64(nil), e.Blocks...)
+		idx.Entries = append(idx.Entries, &e)
+	}
+	dirty := c.dirty
+	c.dirty = make(map[int64]struct{})
+	c.changed = false
+	c.mutex.Unlock()
+
+	for k := range dirty {
+		if err := syncFile(c.path(k)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.markDirty(dirty)
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&idx); err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dir, indexName)
+	if err := writeFileSync(path+".tmp", buf.Bytes()); err != nil {
+		c.markDirty(dirty)
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		c.markDirty(dirty)
+		return err
+	}
+
+	return syncFile(c.dir)
+}
+
+// Returns objects back to the dirty ones after failed save.
+func (c *DiskCache) markDirty(dirty map[int64]struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k := range dirty {
+		if _, ok := c.entries[k]; ok {
+			c.dirty[k] = struct{}{}
+		}
+	}
+	c.changed = true
+}
+
+// Loads the index from the directory. Missing, invalid or foreign index means
+// an empty cache.
+func (c *DiskCache) load() {
+	buf, err := os.ReadFile(filepath.Join(c.dir, indexName))
+	if err != nil {
+		return
+	}
+
+	var idx index
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&idx); err != nil {
+		log.Warn().Err(err).Msgf("Disk cache index in %s is invalid. Cache is emptied.", c.dir)
+		return
+	}
+
+	if idx.Version != indexVersion || idx.Identity != c.identity || int64(idx.BlockSize) != c.blockSize || idx.Offset != c.offset {
+		log.Info().Msgf("Disk cache in %s belongs to %s with block size %d at offset %d. Cache is emptied.",
+			c.dir, idx.Identity, idx.BlockSize, idx.Offset)
+		return
+	}
+
+	for _, e := range idx.Entries {
+		e.element = c.lru.PushBack(e)
+		c.entries[e.Key] = e
+		c.size += e.Cached * c.blockSize
+	}
+}
+
+// Removes files which are not referenced by the index.
+func (c *DiskCache) removeUnreferenced() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.Name() == indexName {
+			continue
+		}
+		key, err := strconv.ParseInt(f.Name(), 10, 64)
+		if _, ok := c.entries[key]; err != nil || !ok {
+			os.Remove(filepath.Join(c.dir, f.Name()))
+		}
+	}
+
+	return nil
+}
+
+// Returns path of the file of the object key.
+func (c *DiskCache) path(key int64) string {
+	return filepath.Join(c.dir, strconv.FormatInt(key, 10))
+}
+
+// Writes data to the file at path and syncs it.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Syncs the file or the directory at path.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
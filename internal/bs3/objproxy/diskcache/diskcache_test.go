@@ -0,0 +1,149 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package diskcache
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+const testBlockSize = 16
+
+// Memory backend counting downloads. Downloads wait for the release when
+// downloaded is set.
+type testBackend struct {
+	*memory.Memory
+
+	downloads  int64
+	downloaded chan struct{}
+	release    chan struct{}
+}
+
+func (b *testBackend) DownloadAt(key int64, buf []byte, offset int64) error {
+	atomic.AddInt64(&b.downloads, 1)
+	err := b.Memory.DownloadAt(key, buf, offset)
+	if b.downloaded != nil {
+		b.downloaded <- struct{}{}
+		<-b.release
+	}
+
+	return err
+}
+
+// Returns the cache in dir over backend with identity.
+func newTestCache(t *testing.T, backend objproxy.ObjectUploadDownloaderAt, dir, identity string, offset int64) *DiskCache {
+	t.Helper()
+
+	c, err := New(Options{
+		Backend:   backend,
+		Dir:       dir,
+		BlockSize: testBlockSize,
+		Offset:    offset,
+		Capacity:  1 << 20,
+		Name:      t.Name(),
+		Identity:  identity,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// Downloads n blocks of the object key at offset from c and fails the test
+// when they differ from want.
+func expectDownload(t *testing.T, c *DiskCache, key, offset int64, want []byte) {
+	t.Helper()
+
+	got := make([]byte, len(want))
+	if err := c.DownloadAt(key, got, offset); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("object %d at %d is %q, want %q", key, offset, got, want)
+	}
+}
+
+func TestHitAtOffset(t *testing.T) {
+	backend := &testBackend{Memory: memory.New()}
+	object := append([]byte("head"), bytes.Repeat([]byte("a"), 2*testBlockSize)...)
+	backend.Upload(1, object, objproxy.SourceWrite)
+	c := newTestCache(t, backend, t.TempDir(), "volume", 4)
+
+	expectDownload(t, c, 1, 4, object[4:])
+	expectDownload(t, c, 1, 4+testBlockSize, object[4+testBlockSize:])
+	if backend.downloads != 1 {
+		t.Fatalf("cached blocks downloaded %d times", backend.downloads)
+	}
+
+	// The header before the offset is not cached.
+	expectDownload(t, c, 1, 0, object[:4])
+	if backend.downloads != 2 {
+		t.Fatal("range before the offset was not downloaded")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	dir := t.TempDir()
+	backend := &testBackend{Memory: memory.New()}
+	object := bytes.Repeat([]byte("a"), testBlockSize)
+	backend.Upload(1, object, objproxy.SourceWrite)
+
+	c := newTestCache(t, backend, dir, "volume", 0)
+	expectDownload(t, c, 1, 0, object)
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newTestCache(t, backend, dir, "volume", 0)
+	expectDownload(t, reopened, 1, 0, object)
+	if backend.downloads != 1 {
+		t.Fatal("cache of the same volume was emptied")
+	}
+
+	// Object with the same key of another volume is not read from the
+	// cache.
+	other := &testBackend{Memory: memory.New()}
+	otherObject := bytes.Repeat([]byte("b"), testBlockSize)
+	other.Upload(1, otherObject, objproxy.SourceWrite)
+	foreign := newTestCache(t, other, dir, "other", 0)
+	expectDownload(t, foreign, 1, 0, otherObject)
+}
+
+func TestUploadDuringMiss(t *testing.T) {
+	backend := &testBackend{
+		Memory:     memory.New(),
+		downloaded: make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	old := bytes.Repeat([]byte("o"), testBlockSize)
+	backend.Upload(1, old, objproxy.SourceWrite)
+	c := newTestCache(t, backend, t.TempDir(), "volume", 0)
+
+	done := make(chan error)
+	go func() {
+		done <- c.DownloadAt(1, make([]byte, testBlockSize), 0)
+	}()
+
+	// The object is uploaded again after the miss downloaded the old data
+	// and before it stores them.
+	<-backend.downloaded
+	replaced := bytes.Repeat([]byte("n"), testBlockSize)
+	if err := c.Upload(1, replaced, objproxy.SourceWrite); err != nil {
+		t.Fatal(err)
+	}
+	backend.release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-backend.downloaded
+		backend.release <- struct{}{}
+	}()
+	expectDownload(t, c, 1, 0, replaced)
+}
@@ -0,0 +1,482 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package encryption implements ObjectUploadDownloaderAt decorator which
+// encrypts and authenticates objects before they leave the host and verifies
+// and decrypts them after the download.
+//
+// The key is derived from a passphrase by PBKDF2 with HMAC-SHA256. The salt and
+// the number of iterations are stored unencrypted in the salt object of the
+// volume, which is created with a random salt when the volume has none, so the
+// same passphrase gives the same key after a restart or on another host.
+// Losing the salt object makes all objects unreadable.
+//
+// Objects are encrypted by AES-256 in the GCM mode. Reads download arbitrary
+// ranges of objects, hence the object is split into segments of the segment
+// size, typically the block size, which are sealed separately. A read
+// downloads and verifies only the segments covering the requested range. Every
+// upload gets a random nonce, from which the key of the object is derived by
+// HMAC-SHA256 of the volume key, so an object rewritten under the same key,
+// e.g. the checkpoint, never reuses the key and the GCM nonce. The GCM nonce of
+// a segment is its index. The key of the object and its header are
+// authenticated with every segment, hence a modified segment, a segment moved
+// within the object or to another object and a modified header are detected
+// when the segment is read. An older version of the object stored under the
+// same key is not detected.
+//
+// Layout of the encrypted object in the backend, all values are little
+// endian:
+//
+//	[0:8]   magic "bs3enc\x00\x02"
+//	[8:12]  segment size
+//	[12:16] reserved, zeroed
+//	[16:24] plaintext size
+//	[24:56] nonce of the object
+//	[56:]   segments, every one is the ciphertext of the segment size of
+//	        plaintext followed by the 16 byte tag, the last one can be
+//	        shorter
+//
+// Empty objects, e.g. the ones replacing dead objects, are stored empty without
+// the header, so their size stays 0 for the recovery. Existing buckets are
+// migrated by rewriting every non-empty object into this layout under its key,
+// with the daemon stopped. Objects without the header are refused.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+const (
+	magic = "bs3enc\x00\x02"
+
+	// Size of the header of the encrypted object.
+	HeaderSize = 56
+
+	// Size of the tag of every segment.
+	TagSize = 16
+
+	// Size of the nonce of the object.
+	nonceSize = 32
+
+	// Default number of PBKDF2 iterations of a new salt.
+	DefaultIterations = 600000
+
+	// Magic and size of the salt object.
+	saltMagic      = "bs3salt\x01"
+	saltObjectSize = 48
+
+	// Size of the salt of the key derivation.
+	saltSize = 32
+
+	// Size of the volume key and of the keys of objects required by
+	// AES-256.
+	keySize = 32
+
+	// Maximal number of headers kept in memory. Download of an object
+	// whose header is not cached downloads the header first.
+	maxCachedHeaders = 1 << 18
+)
+
+// Header of the encrypted object.
+type header struct {
+	raw  [HeaderSize]byte
+	size int64
+}
+
+// Encryption decorator. Sizes of objects and offsets of downloads are the ones
+// of plaintext objects, the header and the tags are hidden from the caller.
+type Encryption struct {
+	backend     objproxy.ObjectUploadDownloaderAt
+	key         []byte
+	segmentSize int64
+
+	// Headers of recently uploaded and downloaded objects, so downloads do
+	// not have to download the header every time. Arbitrary header is
+	// evicted when the cache is full.
+	mutex   sync.Mutex
+	headers map[int64]header
+}
+
+// Options to use in New() function.
+type Options struct {
+	Backend objproxy.ObjectUploadDownloaderAt
+
+	// Passphrase the volume key is derived from.
+	Passphrase string
+
+	// Key of the salt object in the backend.
+	SaltKey int64
+
+	// Number of PBKDF2 iterations of a new salt. 0 means
+	// DefaultIterations. Existing salt keeps its number of iterations.
+	Iterations int
+
+	// Size of plaintext segments, e.g. the block size, so reads of whole
+	// blocks download whole segments only.
+	SegmentSize int
+
+	// Missing salt object is an error instead of being created.
+	ReadOnly bool
+}
+
+// Returns the encryption decorator with the key derived from the passphrase and
+// the salt of the volume. The salt object is created when it does not exist.
+func New(o Options) (*Encryption, error) {
+	if o.Passphrase == "" {
+		return nil, errors.New("encryption passphrase is empty")
+	}
+	if o.SegmentSize <= 0 {
+		return nil, fmt.Errorf("invalid segment size %d", o.SegmentSize)
+	}
+
+	salt, iterations, err := loadSalt(o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encryption{
+		backend:     o.Backend,
+		key:         pbkdf2([]byte(o.Passphrase), salt, iterations, keySize),
+		segmentSize: int64(o.SegmentSize),
+		headers:     make(map[int64]header),
+	}, nil
+}
+
+// Returns the salt and the number of iterations from the salt object. New salt
+// is generated and uploaded when the object does not exist.
+func loadSalt(o Options) ([]byte, int, error) {
+	_, err := o.Backend.GetObjectSize(o.SaltKey)
+	if errors.Is(err, objproxy.ErrNotFound) && !o.ReadOnly {
+		return createSalt(o)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("encryption salt cannot be read: %w", err)
+	}
+
+	raw := make([]byte, saltObjectSize)
+	if err := o.Backend.DownloadAt(o.SaltKey, raw, 0); err != nil {
+		return nil, 0, fmt.Errorf("encryption salt cannot be read: %w", err)
+	}
+	if string(raw[:len(saltMagic)]) != saltMagic {
+		return nil, 0, errors.New("encryption salt object is invalid")
+	}
+
+	iterations := int(binary.LittleEndian.Uint32(raw[8:12]))
+	if iterations <= 0 {
+		return nil, 0, fmt.Errorf("encryption salt has invalid number of iterations %d", iterations)
+	}
+
+	return raw[16:], iterations, nil
+}
+
+// Generates new salt and uploads it in the salt object.
+func createSalt(o Options) ([]byte, int, error) {
+	iterations := o.Iterations
+	if iterations == 0 {
+		iterations = DefaultIterations
+	}
+
+	raw := make([]byte, saltObjectSize)
+	copy(raw, saltMagic)
+	binary.LittleEndian.PutUint32(raw[8:12], uint32(iterations))
+	if _, err := rand.Read(raw[16 : 16+saltSize]); err != nil {
+		return nil, 0, fmt.Errorf("encryption salt cannot be generated: %w", err)
+	}
+
+	if err := o.Backend.Upload(o.SaltKey, raw, objproxy.SourceCheckpoint); err != nil {
+		return nil, 0, fmt.Errorf("encryption salt cannot be uploaded: %w", err)
+	}
+
+	return raw[16:], iterations, nil
+}
+
+// Returns key derived from password and salt by PBKDF2 with HMAC-SHA256, see
+// RFC 8018.
+func pbkdf2(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, size+prf.Size())
+	u := make([]byte, prf.Size())
+	t := make([]byte, prf.Size())
+
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:size]
+}
+
+// Returns AEAD of the object with the header h.
+func (e *Encryption) aead(h *header) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write(h.raw[24 : 24+nonceSize])
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Returns GCM nonce of the segment i.
+func segmentNonce(i int64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce, uint64(i))
+
+	return nonce
+}
+
+// Returns additional data authenticated with every segment of the object with
+// key and the header h.
+func additionalData(key int64, h *header) []byte {
+	ad := make([]byte, 8+HeaderSize)
+	binary.LittleEndian.PutUint64(ad, uint64(key))
+	copy(ad[8:], h.raw[:])
+
+	return ad
+}
+
+// Upload function implemented by the upload of the sealed copy of buf with a
+// new random nonce. Empty buf is uploaded as it is.
+func (e *Encryption) Upload(key int64, buf []byte, source objproxy.Source) error {
+	if len(buf) == 0 {
+		e.forget(key)
+		return e.backend.Upload(key, buf, source)
+	}
+
+	h := header{size: int64(len(buf))}
+	copy(h.raw[:], magic)
+	binary.LittleEndian.PutUint32(h.raw[8:12], uint32(e.segmentSize))
+	binary.LittleEndian.PutUint64(h.raw[16:24], uint64(len(buf)))
+	if _, err := rand.Read(h.raw[24:]); err != nil {
+		return fmt.Errorf("nonce of object %d cannot be generated: %w", key, err)
+	}
+
+	aead, err := e.aead(&h)
+	if err != nil {
+		return err
+	}
+	ad := additionalData(key, &h)
+
+	segments := (int64(len(buf)) + e.segmentSize - 1) / e.segmentSize
+	object := make([]byte, HeaderSize, HeaderSize+int64(len(buf))+segments*TagSize)
+	copy(object, h.raw[:])
+	for i := int64(0); i < segments; i++ {
+		end := (i + 1) * e.segmentSize
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		object = aead.Seal(object, segmentNonce(i), buf[i*e.segmentSize:end], ad)
+	}
+
+	// The previous header is forgotten before the upload, so a failed
+	// upload of the object does not leave behind any header, which may or
+	// may not be the stored one.
+	e.forget(key)
+	if err := e.backend.Upload(key, object, source); err != nil {
+		return err
+	}
+	e.remember(key, h)
+
+	return nil
+}
+
+// DownloadAt function implemented by the download of the segments covering the
+// range, their verification and decryption. The header is downloaded first
+// when it is not cached.
+func (e *Encryption) DownloadAt(key int64, buf []byte, offset int64) error {
+	if len(buf) == 0 {
+		return e.backend.DownloadAt(key, buf, offset)
+	}
+
+	h, err := e.header(key)
+	if err != nil {
+		return err
+	}
+
+	end := offset + int64(len(buf))
+	if offset < 0 || end > h.size {
+		return fmt.Errorf("range %d-%d is out of object %d of %d bytes", offset, end-1, key, h.size)
+	}
+
+	first := offset / e.segmentSize
+	last := (end - 1) / e.segmentSize
+	plainEnd := (last + 1) * e.segmentSize
+	if plainEnd > h.size {
+		plainEnd = h.size
+	}
+
+	sealed := make([]byte, plainEnd-first*e.segmentSize+(last-first+1)*TagSize)
+	if err := e.backend.DownloadAt(key, sealed, HeaderSize+first*(e.segmentSize+TagSize)); err != nil {
+		return err
+	}
+
+	aead, err := e.aead(&h)
+	if err != nil {
+		return err
+	}
+	ad := additionalData(key, &h)
+
+	plain := make([]byte, 0, plainEnd-first*e.segmentSize)
+	for i := first; i <= last; i++ {
+		n := e.segmentSize + TagSize
+		if int64(len(sealed)) < n {
+			n = int64(len(sealed))
+		}
+		plain, err = aead.Open(plain, segmentNonce(i), sealed[:n], ad)
+		if err != nil {
+			e.forget(key)
+			return fmt.Errorf("segment %d of object %d failed authentication", i, key)
+		}
+		sealed = sealed[n:]
+	}
+
+	copy(buf, plain[offset-first*e.segmentSize:])
+
+	return nil
+}
+
+// Returns header of the object with key from the cache or from the backend.
+func (e *Encryption) header(key int64) (header, error) {
+	e.mutex.Lock()
+	h, ok := e.headers[key]
+	e.mutex.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	if err := e.backend.DownloadAt(key, h.raw[:], 0); err != nil {
+		return h, err
+	}
+	if string(h.raw[:len(magic)]) != magic {
+		return h, fmt.Errorf("object %d is not encrypted", key)
+	}
+	if size := int64(binary.LittleEndian.Uint32(h.raw[8:12])); size != e.segmentSize {
+		return h, fmt.Errorf("object %d has segment size %d, %d is configured", key, size, e.segmentSize)
+	}
+	h.size = int64(binary.LittleEndian.Uint64(h.raw[16:24]))
+	e.remember(key, h)
+
+	return h, nil
+}
+
+// Caches header of the object with key.
+func (e *Encryption) remember(key int64, h header) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.headers[key]; !ok && len(e.headers) >= maxCachedHeaders {
+		for k := range e.headers {
+			delete(e.headers, k)
+			break
+		}
+	}
+	e.headers[key] = h
+}
+
+// Drops header of the object with key from the cache.
+func (e *Encryption) forget(key int64) {
+	e.mutex.Lock()
+	delete(e.headers, key)
+	e.mutex.Unlock()
+}
+
+// Returns plaintext size of the object with backend size size.
+func (e *Encryption) plaintextSize(key, size int64) (int64, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	if size < HeaderSize+TagSize {
+		return 0, fmt.Errorf("object %d has %d bytes, which is less than the encryption header", key, size)
+	}
+
+	sealed := size - HeaderSize
+	segments := (sealed + e.segmentSize + TagSize - 1) / (e.segmentSize + TagSize)
+
+	return sealed - segments*TagSize, nil
+}
+
+// GetObjectSize function implemented by the backend without the header and the
+// tags.
+func (e *Encryption) GetObjectSize(key int64) (int64, error) {
+	size, err := e.backend.GetObjectSize(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.plaintextSize(key, size)
+}
+
+// GetObjectInfo function implemented by the backend without the header and the
+// tags.
+func (e *Encryption) GetObjectInfo(key int64) (int64, int64, error) {
+	size, incarnation, err := e.backend.GetObjectInfo(key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, err = e.plaintextSize(key, size)
+
+	return size, incarnation, err
+}
+
+// SetIncarnation function implemented by the backend.
+func (e *Encryption) SetIncarnation(incarnation int64) {
+	e.backend.SetIncarnation(incarnation)
+}
+
+// SetTimeout function implemented by the backend.
+func (e *Encryption) SetTimeout(timeout time.Duration) {
+	e.backend.SetTimeout(timeout)
+}
+
+// DeleteKeyAndSuccessors function implemented by the backend. Headers of
+// deleted objects are dropped from the cache.
+func (e *Encryption) DeleteKeyAndSuccessors(fromKey int64) error {
+	e.mutex.Lock()
+	for key := range e.headers {
+		if key >= fromKey {
+			delete(e.headers, key)
+		}
+	}
+	e.mutex.Unlock()
+
+	return e.backend.DeleteKeyAndSuccessors(fromKey)
+}
+
+// ListKeys function implemented by the backend. Sizes are without the header
+// and the tags, objects too small for the header are listed with their backend
+// size.
+func (e *Encryption) ListKeys(fn func(key, size int64) bool) error {
+	return e.backend.ListKeys(func(key, size int64) bool {
+		if plain, err := e.plaintextSize(key, size); err == nil {
+			size = plain
+		}
+		return fn(key, size)
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+const (
+	testSegmentSize = 64
+	testSaltKey     = -10
+)
+
+// Returns the encryption with passphrase over store. The salt is created with
+// a few iterations only, so tests are fast.
+func newTestEncryption(t *testing.T, store *memory.Memory, passphrase string) *Encryption {
+	t.Helper()
+
+	e, err := New(Options{
+		Backend:     store,
+		Passphrase:  passphrase,
+		SaltKey:     testSaltKey,
+		Iterations:  16,
+		SegmentSize: testSegmentSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// Returns the object with key as it is stored in store.
+func rawObject(t *testing.T, store *memory.Memory, key int64) []byte {
+	t.Helper()
+
+	size, err := store.GetObjectSize(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, size)
+	if err := store.DownloadAt(key, raw, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+// Returns plaintext of n bytes, which differ in every segment.
+func testPlaintext(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i * 7)
+	}
+
+	return buf
+}
+
+func TestRanges(t *testing.T) {
+	store := memory.New()
+	e := newTestEncryption(t, store, "secret")
+
+	// The last segment is shorter than the segment size.
+	plain := testPlaintext(5*testSegmentSize + 10)
+	if err := e.Upload(1, plain, objproxy.SourceWrite); err != nil {
+		t.Fatal(err)
+	}
+	if raw := rawObject(t, store, 1); bytes.Contains(raw, plain[:testSegmentSize]) {
+		t.Fatal("object is stored in plaintext")
+	}
+
+	if size, err := e.GetObjectSize(1); err != nil || size != int64(len(plain)) {
+		t.Fatalf("object has size %d, error %v", size, err)
+	}
+
+	// The restarted encryption downloads the header and the salt.
+	restarted := newTestEncryption(t, store, "secret")
+	tests := []struct {
+		offset, size int
+	}{
+		{0, len(plain)},
+		{0, testSegmentSize},
+		{testSegmentSize, 2 * testSegmentSize},
+		{10, 1},
+		{testSegmentSize - 1, 2},
+		{3*testSegmentSize + 5, 2*testSegmentSize + 5},
+		{len(plain) - 1, 1},
+	}
+	for _, enc := range []*Encryption{e, restarted} {
+		for _, tt := range tests {
+			got := make([]byte, tt.size)
+			if err := enc.DownloadAt(1, got, int64(tt.offset)); err != nil {
+				t.Fatalf("range %d+%d: %v", tt.offset, tt.size, err)
+			}
+			if !bytes.Equal(got, plain[tt.offset:tt.offset+tt.size]) {
+				t.Fatalf("range %d+%d differs from the plaintext", tt.offset, tt.size)
+			}
+		}
+	}
+
+	if err := e.DownloadAt(1, make([]byte, 2), int64(len(plain)-1)); err == nil {
+		t.Fatal("range out of the object downloaded")
+	}
+}
+
+func TestEmptyObject(t *testing.T) {
+	store := memory.New()
+	e := newTestEncryption(t, store, "secret")
+
+	if err := e.Upload(1, nil, objproxy.SourceGC); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := store.GetObjectSize(1); err != nil || size != 0 {
+		t.Fatalf("empty object is stored with size %d, error %v", size, err)
+	}
+	if size, err := e.GetObjectSize(1); err != nil || size != 0 {
+		t.Fatalf("empty object has size %d, error %v", size, err)
+	}
+}
+
+func TestTamperDetected(t *testing.T) {
+	plain := testPlaintext(3 * testSegmentSize)
+	sealedSegment := testSegmentSize + TagSize
+
+	tests := []struct {
+		name   string
+		tamper func(raw []byte) []byte
+	}{
+		{"ciphertext", func(raw []byte) []byte {
+			raw[HeaderSize+sealedSegment+1] ^= 1
+			return raw
+		}},
+		{"tag", func(raw []byte) []byte {
+			raw[HeaderSize+2*sealedSegment-1] ^= 1
+			return raw
+		}},
+		{"swapped segments", func(raw []byte) []byte {
+			first := append([]byte(nil), raw[HeaderSize:HeaderSize+sealedSegment]...)
+			copy(raw[HeaderSize:], raw[HeaderSize+sealedSegment:HeaderSize+2*sealedSegment])
+			copy(raw[HeaderSize+sealedSegment:], first)
+			return raw
+		}},
+		{"header", func(raw []byte) []byte {
+			raw[30] ^= 1
+			return raw
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.New()
+			e := newTestEncryption(t, store, "secret")
+			if err := e.Upload(1, plain, objproxy.SourceWrite); err != nil {
+				t.Fatal(err)
+			}
+			store.Upload(1, tt.tamper(rawObject(t, store, 1)), objproxy.SourceWrite)
+
+			// The header is not cached by the restarted
+			// encryption.
+			restarted := newTestEncryption(t, store, "secret")
+			if err := restarted.DownloadAt(1, make([]byte, 2*testSegmentSize), 0); err == nil {
+				t.Fatal("modified object was decrypted")
+			}
+		})
+	}
+}
+
+func TestObjectMovedDetected(t *testing.T) {
+	store := memory.New()
+	e := newTestEncryption(t, store, "secret")
+	if err := e.Upload(1, testPlaintext(testSegmentSize), objproxy.SourceWrite); err != nil {
+		t.Fatal(err)
+	}
+	store.Upload(2, rawObject(t, store, 1), objproxy.SourceWrite)
+
+	if err := e.DownloadAt(2, make([]byte, testSegmentSize), 0); err == nil {
+		t.Fatal("object moved under another key was decrypted")
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	store := memory.New()
+	e := newTestEncryption(t, store, "secret")
+	if err := e.Upload(1, testPlaintext(testSegmentSize), objproxy.SourceWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := newTestEncryption(t, store, "wrong")
+	if err := wrong.DownloadAt(1, make([]byte, testSegmentSize), 0); err == nil {
+		t.Fatal("object was decrypted with the wrong passphrase")
+	}
+}
+
+func TestSaltReadOnly(t *testing.T) {
+	store := memory.New()
+	_, err := New(Options{
+		Backend:     store,
+		Passphrase:  "secret",
+		SaltKey:     testSaltKey,
+		SegmentSize: testSegmentSize,
+		ReadOnly:    true,
+	})
+	if err == nil {
+		t.Fatal("read-only encryption started without the salt")
+	}
+	if _, err := store.GetObjectSize(testSaltKey); err == nil {
+		t.Fatal("read-only encryption created the salt")
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector of PBKDF2-HMAC-SHA256 from RFC 7914.
+	got := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("derived key %x, want %s", got, want)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package failover implements ObjectUploadDownloaderAt decorator which serves
+// reads from the secondary backend when the primary one fails. The secondary
+// is expected to be a read replica of the primary, e.g. a bucket with cross
+// region replication. Writes always go to the primary backend.
+package failover
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// States of the circuit breaker.
+const (
+	// Reads go to the primary and fail over to the secondary on error.
+	closed = "closed"
+
+	// Primary is considered down and reads go directly to the secondary.
+	open = "open"
+
+	// One probe read goes to the primary to find out whether it recovered.
+	// All other reads go to the secondary.
+	halfOpen = "half-open"
+
+	// Forced by the operator, all reads go to the secondary and the
+	// primary is neither read nor written, see Force().
+	forced = "forced"
+)
+
+// Returned for uploads and deletions while reads are forced to the secondary.
+var ErrForced = errors.New("primary backend is disabled, reads are forced to the read replica")
+
+// Breaker states and failover counts of all decorators, published under
+// "failover" in the metrics.
+var metrics = expvar.NewMap("failover")
+
+// Failover decorator with circuit breaker. The breaker opens after the
+// configured number of consecutive failures of the primary backend and
+// closes again after a successful probe which is sent after the open time.
+//
+// Failure of the primary is counted only when the secondary succeeds with the
+// same request. When both fail, the error is most probably legitimate, e.g. a
+// missing object during recovery, and it does not say anything about the
+// primary health.
+type Failover struct {
+	primary   objproxy.ObjectUploadDownloaderAt
+	secondary objproxy.ObjectUploadDownloaderAt
+
+	failures int64
+	openTime time.Duration
+
+	// Breaker state guarded by mutex. probing is true when the probe is in
+	// flight in the half-open state.
+	mutex       sync.Mutex
+	state       string
+	consecutive int64
+	openedAt    time.Time
+	probing     bool
+
+	// State of the breaker before it was forced, it is restored when the
+	// force is lifted.
+	unforced string
+
+	name      string
+	stateVar  *expvar.String
+	failovers *expvar.Int
+}
+
+// Options to use in New() function.
+type Options struct {
+	Primary   objproxy.ObjectUploadDownloaderAt
+	Secondary objproxy.ObjectUploadDownloaderAt
+
+	// Number of consecutive failures of the primary opening the breaker
+	// and time after which the primary is probed again.
+	Failures int64
+	OpenTime time.Duration
+
+	// Name of the decorator in the metrics, e.g. the bucket name.
+	Name string
+}
+
+func New(o Options) *Failover {
+	f := &Failover{
+		primary:   o.Primary,
+		secondary: o.Secondary,
+		failures:  o.Failures,
+		openTime:  o.OpenTime,
+		state:     closed,
+		name:      o.Name,
+		stateVar:  new(expvar.String),
+		failovers: new(expvar.Int),
+	}
+
+	if f.failures < 1 {
+		f.failures = 1
+	}
+
+	f.stateVar.Set(closed)
+	stats := new(expvar.Map).Init()
+	stats.Set("state", f.stateVar)
+	stats.Set("failovers", f.failovers)
+	metrics.Set(o.Name, stats)
+
+	return f
+}
+
+// Uploads to the primary backend only. Fails while reads are forced to the
+// secondary.
+func (f *Failover) Upload(key int64, buf []byte, source objproxy.Source) error {
+	if f.Forced() {
+		return ErrForced
+	}
+
+	return f.primary.Upload(key, buf, source)
+}
+
+// Downloads from the primary backend or from the secondary one when the
+// primary fails or the breaker is open.
+func (f *Failover) DownloadAt(key int64, buf []byte, offset int64) error {
+	return f.read(func(b objproxy.ObjectUploadDownloaderAt) error {
+		return b.DownloadAt(key, buf, offset)
+	})
+}
+
+// Returns size of the object from the primary backend or from the secondary
+// one when the primary fails or the breaker is open.
+func (f *Failover) GetObjectSize(key int64) (int64, error) {
+	var size int64
+	err := f.read(func(b objproxy.ObjectUploadDownloaderAt) error {
+		var err error
+		size, err = b.GetObjectSize(key)
+		return err
+	})
+
+	return size, err
+}
+
+// Returns size and incarnation of the object from the primary backend or from
+// the secondary one when the primary fails or the breaker is open.
+func (f *Failover) GetObjectInfo(key int64) (int64, int64, error) {
+	var size, incarnation int64
+	err := f.read(func(b objproxy.ObjectUploadDownloaderAt) error {
+		var err error
+		size, incarnation, err = b.GetObjectInfo(key)
+		return err
+	})
+
+	return size, incarnation, err
+}
+
+// Sets the incarnation at the primary backend only, since only it gets
+// uploads.
+func (f *Failover) SetIncarnation(incarnation int64) {
+	f.primary.SetIncarnation(incarnation)
+}
+
+// Sets the timeout at both backends.
+func (f *Failover) SetTimeout(timeout time.Duration) {
+	f.primary.SetTimeout(timeout)
+	f.secondary.SetTimeout(timeout)
+}
+
+// Deletes at the primary backend only. Fails while reads are forced to the
+// secondary.
+func (f *Failover) DeleteKeyAndSuccessors(key int64) error {
+	if f.Forced() {
+		return ErrForced
+	}
+
+	return f.primary.DeleteKeyAndSuccessors(key)
+}
+
+// Lists the primary backend only, since the replica can lag behind.
+func (f *Failover) ListKeys(fn func(key, size int64) bool) error {
+	return f.primary.ListKeys(fn)
+}
+
+// Performs read operation op according to the breaker state.
+func (f *Failover) read(op func(objproxy.ObjectUploadDownloaderAt) error) error {
+	usePrimary, probe := f.route()
+	if !usePrimary {
+		return op(f.secondary)
+	}
+
+	err := op(f.primary)
+	if err == nil {
+		f.succeeded(probe)
+		return nil
+	}
+
+	errSecondary := op(f.secondary)
+	if errSecondary != nil {
+		f.inconclusive(probe)
+		return err
+	}
+
+	f.failovers.Add(1)
+	f.failed(probe, err)
+
+	return nil
+}
+
+// Decides whether the read goes to the primary and whether it is the probe.
+func (f *Failover) route() (usePrimary, probe bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch f.state {
+	case forced:
+		return false, false
+	case closed:
+		return true, false
+	case open:
+		if time.Since(f.openedAt) < f.openTime {
+			return false, false
+		}
+		f.setState(halfOpen)
+		fallthrough
+	default:
+		if f.probing {
+			return false, false
+		}
+		f.probing = true
+		return true, true
+	}
+}
+
+// Records successful read from the primary.
+func (f *Failover) succeeded(probe bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.consecutive = 0
+	if probe {
+		f.probing = false
+		// The force set while the probe was in flight stays.
+		if f.state != forced {
+			f.setState(closed)
+			log.Info().Msgf("Primary backend of %s recovered.", f.name)
+		}
+	}
+}
+
+// Records read which failed on both backends.
+func (f *Failover) inconclusive(probe bool) {
+	if !probe {
+		return
+	}
+
+	f.mutex.Lock()
+	f.probing = false
+	f.mutex.Unlock()
+}
+
+// Records failure of the primary while the secondary succeeded.
+func (f *Failover) failed(probe bool, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if probe {
+		f.probing = false
+	}
+
+	f.consecutive++
+	if f.state == forced {
+		return
+	}
+	if probe || (f.state == closed && f.consecutive >= f.failures) {
+		f.openedAt = time.Now()
+		if f.state != open {
+			log.Warn().Err(err).Msgf("Primary backend of %s failed, reads go to the secondary.", f.name)
+		}
+		f.setState(open)
+	}
+}
+
+// Forces all reads to the secondary when force is true, e.g. during an outage
+// of the primary region, and disables uploads and deletions. Otherwise it
+// returns the breaker to its state before it was forced.
+func (f *Failover) Force(force bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if force == (f.state == forced) {
+		return
+	}
+
+	if force {
+		f.unforced = f.state
+		f.setState(forced)
+		log.Warn().Msgf("Reads of %s are forced to the secondary backend. Uploads are disabled.", f.name)
+		return
+	}
+
+	f.setState(f.unforced)
+	log.Info().Msgf("Reads of %s are not forced to the secondary backend anymore.", f.name)
+}
+
+// Returns true when reads are forced to the secondary.
+func (f *Failover) Forced() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.state == forced
+}
+
+// Changes the breaker state. Must be called with mutex held.
+func (f *Failover) setState(state string) {
+	f.state = state
+	f.stateVar.Set(state)
+}
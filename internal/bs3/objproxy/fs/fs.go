@@ -0,0 +1,251 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package fs implements ObjectUploadDownloaderAt by files in a local directory,
+// e.g. on a fast NVMe drive of a single machine, without any S3 server.
+//
+// Every object is a file named by its key in decimal, the checkpoint objects
+// have negative keys. The file is written under a temporary name, synced and
+// renamed, so an object is either complete or missing after a crash, which is
+// what the prefix consistent recovery expects from the object store. Empty
+// objects replacing the dead ones are empty files, hence their size is 0 as
+// in S3. The incarnation is stored in the extended attribute of the file, so
+// the filesystem has to support user extended attributes when incarnations are
+// used.
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+const (
+	// Extended attribute with the incarnation of the volume.
+	incarnationAttr = "user.bs3.incarnation"
+
+	// Prefix of temporary files of objects being uploaded. They are never
+	// decoded as keys and they are removed by New().
+	tmpPrefix = ".upload-"
+)
+
+type Options struct {
+	// Directory with the objects. It is created when it does not exist.
+	Dir string
+
+	// Nothing is changed in New(), i.e. the directory is not created and
+	// temporary files are not removed, so tools can inspect the directory
+	// of a running volume.
+	ReadOnly bool
+}
+
+// Object store in the local directory.
+type FS struct {
+	dir string
+
+	// Incarnation of the volume stored with every uploaded object when it
+	// is not zero. Accessed atomically.
+	incarnation int64
+}
+
+// Returns new object store in the directory given by o. Temporary files of
+// uploads interrupted by a crash are removed.
+func New(o Options) (*FS, error) {
+	if o.ReadOnly {
+		return &FS{dir: o.Dir}, nil
+	}
+
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(o.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), tmpPrefix) {
+			os.Remove(filepath.Join(o.Dir, f.Name()))
+		}
+	}
+
+	return &FS{dir: o.Dir}, nil
+}
+
+// Returns path of the file of the object with key.
+func (s *FS) path(key int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(key, 10))
+}
+
+// Upload function implemented by a temporary file renamed to the name of the
+// object when it is synced. The directory is synced as well, so the object is
+// durable when the upload returns.
+func (s *FS) Upload(key int64, buf []byte, source objproxy.Source) error {
+	f, err := os.CreateTemp(s.dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = s.write(f, buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return s.syncDir()
+}
+
+// Writes buf with the incarnation into f and syncs it.
+func (s *FS) write(f *os.File, buf []byte) error {
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+
+	if incarnation := atomic.LoadInt64(&s.incarnation); incarnation != 0 {
+		value := []byte(strconv.FormatInt(incarnation, 10))
+		if err := syscall.Setxattr(f.Name(), incarnationAttr, value, 0); err != nil {
+			return fmt.Errorf("incarnation of object cannot be stored: %w", err)
+		}
+	}
+
+	return f.Sync()
+}
+
+// Syncs the directory, so renames and removals of files are durable.
+func (s *FS) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// DownloadAt function implemented by ReadAt of the file. Range out of the
+// object is an error as in S3.
+func (s *FS) DownloadAt(key int64, buf []byte, offset int64) error {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(buf, offset)
+	if err == io.EOF && n < len(buf) {
+		return fmt.Errorf("range %d-%d is out of object %d", offset, offset+int64(len(buf))-1, key)
+	}
+
+	return err
+}
+
+// GetObjectSize function implemented by stat of the file.
+func (s *FS) GetObjectSize(key int64) (int64, error) {
+	fi, err := os.Stat(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %v", objproxy.ErrNotFound, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// GetObjectInfo function implemented by stat and the extended attribute of the
+// file.
+func (s *FS) GetObjectInfo(key int64) (int64, int64, error) {
+	size, err := s.GetObjectSize(key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	value := make([]byte, 32)
+	n, err := syscall.Getxattr(s.path(key), incarnationAttr, value)
+	if errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP) {
+		return size, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	incarnation, err := strconv.ParseInt(string(value[:n]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid incarnation %q of object %d", value[:n], key)
+	}
+
+	return size, incarnation, nil
+}
+
+// SetIncarnation function implemented by the extended attribute.
+func (s *FS) SetIncarnation(incarnation int64) {
+	atomic.StoreInt64(&s.incarnation, incarnation)
+}
+
+// Local files have no timeout.
+func (s *FS) SetTimeout(timeout time.Duration) {}
+
+// DeleteKeyAndSuccessors function implemented by removal of files of all keys
+// greater or equal to fromKey found in the directory.
+func (s *FS) DeleteKeyAndSuccessors(fromKey int64) error {
+	var first error
+	err := s.ListKeys(func(key, size int64) bool {
+		if key >= fromKey {
+			if err := os.Remove(s.path(key)); err != nil && first == nil {
+				first = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if first != nil {
+		return first
+	}
+
+	return s.syncDir()
+}
+
+// ListKeys function implemented by reading of the directory. Files with names
+// which are not keys are skipped.
+func (s *FS) ListKeys(fn func(key, size int64) bool) error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		key, err := strconv.ParseInt(f.Name(), 10, 64)
+		if err != nil || !f.Type().IsRegular() {
+			continue
+		}
+
+		fi, err := f.Info()
+		if err != nil {
+			// Removed in the meantime.
+			continue
+		}
+
+		if !fn(key, fi.Size()) {
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package hedge implements ObjectUploadDownloaderAt decorator which reduces tail
+// latency of downloads by hedged requests. When a download does not finish
+// within the hedge delay, the same download is sent again and whichever of the
+// two finishes first is used.
+package hedge
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// Hedging counts of all decorators, published under "hedge" in the metrics.
+var metrics = expvar.NewMap("hedge")
+
+// Hedge decorator. Only downloads are hedged, all other operations go directly
+// to the backend.
+//
+// Backends cannot cancel requests, hence the slower request of the pair is not
+// cancelled, it just finishes in the background and its result is dropped.
+// Both requests download into private buffers and the result of the faster one
+// is copied into the buffer of the caller, so the slower one never writes into
+// the buffer after DownloadAt returned.
+type Hedge struct {
+	backend objproxy.ObjectUploadDownloaderAt
+	delay   time.Duration
+
+	// Number of hedged downloads and of those where the hedged request
+	// finished first.
+	hedged *expvar.Int
+	won    *expvar.Int
+}
+
+// Options to use in New() function.
+type Options struct {
+	Backend objproxy.ObjectUploadDownloaderAt
+
+	// Time after which the download is sent again.
+	Delay time.Duration
+
+	// Name of the decorator in the metrics, e.g. the bucket name.
+	Name string
+}
+
+func New(o Options) *Hedge {
+	h := &Hedge{
+		backend: o.Backend,
+		delay:   o.Delay,
+		hedged:  new(expvar.Int),
+		won:     new(expvar.Int),
+	}
+
+	stats := new(expvar.Map).Init()
+	stats.Set("hedged", h.hedged)
+	stats.Set("won", h.won)
+	metrics.Set(o.Name, stats)
+
+	return h
+}
+
+// Uploads to the backend.
+func (h *Hedge) Upload(key int64, buf []byte, source objproxy.Source) error {
+	return h.backend.Upload(key, buf, source)
+}
+
+// Result of one request of the hedged pair.
+type result struct {
+	buf    []byte
+	err    error
+	hedged bool
+}
+
+// Downloads from the backend. When the download does not finish within the
+// delay, the same download is sent again and the first successful one is used.
+// The error of the first request is returned when both fail. The error of the
+// first request returned before the delay is returned immediately, since
+// repeating e.g. a download of a missing object is pointless.
+func (h *Hedge) DownloadAt(key int64, buf []byte, offset int64) error {
+	results := make(chan result, 2)
+	download := func(hedged bool) {
+		b := make([]byte, len(buf))
+		err := h.backend.DownloadAt(key, b, offset)
+		results <- result{b, err, hedged}
+	}
+
+	go download(false)
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		if r.err == nil {
+			copy(buf, r.buf)
+		}
+		return r.err
+	case <-timer.C:
+	}
+
+	h.hedged.Add(1)
+	go download(true)
+
+	first := <-results
+	if first.err != nil {
+		second := <-results
+		if second.err != nil {
+			if first.hedged {
+				return second.err
+			}
+			return first.err
+		}
+		first = second
+	}
+
+	if first.hedged {
+		h.won.Add(1)
+	}
+	copy(buf, first.buf)
+
+	return nil
+}
+
+// Returns size of the object from the backend.
+func (h *Hedge) GetObjectSize(key int64) (int64, error) {
+	return h.backend.GetObjectSize(key)
+}
+
+// Returns size and incarnation of the object from the backend.
+func (h *Hedge) GetObjectInfo(key int64) (int64, int64, error) {
+	return h.backend.GetObjectInfo(key)
+}
+
+// Sets the incarnation at the backend.
+func (h *Hedge) SetIncarnation(incarnation int64) {
+	h.backend.SetIncarnation(incarnation)
+}
+
+// Sets the timeout at the backend, hence every hedged request has it.
+func (h *Hedge) SetTimeout(timeout time.Duration) {
+	h.backend.SetTimeout(timeout)
+}
+
+// Deletes at the backend.
+func (h *Hedge) DeleteKeyAndSuccessors(key int64) error {
+	return h.backend.DeleteKeyAndSuccessors(key)
+}
+
+// Lists the backend.
+func (h *Hedge) ListKeys(fn func(key, size int64) bool) error {
+	return h.backend.ListKeys(fn)
+}
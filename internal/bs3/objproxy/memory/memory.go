@@ -0,0 +1,131 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package memory implements ObjectUploadDownloaderAt by a map in memory. It
+// loses everything with the process, hence it is meant for testing of the core
+// of bs3, e.g. writes, reads and the restore, without any S3 server. Empty
+// objects are stored as empty slices, so they exist with size 0 as in S3 and
+// they are distinct from missing objects.
+package memory
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// Object with its incarnation.
+type object struct {
+	data        []byte
+	incarnation int64
+}
+
+// Object store in memory.
+type Memory struct {
+	mutex       sync.Mutex
+	objects     map[int64]object
+	incarnation int64
+}
+
+// Returns new empty object store.
+func New() *Memory {
+	return &Memory{objects: make(map[int64]object)}
+}
+
+// Upload function implemented by a copy of buf, since the caller may reuse it.
+func (m *Memory) Upload(key int64, buf []byte, source objproxy.Source) error {
+	data := make([]byte, len(buf))
+	copy(data, buf)
+
+	m.mutex.Lock()
+	m.objects[key] = object{data: data, incarnation: m.incarnation}
+	m.mutex.Unlock()
+
+	return nil
+}
+
+// DownloadAt function implemented by a copy from the object. Range out of the
+// object is an error as in S3.
+func (m *Memory) DownloadAt(key int64, buf []byte, offset int64) error {
+	m.mutex.Lock()
+	o, ok := m.objects[key]
+	m.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("object %d does not exist", key)
+	}
+	if offset < 0 || offset+int64(len(buf)) > int64(len(o.data)) {
+		return fmt.Errorf("range %d-%d is out of object %d", offset, offset+int64(len(buf))-1, key)
+	}
+
+	copy(buf, o.data[offset:])
+
+	return nil
+}
+
+// GetObjectSize function implemented by the length of the object.
+func (m *Memory) GetObjectSize(key int64) (int64, error) {
+	size, _, err := m.GetObjectInfo(key)
+
+	return size, err
+}
+
+// GetObjectInfo function implemented by the length and the incarnation stored
+// with the object.
+func (m *Memory) GetObjectInfo(key int64) (int64, int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: object %d", objproxy.ErrNotFound, key)
+	}
+
+	return int64(len(o.data)), o.incarnation, nil
+}
+
+// SetIncarnation function implemented by storing the incarnation with every
+// uploaded object.
+func (m *Memory) SetIncarnation(incarnation int64) {
+	m.mutex.Lock()
+	m.incarnation = incarnation
+	m.mutex.Unlock()
+}
+
+// Memory has no timeout.
+func (m *Memory) SetTimeout(timeout time.Duration) {}
+
+// DeleteKeyAndSuccessors function implemented by removal of all keys greater or
+// equal to fromKey from the map.
+func (m *Memory) DeleteKeyAndSuccessors(fromKey int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key := range m.objects {
+		if key >= fromKey {
+			delete(m.objects, key)
+		}
+	}
+
+	return nil
+}
+
+// ListKeys function implemented by iteration of the map. The map is not locked
+// while fn runs, so fn may call other functions of the store.
+func (m *Memory) ListKeys(fn func(key, size int64) bool) error {
+	m.mutex.Lock()
+	sizes := make(map[int64]int64, len(m.objects))
+	for key, o := range m.objects {
+		sizes[key] = int64(len(o.data))
+	}
+	m.mutex.Unlock()
+
+	for key, size := range sizes {
+		if !fn(key, size) {
+			return nil
+		}
+	}
+
+	return nil
+}
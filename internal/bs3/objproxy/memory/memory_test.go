@@ -0,0 +1,37 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package memory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+func TestEmptyObject(t *testing.T) {
+	m := New()
+	m.Upload(1, nil, objproxy.SourceGC)
+
+	if size, err := m.GetObjectSize(1); err != nil || size != 0 {
+		t.Fatalf("empty object has size %d, error %v", size, err)
+	}
+	if _, err := m.GetObjectSize(2); !errors.Is(err, objproxy.ErrNotFound) {
+		t.Fatalf("missing object returned error %v", err)
+	}
+}
+
+func TestUploadCopies(t *testing.T) {
+	m := New()
+	buf := []byte("data")
+	m.Upload(1, buf, objproxy.SourceWrite)
+	buf[0] = 'x'
+
+	got := make([]byte, 3)
+	if err := m.DownloadAt(1, got, 1); err != nil || string(got) != "ata" {
+		t.Fatalf("downloaded %q, error %v", got, err)
+	}
+	if err := m.DownloadAt(1, got, 2); err == nil {
+		t.Fatal("range out of the object downloaded")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package objproxy
+
+import (
+	"expvar"
+	"time"
+)
+
+// Statistics of queues of all proxies, published under "objproxy" in the
+// metrics.
+var metrics = expvar.NewMap("objproxy")
+
+// Upper bounds of buckets of the queue wait histogram. The last bucket is
+// unbounded.
+var waitBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Statistics of one request queue. The wait is the time between sending the
+// request and its start by a worker, i.e. it does not include the execution.
+type queueStats struct {
+	// Number of requests waiting for a worker.
+	queued *expvar.Int
+
+	// Histogram of queue wait times.
+	wait *expvar.Map
+
+	// Number of requests failed since they waited longer than the
+	// deadline.
+	expired *expvar.Int
+}
+
+func newQueueStats() queueStats {
+	return queueStats{
+		queued:  new(expvar.Int),
+		wait:    new(expvar.Map).Init(),
+		expired: new(expvar.Int),
+	}
+}
+
+// Publishes the statistics of the queue under name into stats.
+func (q queueStats) publish(stats *expvar.Map, name string) {
+	m := new(expvar.Map).Init()
+	m.Set("queued", q.queued)
+	m.Set("wait", q.wait)
+	m.Set("expired", q.expired)
+	stats.Set(name, m)
+}
+
+// Counts the request enqueued at start into the wait time histogram.
+func (q queueStats) observe(start time.Time) {
+	wait := time.Since(start)
+	for _, b := range waitBuckets {
+		if wait <= b {
+			q.wait.Add(b.String(), 1)
+			return
+		}
+	}
+	q.wait.Add("inf", 1)
+}
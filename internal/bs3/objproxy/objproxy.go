@@ -5,28 +5,92 @@
 package objproxy
 
 import (
+	"errors"
+	"expvar"
+	"sync/atomic"
 	"time"
 )
 
+// Returned for requests which waited for a worker longer than the deadline.
+var ErrDeadline = errors.New("request deadline exceeded in the queue")
+
+// Wrapped by errors of size requests of objects which do not exist, so they
+// can be told apart from failures of the backend.
+var ErrNotFound = errors.New("object not found")
+
+// Origin of the data of an uploaded object. Backends may store it with the
+// object, so the objects can be told apart in the bucket.
+type Source int
+
+const (
+	// Writes and discards of the device.
+	SourceWrite Source = iota
+
+	// Live data rewritten by GC and empty objects replacing dead ones.
+	SourceGC
+
+	// Checkpoint of the extent map and its shards.
+	SourceCheckpoint
+)
+
+// Returns name of the source.
+func (s Source) String() string {
+	switch s {
+	case SourceGC:
+		return "gc"
+	case SourceCheckpoint:
+		return "checkpoint"
+	default:
+		return "write"
+	}
+}
+
 // Interface for s3 backend storage. Anything implementing this interface can
 // be used as a storage backend.
 type ObjectUploadDownloaderAt interface {
-	// Uploads data in buf under the key identifier.
-	Upload(key int64, buf []byte) error
+	// Uploads data in buf under the key identifier. The buf is owned by
+	// the implementation only until Upload returns, hence it has to be
+	// streamed directly from buf without keeping any reference to it
+	// afterwards. The caller may pass the shared memory of the kernel
+	// which is reused for the next chunk as soon as the write returns.
+	// The source tells where the data come from.
+	Upload(key int64, buf []byte, source Source) error
 
 	// Downloads data into buf starting from offset in the object
 	// identified by key. The length of buf is the legth of requested data.
 	DownloadAt(key int64, buf []byte, offset int64) error
 
-	// Returns size in bytes of object identified by key. Needed only for
-	// garbage collection and extent map recovery. Otherwise can have empty
+	// Returns size in bytes of object identified by key. The error wraps
+	// ErrNotFound when the object does not exist. Needed only for garbage
+	// collection and extent map recovery. Otherwise can have empty
 	// implementation.
 	GetObjectSize(key int64) (int64, error)
 
+	// Returns size in bytes and incarnation of object identified by key
+	// by a single request. Objects without incarnation have incarnation 0.
+	// Needed only for extent map recovery. Otherwise can have empty
+	// implementation.
+	GetObjectInfo(key int64) (size, incarnation int64, err error)
+
+	// Sets incarnation of the volume stored with every object uploaded
+	// afterwards. Zero means no incarnation is stored.
+	SetIncarnation(incarnation int64)
+
+	// Sets timeout of every download and size request started
+	// afterwards. Uploads are never interrupted, since the body could be
+	// read after the interrupted upload returned. Zero means no timeout.
+	SetTimeout(timeout time.Duration)
+
 	// Deletes object identified by key and all successive objects. Needed
 	// only for extent map restoration. Otherwise can have empty
 	// implementation.
 	DeleteKeyAndSuccessors(key int64) error
+
+	// Calls fn for every existing object with its key and size in bytes,
+	// including the checkpoint. The order of keys is not defined. Listing
+	// stops when fn returns false. Needed only for tooling and
+	// restoration.
+	ListKeys(fn func(key, size int64) bool) error
 }
 
 // Proxy for the backend storage which prioritizes requests. Requests coming to
@@ -49,6 +113,18 @@ type ObjectProxy struct {
 	downloads     chan request
 	uploadsPrio   chan request
 	downloadsPrio chan request
+
+	// Channels for stopping surplus workers when the proxy is resized.
+	uploadersStop   chan struct{}
+	downloadersStop chan struct{}
+
+	// Deadline of requests in nanoseconds, see SetDeadline(). Shared by
+	// all copies of the proxy and accessed atomically.
+	deadline *int64
+
+	// Statistics of the queues.
+	uploadStats   queueStats
+	downloadStats queueStats
 }
 
 // Request is internal structure for wrapping the communication into channels.
@@ -56,13 +132,18 @@ type request struct {
 	key    int64
 	data   []byte
 	offset int64
+	source Source
 	done   chan error
+
+	// Time when the request was sent to the proxy.
+	enqueued time.Time
 }
 
 // Return new instance of the proxy which can be directly used. It immediately
-// spawns go routines for upload and download workers.
+// spawns go routines for upload and download workers. Statistics of the proxy
+// are published in the metrics under name.
 func New(storeInstance ObjectUploadDownloaderAt, uploaders, downloaders int,
-	idleTimeout time.Duration) ObjectProxy {
+	idleTimeout time.Duration, name string) ObjectProxy {
 
 	uploads := make(chan request)
 	downloads := make(chan request)
@@ -70,16 +151,26 @@ func New(storeInstance ObjectUploadDownloaderAt, uploaders, downloaders int,
 	downloadsPrio := make(chan request)
 
 	s := ObjectProxy{
-		Instance:      storeInstance,
-		uploaders:     uploaders,
-		downloaders:   downloaders,
-		idleTimeout:   idleTimeout,
-		uploads:       uploads,
-		downloads:     downloads,
-		uploadsPrio:   uploadsPrio,
-		downloadsPrio: downloadsPrio,
+		Instance:        storeInstance,
+		uploaders:       uploaders,
+		downloaders:     downloaders,
+		idleTimeout:     idleTimeout,
+		uploads:         uploads,
+		downloads:       downloads,
+		uploadsPrio:     uploadsPrio,
+		downloadsPrio:   downloadsPrio,
+		uploadersStop:   make(chan struct{}),
+		downloadersStop: make(chan struct{}),
+		deadline:        new(int64),
+		uploadStats:     newQueueStats(),
+		downloadStats:   newQueueStats(),
 	}
 
+	stats := new(expvar.Map).Init()
+	s.uploadStats.publish(stats, "upload")
+	s.downloadStats.publish(stats, "download")
+	metrics.Set(name, stats)
+
 	for i := 0; i < s.uploaders; i++ {
 		go s.uploadWorker()
 	}
@@ -91,16 +182,66 @@ func New(storeInstance ObjectUploadDownloaderAt, uploaders, downloaders int,
 	return s
 }
 
-// Proxy function for uploading the object with key. It selects the right
-// channel according to prio and waits for reply.
-func (p *ObjectProxy) Upload(key int64, body []byte, prio bool) error {
+// Changes the number of upload and download workers. New workers are spawned
+// immediately, surplus workers are stopped when they finish their current
+// request. Values lower than one are ignored.
+func (p *ObjectProxy) Resize(uploaders, downloaders int) {
+	if uploaders < 1 || downloaders < 1 {
+		return
+	}
+
+	for ; p.uploaders < uploaders; p.uploaders++ {
+		go p.uploadWorker()
+	}
+	for ; p.uploaders > uploaders; p.uploaders-- {
+		p.uploadersStop <- struct{}{}
+	}
+
+	for ; p.downloaders < downloaders; p.downloaders++ {
+		go p.downloadWorker()
+	}
+	for ; p.downloaders > downloaders; p.downloaders-- {
+		p.downloadersStop <- struct{}{}
+	}
+}
+
+// Sets the deadline of requests. A request which waited for a worker longer
+// than the deadline fails with ErrDeadline without being started, since it
+// would most likely not finish in time anyway. The deadline covers the queue
+// and the execution, but the execution is never interrupted, because the
+// caller owns the buffer of the request only after the request finishes.
+// Zero means no deadline.
+func (p *ObjectProxy) SetDeadline(deadline time.Duration) {
+	atomic.StoreInt64(p.deadline, int64(deadline))
+}
+
+// Returns ErrDeadline when the request r waited longer than the deadline.
+// Otherwise the wait is counted into stats.
+func (p *ObjectProxy) checkDeadline(r request, stats queueStats) error {
+	stats.queued.Add(-1)
+
+	deadline := time.Duration(atomic.LoadInt64(p.deadline))
+	if deadline > 0 && time.Since(r.enqueued) > deadline {
+		stats.expired.Add(1)
+		return ErrDeadline
+	}
+	stats.observe(r.enqueued)
+
+	return nil
+}
+
+// Proxy function for uploading the object with key and data from source. It
+// selects the right channel according to prio and waits for reply. The body is
+// not copied, it has to stay untouched until the function returns.
+func (p *ObjectProxy) Upload(key int64, body []byte, prio bool, source Source) error {
 	c := p.uploads
 	if prio {
 		c = p.uploadsPrio
 	}
 
 	done := make(chan error)
-	c <- request{key: key, data: body, done: done}
+	p.uploadStats.queued.Add(1)
+	c <- request{key: key, data: body, source: source, done: done, enqueued: time.Now()}
 	return <-done
 }
 
@@ -113,12 +254,14 @@ func (p *ObjectProxy) Download(key int64, chunk []byte, offset int64, prio bool)
 	}
 
 	done := make(chan error)
-	c <- request{key, chunk, offset, done}
+	p.downloadStats.queued.Add(1)
+	c <- request{key: key, data: chunk, offset: offset, done: done, enqueued: time.Now()}
 	return <-done
 }
 
-// Generic function for prioritization used by both, uploader and downloader workers.
-func (p *ObjectProxy) receiveRequest(prio chan request, normal chan request) request {
+// Generic function for prioritization used by both, uploader and downloader
+// workers. Returns false when the worker should stop.
+func (p *ObjectProxy) receiveRequest(prio chan request, normal chan request, stop chan struct{}) (request, bool) {
 	var r request
 
 	select {
@@ -128,17 +271,25 @@ func (p *ObjectProxy) receiveRequest(prio chan request, normal chan request) req
 		select {
 		case r = <-prio:
 		case r = <-normal:
+		case <-stop:
+			return r, false
 		}
 	}
 
-	return r
+	return r, true
 }
 
 // Upload worker just calls Upload() on the instance provided in New().
 func (p *ObjectProxy) uploadWorker() {
 	for {
-		r := p.receiveRequest(p.uploadsPrio, p.uploads)
-		err := p.Instance.Upload(r.key, r.data)
+		r, ok := p.receiveRequest(p.uploadsPrio, p.uploads, p.uploadersStop)
+		if !ok {
+			return
+		}
+		err := p.checkDeadline(r, p.uploadStats)
+		if err == nil {
+			err = p.Instance.Upload(r.key, r.data, r.source)
+		}
 		r.done <- err
 	}
 }
@@ -146,8 +297,14 @@ func (p *ObjectProxy) uploadWorker() {
 // Upload worker just calls Download() on the instance provided in New().
 func (p *ObjectProxy) downloadWorker() {
 	for {
-		r := p.receiveRequest(p.downloadsPrio, p.downloads)
-		err := p.Instance.DownloadAt(r.key, r.data, r.offset)
+		r, ok := p.receiveRequest(p.downloadsPrio, p.downloads, p.downloadersStop)
+		if !ok {
+			return
+		}
+		err := p.checkDeadline(r, p.downloadStats)
+		if err == nil {
+			err = p.Instance.DownloadAt(r.key, r.data, r.offset)
+		}
 		r.done <- err
 	}
 }
@@ -0,0 +1,71 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package s3
+
+import (
+	"fmt"
+)
+
+// Format string for the object name. There should be no need to set this
+// differently. If you want to change it, keep in mind that we rely on the
+// continuous space of keys for prefix consistecy as well as in the GC process.
+//
+// Furthermore we split the key into halves and use the lower half of bits as
+// s3 prefix and upper half for the object key. This is to prevent s3 rate
+// limiting which is applied to objects with the same prefix.
+const keyFmt = "%08x/%08x"
+
+// KeyCodec transforms keys of objects into their names in the bucket and back.
+// The name has to be derivable from the key alone and every key has to have
+// exactly one name, otherwise objects are not found or they are listed more
+// times. Decode returns an error for every name not produced by Encode, since
+// such objects do not belong to the volume and they must not be deleted. The
+// static name prefix and the key window are applied by S3 around the codec,
+// hence the codec sees physical keys without the name prefix.
+type KeyCodec interface {
+	Encode(key int64) string
+	Decode(name string) (int64, error)
+}
+
+// Optional extension of KeyCodec returning the common prefix of names of a
+// small group of keys including key. Codecs implementing it allow listing of
+// the neighbourhood of a key instead of the whole bucket, see
+// Options.PrefixDepth.
+type keyPrefixer interface {
+	Prefix(key int64) string
+}
+
+// The default KeyCodec splitting the key into halves, where the lower half is
+// the s3 prefix and the upper half is the rest of the name, see keyFmt.
+type DefaultKeyCodec struct{}
+
+func (DefaultKeyCodec) Encode(key int64) string {
+	left := (key >> 32) & 0xffffffff
+	right := key & 0xffffffff
+
+	return fmt.Sprintf(keyFmt, right, left)
+}
+
+// The inverse to Encode(). Names with different formatting, e.g. with a suffix
+// or without the leading zeros, would be parsed to the same key as the genuine
+// object, hence they are refused.
+func (c DefaultKeyCodec) Decode(name string) (int64, error) {
+	var prefix, key int64
+	n, err := fmt.Sscanf(name, keyFmt, &prefix, &key)
+	if err != nil || n != 2 {
+		return 0, fmt.Errorf("name %s does not match %s", name, keyFmt)
+	}
+
+	k := (key << 32) + prefix
+	if c.Encode(k) != name {
+		return 0, fmt.Errorf("name %s is not the canonical name of key %d", name, k)
+	}
+
+	return k, nil
+}
+
+// Returns the s3 prefix of the key, i.e. the lower half of its bits. All keys
+// sharing it differ by a multiple of 2^32.
+func (DefaultKeyCodec) Prefix(key int64) string {
+	return fmt.Sprintf("%08x/", key&0xffffffff)
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package s3
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// Keys at the edges of the halves of the default codec.
+var edgeKeys = []int64{
+	0, 1, -1, 0xffffffff, 0x100000000, -0x100000000,
+	-(1 << 40), -(1 << 40) + 1, math.MaxInt64, math.MinInt64,
+}
+
+func TestDefaultKeyCodecRoundTrip(t *testing.T) {
+	var c DefaultKeyCodec
+
+	roundTrip := func(key int64) bool {
+		k, err := c.Decode(c.Encode(key))
+		return err == nil && k == key
+	}
+	for _, key := range edgeKeys {
+		if !roundTrip(key) {
+			t.Fatalf("key %d does not survive the round trip", key)
+		}
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultKeyCodecPrefix(t *testing.T) {
+	var c DefaultKeyCodec
+
+	prefixed := func(key int64) bool {
+		return strings.HasPrefix(c.Encode(key), c.Prefix(key)) && c.Prefix(key) == c.Prefix(key+1<<32)
+	}
+	if err := quick.Check(prefixed, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultKeyCodecRefused(t *testing.T) {
+	var c DefaultKeyCodec
+
+	for _, name := range []string{
+		"",
+		"00000001",
+		"1/0",
+		"00000001/00000000.bak",
+		"00000001/0000000",
+		"0000000g/00000000",
+		"00000001-00000000",
+	} {
+		if key, err := c.Decode(name); err == nil {
+			t.Fatalf("name %q is decoded to key %d", name, key)
+		}
+	}
+}
+
+func TestNameRoundTrip(t *testing.T) {
+	s := &S3{
+		namePrefix: "volume/",
+		codec:      DefaultKeyCodec{},
+		keyBase:    1 << 50,
+		keySpan:    1 << 48,
+	}
+
+	for _, key := range []int64{0, 1, -1, -(1 << 40), 1<<48 - 1} {
+		name := s.encode(key)
+		if !strings.HasPrefix(name, s.namePrefix) {
+			t.Fatalf("name %s of key %d does not have the name prefix", name, key)
+		}
+		if k, ok := s.decode(name); !ok || k != key {
+			t.Fatalf("name %s of key %d is decoded to %d, %v", name, key, k, ok)
+		}
+	}
+
+	// Names of other volumes sharing the bucket are refused.
+	other := &S3{namePrefix: "volume/", codec: DefaultKeyCodec{}}
+	if k, ok := s.decode(other.encode(1)); ok {
+		t.Fatalf("name outside of the key window is decoded to %d", k)
+	}
+	if k, ok := s.decode("other/" + DefaultKeyCodec{}.Encode(1<<50)); ok {
+		t.Fatalf("name with another prefix is decoded to %d", k)
+	}
+}
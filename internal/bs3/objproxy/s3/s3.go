@@ -6,31 +6,51 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/net/http2"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
 )
 
 const (
-	// Format string for the object key. There should be no need to set
-	// this differently, hence the constant. If you want to change it, keep
-	// in mind that we rely on the continuous space of keys for prefix
-	// consistecy as well as in the GC process.
-	//
-	// Furthermore we split the key into halves and use the lower half of
-	// bits as s3 prefix and upper half for the object key. This is to
-	// prevent s3 rate limiting which is applied to objects with the same
-	// prefix.
-	keyFmt = "%08x/%08x"
+	// Validity of presigned urls used for downloads through the CDN. Urls
+	// are generated for every request, hence it can be short.
+	presignExpiration = 15 * time.Minute
+
+	// Name of the user metadata with the volume identifier.
+	volumeMetadata = "Bs3-Volume"
+
+	// Name of the user metadata with the incarnation of the volume.
+	incarnationMetadata = "Bs3-Incarnation"
+
+	// Name of the object tag with the source of the data of the object.
+	sourceTag = "bs3-source"
+
+	// Maximal number of keys deleted by one DeleteObjects request
+	// accepted by AWS S3.
+	maxDeleteBatchSize = 1000
 )
 
 // Implementation of ObjectUploadDownloaderAt using AWS S3 as a backend.
@@ -41,6 +61,58 @@ type S3 struct {
 	downloader *s3manager.Downloader
 	client     *s3.S3
 	bucket     string
+
+	// Http client and base url of the CDN used for downloads. Downloads go
+	// directly to the s3 backend when cdn is nil or cdnEnabled is zero, see
+	// UseCDN(). Accessed atomically.
+	httpClient *http.Client
+	cdn        *url.URL
+	cdnEnabled int32
+
+	// Object lock mode and retention period set on every uploaded object.
+	// Object lock is not used when lockMode is empty.
+	lockMode      string
+	lockRetention time.Duration
+
+	// User metadata set on every uploaded object.
+	metadata map[string]*string
+
+	// Incarnation of the volume added to the user metadata of every
+	// uploaded object when it is not zero. Accessed atomically.
+	incarnation int64
+
+	// Timeout of downloads and size requests in nanoseconds, zero means no
+	// timeout. Accessed atomically.
+	timeout int64
+
+	// Number of keys following the deleted key whose prefixes are listed
+	// in DeleteKeyAndSuccessors. Zero means listing of the whole bucket.
+	prefixDepth int64
+
+	// Maximal number of keys deleted by one request in
+	// DeleteKeyAndSuccessors.
+	deleteBatchSize int
+
+	// Set when the backend does not implement DeleteObjects, e.g. GCS, and
+	// objects are deleted one by one. Accessed atomically.
+	singleDeletes int32
+
+	// Static prefix of names of all objects.
+	namePrefix string
+
+	// Transformation of physical keys into names after the name prefix.
+	codec KeyCodec
+
+	// Window of keys of the volume in the bucket, see Options.
+	keyBase int64
+	keySpan int64
+
+	// Content-Encoding set on every uploaded object. Downloads request the
+	// identity encoding when it is set.
+	contentEncoding string
+
+	// Tag every uploaded object with the source of its data.
+	tagSource bool
 }
 
 // Options to use in New() function due to high number of parameters. There is
@@ -52,6 +124,167 @@ type Options struct {
 	AccessKey string
 	SecretKey string
 	PartSize  int64
+
+	// Detect the region of the bucket and use it instead of Region, which
+	// is used only as a hint and as a fallback when the detection fails.
+	AutoRegion bool
+
+	// Base url of the CDN in front of the s3 backend. When set and enabled
+	// by UseCDN(), downloads of objects with non-negative keys are done by
+	// presigned urls through the CDN. Uploads and all other operations
+	// always go directly to the s3 backend.
+	CDN string
+
+	// Url of the HTTP proxy used for all requests to the s3 backend and
+	// the CDN instead of the proxy given by the environment, e.g.
+	// "http://proxy:3128". The environment still applies to the rest of
+	// the process. Empty string means the proxy from the environment.
+	HTTPProxy string
+
+	// Object lock mode, i.e. GOVERNANCE or COMPLIANCE, and retention
+	// period set on every uploaded object. Empty mode means no object
+	// lock.
+	LockMode      string
+	LockRetention time.Duration
+
+	// Identifier of the volume stored in the metadata of every uploaded
+	// object. Useful for inspection of the bucket by external tools.
+	VolumeID string
+
+	// Number of keys following the key deleted by DeleteKeyAndSuccessors
+	// whose prefixes are listed instead of the whole bucket. The window
+	// is extended whenever a successor is found in it. Zero means listing
+	// of the whole bucket.
+	PrefixDepth int64
+
+	// Maximal number of keys deleted by one DeleteObjects request in
+	// DeleteKeyAndSuccessors. Some S3 compatible backends accept fewer
+	// keys than AWS S3 and reject larger requests as a whole. Zero means
+	// the AWS S3 limit of 1000 keys.
+	DeleteBatchSize int
+
+	// Number of retries of a failed request done by the AWS SDK. Failed
+	// uploads and downloads are retried by bs3 itself with exponential
+	// backoff, hence every our attempt does up to MaxRetries+1 requests.
+	// Negative value means the SDK default.
+	MaxRetries int
+
+	// Static prefix prepended to names of all objects, e.g. "volumes/vol0/".
+	// The object name has to be derivable from its key alone, hence the
+	// prefix cannot change in time.
+	NamePrefix string
+
+	// Offset added to keys of all objects, so volumes sharing a bucket
+	// without name prefixes have disjoint key windows. Key k >= 0 is
+	// stored as KeyBase+k and key k < 0 as k-KeyBase. Only keys with
+	// absolute value under KeySpan belong to the volume, hence listing
+	// and deletion of successors never touch keys of other volumes. Zero
+	// KeySpan means no upper bound, so it can be used only by the volume
+	// with the highest KeyBase.
+	KeyBase int64
+	KeySpan int64
+
+	// Transformation of keys into names of objects following NamePrefix.
+	// Listing of prefixes by PrefixDepth is possible only with codecs
+	// providing prefixes of keys, otherwise the whole bucket is listed.
+	// Nil means DefaultKeyCodec.
+	KeyCodec KeyCodec
+
+	// Comma separated list of AWS SDK logging options, see sdkLogLevels.
+	// The SDK log is routed to the debug level of the bs3 log. Empty
+	// string disables the SDK log.
+	SDKLogLevel string
+
+	// Abort incomplete multipart uploads of objects of the volume left in
+	// the bucket, e.g. by a crash during the checkpoint upload. It is done
+	// once in New(), hence no upload of this instance can be aborted.
+	AbortMultipart bool
+
+	// Nothing is changed in New(), i.e. the bucket is not created and
+	// multipart uploads are not aborted, so tools can inspect the bucket
+	// of a running volume.
+	ReadOnly bool
+
+	// Content-Encoding set on every uploaded object, e.g. for gateways
+	// which transform objects according to it. Objects are always stored
+	// as they are, the header only describes them. When it is set, every
+	// download sends Accept-Encoding: identity, since a gateway decoding
+	// the object on the fly would apply the range to the decoded content
+	// or decode only the requested range, both resulting in wrong data.
+	// The gateway has to honor the identity encoding, bs3 cannot detect
+	// a transformed response. Empty string means no Content-Encoding.
+	ContentEncoding string
+
+	// Tag every uploaded object with bs3-source set to the source of its
+	// data, i.e. write, gc or checkpoint, so bucket analytics can
+	// attribute the storage to writes and GC rewrites separately.
+	TagSource bool
+}
+
+// Names of AWS SDK logging options. All of them enable the debug log of
+// requests and add more details to it.
+var sdkLogLevels = map[string]aws.LogLevelType{
+	"off":     aws.LogOff,
+	"debug":   aws.LogDebug,
+	"signing": aws.LogDebugWithSigning,
+	"body":    aws.LogDebugWithHTTPBody,
+	"retries": aws.LogDebugWithRequestRetries,
+	"errors":  aws.LogDebugWithRequestErrors,
+}
+
+// Returns number of retries of the AWS SDK for n retries of the options. The
+// SDK uses its default only for -1, so every negative value is mapped to it.
+func sdkMaxRetries(n int) int {
+	if n < 0 {
+		return aws.UseServiceDefaultRetries
+	}
+
+	return n
+}
+
+// Returns AWS SDK log level combined from comma separated list of names of
+// logging options.
+func parseSDKLogLevel(names string) (aws.LogLevelType, error) {
+	level := aws.LogOff
+	if names == "" {
+		return level, nil
+	}
+
+	for _, n := range strings.Split(names, ",") {
+		l, ok := sdkLogLevels[strings.TrimSpace(n)]
+		if !ok {
+			return level, fmt.Errorf("unknown AWS SDK log level %q", n)
+		}
+		level |= l
+	}
+
+	return level, nil
+}
+
+// Returns url of the HTTP proxy parsed from proxy or nil when it is empty. Only
+// absolute http, https and socks5 urls are accepted, so a typo is reported at
+// startup instead of failing every request.
+func parseHTTPProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP proxy %q: %w", proxy, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("HTTP proxy %q has to be http, https or socks5 url", proxy)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("HTTP proxy %q has no host", proxy)
+	}
+
+	return u, nil
 }
 
 // Helper struct used for tuning the http connection.
@@ -64,13 +297,21 @@ type httpClientSettings struct {
 	maxHostIdleConns int
 	responseHeader   time.Duration
 	tlsHandshake     time.Duration
+
+	// Proxy of all requests, nil means the proxy from the environment.
+	proxy *url.URL
 }
 
 // Returns http client with configured parameters and added https2 support.
 func newHTTPClientWithSettings(httpSettings httpClientSettings) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if httpSettings.proxy != nil {
+		proxy = http.ProxyURL(httpSettings.proxy)
+	}
+
 	tr := &http.Transport{
 		ResponseHeaderTimeout: httpSettings.responseHeader,
-		Proxy:                 http.ProxyFromEnvironment,
+		Proxy:                 proxy,
 		DialContext: (&net.Dialer{
 			KeepAlive: httpSettings.connKeepAlive,
 			DualStack: true,
@@ -90,44 +331,222 @@ func newHTTPClientWithSettings(httpSettings httpClientSettings) *http.Client {
 	}
 }
 
-// Upload function implemented through s3 api.
-func (s *S3) Upload(key int64, buf []byte) error {
-	_, err := s.uploader.Upload(&s3manager.UploadInput{
+// Upload function implemented through s3 api. The buffer is streamed without
+// copying, since bytes.Reader implements io.ReaderAt and io.Seeker and hence
+// s3manager reads parts directly from it instead of buffering them. Object
+// smaller than the part size is sent by a single request.
+func (s *S3) Upload(key int64, buf []byte, source objproxy.Source) error {
+	if s.keySpan != 0 && (key >= s.keySpan || key <= -s.keySpan) {
+		return fmt.Errorf("key %d is out of the key window of size %d", key, s.keySpan)
+	}
+
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(encode(key)),
+		Key:    aws.String(s.encode(key)),
 		Body:   bytes.NewReader(buf),
-	})
+	}
+
+	if s.metadata != nil {
+		input.Metadata = s.metadata
+	}
+
+	if incarnation := atomic.LoadInt64(&s.incarnation); incarnation != 0 {
+		input.Metadata = make(map[string]*string, len(s.metadata)+1)
+		for k, v := range s.metadata {
+			input.Metadata[k] = v
+		}
+		input.Metadata[incarnationMetadata] = aws.String(strconv.FormatInt(incarnation, 10))
+	}
+
+	if s.contentEncoding != "" {
+		input.ContentEncoding = aws.String(s.contentEncoding)
+	}
+
+	if s.tagSource {
+		input.Tagging = aws.String(url.Values{sourceTag: {source.String()}}.Encode())
+	}
+
+	// Object lock requires Content-MD5 for every upload with retention.
+	if s.lockMode != "" {
+		sum := md5.Sum(buf)
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		input.ObjectLockMode = aws.String(s.lockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(s.lockRetention))
+	}
+
+	_, err := s.uploader.Upload(input)
 
 	return err
 }
 
+// Returns context of a download or size request with the current timeout.
+func (s *S3) requestContext() (aws.Context, context.CancelFunc) {
+	timeout := time.Duration(atomic.LoadInt64(&s.timeout))
+	if timeout == 0 {
+		return context.Background(), func() {}
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// SetTimeout function implemented by the context of requests.
+func (s *S3) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&s.timeout, int64(timeout))
+}
+
 // GetObjectSize function implemented through s3 api.
 func (s *S3) GetObjectSize(key int64) (int64, error) {
-	head, err := s.client.HeadObject(&s3.HeadObjectInput{
+	ctx, cancel := s.requestContext()
+	defer cancel()
+
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(encode(key)),
+		Key:    aws.String(s.encode(key)),
 	})
 
-	var size int64
-	if err == nil {
-		size = *head.ContentLength
+	if err != nil {
+		return 0, headError(key, err)
+	}
+
+	return *head.ContentLength, nil
+}
+
+// Returns err of the HEAD request of the object with key wrapping
+// objproxy.ErrNotFound when the object does not exist.
+func headError(key int64, err error) error {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("%w: object %d: %v", objproxy.ErrNotFound, key, err)
 	}
 
-	return size, err
+	return err
+}
+
+// GetObjectInfo function implemented through s3 api. The incarnation is read
+// from the user metadata of the object.
+func (s *S3) GetObjectInfo(key int64) (int64, int64, error) {
+	ctx, cancel := s.requestContext()
+	defer cancel()
+
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.encode(key)),
+	})
+	if err != nil {
+		return 0, 0, headError(key, err)
+	}
+
+	var incarnation int64
+	if v, ok := head.Metadata[incarnationMetadata]; ok && v != nil {
+		incarnation, err = strconv.ParseInt(*v, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid incarnation %q of object %d", *v, key)
+		}
+	}
+
+	return *head.ContentLength, incarnation, nil
+}
+
+// SetIncarnation function implemented by the user metadata.
+func (s *S3) SetIncarnation(incarnation int64) {
+	atomic.StoreInt64(&s.incarnation, incarnation)
 }
 
 // DownloadAt function implemented through s3 api.
 func (s *S3) DownloadAt(key int64, buf []byte, offset int64) error {
 	to := offset + int64(len(buf)) - 1
 	rng := fmt.Sprintf("bytes=%d-%d", offset, to)
+
+	ctx, cancel := s.requestContext()
+	defer cancel()
+
+	if s.cdn != nil && key >= 0 && atomic.LoadInt32(&s.cdnEnabled) != 0 {
+		return s.downloadAtCDN(ctx, key, buf, offset, rng)
+	}
 	b := aws.NewWriteAtBuffer(buf)
 
-	_, err := s.downloader.Download(b, &s3.GetObjectInput{
+	var opts []func(*s3manager.Downloader)
+	if s.contentEncoding != "" {
+		opts = append(opts, s3manager.WithDownloaderRequestOptions(
+			request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"})))
+	}
+
+	_, err := s.downloader.DownloadWithContext(ctx, b, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(encode(key)),
+		Key:    aws.String(s.encode(key)),
 		Range:  &rng,
+	}, opts...)
+
+	return err
+}
+
+// Enables or disables downloads through the CDN, it is disabled after New().
+// The CDN caches whole objects by their names, hence it may serve only objects
+// which never change under their key. Objects with negative keys, i.e. the
+// checkpoint, its deltas and shards and the integrity log, are rewritten under
+// the same key, so they never go through the CDN. Objects read by the recovery
+// may be discarded and their keys reused, so the CDN has to be enabled only
+// after the recovery, when downloads read immutable data objects only.
+func (s *S3) UseCDN(use bool) {
+	var enabled int32
+	if use {
+		enabled = 1
+	}
+
+	atomic.StoreInt32(&s.cdnEnabled, enabled)
+}
+
+// DownloadAt implemented through the CDN. The object is addressed by the
+// presigned url with scheme and host replaced by the CDN ones. The range is not
+// part of the signature, so the CDN can cache the whole object and serve any
+// range from it.
+func (s *S3) downloadAtCDN(ctx context.Context, key int64, buf []byte, offset int64, rng string) error {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.encode(key)),
 	})
 
+	presigned, err := req.Presign(presignExpiration)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(presigned)
+	if err != nil {
+		return err
+	}
+	u.Scheme = s.cdn.Scheme
+	u.Host = s.cdn.Host
+	u.Path = path.Join("/", s.cdn.Path, u.Path)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Range", rng)
+	if s.contentEncoding != "" {
+		httpReq.Header.Set("Accept-Encoding", "identity")
+	}
+
+	resp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The CDN ignored the range and returns the whole object.
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("CDN download of object %d failed: %s", key, resp.Status)
+	}
+
+	_, err = io.ReadFull(resp.Body, buf)
+
 	return err
 }
 
@@ -135,7 +554,7 @@ func (s *S3) DownloadAt(key int64, buf []byte, offset int64) error {
 func (s *S3) Delete(key int64) error {
 	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(encode(key)),
+		Key:    aws.String(s.encode(key)),
 	})
 
 	return err
@@ -144,6 +563,32 @@ func (s *S3) Delete(key int64) error {
 func New(o Options) (*S3, error) {
 	s := new(S3)
 	s.bucket = o.Bucket
+	s.lockMode = o.LockMode
+	s.lockRetention = o.LockRetention
+	s.prefixDepth = o.PrefixDepth
+	s.deleteBatchSize = o.DeleteBatchSize
+	s.namePrefix = o.NamePrefix
+	s.codec = o.KeyCodec
+	if s.codec == nil {
+		s.codec = DefaultKeyCodec{}
+	}
+	if _, ok := s.codec.(keyPrefixer); !ok && s.prefixDepth > 0 {
+		log.Warn().Msgf("Key codec %T does not provide prefixes of keys. The whole bucket is listed instead.", s.codec)
+		s.prefixDepth = 0
+	}
+	s.keyBase = o.KeyBase
+	s.keySpan = o.KeySpan
+	s.contentEncoding = o.ContentEncoding
+	s.tagSource = o.TagSource
+
+	if o.VolumeID != "" {
+		s.metadata = map[string]*string{volumeMetadata: aws.String(o.VolumeID)}
+	}
+
+	proxy, err := parseHTTPProxy(o.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
 
 	// For the best possible performance (throughput close to 10GB/s) it
 	// should be tuned according to the object backend.
@@ -158,8 +603,21 @@ func New(o Options) (*S3, error) {
 		maxHostIdleConns: 10,
 		responseHeader:   5 * time.Second,
 		tlsHandshake:     5 * time.Second,
+		proxy:            proxy,
 	})
 
+	if s.deleteBatchSize == 0 {
+		s.deleteBatchSize = maxDeleteBatchSize
+	}
+	if s.deleteBatchSize < 0 || s.deleteBatchSize > maxDeleteBatchSize {
+		return nil, fmt.Errorf("delete batch size %d is not between 1 and %d", s.deleteBatchSize, maxDeleteBatchSize)
+	}
+
+	logLevel, err := parseSDKLogLevel(o.SDKLogLevel)
+	if err != nil {
+		return nil, err
+	}
+
 	sess, err := session.NewSession(&aws.Config{
 		Endpoint:                      aws.String(o.Remote),
 		Region:                        aws.String(o.Region),
@@ -167,12 +625,29 @@ func New(o Options) (*S3, error) {
 		S3ForcePathStyle:              aws.Bool(true),
 		S3DisableContentMD5Validation: aws.Bool(true),
 		HTTPClient:                    httpClient,
+		MaxRetries:                    aws.Int(sdkMaxRetries(o.MaxRetries)),
+		LogLevel:                      aws.LogLevel(logLevel),
+		Logger: aws.LoggerFunc(func(args ...interface{}) {
+			log.Debug().Str("bucket", o.Bucket).Msg(fmt.Sprint(args...))
+		}),
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
+	if o.AutoRegion {
+		sess = s.detectRegion(sess, o.Region)
+	}
+
+	if o.CDN != "" {
+		s.cdn, err = url.Parse(o.CDN)
+		if err != nil {
+			return nil, err
+		}
+		s.httpClient = httpClient
+	}
+
 	s.client = s3.New(sess)
 	s.uploader = s3manager.NewUploader(sess)
 	s.downloader = s3manager.NewDownloader(sess)
@@ -184,23 +659,102 @@ func New(o Options) (*S3, error) {
 	// huge (= huge device) and you have fast network and don't want to
 	// wait.
 	s.uploader.Concurrency = 1
+
+	// Objects larger than the part size, i.e. the checkpoint, are uploaded
+	// by multipart upload. When any part fails, the upload is aborted, so
+	// its parts do not consume space in the bucket.
+	s.uploader.LeavePartsOnError = false
+
 	s3manager.WithUploaderRequestOptions(request.Option(func(r *request.Request) {
 		r.HTTPRequest.Header.Add("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
 	}))(s.uploader)
 	s.downloader.Concurrency = 1
 
+	if o.ReadOnly {
+		return s, nil
+	}
+
 	err = s.makeBucketExist()
+	if err == nil && o.AbortMultipart {
+		err = s.abortMultipartUploads()
+	}
 
 	return s, err
 }
 
+// Returns session with the region of the bucket. The region is detected by the
+// HeadBucket request, which is answered with the region of the bucket even when
+// it is sent to a wrong region. The session is returned unchanged when the
+// detection fails, e.g. when the bucket does not exist yet, or when the region
+// is the configured one.
+func (s *S3) detectRegion(sess *session.Session, configured string) *session.Session {
+	region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, s.bucket, configured)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Region of bucket %s was not detected. Configured region %s is used.", s.bucket, configured)
+		return sess
+	}
+
+	if region == configured {
+		log.Info().Msgf("Bucket %s is in the configured region %s.", s.bucket, region)
+		return sess
+	}
+
+	log.Info().Msgf("Bucket %s is in region %s instead of the configured region %s. Detected region is used.",
+		s.bucket, region, configured)
+
+	return sess.Copy(&aws.Config{Region: aws.String(region)})
+}
+
+// Aborts all incomplete multipart uploads of objects of the volume. Parts of
+// the upload interrupted by a crash consume space in the bucket until they are
+// aborted. Uploads of names not produced by encode() are kept, since they do
+// not belong to the volume.
+func (s *S3) abortMultipartUploads() error {
+	var aborted int
+	var abortErr error
+
+	err := s.client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.namePrefix),
+	}, func(page *s3.ListMultipartUploadsOutput, last bool) bool {
+		for _, u := range page.Uploads {
+			if _, ok := s.decode(*u.Key); !ok {
+				continue
+			}
+
+			_, abortErr = s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      u.Key,
+				UploadId: u.UploadId,
+			})
+			if abortErr != nil {
+				return false
+			}
+			aborted++
+		}
+		return true
+	})
+
+	if err == nil {
+		err = abortErr
+	}
+	if aborted > 0 {
+		log.Info().Msgf("Aborted %d incomplete multipart uploads in bucket %s.", aborted, s.bucket)
+	}
+
+	return err
+}
+
 // Check whether bucket exist and if not, create it and wait until it appears.
+// Object lock can be enabled only during bucket creation, hence it is enabled
+// when the lock mode is configured.
 func (s *S3) makeBucketExist() error {
 	_, err := s.client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
 
 	if err != nil {
 		_, err = s.client.CreateBucket(&s3.CreateBucketInput{
-			Bucket: aws.String(s.bucket)})
+			Bucket:                     aws.String(s.bucket),
+			ObjectLockEnabledForBucket: aws.Bool(s.lockMode != "")})
 
 		if err == nil {
 			err = s.client.WaitUntilBucketExists(&s3.HeadBucketInput{
@@ -211,15 +765,194 @@ func (s *S3) makeBucketExist() error {
 	return err
 }
 
-// Delete object with key and all objects with higher keys.
+// Delete object with key and all objects with higher keys. When the prefix
+// depth is set, only prefixes of keys following fromKey are listed, see
+// deleteKeyAndSuccessorsByPrefix(). Objects are deleted in batches of at most
+// deleteBatchSize keys.
 func (s *S3) DeleteKeyAndSuccessors(fromKey int64) error {
+	batch := s.newDeleteBatch()
+	if s.prefixDepth > 0 {
+		if err := s.deleteKeyAndSuccessorsByPrefix(fromKey, batch); err != nil {
+			return err
+		}
+
+		return batch.flush()
+	}
+
+	err := s.ListKeys(func(key, size int64) bool {
+		if key >= fromKey {
+			batch.add(key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return batch.flush()
+}
+
+// Keys collected for deletion by one DeleteObjects request.
+type deleteBatch struct {
+	s       *S3
+	objects []*s3.ObjectIdentifier
+
+	// First error of all requests of the batch.
+	err error
+}
+
+// Returns empty batch of keys to delete.
+func (s *S3) newDeleteBatch() *deleteBatch {
+	return &deleteBatch{
+		s:       s,
+		objects: make([]*s3.ObjectIdentifier, 0, s.deleteBatchSize),
+	}
+}
+
+// Adds key to the batch. Keys are deleted when the batch is full.
+func (d *deleteBatch) add(key int64) {
+	d.objects = append(d.objects, &s3.ObjectIdentifier{Key: aws.String(d.s.encode(key))})
+	if len(d.objects) == d.s.deleteBatchSize {
+		d.flush()
+	}
+}
+
+// Deletes all keys of the batch by one request or one by one when the backend
+// does not implement deletion of multiple objects. Failure of the request or of
+// deletion of individual objects does not stop deletion of next batches.
+// Returns the first error of all requests so far.
+func (d *deleteBatch) flush() error {
+	if len(d.objects) == 0 {
+		return d.err
+	}
+
+	var err error
+	if atomic.LoadInt32(&d.s.singleDeletes) == 0 {
+		err = d.deleteObjects()
+		if notImplemented(err) {
+			log.Info().Msgf("Bucket %s does not support deletion of multiple objects by one request. "+
+				"Objects are deleted one by one.", d.s.bucket)
+			atomic.StoreInt32(&d.s.singleDeletes, 1)
+		}
+	}
+	if atomic.LoadInt32(&d.s.singleDeletes) == 1 {
+		err = d.deleteSingle()
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Deletion of %d objects in bucket %s failed.", len(d.objects), d.s.bucket)
+		if d.err == nil {
+			d.err = err
+		}
+	}
+
+	d.objects = d.objects[:0]
+
+	return d.err
+}
+
+// Deletes all keys of the batch by one DeleteObjects request.
+func (d *deleteBatch) deleteObjects() error {
+	out, err := d.s.client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(d.s.bucket),
+		Delete: &s3.Delete{
+			Objects: d.objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err == nil && len(out.Errors) > 0 {
+		e := out.Errors[0]
+		err = fmt.Errorf("deletion of %d objects failed, %s: %s: %s",
+			len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
+
+	return err
+}
+
+// Deletes all keys of the batch by a DeleteObject request per key. Returns the
+// first error together with the number of failed deletions.
+func (d *deleteBatch) deleteSingle() error {
+	var first error
+	failed := 0
+	for _, o := range d.objects {
+		_, err := d.s.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(d.s.bucket),
+			Key:    o.Key,
+		})
+		if err != nil {
+			failed++
+			if first == nil {
+				first = fmt.Errorf("%s: %w", aws.StringValue(o.Key), err)
+			}
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("deletion of %d objects failed, %w", failed, first)
+	}
+
+	return nil
+}
+
+// Returns true when err is the refusal of a request the backend does not
+// implement.
+func notImplemented(err error) bool {
+	var failure awserr.RequestFailure
+	return errors.As(err, &failure) &&
+		(failure.Code() == "NotImplemented" || failure.StatusCode() == http.StatusNotImplemented)
+}
+
+// Deletes successors by listing just the prefixes of keys in the window
+// following fromKey. Successors are objects uploaded concurrently with the
+// missing one, hence they are close to it. Whenever a successor is found, the
+// window is extended to prefixDepth keys after it. Listing of one prefix
+// returns all keys sharing the lower half of bits, hence the cost does not
+// depend on the number of objects in the bucket.
+func (s *S3) deleteKeyAndSuccessorsByPrefix(fromKey int64, batch *deleteBatch) error {
+	end := fromKey + s.prefixDepth
+	for k := fromKey; k < end && k-fromKey <= 0xffffffff; k++ {
+		err := s.listPrefix(s.prefix(k), func(key, size int64) bool {
+			if key >= fromKey {
+				batch.add(key)
+				if key+s.prefixDepth >= end {
+					end = key + s.prefixDepth + 1
+				}
+			}
+			return true
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListKeys function implemented through paginated s3 listing.
+func (s *S3) ListKeys(fn func(key, size int64) bool) error {
+	return s.listPrefix(s.namePrefix, fn)
+}
+
+// Calls fn for every object with the s3 prefix. The name prefix lists all
+// objects of the volume. Objects with names not produced by encode() are
+// reported and skipped, so they are never deleted as successors of some key.
+func (s *S3) listPrefix(prefix string, fn func(key, size int64) bool) error {
 	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
 	}, func(page *s3.ListObjectsV2Output, last bool) bool {
 		for _, o := range page.Contents {
-			key := decode(*o.Key)
-			if key >= fromKey {
-				s.Delete(key)
+			physical, err := s.parseName(*o.Key)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Object %s in bucket %s does not match the naming scheme. Ignoring it.", *o.Key, s.bucket)
+				continue
+			}
+			key, ok := s.logical(physical)
+			if !ok {
+				// Object of another volume sharing the bucket.
+				continue
+			}
+			if !fn(key, *o.Size) {
+				return false
 			}
 		}
 		return true
@@ -228,22 +961,69 @@ func (s *S3) DeleteKeyAndSuccessors(fromKey int64) error {
 	return err
 }
 
-// We split the key into halves and use the lower half of bits as s3 prefix and
-// upper half for the object key. This is to prevent s3 rate limiting which is
-// applied to objects with the same prefix.
-func encode(key int64) string {
-	left := (key >> 32) & 0xffffffff
-	right := key & 0xffffffff
+// Returns name of the object with key. The key is moved to the key window of
+// the volume, transformed by the key codec and the name prefix is prepended.
+func (s *S3) encode(key int64) string {
+	return s.name(s.physical(key))
+}
+
+// Returns name of the object with the physical key, see encode().
+func (s *S3) name(physical int64) string {
+	return s.namePrefix + s.codec.Encode(physical)
+}
+
+// Returns s3 prefix of the key, i.e. the name prefix and the prefix of the key
+// given by the key codec, see encode(). The codec has to implement
+// keyPrefixer, which is checked in New().
+func (s *S3) prefix(key int64) string {
+	return s.namePrefix + s.codec.(keyPrefixer).Prefix(s.physical(key))
+}
+
+// Returns key of the object in the bucket, i.e. the key moved to the key
+// window of the volume.
+func (s *S3) physical(key int64) int64 {
+	if key >= 0 {
+		return key + s.keyBase
+	}
+
+	return key - s.keyBase
+}
+
+// The inverse to physical(). Returns false when the physical key is outside of
+// the key window of the volume.
+func (s *S3) logical(physical int64) (int64, bool) {
+	var key int64
+	switch {
+	case physical >= s.keyBase:
+		key = physical - s.keyBase
+	case physical < -s.keyBase:
+		key = physical + s.keyBase
+	default:
+		return 0, false
+	}
 
-	return fmt.Sprintf(keyFmt, right, left)
+	return key, s.keySpan == 0 || (key < s.keySpan && key > -s.keySpan)
 }
 
-// The inverse to encode()
-func decode(keyWithPrefix string) int64 {
-	var prefix, key int64
-	fmt.Sscanf(keyWithPrefix, keyFmt, &prefix, &key)
+// The inverse to encode(). Returns false when the name was not produced by
+// encode() for a key of the volume.
+func (s *S3) decode(name string) (int64, bool) {
+	physical, err := s.parseName(name)
+	if err != nil {
+		return 0, false
+	}
+
+	return s.logical(physical)
+}
 
-	k := (key << 32) + prefix
+// The inverse to name(). Returns an error when the name was not produced by
+// name(), i.e. it does not have the name prefix or the key codec refuses it.
+// Every key has exactly one name, hence duplicates of keys cannot appear in
+// the listing.
+func (s *S3) parseName(name string) (int64, error) {
+	if !strings.HasPrefix(name, s.namePrefix) {
+		return 0, fmt.Errorf("name %s does not have prefix %s", name, s.namePrefix)
+	}
 
-	return k
+	return s.codec.Decode(name[len(s.namePrefix):])
 }
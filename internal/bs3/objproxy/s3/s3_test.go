@@ -0,0 +1,136 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Returns S3 with the default key codec talking to the server handled by
+// handler.
+func newTestS3(t *testing.T, handler http.HandlerFunc) *S3 {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &S3{
+		client: s3.New(sess),
+		bucket: "bucket",
+		codec:  DefaultKeyCodec{},
+	}
+}
+
+// Returns handler answering every listing by one page with names.
+func listingHandler(names ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+		fmt.Fprintf(w, "<Name>bucket</Name><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>", len(names))
+		for _, name := range names {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>1</Size></Contents>", name)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	}
+}
+
+func TestListingSkipsDuplicateKeys(t *testing.T) {
+	var c DefaultKeyCodec
+	genuine := c.Encode(1)
+
+	// All the names decode to key 1, but only the genuine one is its
+	// canonical name.
+	s := newTestS3(t, listingHandler(
+		genuine,
+		genuine+".bak",
+		"00000001/0",
+		"1/00000000",
+		c.Encode(2),
+	))
+
+	listed := make(map[int64]int)
+	if err := s.ListKeys(func(key, size int64) bool {
+		listed[key]++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 2 || listed[1] != 1 || listed[2] != 1 {
+		t.Fatalf("listed keys %v, want keys 1 and 2 once", listed)
+	}
+}
+
+func TestNegativeMaxRetriesIsDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	for _, n := range []int{-1, -5} {
+		s, err := New(Options{
+			Remote:     server.URL,
+			Region:     "us-east-1",
+			AccessKey:  "access",
+			SecretKey:  "secret",
+			Bucket:     "bucket",
+			MaxRetries: n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retries := s.client.MaxRetries(); retries != client.DefaultRetryerMaxNumRetries {
+			t.Fatalf("max retries %d gives %d SDK retries", n, retries)
+		}
+	}
+}
+
+func TestDeleteWithoutDeleteObjects(t *testing.T) {
+	var c DefaultKeyCodec
+	var mutex sync.Mutex
+	deleted := make(map[string]bool)
+	listing := listingHandler(c.Encode(1), c.Encode(2), c.Encode(3))
+
+	// The backend refuses deletion of multiple objects like GCS.
+	s := newTestS3(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusNotImplemented)
+			fmt.Fprint(w, "<Error><Code>NotImplemented</Code><Message>not implemented</Message></Error>")
+		case r.Method == http.MethodDelete:
+			mutex.Lock()
+			deleted[strings.TrimPrefix(r.URL.Path, "/bucket/")] = true
+			mutex.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			listing(w, r)
+		}
+	})
+	s.deleteBatchSize = 1
+
+	if err := s.DeleteKeyAndSuccessors(2); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || !deleted[c.Encode(2)] || !deleted[c.Encode(3)] {
+		t.Fatalf("deleted objects %v, want keys 2 and 3", deleted)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Pause states of all volumes, published under "pause" in the metrics.
+var pauseMetrics = expvar.NewMap("pause")
+
+// IO paused by an operator for online maintenance. The pause holds the quiesce
+// lock, so reads, writes and garbage collection block until it is resumed or
+// until the timeout passes, hence a forgotten pause does not wedge the device
+// forever. Requests blocked meanwhile are queued by the kernel. Maintenance
+// operations like the rebuild or the checkpoint run while IO is paused, see
+// quiesceMaintenance().
+type pause struct {
+	mutex sync.Mutex
+
+	// Closed by Resume, nil when IO is not paused.
+	resume chan struct{}
+
+	// When IO was paused.
+	since time.Time
+}
+
+// Pauses IO. It returns when all IO and garbage collection in flight
+// finished and all acknowledged writes are uploaded and in the map. Returns
+// error when IO is already paused.
+func (b *bs3) Pause() error {
+	b.pause.mutex.Lock()
+	defer b.pause.mutex.Unlock()
+
+	if b.pause.resume != nil {
+		return errors.New("IO is already paused")
+	}
+
+	b.warming.Wait()
+
+	b.quiesce.Lock()
+	b.staging.pending.Wait()
+	b.extentMapProxy.Barrier()
+
+	resume := make(chan struct{})
+	b.pause.resume = resume
+	b.pause.since = time.Now()
+
+	timeout := time.Duration(b.cfg().PauseTimeout) * time.Second
+	go func() {
+		select {
+		case <-resume:
+		case <-time.After(timeout):
+			if b.Resume() == nil {
+				log.Warn().Msgf("IO was not resumed in %s and it was resumed automatically.", timeout)
+			}
+		}
+		b.quiesce.Unlock()
+	}()
+
+	log.Info().Msg("IO paused.")
+
+	return nil
+}
+
+// Resumes IO paused by Pause(). Returns error when IO is not paused.
+func (b *bs3) Resume() error {
+	b.pause.mutex.Lock()
+	defer b.pause.mutex.Unlock()
+
+	if b.pause.resume == nil {
+		return errors.New("IO is not paused")
+	}
+
+	close(b.pause.resume)
+	b.pause.resume = nil
+
+	log.Info().Msgf("IO resumed after %s.", time.Since(b.pause.since).Round(time.Millisecond))
+
+	return nil
+}
+
+// Quiesces IO and GC for maintenance and returns function ending it. All IO and
+// GC in flight are finished and all acknowledged writes are uploaded and in the
+// map. IO paused by Pause() is quiesced already, hence the maintenance runs
+// right away instead of waiting for the resume. The pause mutex is held until
+// the returned function is called, so the paused IO is not resumed in the
+// meantime.
+func (b *bs3) quiesceMaintenance() func() {
+	b.pause.mutex.Lock()
+	if b.pause.resume != nil {
+		return b.pause.mutex.Unlock
+	}
+
+	b.quiesce.Lock()
+	b.staging.pending.Wait()
+	b.extentMapProxy.Barrier()
+
+	return func() {
+		b.quiesce.Unlock()
+		b.pause.mutex.Unlock()
+	}
+}
+
+// Returns whether IO is paused by Pause().
+func (b *bs3) paused() bool {
+	b.pause.mutex.Lock()
+	defer b.pause.mutex.Unlock()
+
+	return b.pause.resume != nil
+}
+
+// Returns pause state for the metrics, i.e. whether IO is paused and for how
+// many seconds.
+func (b *bs3) pauseState() interface{} {
+	b.pause.mutex.Lock()
+	defer b.pause.mutex.Unlock()
+
+	state := struct {
+		Paused  bool    `json:"paused"`
+		Seconds float64 `json:"seconds"`
+	}{}
+
+	if b.pause.resume != nil {
+		state.Paused = true
+		state.Seconds = time.Since(b.pause.since).Seconds()
+	}
+
+	return state
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Fails the test when fn does not return in a second.
+func expectReturn(t *testing.T, name string, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s blocks while IO is paused", name)
+	}
+}
+
+func TestMaintenanceWhilePaused(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.EarlyCheckpoint = true
+	b := newTestVolume(t, cfg, memory.New())
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReturn(t, "checkpoint", func() {
+		if err := b.Checkpoint(); err != nil {
+			t.Error(err)
+		}
+	})
+	expectReturn(t, "rebuild", func() {
+		if err := b.Rebuild(); err != nil {
+			t.Error(err)
+		}
+	})
+	expectReturn(t, "dead GC", func() {
+		if err := b.CollectDead(); err == nil {
+			t.Error("dead GC started while IO is paused")
+		}
+	})
+	expectReturn(t, "early checkpoint", func() {
+		b.PrepareStop()
+		b.early.Wait()
+	})
+
+	if !b.paused() {
+		t.Fatal("maintenance resumed paused IO")
+	}
+	if err := b.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, b, 0, testData(1, 1))
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// State of read-ahead of all volumes, published under "readahead" in the
+// metrics.
+var readAheadMetrics = expvar.NewMap("readahead")
+
+// Number of recent reads remembered for the detection of sequential access.
+// The kernel serves reads by multiple queues, hence sequential reads of one
+// stream can arrive slightly out of order.
+const readAheadHistory = 4
+
+// Adaptive read-ahead into the cache, similar to the read-ahead of Linux. A
+// read starting where one of the recent reads ended is sequential. Sequential
+// reads open the window of blocks following the read, which is prefetched from
+// the backend in the background, and every next sequential read doubles the
+// window up to the configured maximum. A random read collapses the window, so
+// no bandwidth is wasted on random workloads. Only blocks beyond the already
+// prefetched range are prefetched.
+type readAhead struct {
+	mutex sync.Mutex
+
+	// Ends of recent reads, -1 when unknown.
+	ends [readAheadHistory]int64
+	next int
+
+	// Current window in blocks, 0 when the access is random.
+	window int64
+
+	// Range of blocks prefetched or being prefetched.
+	start int64
+	end   int64
+
+	// Number of prefetched blocks and sequential reads which were and which
+	// were not covered by the prefetched range.
+	blocks int64
+	hits   int64
+	misses int64
+}
+
+// State of read-ahead published in the metrics.
+type readAheadState struct {
+	Window int64 `json:"window"`
+	Blocks int64 `json:"blocks"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func (r *readAhead) init() {
+	for i := range r.ends {
+		r.ends[i] = -1
+	}
+}
+
+// Records the read of length blocks at sector and returns the range of blocks
+// to prefetch, which is empty when there is nothing to prefetch. The window is
+// limited by max blocks and the range by the end of the device.
+func (r *readAhead) observe(sector, length, max, deviceEnd int64) (int64, int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sequential := false
+	for _, e := range r.ends {
+		if e == sector {
+			sequential = true
+			break
+		}
+	}
+	r.ends[r.next] = sector + length
+	r.next = (r.next + 1) % readAheadHistory
+
+	if !sequential {
+		r.window = 0
+		return 0, 0
+	}
+
+	if sector >= r.start && sector+length <= r.end {
+		r.hits++
+	} else {
+		r.misses++
+	}
+
+	if r.window == 0 {
+		r.window = 2 * length
+	} else {
+		r.window *= 2
+	}
+	if r.window > max {
+		r.window = max
+	}
+
+	from := sector + length
+	if r.end > from {
+		from = r.end
+	} else {
+		r.start = from
+	}
+	to := sector + length + r.window
+	if to > deviceEnd {
+		to = deviceEnd
+	}
+	if to <= from {
+		return 0, 0
+	}
+
+	r.end = to
+	r.blocks += to - from
+
+	return from, to
+}
+
+// Returns state of read-ahead for the metrics.
+func (b *bs3) readAheadState() interface{} {
+	b.readAhead.mutex.Lock()
+	defer b.readAhead.mutex.Unlock()
+
+	return readAheadState{
+		Window: b.readAhead.window,
+		Blocks: b.readAhead.blocks,
+		Hits:   b.readAhead.hits,
+		Misses: b.readAhead.misses,
+	}
+}
+
+// Records the read of length blocks at sector and prefetches blocks following
+// it into the cache in the background when the access is sequential. Needs the
+// cache, read-ahead is disabled without it.
+func (b *bs3) readAheadAfter(sector, length int64) {
+	max := b.cfg().Cache.ReadAhead
+	if b.cache == nil || max <= 0 {
+		return
+	}
+
+	from, to := b.readAhead.observe(sector, length, max, b.cfg().Size/int64(b.cfg().BlockSize))
+	if from < to {
+		go b.prefetch(from, to-from)
+	}
+}
+
+// Downloads blocks of the logical extent starting at sector with length length
+// into the cache by low priority requests. Blocks which are not mapped, which
+// are staged or which are cached already are skipped. Failed downloads are not
+// retried, the read falls back to the normal download.
+func (b *bs3) prefetch(sector, length int64) {
+	pieces := b.getObjectPiecesRefCounterInc(sector, length)
+
+	var wg sync.WaitGroup
+	for _, p := range pieces {
+		if p.Key == mapproxy.NotMappedKey {
+			continue
+		}
+
+		p := p
+		b.readFanout.goDownload(&wg, func() {
+			if b.cache.Contains(p.Key, p.Sector, p.Length) {
+				return
+			}
+
+			data := make([]byte, p.Length*int64(b.cfg().BlockSize))
+			if b.readStaged(p.Key, data, p.Sector) {
+				return
+			}
+
+			err := b.objectStoreProxy.Download(p.Key, data, p.Sector*int64(b.cfg().BlockSize), false)
+			if err == nil && b.checksumValid(p.Flag, data) {
+				b.cache.Put(p.Key, p.Sector, data)
+			}
+		})
+	}
+	wg.Wait()
+
+	b.objectPiecesRefCounterDec(pieces)
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Discards the extent map and rebuilds it from the objects only, starting from
+// the key 0 and ignoring the checkpoint. IO and garbage collection are paused
+// for the whole rebuild. It runs right away when IO is paused by Pause().
+//
+// The map is rebuilt into a staging map first, hence it needs memory for two
+// maps. The live map is replaced only when the rebuild reaches the current
+// object key. Otherwise some object is missing, the live map is kept and error
+// is returned. The next checkpoint is always the full one. Sizes of objects are
+// listed at once or requested one by one according to recovery_listing, as in
+// the recovery. The rebuilt map starts the next incarnation.
+func (b *bs3) Rebuild() error {
+	b.warming.Wait()
+
+	// All objects have to be uploaded before they are read back.
+	defer b.quiesceMaintenance()()
+
+	// The checkpoint must not serialize the map while it is replaced.
+	b.gcData.removing.Lock()
+	defer b.gcData.removing.Unlock()
+
+	log.Info().Msg("Rebuild of extent map from objects started.")
+
+	keyBefore := b.key.Current()
+	incarnationBefore := b.incarnation
+	staging := b.extentMapProxy.Instance.Empty()
+
+	b.key.Replace(0)
+	b.incarnation = 0
+	b.useCDN(false)
+	err := b.restoreFromObjects(staging, b.cfg().RecoveryListing)
+	b.useCDN(true)
+
+	if err == nil && b.key.Current() != keyBefore {
+		err = fmt.Errorf("rebuild stopped at missing object %d before the last object %d", b.key.Current(), keyBefore)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w, keeping the current map", err)
+		b.key.Replace(keyBefore)
+		b.incarnation = incarnationBefore
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	b.extentMapProxy.Replace(staging, b.cfg().Size/int64(b.cfg().BlockSize))
+	b.checkpointGeneration = 0
+
+	// Objects may have no incarnation, so the rebuild can see less than
+	// the current one.
+	if b.incarnation < incarnationBefore {
+		b.incarnation = incarnationBefore
+	}
+	b.nextIncarnation()
+
+	log.Info().Msgf("Rebuild of extent map from objects finished. Last object is %d.", keyBefore)
+
+	return nil
+}
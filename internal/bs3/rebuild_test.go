@@ -0,0 +1,96 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+	"github.com/asch/bs3/internal/config"
+)
+
+// Returns the test configuration with objects tagged by the incarnation.
+func newIncarnationConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	cfg.Incarnation = true
+
+	return cfg
+}
+
+func TestRebuildIgnoresStaleIncarnation(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newIncarnationConfig(t), store)
+	for i := int64(0); i < 3; i++ {
+		if err := b.BuseWrite(1, testChunk(b, 10*(i+1), testWrite{i, testData(1, byte(i+1))})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := b.key.Current() - 3
+
+	// The restore stops at the missing second object and the deletion of
+	// its successor fails, so the third object survives the reset of the
+	// key space.
+	stale := mustDownload(t, b, first+2)
+	store.DeleteKeyAndSuccessors(first + 1)
+	restored := newTestVolume(t, newIncarnationConfig(t), store)
+	if restored.incarnation <= b.incarnation {
+		t.Fatalf("incarnation %d after restore is not higher than %d", restored.incarnation, b.incarnation)
+	}
+	store.SetIncarnation(b.incarnation)
+	store.Upload(first+2, stale, objproxy.SourceWrite)
+	store.SetIncarnation(restored.incarnation)
+
+	// The new object takes the key of the missing one and the stale
+	// object follows it.
+	if err := restored.BuseWrite(1, testChunk(restored, 1, testWrite{5, testData(1, 5)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, restored, 0, testData(1, 1))
+	expectRead(t, restored, 2, testData(1, 0))
+	expectRead(t, restored, 5, testData(1, 5))
+
+	// The restore from objects ignores the stale object as well.
+	again := newTestVolume(t, newIncarnationConfig(t), store)
+	expectRead(t, again, 2, testData(1, 0))
+	expectRead(t, again, 5, testData(1, 5))
+}
+
+// Memory backend counting listings of objects.
+type listingStore struct {
+	*memory.Memory
+
+	listings int64
+}
+
+func (s *listingStore) ListKeys(fn func(key, size int64) bool) error {
+	atomic.AddInt64(&s.listings, 1)
+	return s.Memory.ListKeys(fn)
+}
+
+func TestRebuildHonoursRecoveryListing(t *testing.T) {
+	for _, listing := range []bool{false, true} {
+		store := &listingStore{Memory: memory.New()}
+		cfg := newTestConfig(t)
+		cfg.RecoveryListing = listing
+		b := newTestVolume(t, cfg, store)
+		if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+			t.Fatal(err)
+		}
+
+		atomic.StoreInt64(&store.listings, 0)
+		if err := b.Rebuild(); err != nil {
+			t.Fatal(err)
+		}
+		if listed := atomic.LoadInt64(&store.listings) > 0; listed != listing {
+			t.Fatalf("rebuild with recovery_listing %v listed objects: %v", listing, listed)
+		}
+		expectRead(t, b, 0, testData(1, 1))
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Estimates of space reclaimed by the next dead GC round of all volumes,
+// published under "reclaimable" in the metrics.
+var reclaimMetrics = expvar.NewMap("reclaimable")
+
+// Estimate of space reclaimed by dead GC. Dead objects have no live data,
+// hence their whole size is reclaimable. The size is derived from the number
+// of data blocks recorded in the map, so it is approximate: objects created by
+// GC are uploaded with the full chunk size and the padding is not known for
+// objects created before the alignment was configured. Objects from
+// checkpoints written before the sizes were recorded are counted as unknown.
+// With object lock the space is reclaimed only after the retention period.
+//
+// Sizes unknown to the map can be probed on the backend. A failed probe never
+// fails the estimate nor the dead GC, which does not need the size. It is
+// logged and the object is counted as unknown, i.e. it is excluded from the
+// bytes. The probes run in parallel limited by the GC fanout, since the dead
+// GC and checkpoints waiting for it would be held by serial ones for a round
+// trip per object.
+type reclaimable struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	Unknown int64 `json:"unknown"`
+}
+
+// Returns estimate of space reclaimed by deletion of deadObjects. Sizes
+// unknown to the map are asked from the backend when probe is true.
+func (b *bs3) estimateReclaimable(deadObjects map[int64]struct{}, probe bool) reclaimable {
+	sizes := b.extentMapProxy.DeadObjectSizes()
+
+	var r reclaimable
+	var unknown []int64
+	for k := range deadObjects {
+		r.Objects++
+
+		blocks, ok := sizes[k]
+		if !ok {
+			unknown = append(unknown, k)
+			continue
+		}
+
+		size := b.metadata_size + int(blocks)*b.cfg().BlockSize
+		if align := b.cfg().Write.Align; align > 0 {
+			size = (size + align - 1) / align * align
+		}
+		r.Bytes += int64(size)
+	}
+
+	if !probe {
+		r.Unknown = int64(len(unknown))
+		return r
+	}
+
+	bytes, failed := b.probeSizes(unknown)
+	r.Bytes += bytes
+	r.Unknown = failed
+
+	return r
+}
+
+// Asks the backend for sizes of objects with keys in parallel. Returns their
+// total size and the number of objects whose size could not be probed. Failed
+// probes are logged.
+func (b *bs3) probeSizes(keys []int64) (int64, int64) {
+	sizes := make([]int64, len(keys))
+	errs := make([]error, len(keys))
+
+	var wg sync.WaitGroup
+	for i, k := range keys {
+		i, k := i, k
+		b.gcFanout.goDownload(&wg, func() {
+			sizes[i], errs[i] = b.objectStoreProxy.Instance.GetObjectSize(k)
+		})
+	}
+	wg.Wait()
+
+	var bytes, failed int64
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			bytes += sizes[i]
+			continue
+		}
+		if failed == 0 {
+			firstErr = err
+		}
+		failed++
+	}
+
+	if failed > 0 {
+		log.Warn().Err(firstErr).Msgf("Size of %d dead objects could not be probed. They are counted as unknown.", failed)
+	}
+
+	return bytes, failed
+}
+
+// Returns estimate of space reclaimed by the next dead GC round for the
+// metrics. Objects still being read are excluded the same way as in the dead
+// GC. Returns nil until the map is restored.
+func (b *bs3) reclaimableState() interface{} {
+	select {
+	case <-b.restored:
+	default:
+		return nil
+	}
+
+	deadObjects := b.extentMapProxy.DeadObjects()
+	b.filterDownloadingObjects(deadObjects)
+	b.filterStagedObjects(deadObjects)
+
+	// The metrics are read often, hence they never probe the backend.
+	return b.estimateReclaimable(deadObjects, false)
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Memory backend failing probes of sizes of the failing objects.
+type failingSizeStore struct {
+	*memory.Memory
+
+	failing map[int64]struct{}
+}
+
+func (s *failingSizeStore) GetObjectSize(key int64) (int64, error) {
+	if _, ok := s.failing[key]; ok {
+		return 0, errors.New("probe failed")
+	}
+
+	return s.Memory.GetObjectSize(key)
+}
+
+func TestReclaimableProbeFailures(t *testing.T) {
+	store := &failingSizeStore{Memory: memory.New(), failing: map[int64]struct{}{101: {}}}
+	cfg := newTestConfig(t)
+	cfg.GC.ProbeSizes = true
+	b := newTestVolume(t, cfg, store)
+
+	// Object dead in the map with the recorded size.
+	for i := int64(0); i < 2; i++ {
+		if err := b.BuseWrite(1, testChunk(b, 10*(i+1), testWrite{0, testData(1, byte(i+1))})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known := b.key.Current() - 2
+	knownSize := int64(b.metadata_size + testBlockSize)
+
+	// Objects with sizes unknown to the map, the probe of one of them
+	// fails.
+	for _, k := range []int64{100, 101, 102} {
+		store.Upload(k, make([]byte, 10*k), objproxy.SourceWrite)
+	}
+	dead := map[int64]struct{}{known: {}, 100: {}, 101: {}, 102: {}}
+
+	r := b.estimateReclaimable(dead, true)
+	if r.Objects != 4 || r.Unknown != 1 || r.Bytes != knownSize+1000+1020 {
+		t.Fatalf("estimate with probes is %+v", r)
+	}
+
+	r = b.estimateReclaimable(dead, false)
+	if r.Objects != 4 || r.Unknown != 3 || r.Bytes != knownSize {
+		t.Fatalf("estimate without probes is %+v", r)
+	}
+
+	// The failed probe does not fail the dead GC.
+	if err := b.CollectDead(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.extentMapProxy.DeadObjects()[known]; ok {
+		t.Fatal("dead object was not removed")
+	}
+	expectRead(t, b, 0, testData(1, 2))
+}
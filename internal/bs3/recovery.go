@@ -0,0 +1,116 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Outcome of the recovery of all volumes, published under "recovery" in the
+// metrics.
+var recoveryMetrics = expvar.NewMap("recovery")
+
+// Outcome of the recovery during the start, i.e. the recovery point reached
+// after a crash. Objects after the first hole in the sequence of keys are not
+// replayed and they are deleted, so writes stored in them are lost even when
+// they were acknowledged. The report is published until the next checkpoint,
+// which makes the recovered state the new baseline.
+type recovery struct {
+	mutex  sync.Mutex
+	report *recoveryReport
+}
+
+// Keys are the sequence numbers of objects. Discarded objects are the ones at
+// or after the frontier which were deleted.
+type recoveryReport struct {
+	Time time.Time `json:"time"`
+
+	// First key not covered by the restored checkpoint.
+	Checkpoint int64 `json:"checkpoint"`
+
+	// First key not recovered. Objects from the checkpoint up to it were
+	// replayed by the roll forward recovery.
+	Frontier int64 `json:"frontier"`
+	Replayed int64 `json:"replayed"`
+
+	DiscardedObjects int64 `json:"discarded_objects"`
+	DiscardedBytes   int64 `json:"discarded_bytes"`
+
+	// The last discarded key, -1 when nothing was discarded.
+	LastDiscarded int64 `json:"last_discarded"`
+
+	// Discarded objects are not known, since the listing failed.
+	Unknown bool `json:"unknown"`
+}
+
+// Returns report of objects at or after frontier, which are going to be
+// deleted as unrecoverable. checkpoint is the first key not covered by the
+// restored checkpoint. Objects are listed, hence the report costs one listing
+// of the bucket.
+func (b *bs3) unrecoverable(checkpoint, frontier int64) *recoveryReport {
+	r := &recoveryReport{
+		Time:          time.Now(),
+		Checkpoint:    checkpoint,
+		Frontier:      frontier,
+		Replayed:      frontier - checkpoint,
+		LastDiscarded: -1,
+	}
+
+	err := b.objectStoreProxy.Instance.ListKeys(func(key, size int64) bool {
+		if key >= frontier {
+			r.DiscardedObjects++
+			r.DiscardedBytes += size
+			if key > r.LastDiscarded {
+				r.LastDiscarded = key
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("->Listing of unrecoverable objects failed. The recovery report does not count them.")
+		r.Unknown = true
+	}
+
+	return r
+}
+
+// Logs the report and publishes it until the next checkpoint.
+func (b *bs3) reportRecovery(r *recoveryReport) {
+	e := log.Info()
+	if r.DiscardedObjects > 0 || r.Unknown {
+		e = log.Warn()
+	}
+	e.Int64("checkpoint", r.Checkpoint).Int64("frontier", r.Frontier).Int64("replayed", r.Replayed).
+		Int64("discarded_objects", r.DiscardedObjects).Int64("discarded_bytes", r.DiscardedBytes).
+		Int64("last_discarded", r.LastDiscarded).Bool("unknown", r.Unknown).
+		Msg("->Recovery finished.")
+
+	b.recovery.mutex.Lock()
+	b.recovery.report = r
+	b.recovery.mutex.Unlock()
+}
+
+// Withdraws the report after the checkpoint.
+func (b *bs3) clearRecovery() {
+	b.recovery.mutex.Lock()
+	b.recovery.report = nil
+	b.recovery.mutex.Unlock()
+}
+
+// Returns the report for the metrics, nil after the first checkpoint.
+func (b *bs3) recoveryState() interface{} {
+	b.recovery.mutex.Lock()
+	defer b.recovery.mutex.Unlock()
+
+	if b.recovery.report == nil {
+		return nil
+	}
+
+	r := *b.recovery.report
+
+	return r
+}
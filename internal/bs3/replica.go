@@ -0,0 +1,94 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reads served only by the read replica, switched by the operator during an
+// outage of the primary region. Unlike the automatic failover, the primary is
+// not touched at all. Writes block until the primary is used again, since the
+// replica is read only and cross region replication is one way. GC does not
+// run meanwhile.
+//
+// The replica lags behind the primary by the replication delay. Reads of
+// writes not replicated yet return older data or fail when their object is not
+// in the replica yet, hence the switch should be done only when the primary
+// is really unavailable. Writes acknowledged before the switch are durable in
+// the primary only, so they are lost for good if the primary region does not
+// come back.
+type replica struct {
+	mutex sync.Mutex
+
+	// Signaled with the mutex when the primary is used again.
+	ended *sync.Cond
+
+	active bool
+	since  time.Time
+}
+
+// Switches reads to the read replica and blocks writes. Returns error when no
+// replica is configured or it is already used.
+func (b *bs3) UseReplica() error {
+	if b.failover == nil {
+		return errors.New("no read replica is configured")
+	}
+
+	b.replica.mutex.Lock()
+	defer b.replica.mutex.Unlock()
+
+	if b.replica.active {
+		return errors.New("read replica is already used")
+	}
+
+	b.replica.active = true
+	b.replica.since = time.Now()
+	b.failover.Force(true)
+
+	log.Warn().Msg("Reads switched to the read replica. Writes and GC are blocked until the primary is used again.")
+
+	return nil
+}
+
+// Switches reads back to the primary and unblocks writes. Returns error when the
+// replica is not used.
+func (b *bs3) UsePrimary() error {
+	b.replica.mutex.Lock()
+	defer b.replica.mutex.Unlock()
+
+	if !b.replica.active {
+		return errors.New("read replica is not used")
+	}
+
+	b.failover.Force(false)
+	b.replica.active = false
+	b.replica.ended.Broadcast()
+
+	log.Info().Msgf("Reads switched back to the primary after %s. Writes are unblocked.",
+		time.Since(b.replica.since).Round(time.Second))
+
+	return nil
+}
+
+// Returns true when reads are served by the read replica.
+func (b *bs3) replicaActive() bool {
+	b.replica.mutex.Lock()
+	defer b.replica.mutex.Unlock()
+
+	return b.replica.active
+}
+
+// Waits until the primary is used, i.e. until writes are possible.
+func (b *bs3) waitPrimary() {
+	b.replica.mutex.Lock()
+	defer b.replica.mutex.Unlock()
+
+	for b.replica.active {
+		b.replica.ended.Wait()
+	}
+}
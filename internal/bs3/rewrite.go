@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Object written by GC with live data copied from source objects. It is
+// logged at the trace level, so it is possible to validate that GC moved the
+// expected data and to explain read patterns after GC.
+type gcRewrite struct {
+	// Key of the new object and number of extents copied into it.
+	Key     int64
+	Extents int
+
+	// Keys of the source objects with their live data ratio before the
+	// run. Objects fully collected by previous objects of the run have
+	// the ratio they had at its beginning.
+	Sources map[int64]float64
+}
+
+// Returns true when objects written by GC are reported, i.e. the log level is
+// trace.
+func (b *bs3) gcRewritesReported() bool {
+	return zerolog.GlobalLevel() <= zerolog.TraceLevel && log.Logger.GetLevel() <= zerolog.TraceLevel
+}
+
+// Returns the report of the object with key written by GC with extents.
+// utilization and sizes are the utilization and the sizes of the source
+// objects in blocks before the run. Objects with unknown size, i.e. from
+// checkpoints written before the sizes were recorded, are taken as full
+// chunks.
+func (b *bs3) newGCRewrite(key int64, extents []mapproxy.ExtentWithObjectPart, utilization, sizes map[int64]int64) gcRewrite {
+	r := gcRewrite{
+		Key:     key,
+		Extents: len(extents),
+		Sources: make(map[int64]float64),
+	}
+
+	for _, e := range extents {
+		k := e.ObjectPart.Key
+		size, ok := sizes[k]
+		if !ok || size == 0 {
+			size = int64((b.cfg().Write.ChunkSize - b.metadata_size) / b.cfg().BlockSize)
+		}
+		r.Sources[k] = float64(utilization[k]) / float64(size)
+	}
+
+	return r
+}
+
+// Logs the object with key written by GC with extents, see newGCRewrite().
+func (b *bs3) reportGCRewrite(key int64, extents []mapproxy.ExtentWithObjectPart, utilization, sizes map[int64]int64) {
+	r := b.newGCRewrite(key, extents, utilization, sizes)
+	log.Trace().Int64("key", r.Key).Int("extents", r.Extents).Interface("sources", r.Sources).Msg("GC rewrite.")
+}
@@ -0,0 +1,29 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+func TestGCRewriteLiveRatio(t *testing.T) {
+	b := newTestVolume(t, newTestConfig(t), memory.New())
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{0, testData(1, 1)}, testWrite{1, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	source := b.key.Current() - 1
+	if err := b.BuseWrite(1, testChunk(b, 10, testWrite{0, testData(1, 3)})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source object of two blocks has one of them live, regardless of
+	// the chunk size.
+	extents := []mapproxy.ExtentWithObjectPart{{ObjectPart: mapproxy.ObjectPart{Key: source}}}
+	r := b.newGCRewrite(source+2, extents, b.extentMapProxy.ObjectsUtilization(), b.extentMapProxy.ObjectSizes())
+	if r.Extents != 1 || r.Sources[source] != 0.5 {
+		t.Fatalf("rewrite %+v, want live ratio 0.5 of object %d", r, source)
+	}
+}
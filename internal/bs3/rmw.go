@@ -0,0 +1,116 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Returns true if the raw write metadata describes a write covering whole
+// blocks. The kernel should never send anything else, since it knows the
+// block size, but a write not aligned to the block size would be silently
+// truncated by parseExtent and would shift data of all successive writes in
+// the chunk.
+func isAligned(b []byte, blockSize int) bool {
+	_, sectorAligned := sectorsToBlocks(binary.LittleEndian.Uint64(b[:8]), blockSize)
+	_, lengthAligned := sectorsToBlocks(binary.LittleEndian.Uint64(b[8:16]), blockSize)
+
+	return sectorAligned && lengthAligned
+}
+
+// Builds new object from the chunk where every write is extended to whole
+// blocks. Missing parts of the first and the last block of unaligned writes are
+// read from the device, i.e. from the backend or from the preceding writes in
+// the same chunk, and merged with the written data. Hence the object never
+// contains a partial block. Returns the new object and its extents.
+func (b *bs3) readModifyWrite(writes int64, chunk []byte) ([]byte, []mapproxy.Extent) {
+	perBlock := int64(sectorsPerBlock(b.cfg().BlockSize))
+
+	// Find out how many blocks are needed for all writes extended to whole
+	// blocks.
+	var totalBlocks int64
+	for i := int64(0); i < writes; i++ {
+		raw := chunk[i*int64(b.write_item_size):]
+		sector := int64(binary.LittleEndian.Uint64(raw[:8]))
+		length := int64(binary.LittleEndian.Uint64(raw[8:16]))
+		totalBlocks += (sector+length+perBlock-1)/perBlock - sector/perBlock
+	}
+
+	object := make([]byte, int64(b.metadata_size)+totalBlocks*int64(b.cfg().BlockSize))
+	extents := make([]mapproxy.Extent, writes)
+	offsets := make([]int64, writes)
+
+	srcFrontier := int64(b.metadata_size)
+	dstFrontier := int64(b.metadata_size)
+	for i := int64(0); i < writes; i++ {
+		raw := chunk[i*int64(b.write_item_size):]
+		sector := int64(binary.LittleEndian.Uint64(raw[:8]))
+		length := int64(binary.LittleEndian.Uint64(raw[8:16]))
+
+		e := mapproxy.Extent{
+			Sector: sector / perBlock,
+			Length: (sector+length+perBlock-1)/perBlock - sector/perBlock,
+			SeqNo:  int64(binary.LittleEndian.Uint64(raw[16:24])),
+			Flag:   int64(binary.LittleEndian.Uint64(raw[24:32])),
+		}
+
+		size := e.Length * int64(b.cfg().BlockSize)
+		dst := object[dstFrontier : dstFrontier+size]
+		if sector%perBlock != 0 || length%perBlock != 0 {
+			if err := b.read(e.Sector, e.Length, dst); err != nil {
+				// The chunk already has its key, hence it
+				// cannot be rejected. Only the rest of the
+				// partial blocks is affected, it was not
+				// readable anyway.
+				log.Error().Err(err).Msgf("Partial write at sector %d is merged with data failing the checksum.", sector)
+			}
+			b.mergeChunkWrites(object, extents[:i], offsets[:i], e, dst)
+		}
+
+		data := chunk[srcFrontier : srcFrontier+length*sectorUnit]
+		copy(dst[(sector-e.Sector*perBlock)*sectorUnit:], data)
+
+		writeHeader(int(i)*b.write_item_size, mapproxy.ExtentWithObjectPart{
+			Extent: mapproxy.Extent{
+				Length: e.Length * perBlock,
+				SeqNo:  e.SeqNo,
+				Flag:   e.Flag,
+			},
+			ObjectPart: mapproxy.ObjectPart{Sector: e.Sector * perBlock},
+		}, object)
+
+		extents[i] = e
+		offsets[i] = dstFrontier
+		srcFrontier += length * sectorUnit
+		dstFrontier += size
+	}
+
+	return object, extents
+}
+
+// Copies data of preceding writes in the same chunk overlapping with extent e
+// into dst. These writes are not in the map yet, hence they are not visible to
+// the read in readModifyWrite.
+func (b *bs3) mergeChunkWrites(object []byte, preceding []mapproxy.Extent, offsets []int64, e mapproxy.Extent, dst []byte) {
+	blockSize := int64(b.cfg().BlockSize)
+
+	for j, p := range preceding {
+		from, to := p.Sector, p.Sector+p.Length
+		if e.Sector > from {
+			from = e.Sector
+		}
+		if e.Sector+e.Length < to {
+			to = e.Sector + e.Length
+		}
+		if from >= to {
+			continue
+		}
+
+		src := object[offsets[j]+(from-p.Sector)*blockSize : offsets[j]+(to-p.Sector)*blockSize]
+		copy(dst[(from-e.Sector)*blockSize:], src)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Write of data at sector of 512 bytes given by the kernel.
+type testSectorWrite struct {
+	sector int64
+	data   []byte
+}
+
+// Returns the write chunk with writes in sectors, see testChunk().
+func testSectorChunk(b *bs3, seqNo int64, writes ...testSectorWrite) []byte {
+	chunk := make([]byte, b.metadata_size+b.cfg().Write.ChunkSize)
+	data := chunk[b.metadata_size:]
+	for i, w := range writes {
+		item := chunk[i*b.write_item_size:]
+		binary.LittleEndian.PutUint64(item[0:8], uint64(w.sector))
+		binary.LittleEndian.PutUint64(item[8:16], uint64(len(w.data)/sectorUnit))
+		binary.LittleEndian.PutUint64(item[16:24], uint64(seqNo+int64(i)))
+		data = data[copy(data, w.data):]
+	}
+
+	return chunk
+}
+
+func TestSubBlockWrite(t *testing.T) {
+	store := memory.New()
+	b := newTestVolume(t, newTestConfig(t), store)
+	perBlock := int64(testBlockSize / sectorUnit)
+
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{10, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second sector of block 10 and the last sector of block 11,
+	// which was never written, followed by the first sector of block 12
+	// overwritten by the last write of the chunk.
+	sector := bytes.Repeat([]byte{9}, sectorUnit)
+	chunk := testSectorChunk(b, 10,
+		testSectorWrite{10*perBlock + 1, sector},
+		testSectorWrite{12*perBlock - 1, append(append([]byte(nil), sector...), sector...)},
+		testSectorWrite{12 * perBlock, bytes.Repeat([]byte{8}, sectorUnit)},
+	)
+	if err := b.BuseWrite(3, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	want := testData(3, 0)
+	copy(want, testData(1, 1))
+	copy(want[sectorUnit:], sector)
+	copy(want[2*testBlockSize-sectorUnit:], sector)
+	copy(want[2*testBlockSize:], bytes.Repeat([]byte{8}, sectorUnit))
+	expectRead(t, b, 10, want)
+
+	// The object has whole blocks only, so the restored volume reads the
+	// same.
+	restored := newTestVolume(t, newTestConfig(t), store)
+	expectRead(t, restored, 10, want)
+}
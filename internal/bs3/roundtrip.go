@@ -0,0 +1,48 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"fmt"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+)
+
+// Returns serialized map, or its delta when delta is true. The summary of the
+// serialized map is returned as well when checkpoints are verified, otherwise
+// it is empty.
+func (b *bs3) serializeMap(delta bool) ([]byte, mapproxy.Summary) {
+	if b.cfg().VerifyCheckpoint {
+		return b.extentMapProxy.SerializeWithSummary(delta)
+	}
+
+	if delta {
+		return b.extentMapProxy.SerializeDelta(), mapproxy.Summary{}
+	}
+
+	return b.extentMapProxy.Serialize(), mapproxy.Summary{}
+}
+
+// Deserializes dump into a throwaway map and compares its summary with the
+// summary of the serialized map. Returns error when they differ, i.e. the
+// checkpoint would not restore the map. Deltas carry only changed sectors,
+// hence their mapped sectors are not compared.
+func (b *bs3) verifyRoundTrip(dump []byte, delta bool, want mapproxy.Summary) error {
+	m := b.extentMapProxy.Instance.Empty()
+	if delta {
+		m.DeserializeDelta(dump)
+	} else {
+		m.DeserializeAndReturnNextKey(dump)
+	}
+
+	got := m.Summary()
+	if delta {
+		got.Sectors = want.Sectors
+	}
+
+	if got != want {
+		return fmt.Errorf("deserialized map %+v differs from the serialized one %+v", got, want)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How far the schedule is searched for the next run. Expressions without any
+// run in this period, e.g. 30th February, are rejected.
+const scheduleHorizon = 5 * 366 * 24 * time.Hour
+
+// Schedule of threshold GC given by cron expression with five fields: minute,
+// hour, day of month, month and day of week. Every field is *, a number, a
+// range a-b or a list of them separated by commas, all optionally followed by
+// a step /n. Sunday is both 0 and 7 in the day of week. When both day fields
+// are restricted, the day matches when any of them matches, as in cron. Times
+// are in the local time zone.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Day of month and day of week are not *.
+	domRestricted, dowRestricted bool
+}
+
+// Returns schedule parsed from the cron expression.
+func parseSchedule(expr string) (*schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q has to have 5 fields", expr)
+	}
+
+	var s schedule
+	var err error
+	if s.minute, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never runs", expr)
+	}
+
+	return &s, nil
+}
+
+// Returns bitmap of values of the field within min and max.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in schedule field %q", field)
+			}
+			item = item[:i]
+		}
+
+		low, high := min, max
+		if item != "*" {
+			var err error
+			bounds := strings.SplitN(item, "-", 2)
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in schedule field %q", field)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in schedule field %q", field)
+				}
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("schedule field %q is out of range %d-%d", field, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Returns true when the day of t matches the schedule.
+func (s *schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+// Returns the first time matching the schedule after t or zero time when there
+// is none within the horizon.
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(scheduleHorizon)
+
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Runs threshold GC whenever the schedule matches until the device is being
+// stopped. Runs missed because the previous one was still running are skipped.
+func (b *bs3) gcScheduled() {
+	b.warming.Wait()
+
+	for {
+		next := b.gcSchedule.next(time.Now())
+		log.Debug().Msgf("Next scheduled threshold GC at %s.", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-b.stopping:
+			timer.Stop()
+			return
+		}
+
+		b.runGCThreshold(b.cfg().GC.ScheduleLiveData)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Sector is a linux constant, which is always 512, no matter how big your
+// sectors or blocks are. Please be careful since the terminology is ambiguous.
+// Write items from the kernel and headers of objects are in sectors, the
+// extent map is in blocks.
+const sectorUnit = 512
+
+// Returns the number of sectors in one block of blockSize bytes. The block size
+// is 512 or 4096, which is enforced by the configuration. Anything else is a
+// programming error, since every conversion would be wrong.
+func sectorsPerBlock(blockSize int) uint64 {
+	if blockSize < sectorUnit || blockSize%sectorUnit != 0 {
+		log.Panic().Msgf("Block size %d is not a multiple of the sector size %d.", blockSize, sectorUnit)
+	}
+
+	return uint64(blockSize / sectorUnit)
+}
+
+// Converts sectors to blocks of blockSize bytes. Returns false when sectors are
+// not aligned to blocks, the result is rounded down then.
+func sectorsToBlocks(sectors uint64, blockSize int) (int64, bool) {
+	perBlock := sectorsPerBlock(blockSize)
+
+	return int64(sectors / perBlock), sectors%perBlock == 0
+}
+
+// Converts blocks of blockSize bytes to sectors.
+func blocksToSectors(blocks int64, blockSize int) int64 {
+	return blocks * int64(sectorsPerBlock(blockSize))
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/asch/bs3/internal/bs3/mapproxy"
+	"github.com/asch/bs3/internal/bs3/mapproxy/sectormap"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Returns write item with raw values as the kernel stores them.
+func testItem(sector, length, seqNo uint64) []byte {
+	item := make([]byte, WRITE_ITEM_SIZE)
+	binary.LittleEndian.PutUint64(item[0:8], sector)
+	binary.LittleEndian.PutUint64(item[8:16], length)
+	binary.LittleEndian.PutUint64(item[16:24], seqNo)
+
+	return item
+}
+
+func TestParseExtent(t *testing.T) {
+	tests := []struct {
+		blockSize      int
+		sector, length uint64
+		want           mapproxy.Extent
+		aligned        bool
+	}{
+		{512, 0, 1, mapproxy.Extent{Sector: 0, Length: 1, SeqNo: 7}, true},
+		{512, 13, 3, mapproxy.Extent{Sector: 13, Length: 3, SeqNo: 7}, true},
+		{4096, 0, 8, mapproxy.Extent{Sector: 0, Length: 1, SeqNo: 7}, true},
+		{4096, 16, 24, mapproxy.Extent{Sector: 2, Length: 3, SeqNo: 7}, true},
+		{4096, 2048, 2048, mapproxy.Extent{Sector: 256, Length: 256, SeqNo: 7}, true},
+		{4096, 8, 4, mapproxy.Extent{Sector: 1, Length: 0, SeqNo: 7}, false},
+		{4096, 3, 8, mapproxy.Extent{Sector: 0, Length: 1, SeqNo: 7}, false},
+	}
+
+	for _, tt := range tests {
+		item := testItem(tt.sector, tt.length, 7)
+		if got := parseExtent(item, tt.blockSize); got != tt.want {
+			t.Errorf("block size %d, sectors %d+%d: parsed %+v, want %+v", tt.blockSize, tt.sector, tt.length, got, tt.want)
+		}
+		if got := isAligned(item, tt.blockSize); got != tt.aligned {
+			t.Errorf("block size %d, sectors %d+%d: aligned %v", tt.blockSize, tt.sector, tt.length, got)
+		}
+		if tt.aligned && blocksToSectors(tt.want.Sector, tt.blockSize) != int64(tt.sector) {
+			t.Errorf("block size %d: block %d does not convert back to sector %d", tt.blockSize, tt.want.Sector, tt.sector)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockSize int
+		version   int64
+		items     [][]byte
+		size      func(b *bs3) int64
+		want      []mapproxy.Extent
+		ok        bool
+	}{
+		{"write in sectors", 4096, formatVersion, [][]byte{testItem(16, 8, 1)},
+			func(b *bs3) int64 { return int64(b.metadata_size + 4096) },
+			[]mapproxy.Extent{{Sector: 2, Length: 1, SeqNo: 1}}, true},
+		{"legacy write in sectors", 4096, 0, [][]byte{testItem(16, 16, 1)},
+			func(b *bs3) int64 { return int64(b.metadata_size + 8192) },
+			[]mapproxy.Extent{{Sector: 2, Length: 2, SeqNo: 1}}, true},
+		{"legacy GC object in blocks", 4096, 0, [][]byte{testItem(3, 2, 1), testItem(10, 1, 2)},
+			func(b *bs3) int64 { return testChunkSize },
+			[]mapproxy.Extent{{Sector: 3, Length: 2, SeqNo: 1}, {Sector: 10, Length: 1, SeqNo: 2}}, true},
+		{"legacy GC object with 512 byte blocks", 512, 0, [][]byte{testItem(3, 2, 1)},
+			func(b *bs3) int64 { return testChunkSize },
+			[]mapproxy.Extent{{Sector: 3, Length: 2, SeqNo: 1}}, true},
+		{"legacy object of unknown size", 4096, 0, [][]byte{testItem(3, 2, 1)},
+			func(b *bs3) int64 { return int64(b.metadata_size + 4096) }, nil, false},
+		{"unaligned write", 4096, formatVersion, [][]byte{testItem(3, 2, 1)},
+			func(b *bs3) int64 { return testChunkSize }, nil, false},
+		{"newer format", 4096, formatVersion + 1, [][]byte{testItem(16, 8, 1)},
+			func(b *bs3) int64 { return int64(b.metadata_size + 4096) }, nil, false},
+	}
+
+	for _, tt := range tests {
+		cfg := newTestConfig(t)
+		cfg.BlockSize = tt.blockSize
+		b := New(cfg, memory.New(), sectormap.New(0))
+
+		header := make([]byte, b.metadata_size)
+		for i, item := range tt.items {
+			copy(header[i*WRITE_ITEM_SIZE:], item)
+		}
+		if tt.version > 0 {
+			b.stampFormat(header)
+			binary.LittleEndian.PutUint64(header[b.metadata_size-WRITE_ITEM_SIZE+16:], uint64(tt.version))
+		}
+
+		got, err := b.parseHeader(header, 1, tt.size(b))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: parsed %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: parsed %+v, want %+v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
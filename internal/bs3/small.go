@@ -0,0 +1,69 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Histograms of sizes of created objects of all volumes, published under
+// "objects" in the metrics.
+var objectMetrics = expvar.NewMap("objects")
+
+// Counts the object with blocks of data in the histogram of object sizes.
+// Buckets are powers of two of the data size in bytes, starting with the block
+// size.
+func (b *bs3) recordObjectSize(blocks int64) {
+	size := blocks * int64(b.cfg().BlockSize)
+	bound := int64(b.cfg().BlockSize)
+	for bound < size {
+		bound *= 2
+	}
+
+	b.objectSizes.Add(fmt.Sprintf("%dB", bound), 1)
+}
+
+// Returns small objects, i.e. objects with data under the fraction size of the
+// chunk, when their fraction among all live objects with known size exceeds
+// ratio. The object with the highest key is never returned, same as in the
+// threshold GC.
+func (b *bs3) filterSmallObjects(sizes map[int64]int64, size, ratio float64) map[int64]struct{} {
+	var maxKey int64
+	small := make(map[int64]struct{})
+
+	for k, v := range sizes {
+		if float64(v*int64(b.cfg().BlockSize)) < size*float64(b.cfg().Write.ChunkSize) {
+			small[k] = struct{}{}
+		}
+
+		if k > maxKey {
+			maxKey = k
+		}
+	}
+
+	delete(small, maxKey)
+
+	if len(small) < 2 || float64(len(small)) <= ratio*float64(len(sizes)) {
+		return nil
+	}
+
+	return small
+}
+
+// Packs live data of small objects into full objects when there are too many
+// of them.
+func (b *bs3) gcSmall() {
+	sizes := b.extentMapProxy.ObjectSizes()
+	small := b.filterSmallObjects(sizes, b.cfg().GC.SmallSize, b.cfg().GC.SmallRatio)
+	if small == nil {
+		return
+	}
+
+	log.Info().Msgf("Small objects GC started. %d of %d live objects are small.", len(small), len(sizes))
+	b.collect(small, b.cfg().GC.Step, time.Time{})
+	log.Info().Msg("Small objects GC finished.")
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"sync"
+	"time"
+)
+
+// Phase of the device deciding the timeout of backend requests. Requests of the
+// restore, i.e. the download of the checkpoint and headers and sizes of objects
+// of the roll forward recovery, take much longer than requests of the runtime
+// IO, hence they have a timeout of their own. The recovery timeout is used
+// until the map is restored, including the lazy restore. Runtime IO served
+// during the lazy restore has the recovery timeout as well.
+type timeouts struct {
+	mutex     sync.Mutex
+	recovered bool
+}
+
+// Sets the timeout of backend requests of the current phase.
+func (b *bs3) applyTimeout() {
+	b.timeouts.mutex.Lock()
+	defer b.timeouts.mutex.Unlock()
+
+	timeout := b.cfg().S3.RecoveryTimeoutMs
+	if b.timeouts.recovered {
+		timeout = b.cfg().S3.TimeoutMs
+	}
+
+	b.objectStoreProxy.Instance.SetTimeout(time.Duration(timeout) * time.Millisecond)
+}
+
+// Switches backend requests to the runtime timeout and downloads to the CDN
+// once the map is restored.
+func (b *bs3) finishRecovery() {
+	b.warming.Wait()
+
+	b.timeouts.mutex.Lock()
+	b.timeouts.recovered = true
+	b.timeouts.mutex.Unlock()
+
+	b.applyTimeout()
+	b.useCDN(true)
+}
+
+// Enables or disables downloads through the CDN, when it is configured. See
+// s3.UseCDN() for objects which may go through it.
+func (b *bs3) useCDN(use bool) {
+	if b.cdn != nil {
+		b.cdn.UseCDN(use)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+)
+
+// Uploads the object with key and data from source and retries until the
+// upload succeeds. Some s3 backends, like minio just drops connection when they
+// are under load, hence the retries with exponential backoff limited by the
+// configured maximal delay. There is no point to return error, since the data
+// are acknowledged or relocated afterwards and the best thing we can do is to
+// try infinitely and print a message to log.
+//
+// Uploads are idempotent per key. Every retry uploads the same content under
+// the same key, hence an attempt which failed for us but succeeded on the
+// backend, e.g. after a timeout, is just overwritten by identical object. The
+// key is allocated by the caller once before the first attempt and never
+// again, which is essential for GC. A new key for the retry would leave the
+// first key either missing, stopping the roll forward recovery, or duplicating
+// the data of the retried object.
+func (b *bs3) uploadRetry(key int64, object []byte, prio bool, source objproxy.Source) {
+	delay := time.Second
+	for {
+		err := b.objectStoreProxy.Upload(key, object, prio, source)
+		if err == nil {
+			return
+		}
+		log.Info().Err(err).Msgf("Upload of object %d failed. Retrying in %s.", key, delay)
+		time.Sleep(delay)
+
+		delay = b.nextRetryDelay(delay)
+	}
+}
+
+// Returns delay of the retry following the one delayed by delay, i.e. twice
+// delay limited by the configured maximal delay.
+func (b *bs3) nextRetryDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if max := time.Duration(b.cfg().S3.RetryMaxDelay) * time.Second; max > 0 && delay > max {
+		delay = max
+	}
+
+	return delay
+}
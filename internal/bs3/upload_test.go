@@ -0,0 +1,163 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asch/bs3/internal/bs3/objproxy"
+	"github.com/asch/bs3/internal/bs3/objproxy/memory"
+)
+
+// Memory backend whose uploads store the object and then fail the given number
+// of times, like an upload which timed out after it succeeded on the backend.
+type lostAckStore struct {
+	*memory.Memory
+
+	failures int32
+
+	mutex   sync.Mutex
+	uploads map[int64]int
+}
+
+func (s *lostAckStore) Upload(key int64, buf []byte, source objproxy.Source) error {
+	s.Memory.Upload(key, buf, source)
+	s.mutex.Lock()
+	s.uploads[key]++
+	s.mutex.Unlock()
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("acknowledgement lost")
+	}
+
+	return nil
+}
+
+func newLostAckStore() *lostAckStore {
+	return &lostAckStore{Memory: memory.New(), uploads: make(map[int64]int)}
+}
+
+// Memory backend whose first upload after gated is set waits for the release
+// and fails without storing the object.
+type gatedUploadStore struct {
+	*memory.Memory
+
+	gated     int32
+	uploading chan struct{}
+	release   chan struct{}
+}
+
+func (s *gatedUploadStore) Upload(key int64, buf []byte, source objproxy.Source) error {
+	if atomic.CompareAndSwapInt32(&s.gated, 1, 0) {
+		s.uploading <- struct{}{}
+		<-s.release
+		return errors.New("upload failed")
+	}
+
+	return s.Memory.Upload(key, buf, source)
+}
+
+// Returns keys of all objects in store.
+func storedKeys(t *testing.T, store objproxy.ObjectUploadDownloaderAt) []int64 {
+	t.Helper()
+
+	var keys []int64
+	err := store.ListKeys(func(key, size int64) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestWriteUploadRetriedUnderSameKey(t *testing.T) {
+	store := newLostAckStore()
+	b := newTestVolume(t, newTestConfig(t), store)
+	keyBefore := b.key.Current()
+
+	atomic.StoreInt32(&store.failures, 1)
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{5, testData(1, 7)})); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.key.Current() != keyBefore+1 {
+		t.Fatalf("retried write advanced the key by %d", b.key.Current()-keyBefore)
+	}
+	if store.uploads[keyBefore] != 2 {
+		t.Fatalf("object %d was uploaded %d times, not retried once", keyBefore, store.uploads[keyBefore])
+	}
+	if keys := storedKeys(t, store); len(keys) != 1 || keys[0] != keyBefore {
+		t.Fatalf("retried write left objects %v", keys)
+	}
+	expectRead(t, b, 5, testData(1, 7))
+}
+
+func TestGCUploadRetriedUnderSameKey(t *testing.T) {
+	store := newLostAckStore()
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(2, testChunk(b, 1, testWrite{0, testData(1, 1)}, testWrite{300, testData(1, 2)})); err != nil {
+		t.Fatal(err)
+	}
+	source := b.key.Current() - 1
+
+	atomic.StoreInt32(&store.failures, 1)
+	b.collect(map[int64]struct{}{source: {}}, b.cfg().GC.Step, time.Time{})
+
+	gcKey := source + 1
+	if b.key.Current() != gcKey+1 {
+		t.Fatalf("retried GC upload allocated %d keys", b.key.Current()-gcKey)
+	}
+	if store.uploads[gcKey] != 2 {
+		t.Fatalf("GC object %d was uploaded %d times, not retried once", gcKey, store.uploads[gcKey])
+	}
+	utilization := b.extentMapProxy.ObjectsUtilization()
+	if _, ok := utilization[source]; ok || utilization[gcKey] != 2 {
+		t.Fatalf("extents were not relocated to the retried GC object: %v", utilization)
+	}
+	expectRead(t, b, 0, testData(1, 1))
+	expectRead(t, b, 300, testData(1, 2))
+}
+
+func TestWriteAllOrNothing(t *testing.T) {
+	store := &gatedUploadStore{
+		Memory:    memory.New(),
+		uploading: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	b := newTestVolume(t, newTestConfig(t), store)
+	if err := b.BuseWrite(1, testChunk(b, 1, testWrite{0, testData(1, 1)})); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&store.gated, 1)
+	done := make(chan error)
+	go func() {
+		done <- b.BuseWrite(2, testChunk(b, 10, testWrite{0, testData(1, 2)}, testWrite{1, testData(1, 3)}))
+	}()
+
+	// None of the writes is visible before the upload, not even after a
+	// crash.
+	<-store.uploading
+	expectRead(t, b, 0, testData(1, 1))
+	expectRead(t, b, 1, testData(1, 0))
+	crashed := newTestVolume(t, newTestConfig(t), store.Memory)
+	expectRead(t, crashed, 0, testData(1, 1))
+	expectRead(t, crashed, 1, testData(1, 0))
+
+	// The failed upload is retried and not returned.
+	store.release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expectRead(t, b, 0, testData(1, 2))
+	expectRead(t, b, 1, testData(1, 3))
+	restored := newTestVolume(t, newTestConfig(t), store.Memory)
+	expectRead(t, restored, 0, testData(1, 2))
+	expectRead(t, restored, 1, testData(1, 3))
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package bs3
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/asch/bs3/internal/config"
+)
+
+// Volume identifier in the form of UUID. It is stored in the checkpoint and
+// validated during restore, so the daemon refuses to start with a bucket of a
+// different volume.
+type volumeID [16]byte
+
+// Returns true for the zero identifier which means unknown volume.
+func (v volumeID) isZero() bool {
+	return v == volumeID{}
+}
+
+// Returns canonical textual representation of the UUID.
+func (v volumeID) String() string {
+	h := hex.EncodeToString(v[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// Parses volume identifier from its textual representation.
+func parseVolumeID(s string) (volumeID, error) {
+	var v volumeID
+
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	if err != nil || len(raw) != len(v) {
+		return v, errors.New("Invalid volume id " + s)
+	}
+	copy(v[:], raw)
+
+	return v, nil
+}
+
+// Generates new random (version 4) UUID.
+func newVolumeID() (volumeID, error) {
+	var v volumeID
+
+	if _, err := rand.Read(v[:]); err != nil {
+		return v, err
+	}
+	v[6] = (v[6] & 0x0f) | 0x40
+	v[8] = (v[8] & 0x3f) | 0x80
+
+	return v, nil
+}
+
+// Returns the volume identifier from the configuration or from the volume id
+// file persisted during the first run. When there is none, new identifier is
+// generated and false is returned, since it is not persisted yet.
+func loadVolumeID(cfg *config.Config) (volumeID, bool, error) {
+	if cfg.VolumeID != "" {
+		v, err := parseVolumeID(cfg.VolumeID)
+		return v, true, err
+	}
+
+	if cfg.VolumeIDFile != "" {
+		raw, err := ioutil.ReadFile(cfg.VolumeIDFile)
+		if err == nil {
+			v, err := parseVolumeID(string(raw))
+			return v, true, err
+		}
+		if !os.IsNotExist(err) {
+			return volumeID{}, false, err
+		}
+	}
+
+	v, err := newVolumeID()
+
+	return v, false, err
+}
+
+// Persists newly generated volume identifier into the volume id file path.
+func persistVolumeID(v volumeID, path string) {
+	if path == "" {
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(v.String()+"\n"), 0644)
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msgf("Volume id %s cannot be persisted.", v)
+	} else {
+		log.Info().Msgf("Volume id %s persisted in %s.", v, path)
+	}
+}
+
+// Validates volume identifier found in the checkpoint against the expected
+// one. Legacy checkpoints do not have any identifier and are accepted. When
+// the expected identifier is not known, the one from the checkpoint is
+// adopted. Panics on mismatch, because replaying objects of a different volume
+// would corrupt the device.
+func (b *bs3) checkVolumeID(found volumeID) {
+	switch {
+	case found.isZero() || found == b.volumeID:
+	case b.volumeID.isZero():
+		b.volumeID = found
+	case !b.volumeIDPersisted:
+		log.Panic().Msgf("Bucket %s contains volume %s, but no volume id is configured. "+
+			"Set volume_id = \"%s\" if it is the intended volume.",
+			b.cfg().S3.Bucket, found, found)
+	default:
+		log.Panic().Msgf("Bucket %s contains volume %s, but volume %s is configured. Refusing to start.",
+			b.cfg().S3.Bucket, found, b.volumeID)
+	}
+}
@@ -1,12 +1,19 @@
 // Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
 
 // Package config is a singleton and provides global access to the
-// configuration values.
+// configuration values. When the daemon manages multiple volumes, every volume
+// has its own copy of the configuration, see Volumes().
 package config
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -15,10 +22,23 @@ const (
 	// Default config path. It does not need to exist, default values for all parameters will be
 	// used instead.
 	defaultConfig = "/etc/bs3/config.toml"
+
+	// Config path meaning that the configuration is read from stdin.
+	stdinConfig = "-"
+
+	// Timeout of the download of the configuration from the url.
+	fetchTimeout = 30 * time.Second
 )
 
 var Cfg Config
 
+// Configurations of all volumes managed by the daemon.
+var volumes []*Config
+
+// Configuration read from stdin. Stdin can be read only once, hence it is kept
+// for reloads.
+var stdinBytes []byte
+
 // Configuration structure for the program. We use toml format for file-based
 // configuration and also all configuration options can be overriden by
 // environment variable specified in this structure.
@@ -37,88 +57,498 @@ type Config struct {
 	QueueDepth  int   `toml:"queue_depth" env:"BS3_QUEUEDEPTH" env-default:"128" env-description:"Device IO queue depth."`
 
 	S3 struct {
-		Bucket      string `toml:"bucket" env:"BS3_S3_BUCKET" env-description:"S3 Bucket name." env-default:"bs3"`
-		Remote      string `toml:"remote" env:"BS3_S3_REMOTE" env-description:"S3 Remote address. Empty string for AWS S3 endpoint." env-default:""`
-		Region      string `toml:"region" env:"BS3_S3_REGION" env-description:"S3 Region." env-default:"us-east-1"`
-		AccessKey   string `toml:"access_key" env:"BS3_S3_ACCESSKEY" env-description:"S3 Access Key." env-default:""`
-		SecretKey   string `toml:"secret_key" env:"BS3_S3_SECRETKEY" env-description:"S3 Secret Key." env-default:""`
-		Uploaders   int    `toml:"uploaders" env:"BS3_S3_UPLOADERS" env-description:"S3 Max number of uploader threads." env-default:"16"`
-		Downloaders int    `toml:"downloaders" env:"BS3_S3_DOWNLOADERS" env-description:"S3 Max number of downloader threads." env-default:"16"`
+		Bucket            string `toml:"bucket" env:"BS3_S3_BUCKET" env-description:"S3 Bucket name." env-default:"bs3"`
+		Remote            string `toml:"remote" env:"BS3_S3_REMOTE" env-description:"S3 Remote address. Empty string for AWS S3 endpoint." env-default:""`
+		Region            string `toml:"region" env:"BS3_S3_REGION" env-description:"S3 Region." env-default:"us-east-1"`
+		AutoRegion        bool   `toml:"auto_region" env:"BS3_S3_AUTOREGION" env-description:"Detect the region of the bucket and use it instead of the configured one, which is the fallback when the detection fails." env-default:"false"`
+		AccessKey         string `toml:"access_key" env:"BS3_S3_ACCESSKEY" env-description:"S3 Access Key." env-default:""`
+		SecretKey         string `toml:"secret_key" env:"BS3_S3_SECRETKEY" env-description:"S3 Secret Key." env-default:""`
+		Uploaders         int    `toml:"uploaders" env:"BS3_S3_UPLOADERS" env-description:"S3 Max number of uploader threads." env-default:"16"`
+		Downloaders       int    `toml:"downloaders" env:"BS3_S3_DOWNLOADERS" env-description:"S3 Max number of downloader threads." env-default:"16"`
+		HedgeDelayMs      int64  `toml:"hedge_delay" env:"BS3_S3_HEDGEDELAY" env-description:"Download not finished within this time is sent again and the faster one is used. In ms. 0 disables hedging." env-default:"0"`
+		RetryMaxDelay     int64  `toml:"retry_max_delay" env:"BS3_S3_RETRYMAXDELAY" env-description:"Maximal delay between retries of a failed upload or download in seconds. Retries are exponentially backed off up to it. 0 means no limit." env-default:"60"`
+		DeadlineMs        int64  `toml:"deadline" env:"BS3_S3_DEADLINE" env-description:"Deadline of uploads and downloads including the wait for a free thread. Requests waiting longer fail without being started. In ms. 0 means no deadline." env-default:"0"`
+		TimeoutMs         int64  `toml:"timeout" env:"BS3_S3_TIMEOUT" env-description:"Timeout of every download and size request after the recovery. Uploads are never interrupted. In ms. 0 means no timeout." env-default:"0"`
+		RecoveryTimeoutMs int64  `toml:"recovery_timeout" env:"BS3_S3_RECOVERYTIMEOUT" env-description:"Timeout of every download and size request until the extent map is restored, including the lazy restore. In ms. 0 means no timeout." env-default:"0"`
+		CDN               string `toml:"cdn" env:"BS3_S3_CDN" env-description:"Base URL of the CDN used for downloads by presigned URLs. Empty string for direct downloads." env-default:""`
+		HTTPProxy         string `toml:"http_proxy" env:"BS3_S3_HTTPPROXY" env-description:"URL of the HTTP proxy of all requests to the S3 backend and the CDN. Empty string for the proxy from the environment." env-default:""`
+		LockMode          string `toml:"lock_mode" env:"BS3_S3_LOCKMODE" env-description:"S3 Object Lock mode, GOVERNANCE or COMPLIANCE. Empty string disables object lock." env-default:""`
+		LockDays          int    `toml:"lock_days" env:"BS3_S3_LOCKDAYS" env-description:"S3 Object Lock retention period in days." env-default:"30"`
+		PrefixDepth       int64  `toml:"prefix_depth" env:"BS3_S3_PREFIXDEPTH" env-description:"Number of keys after the last recovered object whose prefixes are listed to delete stale objects. 0 lists the whole bucket." env-default:"0"`
+		DeleteBatchSize   int    `toml:"delete_batch_size" env:"BS3_S3_DELETEBATCHSIZE" env-description:"Maximal number of objects deleted by one request when objects after the last recovered one are deleted. At most 1000." env-default:"1000"`
+		NamePrefix        string `toml:"name_prefix" env:"BS3_S3_NAMEPREFIX" env-description:"Static prefix of names of all objects in the bucket, e.g. volumes/vol0/." env-default:""`
+		KeyBase           int64  `toml:"key_base" env:"BS3_S3_KEYBASE" env-description:"Offset of keys of all objects of the volume, so volumes can share a bucket by disjoint key windows." env-default:"0"`
+		KeySpan           int64  `toml:"key_span" env:"BS3_S3_KEYSPAN" env-description:"Size of the key window starting at key_base. 0 means unbounded." env-default:"0"`
+		MaxRetries        int    `toml:"max_retries" env:"BS3_S3_MAXRETRIES" env-description:"Retries of a failed request done by the AWS SDK within one bs3 attempt. Negative value means the SDK default." env-default:"1"`
+		SDKLogLevel       string `toml:"sdk_log_level" env:"BS3_S3_SDKLOGLEVEL" env-description:"Comma separated AWS SDK logging options: debug, signing, body, retries, errors. Logged at the debug level. Empty string disables the SDK log." env-default:""`
+		AbortMultipart    bool   `toml:"abort_multipart" env:"BS3_S3_ABORTMULTIPART" env-description:"Abort incomplete multipart uploads of objects of the volume during start." env-default:"false"`
+		ContentEncoding   string `toml:"content_encoding" env:"BS3_S3_CONTENTENCODING" env-description:"Content-Encoding set on uploaded objects. When set, downloads request the identity encoding. Empty string sets no Content-Encoding." env-default:""`
+		TagSource         bool   `toml:"tag_source" env:"BS3_S3_TAGSOURCE" env-description:"Tag uploaded objects with bs3-source set to write, gc or checkpoint." env-default:"false"`
+
+		Secondary struct {
+			Bucket    string `toml:"bucket" env:"BS3_S3_SECONDARY_BUCKET" env-description:"Bucket of the read replica used when the primary backend fails. Empty string disables failover." env-default:""`
+			Remote    string `toml:"remote" env:"BS3_S3_SECONDARY_REMOTE" env-description:"Read replica remote address. Empty string for AWS S3 endpoint." env-default:""`
+			Region    string `toml:"region" env:"BS3_S3_SECONDARY_REGION" env-description:"Read replica region." env-default:"us-east-1"`
+			AccessKey string `toml:"access_key" env:"BS3_S3_SECONDARY_ACCESSKEY" env-description:"Read replica Access Key." env-default:""`
+			SecretKey string `toml:"secret_key" env:"BS3_S3_SECONDARY_SECRETKEY" env-description:"Read replica Secret Key." env-default:""`
+			Failures  int64  `toml:"failures" env:"BS3_S3_SECONDARY_FAILURES" env-description:"Consecutive failures of the primary backend after which all reads go to the read replica." env-default:"5"`
+			OpenTime  int64  `toml:"open_time" env:"BS3_S3_SECONDARY_OPENTIME" env-description:"Seconds after which the failed primary backend is probed again." env-default:"30"`
+		} `toml:"secondary"`
 	} `toml:"s3"`
 
+	FS struct {
+		Path string `toml:"path" env:"BS3_FS_PATH" env-description:"Directory used as the object store instead of S3. Empty string means S3." env-default:""`
+	} `toml:"fs"`
+
 	Write struct {
-		Durable       bool `toml:"durable" env:"BS3_WRITE_DURABLE" env-description:"Flush semantics. True means durable, false means barrier only." env-default:"false"`
-		BufSize       int  `toml:"shared_buffer_size" env:"BS3_WRITE_BUFSIZE" env-description:"Write shared memory size in MB." env-default:"32"`
-		ChunkSize     int  `toml:"chunk_size" env:"BS3_WRITE_CHUNKSIZE" env-description:"Chunk size in MB." env-default:"4"`
-		CollisionSize int  `toml:"collision_chunk_size" env:"BS3_WRITE_COLSIZE" env-description:"Collision size in MB." env-default:"1"`
+		Durable            bool  `toml:"durable" env:"BS3_WRITE_DURABLE" env-description:"Flush semantics. True means durable, false means barrier only." env-default:"false"`
+		BufSize            int   `toml:"shared_buffer_size" env:"BS3_WRITE_BUFSIZE" env-description:"Write shared memory size in MB." env-default:"32"`
+		ChunkSize          int   `toml:"chunk_size" env:"BS3_WRITE_CHUNKSIZE" env-description:"Chunk size in MB." env-default:"4"`
+		CollisionSize      int   `toml:"collision_chunk_size" env:"BS3_WRITE_COLSIZE" env-description:"Collision size in MB." env-default:"1"`
+		Coalesce           bool  `toml:"coalesce" env:"BS3_WRITE_COALESCE" env-description:"Merge adjacent writes within one chunk before the extent map update." env-default:"false"`
+		Async              bool  `toml:"async" env:"BS3_WRITE_ASYNC" env-description:"Acknowledge writes before they are uploaded. Acknowledged writes can be lost." env-default:"false"`
+		Checksum           bool  `toml:"checksum" env:"BS3_WRITE_CHECKSUM" env-description:"Store checksum of every write in the object header and verify it on reads." env-default:"false"`
+		MaxInflight        int64 `toml:"max_inflight" env:"BS3_WRITE_MAXINFLIGHT" env-description:"Maximal size of objects of writes being uploaded in MB. Writes block when it is reached. 0 means no limit." env-default:"0"`
+		ThrottleWatermark  int64 `toml:"throttle_watermark" env:"BS3_WRITE_THROTTLEWATERMARK" env-description:"Size of objects of writes being uploaded in MB above which writes are delayed. 0 disables throttling." env-default:"0"`
+		ThrottleMaxDelayMs int64 `toml:"throttle_max_delay" env:"BS3_WRITE_THROTTLEMAXDELAY" env-description:"Maximal delay of a write when throttled. In ms." env-default:"100"`
+		Align              int   `toml:"align" env:"BS3_WRITE_ALIGN" env-description:"Objects are padded by zeros to the multiple of this size in KB. 0 means no padding." env-default:"0"`
 	} `toml:"write"`
 
 	Read struct {
-		BufSize int `toml:"shared_buffer_size" env:"BS3_READ_BUFSIZE" env-description:"Read shared memory size in MB." env-default:"32"`
+		BufSize            int   `toml:"shared_buffer_size" env:"BS3_READ_BUFSIZE" env-description:"Read shared memory size in MB." env-default:"32"`
+		MaxFanout          int   `toml:"max_fanout" env:"BS3_READ_MAXFANOUT" env-description:"Maximal number of goroutines downloading object parts of reads and prefetches. 0 means no limit." env-default:"4096"`
+		MultipartThreshold int64 `toml:"multipart_threshold" env:"BS3_READ_MULTIPARTTHRESHOLD" env-description:"Reads from one object bigger than this size are split into parallel downloads of this size. In KB. 0 disables splitting." env-default:"0"`
 	} `toml:"read"`
 
+	Cache struct {
+		Size        int64   `toml:"size" env:"BS3_CACHE_SIZE" env-description:"Size of the in-memory read cache in MB. 0 disables the cache." env-default:"0"`
+		MemoryLimit int64   `toml:"memory_limit" env:"BS3_CACHE_MEMORYLIMIT" env-description:"Memory limit of the process in MB used for detection of memory pressure. 0 means total memory." env-default:"0"`
+		DiskDir     string  `toml:"disk_dir" env:"BS3_CACHE_DISKDIR" env-description:"Directory of the persistent disk cache of downloaded blocks surviving restarts. Empty string disables the disk cache." env-default:""`
+		DiskSize    int64   `toml:"disk_size" env:"BS3_CACHE_DISKSIZE" env-description:"Maximal size of data in the disk cache in MB." env-default:"1024"`
+		ReadAhead   int64   `toml:"read_ahead" env:"BS3_CACHE_READAHEAD" env-description:"Maximal window of blocks prefetched into the cache after sequential reads. The window grows with sequential reads and collapses on random reads. In blocks. 0 disables read-ahead." env-default:"0"`
+		Pressure    float64 `toml:"pressure" env:"BS3_CACHE_PRESSURE" env-description:"Fraction of the memory limit used by the heap when the cache starts to shrink. 0 disables the detection." env-default:"0.8"`
+	} `toml:"cache"`
+
 	GC struct {
-		Step          int64   `toml:"step" env:"BS3_GC_STEP" env-description:"Step for traversing the extent map for living extents. In blocks." env-default:"1024"`
-		LiveData      float64 `toml:"live_data" env:"BS3_GC_LIVEDATA" env-description:"Live data ratio threshold for threshold GC. This is for the threshold GC which is triggered by the user or systemd timer." env-default:"0.3"`
-		IdleTimeoutMs int64   `toml:"idle_timeout" env:"BS3_GC_IDLETIMEOUT" env-description:"Idle timeout for running GC requests. In ms." env-default:"200"`
-		Wait          int64   `toml:"wait" env:"BS3_GC_WAIT" env-description:"How many seconds wait before next dead GC round. This just for cleaning dead objects with minimal performance impact." env-default:"600"`
+		Step             int64   `toml:"step" env:"BS3_GC_STEP" env-description:"Step for traversing the extent map for living extents. In blocks." env-default:"1024"`
+		LiveData         float64 `toml:"live_data" env:"BS3_GC_LIVEDATA" env-description:"Live data ratio threshold for threshold GC. This is for the threshold GC which is triggered by the user or systemd timer." env-default:"0.3"`
+		IdleTimeoutMs    int64   `toml:"idle_timeout" env:"BS3_GC_IDLETIMEOUT" env-description:"Idle timeout for running GC requests. In ms." env-default:"200"`
+		SpanExtents      int     `toml:"span_extents" env:"BS3_GC_SPANEXTENTS" env-description:"Minimal number of extents copied from one object by threshold GC which are downloaded by a single request covering all of them. 0 means a request per extent." env-default:"4"`
+		SpanGapRatio     float64 `toml:"span_gap_ratio" env:"BS3_GC_SPANGAPRATIO" env-description:"Maximal ratio of gaps between extents of one object to the span covering them, under which threshold GC downloads the whole span by a single request. Otherwise only adjacent extents are downloaded together." env-default:"1"`
+		Mode             string  `toml:"mode" env:"BS3_GC_MODE" env-description:"GC run by SIGUSR1 and the schedule. threshold reclaims space of objects under the live data threshold, locality consolidates logically adjacent sectors into the same objects." env-default:"threshold"`
+		LocalityObjects  int     `toml:"locality_objects" env:"BS3_GC_LOCALITYOBJECTS" env-description:"Minimal number of objects over which live data of a region of the object size have to be spread to be consolidated by locality GC. At least 3." env-default:"4"`
+		MaxDurationSec   int64   `toml:"max_duration" env:"BS3_GC_MAXDURATION" env-description:"Time budget of one threshold GC run in seconds. The next run continues where the previous one stopped. 0 means no limit." env-default:"0"`
+		MaxFanout        int     `toml:"max_fanout" env:"BS3_GC_MAXFANOUT" env-description:"Maximal number of goroutines downloading extents copied by GC. 0 means no limit." env-default:"1024"`
+		ProbeSizes       bool    `toml:"probe_sizes" env:"BS3_GC_PROBESIZES" env-description:"Ask the backend for sizes of dead objects unknown to the map for the estimate of space reclaimed by dead GC. Failed probes are logged and the objects are counted as unknown." env-default:"false"`
+		DeadMinObjects   int64   `toml:"dead_min_objects" env:"BS3_GC_DEADMINOBJECTS" env-description:"Minimal number of dead objects for which dead GC round removes them. Fewer dead objects wait for the next round." env-default:"1"`
+		DeadManual       bool    `toml:"dead_manual" env:"BS3_GC_DEADMANUAL" env-description:"Do not run dead GC in the background. Dead objects are removed only by the dead admin command and after threshold GC." env-default:"false"`
+		Wait             int64   `toml:"wait" env:"BS3_GC_WAIT" env-description:"How many seconds wait before next dead GC round. This just for cleaning dead objects with minimal performance impact." env-default:"600"`
+		SmallSize        float64 `toml:"small_size" env:"BS3_GC_SMALLSIZE" env-description:"Objects with data under this fraction of the chunk size are small." env-default:"0.25"`
+		SmallRatio       float64 `toml:"small_ratio" env:"BS3_GC_SMALLRATIO" env-description:"Fraction of small live objects which triggers coalescing of them after the dead GC round. 0 disables the trigger." env-default:"0"`
+		Schedule         string  `toml:"schedule" env:"BS3_GC_SCHEDULE" env-description:"Cron expression with minute, hour, day of month, month and day of week of scheduled threshold GC runs. Empty string disables the schedule." env-default:""`
+		ScheduleLiveData float64 `toml:"schedule_live_data" env:"BS3_GC_SCHEDULELIVEDATA" env-description:"Live data ratio threshold for scheduled threshold GC runs." env-default:"0.3"`
+		IdleWindowSec    int64   `toml:"idle_window" env:"BS3_GC_IDLEWINDOW" env-description:"GC runs are deferred until there was no read nor write for this number of seconds. 0 runs GC regardless of the foreground IO." env-default:"0"`
 	} `toml:"gc"`
 
 	Log struct {
-		Level  int  `toml:"level" env:"BS3_LOG_LEVEL" env-description:"Log level." env-default:"-1"`
-		Pretty bool `toml:"pretty" env:"BS3_LOG_PRETTY" env-description:"Pretty logging." env-default:"true"`
+		Level  int               `toml:"level" env:"BS3_LOG_LEVEL" env-description:"Log level." env-default:"-1"`
+		Pretty bool              `toml:"pretty" env:"BS3_LOG_PRETTY" env-description:"Pretty logging." env-default:"true"`
+		JSON   bool              `toml:"json" env:"BS3_LOG_JSON" env-description:"Single-line JSON logging with RFC3339 timestamps. Takes precedence over pretty logging." env-default:"false"`
+		Fields map[string]string `toml:"fields" env:"BS3_LOG_FIELDS" env-description:"Static fields added to every log message, e.g. volume:vol0,instance:node1."`
 	} `toml:"log"`
 
-	SkipCheckpoint bool `toml:"skip_checkpoint" env:"BS3_SKIP" env-description:"Skip restoring from and creating checkpoint." env-default:"false"`
-	Profiler       bool `toml:"profiler" env:"BS3_PROFILER" env-description:"Enable golang web profiler." env-default:"false"`
-	ProfilerPort   int  `toml:"profiler_port" env:"BS3_PROFILER_PORT" env-description:"Port to listen on." env-default:"6060"`
+	Encryption struct {
+		Passphrase       string `toml:"passphrase" env:"BS3_ENCRYPTION_PASSPHRASE" env-description:"Passphrase the key of the client-side encryption of objects is derived from. Empty string means no encryption." env-default:""`
+		PassphraseSource string `toml:"passphrase_source" env:"BS3_ENCRYPTION_PASSPHRASE_SOURCE" env-description:"Source of the encryption passphrase read at startup instead of the passphrase option: file:<path>, env:<variable> or http(s) url returning the passphrase. Empty string means the passphrase option." env-default:""`
+	} `toml:"encryption"`
+
+	SkipCheckpoint         bool   `toml:"skip_checkpoint" env:"BS3_SKIP" env-description:"Skip restoring from and creating checkpoint." env-default:"false"`
+	LazyRestore            bool   `toml:"lazy_restore" env:"BS3_LAZY_RESTORE" env-description:"Make the device available before the checkpoint is restored. Not yet restored sectors read as zeros." env-default:"false"`
+	DeepRead               int64  `toml:"deep_read" env:"BS3_DEEP_READ" env-description:"Number of the most recent objects scanned for writes of blocks which read as unmapped. Found writes are logged. Debugging aid, very expensive. 0 disables it." env-default:"0"`
+	VerifyMap              bool   `toml:"verify_map" env:"BS3_VERIFY_MAP" env-description:"Verify consistency of the extent map restored from the checkpoint. It is a full scan of the map." env-default:"false"`
+	Integrity              bool   `toml:"integrity" env:"BS3_INTEGRITY" env-description:"Store Merkle root of the serialized map in every checkpoint and verify it during the restore." env-default:"false"`
+	IntegrityLog           bool   `toml:"integrity_log" env:"BS3_INTEGRITY_LOG" env-description:"Append Merkle roots of checkpoints to the hash chained integrity log object and verify checkpoints against it. Needs integrity." env-default:"false"`
+	IntegrityAdopt         bool   `toml:"integrity_adopt" env:"BS3_INTEGRITY_ADOPT" env-description:"Accept the checkpoint without Merkle roots or integrity log when the integrity is enabled on an existing volume. Disable it after the first checkpoint." env-default:"false"`
+	VerifyCheckpoint       bool   `toml:"verify_checkpoint" env:"BS3_VERIFY_CHECKPOINT" env-description:"Deserialize every checkpoint into a temporary map and refuse to upload it when the map differs." env-default:"false"`
+	Incarnation            bool   `toml:"incarnation" env:"BS3_INCARNATION" env-description:"Tag objects with the incarnation of the volume and ignore objects of older incarnations during roll forward recovery." env-default:"false"`
+	RecoveryMemory         int64  `toml:"recovery_memory" env:"BS3_RECOVERY_MEMORY" env-description:"Memory for object headers downloaded in parallel during roll forward recovery. In MB." env-default:"64"`
+	RecoveryListing        bool   `toml:"recovery_listing" env:"BS3_RECOVERY_LISTING" env-description:"List all objects at once during roll forward recovery instead of requesting size of every object separately." env-default:"false"`
+	RecoveryMissingRetries int    `toml:"recovery_missing_retries" env:"BS3_RECOVERY_MISSING_RETRIES" env-description:"Retries with exponential backoff of an object missing during roll forward recovery before the prefix gap is accepted." env-default:"0"`
+	CheckpointDeltas       int64  `toml:"checkpoint_deltas" env:"BS3_CHECKPOINT_DELTAS" env-description:"Maximal number of delta checkpoints before the full checkpoint is written. 0 disables delta checkpoints." env-default:"0"`
+	CheckpointShards       int64  `toml:"checkpoint_shards" env:"BS3_CHECKPOINT_SHARDS" env-description:"Number of objects the checkpoint is split into and uploaded in parallel. 1 stores the checkpoint in a single object." env-default:"1"`
+	EarlyCheckpoint        bool   `toml:"early_checkpoint" env:"BS3_EARLY_CHECKPOINT" env-description:"Start checkpointing when the stop signal comes in and upload only a delta after the device is removed." env-default:"false"`
+	MapFile                string `toml:"map_file" env:"BS3_MAP_FILE" env-description:"Local file where the extent map is memory-mapped and kept across restarts. Empty string keeps the map in memory." env-default:""`
+	PauseTimeout           int64  `toml:"pause_timeout" env:"BS3_PAUSE_TIMEOUT" env-description:"Seconds after which IO paused by the admin command is resumed automatically." env-default:"300"`
+	Trace                  bool   `toml:"trace" env:"BS3_TRACE" env-description:"Record all reads and writes of the device without data to trace_path for replay by bs3-replay." env-default:"false"`
+	TracePath              string `toml:"trace_path" env:"BS3_TRACE_PATH" env-description:"File where the IO trace is recorded and where bs3-replay reads it from." env-default:"/var/lib/bs3/trace"`
+	Profiler               bool   `toml:"profiler" env:"BS3_PROFILER" env-description:"Enable golang web profiler." env-default:"false"`
+	ProfilerPort           int    `toml:"profiler_port" env:"BS3_PROFILER_PORT" env-description:"Port to listen on." env-default:"6060"`
+	Admin                  bool   `toml:"admin" env:"BS3_ADMIN" env-description:"Serve metrics in JSON at /debug/vars and control commands at /volumes/<major>/<command>." env-default:"false"`
+	AdminPort              int    `toml:"admin_port" env:"BS3_ADMIN_PORT" env-description:"Admin port to listen on." env-default:"6061"`
+	Metrics                bool   `toml:"metrics" env:"BS3_METRICS" env-description:"Deprecated name of admin." env-default:"false"`
+	MetricsPort            int    `toml:"metrics_port" env:"BS3_METRICS_PORT" env-description:"Deprecated name of admin_port. 0 means admin_port." env-default:"0"`
+
+	VolumeID     string `toml:"volume_id" env:"BS3_VOLUME_ID" env-description:"UUID of the volume validated against the checkpoint. Empty string means the one from volume_id_file." env-default:""`
+	VolumeIDFile string `toml:"volume_id_file" env:"BS3_VOLUME_ID_FILE" env-description:"File where the volume UUID generated during the first run is persisted." env-default:"/var/lib/bs3/volume_id"`
+
+	Volumes []Volume `toml:"volume"`
+}
+
+// Configuration specific to one of multiple volumes managed by the daemon. It
+// can be specified only in the configuration file. Zero values are inherited
+// from the top level configuration, except the major which has to be unique.
+type Volume struct {
+	Major        int    `toml:"major"`
+	Size         int64  `toml:"size"`
+	Bucket       string `toml:"bucket"`
+	NamePrefix   string `toml:"name_prefix"`
+	KeyBase      int64  `toml:"key_base"`
+	VolumeID     string `toml:"volume_id"`
+	VolumeIDFile string `toml:"volume_id_file"`
 }
 
 // Configure reads commandline flags and handles the configuration. The
 // configuration file has the lower priotiry and the environment variables have
 // the highest priority. It is perfetcly to fine to use just one of these or to
-// combine them.
+// combine them. Instead of the file path, the configuration can be given as -
+// for stdin or as http(s) url where it is downloaded from. It is always in the
+// toml format then.
 func Configure() error {
 	flagSetup()
-	err := parse()
+	if err := parse(&Cfg); err != nil {
+		return err
+	}
+
+	var err error
+	volumes, err = split(&Cfg)
 
 	return err
 }
 
+// Returns configurations of all volumes managed by the daemon. When there is no
+// volume section, the top level configuration is the only volume.
+func Volumes() []*Config {
+	return volumes
+}
+
+// Splits the configuration into the configurations of individual volumes.
+// Every volume has to have its own major and bucket, name prefix or key
+// window, since the keys of objects are not prefixed by the volume. When the
+// volume id file is not set for a volume, the top level one suffixed by the
+// major is used.
+func split(cfg *Config) ([]*Config, error) {
+	if len(cfg.Volumes) == 0 {
+		if err := checkFSOptions(cfg); err != nil {
+			return nil, err
+		}
+		return []*Config{cfg}, nil
+	}
+
+	majors := make(map[int]struct{})
+	buckets := make(map[string][]int64)
+	split := make([]*Config, 0, len(cfg.Volumes))
+
+	for _, v := range cfg.Volumes {
+		c := *cfg
+		c.Volumes = nil
+		c.Major = v.Major
+		c.VolumeIDFile = fmt.Sprintf("%s.%d", cfg.VolumeIDFile, v.Major)
+		c.TracePath = fmt.Sprintf("%s.%d", cfg.TracePath, v.Major)
+		if cfg.MapFile != "" {
+			c.MapFile = fmt.Sprintf("%s.%d", cfg.MapFile, v.Major)
+		}
+		if cfg.Cache.DiskDir != "" {
+			c.Cache.DiskDir = fmt.Sprintf("%s.%d", cfg.Cache.DiskDir, v.Major)
+		}
+		if cfg.FS.Path != "" {
+			c.FS.Path = fmt.Sprintf("%s.%d", cfg.FS.Path, v.Major)
+		}
+
+		if v.Size != 0 {
+			c.Size = v.Size * 1024 * 1024 * 1024
+		}
+		if v.Bucket != "" {
+			c.S3.Bucket = v.Bucket
+		}
+		if v.NamePrefix != "" {
+			c.S3.NamePrefix = v.NamePrefix
+		}
+		if v.KeyBase != 0 {
+			c.S3.KeyBase = v.KeyBase
+		}
+		if v.VolumeID != "" {
+			c.VolumeID = v.VolumeID
+		}
+		if v.VolumeIDFile != "" {
+			c.VolumeIDFile = v.VolumeIDFile
+		}
+
+		if err := checkFSOptions(&c); err != nil {
+			return nil, err
+		}
+		if _, ok := majors[c.Major]; ok {
+			return nil, fmt.Errorf("major %d is used by more volumes", c.Major)
+		}
+		bucket := c.S3.Remote + "/" + c.S3.Bucket + "/" + c.S3.NamePrefix
+		if c.FS.Path != "" {
+			// Every volume has its own directory.
+			bucket = c.FS.Path
+		}
+		for _, base := range buckets[bucket] {
+			if !keyWindowsDisjoint(base, c.S3.KeyBase, c.S3.KeySpan) {
+				return nil, fmt.Errorf("bucket %s with name prefix %q is used by more volumes with overlapping key windows",
+					c.S3.Bucket, c.S3.NamePrefix)
+			}
+		}
+		majors[c.Major] = struct{}{}
+		buckets[bucket] = append(buckets[bucket], c.S3.KeyBase)
+
+		split = append(split, &c)
+	}
+
+	return split, nil
+}
+
+// Returns error when an option of S3 objects which the local directory does not
+// support is set together with fs.path. Objects in the directory are named by
+// their keys only and they cannot be locked.
+func checkFSOptions(cfg *Config) error {
+	if cfg.FS.Path == "" {
+		return nil
+	}
+
+	options := []struct {
+		name string
+		set  bool
+	}{
+		{"s3.key_base", cfg.S3.KeyBase != 0},
+		{"s3.key_span", cfg.S3.KeySpan != 0},
+		{"s3.lock_mode", cfg.S3.LockMode != ""},
+		{"s3.name_prefix", cfg.S3.NamePrefix != ""},
+	}
+	for _, o := range options {
+		if o.set {
+			return fmt.Errorf("option %s cannot be used together with fs.path", o.name)
+		}
+	}
+
+	return nil
+}
+
+// Returns true when key windows of the same span starting at bases a and b do
+// not overlap. Windows without span never end.
+func keyWindowsDisjoint(a, b, span int64) bool {
+	if span == 0 {
+		return false
+	}
+
+	if a > b {
+		a, b = b, a
+	}
+
+	return b-a >= span
+}
+
+// Reload reads the configuration again and returns new configurations of all
+// volumes, in the order of Volumes(), with the subset of values which can be
+// changed at runtime applied, i.e. GC parameters, number of uploaders and
+// downloaders and log level. Configurations in use are never modified, they
+// are read concurrently, so the caller replaces them by the returned ones.
+// Returns also names of changed options which cannot be changed at runtime and
+// were ignored.
+func Reload() ([]*Config, []string, error) {
+	fresh := Config{ConfigPath: Cfg.ConfigPath}
+	if err := parse(&fresh); err != nil {
+		return nil, nil, err
+	}
+
+	reloaded := make([]*Config, 0, len(volumes))
+	for _, v := range volumes {
+		c := *v
+		apply(&c, &fresh)
+		reloaded = append(reloaded, &c)
+	}
+
+	current := Cfg
+	apply(&current, &fresh)
+
+	return reloaded, changedOptions(reflect.ValueOf(current), reflect.ValueOf(fresh), ""), nil
+}
+
+// Applies values which can be changed at runtime from fresh to cfg.
+func apply(cfg, fresh *Config) {
+	cfg.GC.Step = fresh.GC.Step
+	cfg.GC.LiveData = fresh.GC.LiveData
+	cfg.GC.Wait = fresh.GC.Wait
+	cfg.GC.DeadMinObjects = fresh.GC.DeadMinObjects
+	cfg.GC.ProbeSizes = fresh.GC.ProbeSizes
+	cfg.GC.SpanExtents = fresh.GC.SpanExtents
+	cfg.GC.SpanGapRatio = fresh.GC.SpanGapRatio
+	cfg.GC.MaxDurationSec = fresh.GC.MaxDurationSec
+	cfg.GC.Mode = fresh.GC.Mode
+	cfg.GC.LocalityObjects = fresh.GC.LocalityObjects
+	cfg.GC.SmallSize = fresh.GC.SmallSize
+	cfg.GC.SmallRatio = fresh.GC.SmallRatio
+	cfg.GC.ScheduleLiveData = fresh.GC.ScheduleLiveData
+	cfg.GC.IdleWindowSec = fresh.GC.IdleWindowSec
+	cfg.S3.Uploaders = fresh.S3.Uploaders
+	cfg.S3.Downloaders = fresh.S3.Downloaders
+	cfg.S3.DeadlineMs = fresh.S3.DeadlineMs
+	cfg.S3.TimeoutMs = fresh.S3.TimeoutMs
+	cfg.S3.RecoveryTimeoutMs = fresh.S3.RecoveryTimeoutMs
+	cfg.S3.RetryMaxDelay = fresh.S3.RetryMaxDelay
+	cfg.Write.ThrottleWatermark = fresh.Write.ThrottleWatermark
+	cfg.Write.ThrottleMaxDelayMs = fresh.Write.ThrottleMaxDelayMs
+	cfg.Cache.ReadAhead = fresh.Cache.ReadAhead
+	cfg.Log.Level = fresh.Log.Level
+	cfg.PauseTimeout = fresh.PauseTimeout
+	cfg.DeepRead = fresh.DeepRead
+}
+
+// Returns toml names of all options which differ in old and new. Fields without
+// toml name, e.g. the ones set by flags, are not options of the file.
+func changedOptions(old, new reflect.Value, prefix string) []string {
+	var changed []string
+
+	for i := 0; i < old.NumField(); i++ {
+		tag := old.Type().Field(i).Tag.Get("toml")
+		if tag == "" {
+			continue
+		}
+		name := prefix + tag
+
+		if old.Field(i).Kind() == reflect.Struct {
+			changed = append(changed, changedOptions(old.Field(i), new.Field(i), name+".")...)
+		} else if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
 // Parse the configuration file and reads the environment variable. After that
-// it does some values postprocessing and fills the Cfg structure.
-func parse() error {
-	if err := cleanenv.ReadConfig(Cfg.ConfigPath, &Cfg); err != nil {
-		if err := cleanenv.ReadEnv(&Cfg); err != nil {
+// it does some values postprocessing and fills the cfg structure. Missing or
+// invalid configuration file is ignored and only the environment variables are
+// used, but the configuration from stdin or url has to be valid.
+func parse(cfg *Config) error {
+	path, remove, err := localConfig(cfg.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	if err := cleanenv.ReadConfig(path, cfg); err != nil {
+		if path != cfg.ConfigPath {
+			return fmt.Errorf("configuration from %s: %w", cfg.ConfigPath, err)
+		}
+		if err := cleanenv.ReadEnv(cfg); err != nil {
 			return err
 		}
 	}
 
-	Cfg.Size *= 1024 * 1024 * 1024
-	Cfg.Write.BufSize *= 1024 * 1024
-	Cfg.Write.ChunkSize *= 1024 * 1024
-	Cfg.Write.CollisionSize *= 1024 * 1024
-	Cfg.Read.BufSize *= 1024 * 1024
+	cfg.Size *= 1024 * 1024 * 1024
+	cfg.Write.BufSize *= 1024 * 1024
+	cfg.Write.ChunkSize *= 1024 * 1024
+	cfg.Write.CollisionSize *= 1024 * 1024
+	cfg.Write.Align *= 1024
+	cfg.Write.MaxInflight *= 1024 * 1024
+	cfg.Write.ThrottleWatermark *= 1024 * 1024
+	cfg.Read.BufSize *= 1024 * 1024
+	cfg.Read.MultipartThreshold *= 1024
+	cfg.RecoveryMemory *= 1024 * 1024
+	cfg.Cache.Size *= 1024 * 1024
+	cfg.Cache.MemoryLimit *= 1024 * 1024
+	cfg.Cache.DiskSize *= 1024 * 1024
+
+	if cfg.BlockSize != 512 {
+		cfg.BlockSize = 4096
+	}
 
-	if Cfg.BlockSize != 512 {
-		Cfg.BlockSize = 4096
+	// The admin server was the metrics server, configurations with the
+	// old names keep working.
+	if cfg.Metrics {
+		cfg.Admin = true
+	}
+	if cfg.MetricsPort != 0 {
+		cfg.AdminPort = cfg.MetricsPort
 	}
 
-	if Cfg.IOMin == 0 {
-		Cfg.IOMin = Cfg.BlockSize
+	if cfg.IOMin == 0 {
+		cfg.IOMin = cfg.BlockSize
 	}
 
-	if Cfg.IOOpt == 0 {
-		Cfg.IOOpt = Cfg.BlockSize
+	if cfg.IOOpt == 0 {
+		cfg.IOOpt = cfg.BlockSize
 	}
 
-	return nil
+	return resolvePassphrase(cfg)
+}
+
+// Returns path of a local file with the configuration given by path and
+// function removing the file when it is not needed anymore. The configuration
+// from stdin or url is stored in a temporary toml file, so it is parsed and
+// overridden by the environment variables exactly like the configuration file.
+func localConfig(path string) (string, func(), error) {
+	var content []byte
+	var err error
+	switch {
+	case path == stdinConfig:
+		if stdinBytes == nil {
+			if stdinBytes, err = io.ReadAll(os.Stdin); err != nil {
+				return "", nil, err
+			}
+		}
+		content = stdinBytes
+	case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+		if content, err = fetchConfig(path); err != nil {
+			return "", nil, err
+		}
+	default:
+		return path, func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "bs3-*.toml")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() {
+		os.Remove(f.Name())
+	}
+
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	return f.Name(), remove, nil
+}
+
+// Downloads the configuration from url. It is downloaded again on every
+// reload.
+func fetchConfig(url string) ([]byte, error) {
+	client := http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download of configuration from %s failed: %s", url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
 }
 
 // Handle program flags.
 func flagSetup() {
 	f := flag.NewFlagSet("bs3", flag.ExitOnError)
-	f.StringVar(&Cfg.ConfigPath, "c", defaultConfig, "Path to configuration file")
+	f.StringVar(&Cfg.ConfigPath, "c", defaultConfig, "Path to configuration file, - for stdin or http(s) url")
 	f.Usage = cleanenv.FUsage(f.Output(), &Cfg, nil, f.Usage)
 	f.Parse(os.Args[1:])
 }
@@ -0,0 +1,87 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Writes the configuration file and loads it as the daemon does at startup.
+func loadTestConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	Cfg = Config{ConfigPath: path}
+	if err := parse(&Cfg); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if volumes, err = split(&Cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestReloadReplacesConfig(t *testing.T) {
+	path := loadTestConfig(t, "[gc]\nstep = 100\n")
+	old := Volumes()[0]
+
+	if err := os.WriteFile(path, []byte("size = 16\n[gc]\nstep = 200\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, ignored, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if old.GC.Step != 100 || Cfg.GC.Step != 100 {
+		t.Fatal("configuration in use was modified by the reload")
+	}
+	if len(reloaded) != 1 || reloaded[0].GC.Step != 200 {
+		t.Fatalf("reloaded configurations %+v do not have the new GC step", reloaded)
+	}
+	if reloaded[0].Size != old.Size {
+		t.Fatal("option which cannot be changed at runtime was applied")
+	}
+	if !reflect.DeepEqual(ignored, []string{"size"}) {
+		t.Fatalf("ignored options are %v", ignored)
+	}
+}
+
+func TestChangedOptionsSkipsFlags(t *testing.T) {
+	old := Config{ConfigPath: "old.toml"}
+	new := Config{ConfigPath: "new.toml"}
+
+	if changed := changedOptions(reflect.ValueOf(old), reflect.ValueOf(new), ""); len(changed) != 0 {
+		t.Fatalf("flag values are reported as changed options %v", changed)
+	}
+}
+
+func TestFSRefusesS3Options(t *testing.T) {
+	for _, option := range []string{
+		"key_base = 4096",
+		"key_span = 4096",
+		"lock_mode = \"GOVERNANCE\"",
+		"name_prefix = \"volume/\"",
+	} {
+		cfg := Config{ConfigPath: filepath.Join(t.TempDir(), "config.toml")}
+		content := "[fs]\npath = \"/tmp/bs3\"\n[s3]\n" + option + "\n"
+		if err := os.WriteFile(cfg.ConfigPath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := parse(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := split(&cfg); err == nil {
+			t.Fatalf("option %s is accepted together with fs.path", option)
+		}
+	}
+}
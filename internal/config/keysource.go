@@ -0,0 +1,83 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Prefixes of the passphrase source selecting the provider.
+const (
+	passphraseSourceFile = "file:"
+	passphraseSourceEnv  = "env:"
+)
+
+// Replaces the encryption passphrase by the one from the configured passphrase
+// source. The passphrase is read from the file, the environment variable or the
+// http(s) endpoint, e.g. Vault or its agent. Errors never contain the
+// passphrase, so they can be logged.
+func resolvePassphrase(cfg *Config) error {
+	source := cfg.Encryption.PassphraseSource
+	if source == "" {
+		return nil
+	}
+
+	passphrase, err := fetchPassphrase(source)
+	if err != nil {
+		return fmt.Errorf("encryption passphrase from %s: %w", source, err)
+	}
+	if passphrase == "" {
+		return fmt.Errorf("encryption passphrase from %s is empty", source)
+	}
+	cfg.Encryption.Passphrase = passphrase
+
+	return nil
+}
+
+// Returns the passphrase given by the passphrase source without surrounding
+// whitespace.
+func fetchPassphrase(source string) (string, error) {
+	var passphrase []byte
+	var err error
+	switch {
+	case strings.HasPrefix(source, passphraseSourceFile):
+		passphrase, err = os.ReadFile(strings.TrimPrefix(source, passphraseSourceFile))
+	case strings.HasPrefix(source, passphraseSourceEnv):
+		name := strings.TrimPrefix(source, passphraseSourceEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		passphrase = []byte(value)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		passphrase, err = downloadPassphrase(source)
+	default:
+		return "", fmt.Errorf("unknown passphrase source, use file:, env: or http(s) url")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(passphrase)), nil
+}
+
+// Downloads the passphrase from url. The body of the response is the
+// passphrase.
+func downloadPassphrase(url string) ([]byte, error) {
+	client := http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
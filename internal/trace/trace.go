@@ -0,0 +1,229 @@
+// Copyright (C) 2021 Vojtech Aschenbrenner <v@asch.cz>
+
+// Package trace records the IO stream of a block device to a file and reads it
+// back for replay. Tracer is a decorator of any BuseReadWriter, so it works
+// the same for bs3 and null devices.
+//
+// The trace contains only the description of every read and write, i.e.
+// sectors, lengths, sequence numbers and flags. Data are never recorded, so the
+// trace of a production device can be shared without sharing its content.
+//
+// The file starts with the magic and the version and it is followed by
+// records. All numbers are little endian int64. Every record starts with the
+// operation and the nanoseconds since the trace start. Write continues with the
+// number of writes, the chunk length and write items of all writes as they
+// came from the kernel. Read continues with the sector and the length in
+// blocks.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/asch/buse/lib/go/buse"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	magic   = "bs3trace"
+	version = 1
+
+	// Size of the write item describing one write at the beginning of the
+	// chunk. Given by the buse kernel module.
+	WriteItemSize = 32
+
+	// Size of the buffer for records. The buffer is flushed when it is
+	// full and when the device is removed.
+	bufferSize = 1024 * 1024
+)
+
+// Operations of records.
+const (
+	OpWrite = 1
+	OpRead  = 2
+)
+
+// One read or write from the trace.
+type Record struct {
+	Op int64
+
+	// Time since the start of the trace.
+	Time time.Duration
+
+	// Number of writes and write items of all of them from the write
+	// chunk of length ChunkLength. Valid for writes only.
+	Writes      int64
+	ChunkLength int64
+	Items       []byte
+
+	// Sector and length in blocks. Valid for reads only.
+	Sector int64
+	Length int64
+}
+
+// Decorator of BuseReadWriter recording every read and write to the trace file
+// before it is passed to the decorated one. Failure of the trace file does not
+// affect IO, it only stops the tracing.
+type Tracer struct {
+	rw buse.BuseReadWriter
+
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	start  time.Time
+
+	// Set on the first failure of the trace file. No more records are
+	// written after that.
+	failed bool
+}
+
+// Returns tracer recording IO of rw to the file at path. The file is
+// truncated.
+func New(rw buse.BuseReadWriter, path string) (*Tracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tracer{
+		rw:     rw,
+		file:   file,
+		writer: bufio.NewWriterSize(file, bufferSize),
+		start:  time.Now(),
+	}
+
+	var header [16]byte
+	copy(header[:8], magic)
+	binary.LittleEndian.PutUint64(header[8:], version)
+	if _, err := t.writer.Write(header[:]); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Records the write and passes it to the decorated BuseReadWriter. The record
+// is written before, since the decorated one can modify the chunk.
+func (t *Tracer) BuseWrite(writes int64, chunk []byte) error {
+	t.record(OpWrite, writes, int64(len(chunk)), chunk[:writes*WriteItemSize])
+
+	return t.rw.BuseWrite(writes, chunk)
+}
+
+// Records the read and passes it to the decorated BuseReadWriter.
+func (t *Tracer) BuseRead(sector, length int64, chunk []byte) error {
+	t.record(OpRead, sector, length, nil)
+
+	return t.rw.BuseRead(sector, length, chunk)
+}
+
+func (t *Tracer) BusePreRun() {
+	t.rw.BusePreRun()
+}
+
+// Passes the removal to the decorated BuseReadWriter and closes the trace file.
+func (t *Tracer) BusePostRemove() {
+	t.rw.BusePostRemove()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.failed {
+		if err := t.writer.Flush(); err != nil {
+			log.Error().Err(err).Msg("Flushing of the trace failed.")
+		}
+	}
+	t.file.Close()
+	t.failed = true
+}
+
+// Appends record with two numbers and optional payload to the trace.
+func (t *Tracer) record(op, a, b int64, payload []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.failed {
+		return
+	}
+
+	var header [32]byte
+	binary.LittleEndian.PutUint64(header[0:], uint64(op))
+	binary.LittleEndian.PutUint64(header[8:], uint64(time.Since(t.start)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(a))
+	binary.LittleEndian.PutUint64(header[24:], uint64(b))
+
+	_, err := t.writer.Write(header[:])
+	if err == nil {
+		_, err = t.writer.Write(payload)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("Writing of the trace failed. Tracing is stopped.")
+		t.failed = true
+	}
+}
+
+// Reader of the trace file.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// Returns reader of the trace from r. Returns error when r is not a trace.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, bufferSize)
+
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != magic {
+		return nil, errors.New("not a bs3 trace")
+	}
+	if v := binary.LittleEndian.Uint64(header[8:]); v != version {
+		return nil, fmt.Errorf("unsupported trace version %d", v)
+	}
+
+	return &Reader{r: br}, nil
+}
+
+// Returns the next record. Returns io.EOF at the end of the trace and
+// io.ErrUnexpectedEOF when the trace is cut in the middle of a record, e.g.
+// by a crash.
+func (r *Reader) Next() (Record, error) {
+	var header [32]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return Record{}, err
+	}
+
+	rec := Record{
+		Op:   int64(binary.LittleEndian.Uint64(header[0:])),
+		Time: time.Duration(binary.LittleEndian.Uint64(header[8:])),
+	}
+	a := int64(binary.LittleEndian.Uint64(header[16:]))
+	b := int64(binary.LittleEndian.Uint64(header[24:]))
+
+	switch rec.Op {
+	case OpWrite:
+		rec.Writes, rec.ChunkLength = a, b
+		if a < 0 || a*WriteItemSize > b {
+			return Record{}, fmt.Errorf("invalid write record with %d writes in chunk of %d bytes", a, b)
+		}
+		rec.Items = make([]byte, a*WriteItemSize)
+		if _, err := io.ReadFull(r.r, rec.Items); err != nil {
+			return Record{}, io.ErrUnexpectedEOF
+		}
+	case OpRead:
+		rec.Sector, rec.Length = a, b
+	default:
+		return Record{}, fmt.Errorf("invalid trace operation %d", rec.Op)
+	}
+
+	return rec, nil
+}
@@ -23,6 +23,9 @@
 //
 // - internal/config contains configuration package which is common for both,
 // bs3 and null implementations.
+//
+// - internal/trace contains decorator of both implementations recording their
+// IO stream, which is replayed offline by cmd/bs3-replay.
 package main
 
 import (
@@ -31,7 +34,10 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -39,92 +45,198 @@ import (
 	"github.com/asch/bs3/internal/bs3"
 	"github.com/asch/bs3/internal/config"
 	"github.com/asch/bs3/internal/null"
+	"github.com/asch/bs3/internal/trace"
 	"github.com/asch/buse/lib/go/buse"
 )
 
 // Parse configuration from file and environment variables, creates a
-// BuseReadWriter and creates new buse device with it. The device is ran until
-// it is signaled by SIGINT or SIGTERM to gracefully finish.
+// BuseReadWriter and creates new buse device with it for every configured
+// volume. Devices are ran until they are signaled by SIGINT or SIGTERM to
+// gracefully finish.
 func main() {
 	err := config.Configure()
 	if err != nil {
 		log.Panic().Err(err).Send()
 	}
 
-	loggerSetup(config.Cfg.Log.Pretty, config.Cfg.Log.Level)
-
-	log.Info().Msgf("Configuration for block device buse%d loaded from %s",
-		config.Cfg.Major, config.Cfg.ConfigPath)
+	loggerSetup(config.Cfg.Log.Pretty, config.Cfg.Log.JSON, config.Cfg.Log.Level, config.Cfg.Log.Fields)
 
 	if config.Cfg.Profiler {
 		log.Info().Msg("Running profiler.")
 		runProfiler(config.Cfg.ProfilerPort)
 	}
 
-	buseReadWriter, err := getBuseReadWriter(config.Cfg.Null)
-	if err != nil {
-		log.Panic().Err(err).Send()
+	var devices []buse.Buse
+	var readWriters []buse.BuseReadWriter
+	var majors []int
+	for _, cfg := range config.Volumes() {
+		log.Info().Msgf("Configuration for block device buse%d loaded from %s",
+			cfg.Major, cfg.ConfigPath)
+
+		buseReadWriter, err := getBuseReadWriter(cfg)
+		if err != nil {
+			log.Panic().Err(err).Send()
+		}
+
+		deviceReadWriter := buseReadWriter
+		if cfg.Trace {
+			deviceReadWriter, err = trace.New(buseReadWriter, cfg.TracePath)
+			if err != nil {
+				log.Panic().Err(err).Send()
+			}
+			log.Info().Msgf("IO of block device buse%d is traced to %s.", cfg.Major, cfg.TracePath)
+		}
+
+		device, err := newDevice(cfg, deviceReadWriter)
+		if err != nil {
+			log.Panic().Msg(err.Error())
+		}
+		log.Info().Msgf("Block device buse%d registered.", cfg.Major)
+
+		devices = append(devices, device)
+		readWriters = append(readWriters, buseReadWriter)
+		majors = append(majors, cfg.Major)
 	}
 
-	buse, err := buse.New(buseReadWriter, buse.Options{
-		Durable:        config.Cfg.Write.Durable,
-		WriteChunkSize: int64(config.Cfg.Write.ChunkSize),
-		BlockSize:      int64(config.Cfg.BlockSize),
-		IOMin:          int64(config.Cfg.IOMin),
-		Threads:        int(config.Cfg.Threads),
-		Major:          int64(config.Cfg.Major),
-		WriteShmSize:   int64(config.Cfg.Write.BufSize),
-		ReadShmSize:    int64(config.Cfg.Read.BufSize),
-		Size:           int64(config.Cfg.Size),
-		CollisionArea:  int64(config.Cfg.Write.CollisionSize),
-		QueueDepth:     int64(config.Cfg.QueueDepth),
-		Scheduler:      config.Cfg.Scheduler,
-		CPUsPerNode:    config.Cfg.CPUsPerNode,
-	})
+	registerSigHandlers(devices, readWriters)
+	registerReloadHandler(readWriters)
 
-	if err != nil {
-		log.Panic().Msg(err.Error())
+	if config.Cfg.Admin {
+		log.Info().Msg("Running admin server.")
+		runAdmin(config.Cfg.AdminPort, majors, readWriters)
 	}
-	log.Info().Msgf("Block device buse%d registered.", config.Cfg.Major)
 
-	registerSigHandlers(buse)
+	var wg sync.WaitGroup
+	for i, cfg := range config.Volumes() {
+		wg.Add(1)
+		go func(device buse.Buse, major int) {
+			defer wg.Done()
 
-	buse.Run()
-	log.Info().Msgf("Block device buse%d stopped.", config.Cfg.Major)
+			device.Run()
+			log.Info().Msgf("Block device buse%d stopped.", major)
 
-	buse.RemoveDevice()
-	log.Info().Msgf("Block device buse%d removed.", config.Cfg.Major)
+			device.RemoveDevice()
+			log.Info().Msgf("Block device buse%d removed.", major)
+		}(devices[i], cfg.Major)
+	}
+	wg.Wait()
+}
+
+// Creates new buse device for the volume configured by cfg and served by rw.
+func newDevice(cfg *config.Config, rw buse.BuseReadWriter) (buse.Buse, error) {
+	return buse.New(rw, buse.Options{
+		Durable:        cfg.Write.Durable,
+		WriteChunkSize: int64(cfg.Write.ChunkSize),
+		BlockSize:      int64(cfg.BlockSize),
+		IOMin:          int64(cfg.IOMin),
+		Threads:        int(cfg.Threads),
+		Major:          int64(cfg.Major),
+		WriteShmSize:   int64(cfg.Write.BufSize),
+		ReadShmSize:    int64(cfg.Read.BufSize),
+		Size:           int64(cfg.Size),
+		CollisionArea:  int64(cfg.Write.CollisionSize),
+		QueueDepth:     int64(cfg.QueueDepth),
+		Scheduler:      cfg.Scheduler,
+		CPUsPerNode:    cfg.CPUsPerNode,
+	})
 }
 
 // Return null device if user wants it, otherwise returns bs3 device, which is
 // default.
-func getBuseReadWriter(wantNullDevice bool) (buse.BuseReadWriter, error) {
-	if wantNullDevice {
+func getBuseReadWriter(cfg *config.Config) (buse.BuseReadWriter, error) {
+	if cfg.Null {
 		return null.NewNull(), nil
 	}
 
-	bs3, err := bs3.NewWithDefaults()
+	bs3, err := bs3.NewWithDefaults(cfg)
 
 	return bs3, err
 }
 
-// Register handler for graceful stop when SIGINT or SIGTERM came in.
-func registerSigHandlers(buse buse.Buse) {
+// Implemented by BuseReadWriters which want to be notified before the device
+// is stopped.
+type stopPreparer interface {
+	PrepareStop()
+}
+
+// Register handler for graceful stop of all devices when SIGINT or SIGTERM came
+// in.
+func registerSigHandlers(devices []buse.Buse, readWriters []buse.BuseReadWriter) {
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt)
 	signal.Notify(stopChan, syscall.SIGTERM)
 	go func() {
 		<-stopChan
-		log.Info().Msg("Stopping bs3 device.")
-		buse.StopDevice()
+		for _, rw := range readWriters {
+			if p, ok := rw.(stopPreparer); ok {
+				p.PrepareStop()
+			}
+		}
+		for _, d := range devices {
+			log.Info().Msgf("Stopping bs3 device buse%d.", d.Options.Major)
+			d.StopDevice()
+		}
 	}()
 }
 
-func loggerSetup(pretty bool, level int) {
-	if pretty {
+// Implemented by BuseReadWriters which can apply configuration changes at
+// runtime.
+type reconfigurer interface {
+	Reconfigure(cfg *config.Config)
+}
+
+// Register handler for configuration reload when SIGHUP came in. Only the
+// subset of options which can be changed at runtime is applied, changes of all
+// other options are ignored with a warning.
+func registerReloadHandler(readWriters []buse.BuseReadWriter) {
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			reloaded, ignored, err := config.Reload()
+			if err != nil {
+				log.Error().Err(err).Msg("Configuration reload failed.")
+				continue
+			}
+
+			for _, o := range ignored {
+				log.Warn().Msgf("Option %s cannot be changed at runtime. Ignoring.", o)
+			}
+
+			zerolog.SetGlobalLevel(zerolog.Level(reloaded[0].Log.Level))
+			for i, rw := range readWriters {
+				if r, ok := rw.(reconfigurer); ok {
+					r.Reconfigure(reloaded[i])
+				}
+			}
+
+			log.Info().Msgf("Configuration reloaded from %s.", config.Cfg.ConfigPath)
+		}
+	}()
+}
+
+// Sets up the global logger used by all packages. JSON output has a stable
+// schema, i.e. timestamp in RFC3339, level, message and static fields sorted by
+// name, which identify the volume in multi-volume deployments.
+func loggerSetup(pretty, json bool, level int, fields map[string]string) {
+	if json {
+		zerolog.TimeFieldFormat = time.RFC3339
+	} else if pretty {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
+	names := make([]string, 0, len(fields))
+	for n := range fields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	ctx := log.With()
+	for _, n := range names {
+		ctx = ctx.Str(n, fields[n])
+	}
+	log.Logger = ctx.Logger()
+
 	zerolog.SetGlobalLevel(zerolog.Level(level))
 }
 